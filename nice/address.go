@@ -1,5 +1,10 @@
 package nice
 
+import (
+	"net"
+	"strconv"
+)
+
 //type NiceAddress net.Addr
 
 type NiceAddress struct {
@@ -27,3 +32,45 @@ func nice_address_equal_no_port (a NiceAddress, b NiceAddress) bool {
 func nice_address_equal (a NiceAddress, b NiceAddress) bool {
 	return a.family == b.family && a.network == b.network && a.ip == b.ip && a.port == b.port
 }
+
+func nice_address_to_string(a NiceAddress) string {
+	return net.JoinHostPort(a.ip, strconv.Itoa(a.port))
+}
+
+func nice_address_to_udp_addr(a NiceAddress) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.ParseIP(a.ip), Port: a.port}
+}
+
+func nice_address_to_tcp_addr(a NiceAddress) *net.TCPAddr {
+	return &net.TCPAddr{IP: net.ParseIP(a.ip), Port: a.port}
+}
+
+/*
+ * Builds a NiceAddress from a net.Addr returned by the OS, keeping
+ * the family/network naming used by nice_interfaces_get_local_ips().
+ */
+func nice_address_from_net_addr(addr net.Addr) NiceAddress {
+	var a NiceAddress
+	var ip net.IP
+	switch v := addr.(type) {
+	case *net.UDPAddr:
+		ip = v.IP
+		a.port = v.Port
+		a.network = "udp"
+	case *net.TCPAddr:
+		ip = v.IP
+		a.port = v.Port
+		a.network = "tcp"
+	default:
+		return a
+	}
+
+	if ip.To4() != nil {
+		a.family = "ip4"
+		a.ip = ip.To4().String()
+	} else {
+		a.family = "ip6"
+		a.ip = ip.String()
+	}
+	return a
+}
@@ -1,5 +1,14 @@
 package nice
 
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+)
+
 /**
  * NiceInputMessage:
  * @buffers: (array length=n_buffers): unowned array of #GInputVector buffers to
@@ -29,6 +38,7 @@ package nice
 type NiceInputMessage struct {
 	buffers			[]([]byte)
 	from 			*NiceAddress
+	length			int
 }
 
 /**
@@ -58,6 +68,27 @@ type  NiceOutputMessage struct {
 	buffers []([]byte)
 }
 
+/*
+ * Returned by the non-blocking sends and receives, when nothing could be
+ * sent or there was nothing to receive.
+ */
+var NICE_AGENT_ERR_WOULD_BLOCK = errors.New("nice agent operation would block")
+
+/* Returned by nice_agent_new_full() for flags which do not go together */
+var NICE_AGENT_ERR_INVALID_OPTIONS = errors.New("nice agent options do not go with its compatibility")
+
+/* Returned by the receives of a component whose packets go to a callback */
+var NICE_AGENT_ERR_RECV_CALLBACK_ATTACHED = errors.New("nice agent component has a receive callback attached")
+
+/* The number of bytes in the buffers of @message */
+func output_message_get_size(message *NiceOutputMessage) int {
+	size := 0
+	for i := 0; i < len(message.buffers); i++ {
+		size += len(message.buffers[i])
+	}
+	return size
+}
+
 
 /**
  * NICE_AGENT_MAX_REMOTE_CANDIDATES:
@@ -95,6 +126,33 @@ const (
 	NICE_COMPONENT_STATE_LAST
 )
 
+/**
+ * Nice_component_state_to_string:
+ * @state: a #NiceComponentState
+ *
+ * Returns a string representation of the state, generally to use in debug
+ * messages.
+ *
+ * Returns: a string representation of @state
+ */
+func Nice_component_state_to_string(state NiceComponentState) string {
+	switch state {
+	case NICE_COMPONENT_STATE_DISCONNECTED:
+		return "disconnected"
+	case NICE_COMPONENT_STATE_GATHERING:
+		return "gathering"
+	case NICE_COMPONENT_STATE_CONNECTING:
+		return "connecting"
+	case NICE_COMPONENT_STATE_CONNECTED:
+		return "connected"
+	case NICE_COMPONENT_STATE_READY:
+		return "ready"
+	case NICE_COMPONENT_STATE_FAILED:
+		return "failed"
+	}
+	return "invalid"
+}
+
 /**
  * NiceComponentType:
  * @NICE_COMPONENT_TYPE_RTP: RTP Component type
@@ -148,14 +206,13 @@ const (
  */
 type NiceCompatibility byte
 const (
-	_ NiceCompatibility = iota
-	NICE_COMPATIBILITY_RFC5245 = 0
-	NICE_COMPATIBILITY_DRAFT19 = NICE_COMPATIBILITY_RFC5245
+	NICE_COMPATIBILITY_RFC5245 NiceCompatibility = iota
 	NICE_COMPATIBILITY_GOOGLE
 	NICE_COMPATIBILITY_MSN
 	NICE_COMPATIBILITY_WLM2009
 	NICE_COMPATIBILITY_OC2007
 	NICE_COMPATIBILITY_OC2007R2
+	NICE_COMPATIBILITY_DRAFT19 = NICE_COMPATIBILITY_RFC5245
 	NICE_COMPATIBILITY_LAST = NICE_COMPATIBILITY_OC2007R2
 )
 
@@ -212,6 +269,7 @@ const (
  * @NICE_AGENT_OPTION_ICE_TRICKLE: Enable ICE trickle mode
  * @NICE_AGENT_OPTION_SUPPORT_RENOMINATION: Enable renomination triggered by NOMINATION STUN attribute
  * proposed here: https://tools.ietf.org/html/draft-thatcher-ice-renomination-00
+ * @NICE_AGENT_OPTION_CONSENT_FRESHNESS: Enable RFC 7675 consent freshness
  *
  * These are options that can be passed to nice_agent_new_full(). They set
  * various properties on the agent. Not including them sets the property to
@@ -221,12 +279,12 @@ const (
  */
 type NiceAgentOption int
 const (
-	_ NiceAgentOption = iota
-	 NICE_AGENT_OPTION_REGULAR_NOMINATION = 1 << 0
-	 NICE_AGENT_OPTION_RELIABLE = 1 << 1
-	 NICE_AGENT_OPTION_LITE_MODE = 1 << 2
-	 NICE_AGENT_OPTION_ICE_TRICKLE = 1 << 3
-	 NICE_AGENT_OPTION_SUPPORT_RENOMINATION = 1 << 4
+	NICE_AGENT_OPTION_REGULAR_NOMINATION NiceAgentOption = 1 << 0
+	NICE_AGENT_OPTION_RELIABLE NiceAgentOption = 1 << 1
+	NICE_AGENT_OPTION_LITE_MODE NiceAgentOption = 1 << 2
+	NICE_AGENT_OPTION_ICE_TRICKLE NiceAgentOption = 1 << 3
+	NICE_AGENT_OPTION_SUPPORT_RENOMINATION NiceAgentOption = 1 << 4
+	NICE_AGENT_OPTION_CONSENT_FRESHNESS NiceAgentOption = 1 << 5
 )
 
 /**
@@ -240,8 +298,131 @@ const (
  * Returns: The new agent GObject
  */
 func nice_agent_new(compat NiceCompatibility ) *NiceAgent {
-	return &NiceAgent{
+	agent, _ := Nice_agent_new_full(compat, 0)
+	return agent
+}
+
+/**
+ * nice_agent_new_reliable:
+ * @compat: The compatibility mode of the agent
+ *
+ * Create a new #NiceAgent in reliable mode, see
+ * #NICE_AGENT_OPTION_RELIABLE.
+ *
+ * Returns: The new agent, nil if @compat is not valid
+ */
+func nice_agent_new_reliable(compat NiceCompatibility) *NiceAgent {
+	agent, _ := Nice_agent_new_full(compat, NICE_AGENT_OPTION_RELIABLE)
+	return agent
+}
+
+/**
+ * Nice_agent_new_full:
+ * @compat: The compatibility mode of the agent
+ * @flags: Flags to set the properties
+ *
+ * Create a new #NiceAgent with parameters that must be be defined at
+ * construction time. The STUN compatibility and usage flags, the candidate
+ * priorities and credentials all follow from @compat, see
+ * agent_to_stun_compatibility().
+ *
+ * Returns: The new agent, or NICE_AGENT_ERR_INVALID_OPTIONS if @flags do
+ * not go with @compat or with each other
+ */
+func Nice_agent_new_full(compat NiceCompatibility, flags NiceAgentOption) (*NiceAgent, error) {
+	agent := NewNiceAgent()
+	agent.compatibility = compat
+	agent.reliable = flags & NICE_AGENT_OPTION_RELIABLE != 0
+	agent.full_mode = flags & NICE_AGENT_OPTION_LITE_MODE == 0
+	agent.use_ice_trickle = flags & NICE_AGENT_OPTION_ICE_TRICKLE != 0
+	agent.support_renomination = flags & NICE_AGENT_OPTION_SUPPORT_RENOMINATION != 0
+	agent.consent_freshness = flags & NICE_AGENT_OPTION_CONSENT_FRESHNESS != 0
+	if flags & NICE_AGENT_OPTION_REGULAR_NOMINATION != 0 {
+		agent.nomination_mode = NICE_NOMINATION_MODE_REGULAR
+	} else {
+		agent.nomination_mode = NICE_NOMINATION_MODE_AGGRESSIVE
+	}
+
+	if err := agent_check_options(agent); err != nil {
+		agent.Nice_agent_close_async(nil)
+		return nil, err
 	}
+	return agent, nil
+}
+
+/*
+ * Checks that the properties set at construction time go together.
+ */
+func agent_check_options(agent *NiceAgent) error {
+	if agent.compatibility > NICE_COMPATIBILITY_LAST {
+		return NICE_AGENT_ERR_INVALID_OPTIONS
+	}
+	/* a lite agent never initiates the checks the pseudo TCP connection
+	 * of a reliable one waits for */
+	if !agent.full_mode && agent.reliable {
+		return NICE_AGENT_ERR_INVALID_OPTIONS
+	}
+	/* only the RFC 5245 and MS-ICE2 checks carry USE-CANDIDATE, the other
+	 * dialects nominate the first pair that works */
+	if agent.nomination_mode == NICE_NOMINATION_MODE_REGULAR && !NICE_AGENT_IS_COMPATIBLE_WITH_RFC5245_OR_OC2007R2(agent) {
+		return NICE_AGENT_ERR_INVALID_OPTIONS
+	}
+	/* renomination and trickle are extensions of RFC 5245 */
+	if (agent.support_renomination || agent.use_ice_trickle) && agent.compatibility != NICE_COMPATIBILITY_RFC5245 {
+		return NICE_AGENT_ERR_INVALID_OPTIONS
+	}
+	/* the consent checks are those of RFC 5245, a lite agent sends none */
+	if agent.consent_freshness && (agent.compatibility != NICE_COMPATIBILITY_RFC5245 || !agent.full_mode) {
+		return NICE_AGENT_ERR_INVALID_OPTIONS
+	}
+	return nil
+}
+
+/*
+ * The STUN dialect of the connectivity checks of @agent.
+ */
+func agent_to_stun_compatibility(agent *NiceAgent) StunCompatibility {
+	switch agent.compatibility {
+	case NICE_COMPATIBILITY_GOOGLE, NICE_COMPATIBILITY_MSN, NICE_COMPATIBILITY_OC2007:
+		return STUN_COMPATIBILITY_RFC3489
+	case NICE_COMPATIBILITY_WLM2009, NICE_COMPATIBILITY_OC2007R2:
+		return STUN_COMPATIBILITY_MSICE2
+	}
+	return STUN_COMPATIBILITY_RFC5389
+}
+
+/*
+ * The usage flags of the STUN agent of the connectivity checks of @agent.
+ */
+func agent_to_stun_usage_flags(agent *NiceAgent) StunAgentUsageFlags {
+	switch agent.compatibility {
+	case NICE_COMPATIBILITY_GOOGLE:
+		return STUN_AGENT_USAGE_SHORT_TERM_CREDENTIALS | STUN_AGENT_USAGE_IGNORE_CREDENTIALS
+	case NICE_COMPATIBILITY_MSN:
+		return STUN_AGENT_USAGE_SHORT_TERM_CREDENTIALS | STUN_AGENT_USAGE_FORCE_VALIDATER
+	case NICE_COMPATIBILITY_WLM2009:
+		return STUN_AGENT_USAGE_SHORT_TERM_CREDENTIALS | STUN_AGENT_USAGE_USE_FINGERPRINT
+	case NICE_COMPATIBILITY_OC2007:
+		return STUN_AGENT_USAGE_SHORT_TERM_CREDENTIALS | STUN_AGENT_USAGE_FORCE_VALIDATER | STUN_AGENT_USAGE_NO_ALIGNED_ATTRIBUTES
+	case NICE_COMPATIBILITY_OC2007R2:
+		return STUN_AGENT_USAGE_SHORT_TERM_CREDENTIALS | STUN_AGENT_USAGE_USE_FINGERPRINT | STUN_AGENT_USAGE_NO_ALIGNED_ATTRIBUTES
+	}
+	return STUN_AGENT_USAGE_SHORT_TERM_CREDENTIALS | STUN_AGENT_USAGE_USE_FINGERPRINT
+}
+
+/*
+ * The priority of @candidate in the dialect of @agent.
+ */
+func agent_candidate_priority(agent *NiceAgent, candidate *NiceCandidate, nat_assisted bool) uint32 {
+	switch agent.compatibility {
+	case NICE_COMPATIBILITY_GOOGLE:
+		return nice_candidate_jingle_priority(candidate)
+	case NICE_COMPATIBILITY_MSN, NICE_COMPATIBILITY_OC2007:
+		return nice_candidate_msn_priority(candidate)
+	case NICE_COMPATIBILITY_OC2007R2:
+		return nice_candidate_ms_ice_priority(candidate, agent.reliable, nat_assisted)
+	}
+	return nice_candidate_ice_priority(candidate, agent.reliable, nat_assisted)
 }
 
 func (this *NiceAgent) agent_candidate_pair_priority (local *NiceCandidate, remote *NiceCandidate) uint64 {
@@ -254,7 +435,6 @@ func (this *NiceAgent) agent_candidate_pair_priority (local *NiceCandidate, remo
 
 func (this *NiceAgent) agent_signal_component_state_change(stream_id uint, component_id uint, new_state NiceComponentState) {
 	var old_state NiceComponentState
-	var component *NiceComponent
 
 	s, c := this.agent_find_component(stream_id, component_id)
 	if s == nil || c == nil {
@@ -262,45 +442,878 @@ func (this *NiceAgent) agent_signal_component_state_change(stream_id uint, compo
 	}
 
 	/* Validate the state change. */
-	old_state = component.state
+	old_state = c.state
 	if new_state == old_state {
 		return
 	}
 
-	component.state = new_state
+	c.state = new_state
+	this.metrics.ComponentStateChanged(old_state, new_state)
+	nice_component_log(this, NICE_LOG_AGENT, stream_id, component_id).Info("component state changed",
+		"old", Nice_component_state_to_string(old_state), "new", Nice_component_state_to_string(new_state))
+	if new_state == NICE_COMPONENT_STATE_CONNECTING && c.connecting_since.IsZero() {
+		c.connecting_since = this.clock.Now()
+	} else if new_state == NICE_COMPONENT_STATE_READY && !c.connecting_since.IsZero() {
+		this.metrics.Connected(this.clock.Now().Sub(c.connecting_since))
+		c.connecting_since = time.Time{}
+	} else if new_state == NICE_COMPONENT_STATE_FAILED {
+		c.connecting_since = time.Time{}
+	}
 	if this.reliable {
-		// todo
-		// process_queued_tcp_packets (agent, stream, component);
+		process_queued_tcp_packets(this, s, c)
 	}
 
-	if this.componet_state_change_cb != nil {
-		this.componet_state_change_cb(this, stream_id, component_id, uint(new_state), nil)
-	}
+	agent_emit_event(this, ComponentStateChangedEvent{StreamID: stream_id, ComponentID: component_id, State: new_state})
 }
 
 func priv_add_new_candidate_discovery_stun(agent *NiceAgent, nicesock NiceSockInterface, server NiceAddress, stream *NiceStream, component_id uint) {
 	cdisco := NewCandidateDiscovery()
-	//todo
 	cdisco.typ = NICE_CANDIDATE_TYPE_SERVER_REFLEXIVE
 	cdisco.nicesock = nicesock
 	cdisco.server = server
 	cdisco.stream_id = stream.id
 	cdisco.component_id = component_id
 
+	/* the servers of the Google and Microsoft dialects speak classic
+	 * STUN, others are tried with RFC 5389 first, see
+	 * priv_discovery_tick_unlocked() */
 	var usage_flags StunAgentUsageFlags
-	if agent.compatibility == NICE_COMPATIBILITY_OC2007 || agent.compatibility == NICE_COMPATIBILITY_OC2007R2 {
+	compatibility := STUN_COMPATIBILITY_RFC5389
+	switch agent.compatibility {
+	case NICE_COMPATIBILITY_OC2007, NICE_COMPATIBILITY_OC2007R2:
 		usage_flags = STUN_AGENT_USAGE_NO_ALIGNED_ATTRIBUTES
+		compatibility = STUN_COMPATIBILITY_RFC3489
+	case NICE_COMPATIBILITY_GOOGLE, NICE_COMPATIBILITY_MSN, NICE_COMPATIBILITY_WLM2009:
+		compatibility = STUN_COMPATIBILITY_RFC3489
+	default:
+		if known, ok := agent.stun_server_compatibility[nice_address_to_string(server)]; ok {
+			compatibility = known
+		} else {
+			cdisco.detect_flavour = true
+		}
 	}
-	stun_agent_init(&cdisco.stun_agent, STUN_COMPATIBILITY_RFC3489, usage_flags)
+	if agent.stun_username != "" {
+		usage_flags |= STUN_AGENT_USAGE_LONG_TERM_CREDENTIALS
+		cdisco.creds = agent_long_term_credentials(agent, server, agent.stun_username, agent.stun_password)
+	}
+	stun_agent_init(&cdisco.stun_agent, compatibility, usage_flags)
 	agent.discovery_list = append(agent.discovery_list, cdisco)
 	agent.discovery_unsched_items++
 }
 
+/*
+ * The long-term credentials of @username on @server, shared by all the
+ * discoveries and allocations on it so that they reuse its REALM and
+ * NONCE instead of being challenged again.
+ */
+func agent_long_term_credentials(agent *NiceAgent, server NiceAddress, username string, password string) *StunLongTermCredentials {
+	key := username + "@" + nice_address_to_string(server)
+	creds := agent.long_term_credentials[key]
+	if creds == nil || creds.password != password {
+		creds = &StunLongTermCredentials{username: username, password: password}
+		agent.long_term_credentials[key] = creds
+	}
+	return creds
+}
+
+/*
+ * Adds the discovery of a relayed candidate on @turn. A UDP relay shares the
+ * socket of the host candidate, a TCP or TLS relay gets its own connection,
+ * made by priv_discovery_turn_connect() before the Allocate is scheduled.
+ */
+func priv_add_new_candidate_discovery_turn(agent *NiceAgent, nicesock NiceSockInterface, turn *TurnServer, stream *NiceStream, component_id uint) {
+	_, component := agent.agent_find_component(stream.id, component_id)
+	if component == nil {
+		return
+	}
+
+	var local NiceAddress
+	if turn.typ != NICE_RELAY_TYPE_TURN_UDP {
+		switch sock := nicesock.(type) {
+		case *UdpBsdSocket:
+			local = sock.local_addr
+		case *UdpMuxSocket:
+			local = sock.local_addr
+		default:
+			return
+		}
+		local.network = "tcp"
+	}
+
+	cdisco := NewCandidateDiscovery()
+	cdisco.typ = NICE_CANDIDATE_TYPE_RELAYED
+	cdisco.server = turn.server
+	cdisco.turn = turn
+	cdisco.stream_id = stream.id
+	cdisco.component_id = component_id
+
+	usage_flags := StunAgentUsageFlags(STUN_AGENT_USAGE_LONG_TERM_CREDENTIALS)
+	compatibility := STUN_COMPATIBILITY_RFC5389
+	if agent.compatibility == NICE_COMPATIBILITY_GOOGLE {
+		/* the Google relays only take the USERNAME */
+		compatibility = STUN_COMPATIBILITY_RFC3489
+		usage_flags = 0
+	} else if agent.compatibility == NICE_COMPATIBILITY_OC2007 || agent.compatibility == NICE_COMPATIBILITY_OC2007R2 {
+		compatibility = STUN_COMPATIBILITY_OC2007
+		usage_flags |= STUN_AGENT_USAGE_NO_ALIGNED_ATTRIBUTES
+	}
+	stun_agent_init(&cdisco.stun_agent, compatibility, usage_flags)
+	if usage_flags & STUN_AGENT_USAGE_LONG_TERM_CREDENTIALS != 0 {
+		cdisco.creds = agent_long_term_credentials(agent, turn.server, turn.username, turn.password)
+	}
+	agent.discovery_list = append(agent.discovery_list, cdisco)
+
+	if turn.typ == NICE_RELAY_TYPE_TURN_UDP {
+		cdisco.nicesock = nicesock
+		agent.discovery_unsched_items++
+		return
+	}
+	priv_discovery_turn_connect(agent, cdisco, local)
+}
+
+/*
+ * Connects from @local to the TCP or TLS relay of @cand in a goroutine of
+ * its own, the discovery staying unscheduled meanwhile, then frames the
+ * connection (see UdpTurnOverTcpSocket) and schedules the Allocate on it.
+ * The TLS relays of Google and OC2007 get the pseudo-SSL handshake first.
+ * The connect is cancelled when the agent is closed, and its connection
+ * dropped if the discovery was pruned in between.
+ * Must be called with the agent lock held.
+ */
+func priv_discovery_turn_connect(agent *NiceAgent, cand *CandidateDiscovery, local NiceAddress) {
+	cand.connecting = true
+	ctx := agent.connect_ctx
+	turn := cand.turn
+	framing := NICE_TURN_OVER_TCP_COMPATIBILITY_RFC5766
+	pseudossl := false
+	pseudossl_compatibility := NICE_PSEUDOSSL_SOCKET_COMPATIBILITY_MSOC
+	switch agent.compatibility {
+	case NICE_COMPATIBILITY_GOOGLE:
+		framing = NICE_TURN_OVER_TCP_COMPATIBILITY_GOOGLE
+		pseudossl = turn.typ == NICE_RELAY_TYPE_TURN_TLS
+		pseudossl_compatibility = NICE_PSEUDOSSL_SOCKET_COMPATIBILITY_GOOGLE
+	case NICE_COMPATIBILITY_OC2007, NICE_COMPATIBILITY_OC2007R2:
+		framing = NICE_TURN_OVER_TCP_COMPATIBILITY_OC2007
+		pseudossl = turn.typ == NICE_RELAY_TYPE_TURN_TLS
+	}
+
+	go func() {
+		var nicesock NiceSockInterface
+		tcpsock, err := nice_tcp_bsd_socket_connect(ctx, local, turn.server)
+		if err == nil {
+			nicesock = tcpsock
+			if pseudossl {
+				if sslsock := nice_pseudossl_socket_new(tcpsock, pseudossl_compatibility); sslsock != nil {
+					nicesock = sslsock
+				} else {
+					tcpsock.close()
+					nicesock = nil
+					err = errors.New("could not open the TLS connection")
+				}
+			}
+		}
+		if nicesock != nil {
+			nicesock = nice_udp_turn_over_tcp_socket_new(nicesock, framing)
+		}
+
+		agent.agent_mutex.Lock()
+		defer agent.agent_mutex.Unlock()
+		cand.connecting = false
+		stream, component := agent.agent_find_component(cand.stream_id, cand.component_id)
+		if agent.closed || stream == nil || component == nil || !priv_discovery_list_has(agent, cand) {
+			if nicesock != nil {
+				nicesock.close()
+			}
+			return
+		}
+		if err != nil {
+			nice_component_log(agent, NICE_LOG_TURN, cand.stream_id, cand.component_id).Warn("could not connect to the TURN server",
+				"server", nice_address_to_string(turn.server), "error", err)
+			agent.metrics.TurnAllocationError()
+			cand.done = true
+			agent_gathering_done(agent)
+			return
+		}
+
+		cand.nicesock = nicesock
+		component.nice_component_attach_socket(nicesock)
+		agent.discovery_unsched_items++
+		discovery_schedule(agent)
+	}()
+}
+
+/* Whether @cand is still in the discovery list of @agent */
+func priv_discovery_list_has(agent *NiceAgent, cand *CandidateDiscovery) bool {
+	for i := 0; i < len(agent.discovery_list); i++ {
+		if agent.discovery_list[i] == cand {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Handles a STUN message received on one of the sockets of @component:
+ * @raw is the message as received, @buf the same with its attributes
+ * aligned (see stun_message_align()), which is parsed; MESSAGE-INTEGRITY
+ * and FINGERPRINT are checked on @raw.
+ * Must be called with the agent lock held.
+ */
+func agent_recv_stun(agent *NiceAgent, stream *NiceStream, component *NiceComponent, nicesock NiceSockInterface, from NiceAddress, buf []byte, raw []byte) {
+	if refresh_handle_inbound_stun(agent, buf, raw) {
+		return
+	}
+	if discovery_handle_inbound_stun(agent, stream, component, from, buf, raw) {
+		return
+	}
+	if turnsock := nice_component_find_turn_socket(component, nicesock, from); turnsock != nil &&
+		nice_udp_turn_socket_handle_inbound_stun(turnsock, buf, raw) {
+		return
+	}
+
+	nice_log_stun(nice_agent_log(agent, NICE_LOG_CONNCHECK), "received STUN message", stream.id, component.id, from, buf)
+	conn_check_stats_inbound_stun(agent, stream, component, nicesock, from, buf)
+
+	conn_check_handle_inbound_stun(agent, stream, component, nicesock, from, buf, raw)
+}
+
+/*
+ * Stops the legacy twins of the checks of @stream once a check of the
+ * peer carries MS-IMPLEMENTATION-VERSION: it speaks [MS-ICE2].
+ */
+func priv_check_ms_ice2_peer(agent *NiceAgent, stream *NiceStream, component *NiceComponent, buf []byte) {
+	if agent.compatibility != NICE_COMPATIBILITY_OC2007R2 || !stream.stun_agent.ms_ice2_send_legacy_connchecks {
+		return
+	}
+	version := stun_message_find_attribute(buf, STUN_ATTRIBUTE_MS_IMPLEMENTATION_VERSION)
+	if len(version) == 4 && binary.BigEndian.Uint32(version) >= STUN_MSICE2_IMPLEMENTATION_VERSION {
+		nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Debug("peer speaks MS-ICE2, no more legacy checks")
+		stream.stun_agent.ms_ice2_send_legacy_connchecks = false
+	}
+}
+
+/*
+ * Ends the gathering of the streams which have no candidate discovery left
+ * running, and signals it.
+ */
+func agent_gathering_done(agent *NiceAgent) {
+	for i := 0; i < len(agent.streams); i++ {
+		stream := agent.streams[i]
+		if !stream.gathering {
+			continue
+		}
+
+		pending := false
+		for j := 0; j < len(agent.discovery_list); j++ {
+			if agent.discovery_list[j].stream_id == stream.id && !agent.discovery_list[j].done {
+				pending = true
+				break
+			}
+		}
+		if pending {
+			continue
+		}
+
+		stream.gathering = false
+		duration := agent.clock.Now().Sub(stream.gathering_start)
+		nice_agent_log(agent, NICE_LOG_DISCOVERY).Info("gathering done", "stream", stream.id, "duration", duration)
+		agent.metrics.GatheringDone(duration)
+		agent_emit_event(agent, GatheringDoneEvent{StreamID: stream.id})
+	}
+}
+
 func agent_signal_new_candidate(agent *NiceAgent, candidate *NiceCandidate) {
-	//todo
+	nice_component_log(agent, NICE_LOG_DISCOVERY, candidate.stream_id, candidate.component_id).Debug("new local candidate",
+		"type", Nice_candidate_type_to_string(candidate.typ),
+		"transport", Nice_candidate_transport_to_string(candidate.transport),
+		"addr", nice_address_to_string(candidate.addr))
+	agent_emit_event(agent, NewCandidateEvent{StreamID: candidate.stream_id, ComponentID: candidate.component_id, Candidate: candidate_from_nice(candidate)})
 }
 
 func agent_signal_component_state_change(agent *NiceAgent, stream_id uint, component_id uint, new_state NiceComponentState) {
-	//todo
+	agent.agent_signal_component_state_change(stream_id, component_id, new_state)
+}
+
+/*
+ * Signals the first Binding request of the peer on @stream, once.
+ */
+func agent_signal_initial_binding_request_received(agent *NiceAgent, stream *NiceStream) {
+	if stream.initial_binding_request_received {
+		return
+	}
+	stream.initial_binding_request_received = true
+	agent_emit_event(agent, InitialBindingRequestReceivedEvent{StreamID: stream.id})
+}
+
+/*
+ * Signals that the consent to send on the selected pair of the component
+ * expired (RFC 7675).
+ */
+func agent_signal_consent_lost(agent *NiceAgent, stream_id uint, component_id uint) {
+	nice_component_log(agent, NICE_LOG_CONNCHECK, stream_id, component_id).Warn("consent lost")
+	if _, component := agent.agent_find_component(stream_id, component_id); component != nil && component.selected_pair.stats != nil {
+		component.selected_pair.stats.consent_expired = agent.clock.Now()
+	}
+	agent_emit_event(agent, ConsentLostEvent{StreamID: stream_id, ComponentID: component_id})
 }
 
+
+/*
+ * Signals that the pseudo TCP connection of a reliable component is open,
+ * or that its send buffer has room again after NICE_AGENT_ERR_WOULD_BLOCK.
+ */
+func agent_signal_reliable_transport_writable(agent *NiceAgent, stream_id uint, component_id uint) {
+	if _, component := agent.agent_find_component(stream_id, component_id); component != nil && component.conn != nil {
+		component.conn.nice_conn_writable()
+	}
+	agent_emit_event(agent, ReliableTransportWritableEvent{StreamID: stream_id, ComponentID: component_id})
+}
+
+/*
+ * Signals the new selected pair of a component, already recorded with
+ * nice_component_update_selected_pair(). For a reliable agent whose pair
+ * is not itself reliable, this is where the pseudo TCP connection is
+ * started on top of it.
+ */
+func agent_signal_new_selected_pair(agent *NiceAgent, stream_id uint, component_id uint, lcandidate *NiceCandidate, rcandidate *NiceCandidate) {
+	stream, component := agent.agent_find_component(stream_id, component_id)
+	if stream == nil || component == nil {
+		return
+	}
+
+	sock := component.nice_component_selected_socket()
+	if agent.reliable && sock != nil && !sock.is_reliable() {
+		if component.tcp == nil {
+			pseudo_tcp_socket_create(agent, stream, component)
+		}
+		process_queued_tcp_packets(agent, stream, component)
+
+		component.tcp.pseudo_tcp_socket_connect()
+		component.tcp.pseudo_tcp_socket_notify_mtu(MAX_TCP_MTU)
+		adjust_tcp_clock(agent, stream, component)
+	}
+
+	nice_component_log(agent, NICE_LOG_CONNCHECK, stream_id, component_id).Info("selected pair",
+		slog.Group("pair",
+			"local", nice_address_to_string(lcandidate.addr),
+			"remote", nice_address_to_string(rcandidate.addr),
+			"local_type", Nice_candidate_type_to_string(lcandidate.typ),
+			"remote_type", Nice_candidate_type_to_string(rcandidate.typ)))
+	agent.metrics.SelectedPair(lcandidate.typ, rcandidate.typ)
+	agent_emit_event(agent, NewSelectedPairEvent{StreamID: stream_id, ComponentID: component_id, Local: candidate_from_nice(lcandidate), Remote: candidate_from_nice(rcandidate)})
+}
+
+/**
+ * Nice_agent_send:
+ * @stream_id: The ID of the stream to send to
+ * @component_id: The ID of the component to send to
+ * @buf: The buffer of data to send
+ *
+ * Sends a data payload over a stream's component.
+ *
+ * <note>
+   <para>
+     Component state MUST be NICE_COMPONENT_STATE_READY, or as a special case,
+     in any state if it was previously ready and was then restarted
+   </para>
+   <para>
+     In reliable mode, the data goes through the pseudo TCP connection of the
+     component and may be queued, or only partially accepted: the number of
+     bytes actually taken is returned, and NICE_AGENT_ERR_WOULD_BLOCK when
+     the send buffer is full.
+   </para>
+ </note>
+ *
+ * Returns: The number of bytes sent, or an error
+ */
+func (this *NiceAgent) Nice_agent_send(stream_id uint, component_id uint, buf []byte) (int, error) {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	stream, component := this.agent_find_component(stream_id, component_id)
+	if stream == nil || component == nil {
+		return -1, errors.New("could not find the component")
+	}
+
+	out := &NiceOutputMessage{buffers: [][]byte{buf}}
+	return nice_agent_send_messages_nonblocking_internal(this, stream, component, []*NiceOutputMessage{out}, true)
+}
+
+/**
+ * Nice_agent_send_messages_nonblocking:
+ * @stream_id: The ID of the stream to send to
+ * @component_id: The ID of the component to send to
+ * @messages: The messages to send
+ *
+ * Sends multiple messages on the socket identified by the given
+ * stream/component pair. Transmission is non-blocking, so a
+ * NICE_AGENT_ERR_WOULD_BLOCK error may be returned if the send buffer is
+ * full.
+ *
+ * As with nice_agent_send(), the given component must be in
+ * %NICE_COMPONENT_STATE_READY or, as a special case, in any state if it was
+ * previously ready and was then restarted.
+ *
+ * On reliable connections, the messages are sent as one stream, and each
+ * one is queued whole or not at all: the data is never truncated in the
+ * middle of a message. On non-reliable connections, each message is one
+ * packet, and the sending stops at the first packet the socket refuses.
+ *
+ * Returns: the number of messages sent (may be less than len(@messages)),
+ * or an error if none could be
+ */
+func (this *NiceAgent) Nice_agent_send_messages_nonblocking(stream_id uint, component_id uint, messages []*NiceOutputMessage) (int, error) {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	stream, component := this.agent_find_component(stream_id, component_id)
+	if stream == nil || component == nil {
+		return -1, errors.New("could not find the component")
+	}
+	if len(messages) == 0 {
+		return 0, nil
+	}
+	return nice_agent_send_messages_nonblocking_internal(this, stream, component, messages, false)
+}
+
+/*
+ * Sends @messages on the selected pair of the component, or on its pseudo
+ * TCP connection for a reliable agent. With @allow_partial, as for
+ * nice_agent_send(), returns the number of bytes sent, and otherwise the
+ * number of messages.
+ * Must be called with the agent lock held.
+ */
+func nice_agent_send_messages_nonblocking_internal(agent *NiceAgent, stream *NiceStream, component *NiceComponent, messages []*NiceOutputMessage, allow_partial bool) (int, error) {
+	pair := component.selected_pair
+	sock := component.nice_component_selected_socket()
+	if agent.reliable && (sock == nil || !sock.is_reliable()) {
+		if component.tcp == nil {
+			return -1, PSEUDO_TCP_ERR_NOT_CONNECTED
+		}
+		n, err := component.tcp.pseudo_tcp_socket_send_messages(messages, allow_partial)
+		adjust_tcp_clock(agent, stream, component)
+		if err == PSEUDO_TCP_ERR_WOULD_BLOCK {
+			return -1, NICE_AGENT_ERR_WOULD_BLOCK
+		}
+		return n, err
+	}
+
+	if pair.local == nil || pair.remote == nil || sock == nil {
+		return -1, errors.New("no selected pair on the component")
+	}
+
+	sent := 0
+	if agent.reliable {
+		/* a TCP pair: the socket keeps what the network does not take yet */
+		if err := sock.send_messages_reliable(&pair.remote.addr, messages); err != nil {
+			return -1, err
+		}
+		sent = len(messages)
+	} else {
+		for ; sent < len(messages); sent++ {
+			if err := sock.send_messages(&pair.remote.addr, messages[sent:sent + 1]); err != nil {
+				if sent == 0 {
+					return -1, err
+				}
+				break
+			}
+		}
+	}
+
+	bytes := 0
+	for i := 0; i < sent; i++ {
+		bytes += output_message_get_size(messages[i])
+	}
+	nice_component_stats_sent(agent, component, sent, bytes)
+
+	if !allow_partial {
+		return sent, nil
+	}
+	return bytes, nil
+}
+
+/**
+ * Nice_agent_recv_messages:
+ * @ctx: cancels the wait, and bounds it with its deadline
+ * @stream_id: the ID of the stream to receive on
+ * @component_id: the ID of the component to receive on
+ * @messages: the messages to fill with the received data
+ *
+ * Block on receiving data from the given stream/component combination on
+ * @agent, returning only once at least one message has been received or
+ * @ctx is done.
+ *
+ * This must not be used in combination with nice_agent_attach_recv() on
+ * the same stream/component pair: NICE_AGENT_ERR_RECV_CALLBACK_ATTACHED is
+ * returned when a callback is attached.
+ *
+ * On a reliable connection, the received data is one stream filling the
+ * buffers of the messages in turn, and io.EOF is returned once the peer
+ * closed the connection and all the data was read. On a non-reliable
+ * connection, each message receives one packet, truncated to the size of
+ * its buffers.
+ *
+ * Returns: the number of valid messages in @messages, each with its length
+ * and the address of the peer set, or an error
+ */
+func (this *NiceAgent) Nice_agent_recv_messages(ctx context.Context, stream_id uint, component_id uint, messages []*NiceInputMessage) (int, error) {
+	for {
+		this.agent_mutex.Lock()
+		_, component := this.agent_find_component(stream_id, component_id)
+		if component == nil {
+			this.agent_mutex.Unlock()
+			return -1, errors.New("could not find the component")
+		}
+		n, err := nice_agent_recv_messages_unlocked(this, component, messages)
+		wait := component.nice_component_recv_wait()
+		this.agent_mutex.Unlock()
+
+		if err != NICE_AGENT_ERR_WOULD_BLOCK {
+			return n, err
+		}
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		}
+	}
+}
+
+/**
+ * Nice_agent_recv_messages_nonblocking:
+ * @stream_id: the ID of the stream to receive on
+ * @component_id: the ID of the component to receive on
+ * @messages: the messages to fill with the received data
+ *
+ * Try to receive data from the given stream/component combination on
+ * @agent, without blocking. See nice_agent_recv_messages().
+ *
+ * Returns: the number of valid messages in @messages, or
+ * NICE_AGENT_ERR_WOULD_BLOCK if there is nothing to receive
+ */
+func (this *NiceAgent) Nice_agent_recv_messages_nonblocking(stream_id uint, component_id uint, messages []*NiceInputMessage) (int, error) {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	_, component := this.agent_find_component(stream_id, component_id)
+	if component == nil {
+		return -1, errors.New("could not find the component")
+	}
+	return nice_agent_recv_messages_unlocked(this, component, messages)
+}
+
+/*
+ * Fills @messages with the data queued on the component while no io
+ * callback is attached.
+ * Must be called with the agent lock held.
+ */
+func nice_agent_recv_messages_unlocked(agent *NiceAgent, component *NiceComponent, messages []*NiceInputMessage) (int, error) {
+	if component.io_callback != nil {
+		return -1, NICE_AGENT_ERR_RECV_CALLBACK_ATTACHED
+	}
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	if agent.reliable && component.tcp != nil {
+		/* the stream fills the buffers in turn, across the messages */
+		n := 0
+		for ; n < len(messages); n++ {
+			message := messages[n]
+			message.length = 0
+			if message.from != nil && component.selected_pair.remote != nil {
+				*message.from = component.selected_pair.remote.addr
+			}
+			if !priv_recv_pseudo_tcp_message(component.tcp, message) {
+				if message.length > 0 {
+					n++
+				}
+				break
+			}
+		}
+		if n > 0 {
+			/* the window reopened */
+			adjust_tcp_clock(agent, component.stream, component)
+			return n, nil
+		}
+		if component.tcp.pseudo_tcp_socket_is_closed_remotely() {
+			return 0, io.EOF
+		}
+		return -1, NICE_AGENT_ERR_WOULD_BLOCK
+	}
+
+	if len(component.recv_queue) == 0 {
+		return -1, NICE_AGENT_ERR_WOULD_BLOCK
+	}
+
+	n := 0
+	for ; n < len(messages) && len(component.recv_queue) > 0; n++ {
+		packet := component.recv_queue[0]
+		component.recv_queue[0] = nil
+		component.recv_queue = component.recv_queue[1:]
+
+		message := messages[n]
+		message.length = 0
+		if message.from != nil {
+			*message.from = *packet.from
+		}
+		data := packet.buffers[0]
+		for i := 0; i < len(message.buffers) && len(data) > 0; i++ {
+			c := copy(message.buffers[i], data)
+			data = data[c:]
+			message.length += c
+		}
+	}
+	return n, nil
+}
+
+/*
+ * Fills the buffers of @message from the receive buffer of @tcp. Returns
+ * false once it has nothing more to read.
+ */
+func priv_recv_pseudo_tcp_message(tcp *PseudoTcpSocket, message *NiceInputMessage) bool {
+	for i := 0; i < len(message.buffers); i++ {
+		buf := message.buffers[i]
+		for len(buf) > 0 {
+			c, err := tcp.pseudo_tcp_socket_recv(buf)
+			if err != nil || c <= 0 {
+				return false
+			}
+			buf = buf[c:]
+			message.length += c
+		}
+	}
+	return true
+}
+
+/* Use 1400 because of VPNs and we assume IEE 802.3 */
+const MAX_TCP_MTU = 1400
+
+func pseudo_tcp_socket_create(agent *NiceAgent, stream *NiceStream, component *NiceComponent) {
+	tcp_callbacks := PseudoTcpCallbacks{
+		user_data:         component,
+		PseudoTcpOpened:   pseudo_tcp_socket_opened,
+		PseudoTcpReadable: pseudo_tcp_socket_readable,
+		PseudoTcpWritable: pseudo_tcp_socket_writable,
+		PseudoTcpClosed:   pseudo_tcp_socket_closed,
+		WritePacket:       pseudo_tcp_socket_write_packet,
+	}
+	component.tcp = pseudo_tcp_socket_new(0, &tcp_callbacks, agent.clock)
+	adjust_tcp_clock(agent, stream, component)
+}
+
+func pseudo_tcp_socket_opened(sock *PseudoTcpSocket, user_data interface{}) {
+	component := user_data.(*NiceComponent)
+	agent_signal_reliable_transport_writable(component.agent, component.stream.id, component.id)
+}
+
+/*
+ * The data stays in the pseudo TCP receive buffer, whose window closes
+ * while nobody reads it, until agent_deliver_pseudo_tcp_data() hands it to
+ * the io callback or nice_agent_recv_messages() to its caller.
+ */
+func pseudo_tcp_socket_readable(sock *PseudoTcpSocket, user_data interface{}) {
+	component := user_data.(*NiceComponent)
+	/* new data, or the end of the stream */
+	component.nice_component_recv_signal()
+}
+
+func pseudo_tcp_socket_writable(sock *PseudoTcpSocket, user_data interface{}) {
+	component := user_data.(*NiceComponent)
+	agent_signal_reliable_transport_writable(component.agent, component.stream.id, component.id)
+}
+
+func pseudo_tcp_socket_closed(sock *PseudoTcpSocket, err error, user_data interface{}) {
+	component := user_data.(*NiceComponent)
+	component.nice_component_recv_signal()
+	if err != nil {
+		component.agent.agent_signal_component_state_change(component.stream.id, component.id, NICE_COMPONENT_STATE_FAILED)
+	}
+}
+
+func pseudo_tcp_socket_write_packet(sock *PseudoTcpSocket, buf []byte, user_data interface{}) PseudoTcpWriteResult {
+	component := user_data.(*NiceComponent)
+	pair := component.selected_pair
+	nicesock := component.nice_component_selected_socket()
+	if pair.local == nil || pair.remote == nil || nicesock == nil {
+		return WR_FAIL
+	}
+
+	out := &NiceOutputMessage{buffers: [][]byte{buf}}
+	if err := nicesock.send_messages(&pair.remote.addr, []*NiceOutputMessage{out}); err != nil {
+		return WR_FAIL
+	}
+	nice_component_stats_sent(component.agent, component, 1, len(buf))
+	return WR_SUCCESS
+}
+
+/*
+ * Schedules @function on the reactor of the agent every @interval msecs,
+ * with the agent lock held, for as long as it returns true. The pending
+ * timer is kept in *@source, which is cleared once the function returns
+ * false; a timer already in *@source is cancelled first.
+ * Must be called with the agent lock held.
+ */
+func agent_timeout_add(agent *NiceAgent, source **NiceTimer, interval uint, function func(agent *NiceAgent) bool) {
+	agent_timeout_remove(source)
+
+	d := time.Duration(interval) * time.Millisecond
+
+	var timer *NiceTimer
+	var callback func()
+	callback = func() {
+		agent.agent_mutex.Lock()
+		defer agent.agent_mutex.Unlock()
+
+		/* cancelled, or replaced, while it was firing */
+		if *source != timer {
+			return
+		}
+		if !function(agent) {
+			if *source == timer {
+				*source = nil
+			}
+			return
+		}
+		/* the function may have rescheduled itself */
+		if *source == timer {
+			timer = agent.reactor.nice_reactor_timeout_add(d, callback)
+			*source = timer
+		}
+	}
+	timer = agent.reactor.nice_reactor_timeout_add(d, callback)
+	*source = timer
+}
+
+/*
+ * Cancels the timer in *@source, if any.
+ * Must be called with the agent lock held.
+ */
+func agent_timeout_remove(source **NiceTimer) {
+	if *source != nil {
+		(*source).nice_timer_cancel()
+		*source = nil
+	}
+}
+
+/*
+ * (Re)arms the timer driving the pseudo TCP clock of 'component', or
+ * stops it once the pseudo TCP socket is closed.
+ */
+func adjust_tcp_clock(agent *NiceAgent, stream *NiceStream, component *NiceComponent) {
+	if component.tcp == nil {
+		return
+	}
+
+	timeout, ok := component.tcp.pseudo_tcp_socket_get_next_clock()
+	if !ok {
+		agent_timeout_remove(&component.tcp_clock)
+		return
+	}
+
+	agent_timeout_remove(&component.tcp_clock)
+	stream_id := stream.id
+	component_id := component.id
+	/* not through agent_timeout_add(): the clock takes the agent lock
+	 * itself, to deliver the received data without it */
+	component.tcp_clock = agent.reactor.nice_reactor_timeout_add(timeout, func() {
+		notify_pseudo_tcp_socket_clock(agent, stream_id, component_id)
+	})
+}
+
+func notify_pseudo_tcp_socket_clock(agent *NiceAgent, stream_id uint, component_id uint) {
+	agent.agent_mutex.Lock()
+	stream, component := agent.agent_find_component(stream_id, component_id)
+	if stream == nil || component == nil || component.tcp == nil {
+		agent.agent_mutex.Unlock()
+		return
+	}
+
+	component.tcp.pseudo_tcp_socket_notify_clock()
+	adjust_tcp_clock(agent, stream, component)
+	agent.agent_mutex.Unlock()
+
+	agent_deliver_pseudo_tcp_data(agent, stream_id, component_id)
+}
+
+/*
+ * Hands the data of the pseudo TCP socket of the component to its io
+ * callback, a buffer at a time and without the agent lock, as the sockets
+ * hand their packets: @buf is reused once the callback returned. Without
+ * io callback, the data is left to nice_agent_recv_messages().
+ * Must be called without the agent lock.
+ */
+func agent_deliver_pseudo_tcp_data(agent *NiceAgent, stream_id uint, component_id uint) {
+	var buf []byte
+	for {
+		agent.agent_mutex.Lock()
+		stream, component := agent.agent_find_component(stream_id, component_id)
+		if stream == nil || component == nil || component.tcp == nil || component.io_callback == nil {
+			agent.agent_mutex.Unlock()
+			return
+		}
+		if buf == nil {
+			buf = make([]byte, MAX_BUFFER_SIZE)
+		}
+		n, err := component.tcp.pseudo_tcp_socket_recv(buf)
+		if err != nil || n <= 0 {
+			agent.agent_mutex.Unlock()
+			return
+		}
+		/* the window reopened */
+		adjust_tcp_clock(agent, stream, component)
+		io_callback := component.io_callback
+		agent.agent_mutex.Unlock()
+
+		io_callback(agent, stream_id, component_id, buf[:n], nil)
+	}
+}
+
+/*
+ * Feeds the packets the remote candidate of the selected pair sent before
+ * the pair got selected to the pseudo TCP socket.
+ */
+func process_queued_tcp_packets(agent *NiceAgent, stream *NiceStream, component *NiceComponent) {
+	if component.selected_pair.local == nil || component.selected_pair.remote == nil || component.tcp == nil {
+		return
+	}
+
+	queued := component.queued_tcp_packets
+	component.queued_tcp_packets = nil
+	for i := 0; i < len(queued); i++ {
+		if nice_address_equal(*queued[i].from, component.selected_pair.remote.addr) {
+			component.tcp.pseudo_tcp_socket_notify_packet(queued[i].buffers[0])
+		}
+	}
+	adjust_tcp_clock(agent, stream, component)
+}
+
+/*
+ * Handles a non-STUN packet received from @from by a reliable agent over
+ * a non-reliable socket: only the remote candidate of the selected pair
+ * feeds the pseudo TCP socket. Before a pair is selected, up to
+ * NICE_COMPONENT_RECV_QUEUE_LEN packets are kept, the peer retransmits
+ * the others. Must be called with the agent lock held.
+ */
+func agent_recv_pseudo_tcp_packet(agent *NiceAgent, stream *NiceStream, component *NiceComponent, from NiceAddress, buf []byte) {
+	if component.tcp == nil {
+		return
+	}
+
+	if component.selected_pair.local == nil || component.selected_pair.remote == nil {
+		if len(component.queued_tcp_packets) >= NICE_COMPONENT_RECV_QUEUE_LEN {
+			return
+		}
+		/* the socket reuses its buffer for the next packet */
+		packet := &NiceInputMessage{buffers: [][]byte{append([]byte{}, buf...)}, from: &from, length: len(buf)}
+		component.queued_tcp_packets = append(component.queued_tcp_packets, packet)
+		return
+	}
+	if !nice_address_equal(from, component.selected_pair.remote.addr) {
+		return
+	}
+
+	component.tcp.pseudo_tcp_socket_notify_packet(buf)
+	adjust_tcp_clock(agent, stream, component)
+}
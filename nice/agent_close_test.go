@@ -0,0 +1,166 @@
+package nice
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+/*
+ * The goroutines and file descriptors of the process, once the shared
+ * reactors, which live as long as the process, are started.
+ */
+func test_resources(t *testing.T) (int, int) {
+	nice_reactor_pool_get()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("no /proc/self/fd")
+	}
+	return runtime.NumGoroutine(), len(fds)
+}
+
+/*
+ * Waits until the goroutines and file descriptors are back to
+ * @goroutines and @fds: the goroutines of the sockets return a little
+ * after their sockets are closed.
+ */
+func test_resources_wait(t *testing.T, goroutines int, fds int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		g, f := test_resources(t)
+		if g <= goroutines && f <= fds {
+			return
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1 << 20)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("%d goroutines and %d fds, expected %d and %d\n%s", g, f, goroutines, fds, buf)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/*
+ * Two agents that connected and exchanged data leave no goroutine or
+ * socket behind once closed, reliable or not.
+ */
+func TestAgentCloseNoLeak(t *testing.T) {
+	for _, reliable := range []bool{false, true} {
+		goroutines, fds := test_resources(t)
+		t.Run(map[bool]string{false: "udp", true: "reliable"}[reliable], func(t *testing.T) {
+			var opts []AgentOption
+			if reliable {
+				opts = append(opts, WithReliable())
+			}
+			/* the agents are closed by the cleanup of the subtest */
+			a, b := test_conn_check_agents(t, true, false, opts...)
+			test_conn_check_wait_ready(t, a)
+			test_conn_check_wait_ready(t, b)
+			if _, err := a.Component(1).Send([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+		})
+		test_resources_wait(t, goroutines, fds)
+	}
+}
+
+/* A removed stream closes its sockets while the agent stays open */
+func TestAgentRemoveStreamNoLeak(t *testing.T) {
+	agent, err := NewAgent(WithLocalAddresses("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close(context.Background())
+	goroutines, fds := test_resources(t)
+
+	s, err := agent.AddStream(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if err := s.Gather(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, f := test_resources(t); f <= fds {
+		t.Fatal("the gathering opened no socket")
+	}
+	if err := agent.RemoveStream(s.ID()); err != nil {
+		t.Fatal(err)
+	}
+	test_resources_wait(t, goroutines, fds)
+}
+
+/*
+ * Closing the agent releases its TURN allocations with a Refresh of
+ * lifetime 0, then closes their sockets.
+ */
+func TestAgentCloseTurnNoLeak(t *testing.T) {
+	srv, server, _ := test_turn_server(t)
+	goroutines, fds := test_resources(t)
+
+	agent := NewNiceAgent()
+	agent.local_addresses = []NiceAddress{{family: "ip4", network: "udp", ip: "127.0.0.1"}}
+	id := agent.Nice_agent_add_stream(1)
+	agent.Nice_agent_set_relay_info(id, 1, server.ip, server.port, "user", "pass", NICE_RELAY_TYPE_TURN_UDP)
+	if err := agent.Nice_agent_gather_candidates(id); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	srv.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := srv.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := test_turn_response(t, buf[:n], STUN_ALLOCATE,
+		test_turn_xor_addr(STUN_ATTRIBUTE_XOR_RELAYED_ADDRESS, net.IPv4(203, 0, 113, 1), 4000),
+		test_turn_xor_addr(STUN_ATTRIBUTE_XOR_MAPPED_ADDRESS, from.IP, from.Port),
+		StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_LIFETIME}, value: &StunLifetimeAttrValue{lifetime: 300}})
+	srv.WriteToUDP(resp, from)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		agent.agent_mutex.Lock()
+		allocated := len(agent.refresh_list) == 1
+		agent.agent_mutex.Unlock()
+		if allocated {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not allocated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- agent.Close(context.Background())
+	}()
+	req := test_turn_read(t, srv)
+	if method := StunMethod(binary.BigEndian.Uint16(req[0:2]) & 0x3eef); method != STUN_REFRESH {
+		t.Fatalf("method %#x, expected a Refresh", method)
+	}
+	lifetime := stun_message_find_attribute(req, STUN_ATTRIBUTE_LIFETIME)
+	if lifetime == nil || binary.BigEndian.Uint32(lifetime) != 0 {
+		t.Fatalf("Refresh of lifetime %v", lifetime)
+	}
+	select {
+	case <-closed:
+		t.Fatal("closed before the allocation was released")
+	default:
+	}
+	srv.WriteToUDP(test_turn_response(t, req, STUN_REFRESH), from)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("close did not return")
+	}
+	test_resources_wait(t, goroutines, fds)
+}
@@ -1,12 +1,12 @@
 package nice
 
 import (
+	"context"
 	"sync"
 	"errors"
 	"net"
 	"strconv"
-	"fmt"
-	"time"
+	"log/slog"
 )
 
 /* XXX: starting from ICE ID-18, Ta SHOULD now be set according
@@ -14,6 +14,9 @@ import (
 
 const NICE_AGENT_TIMER_TA_DEFAULT = 20      /* timer Ta, msecs (impl. defined) */
 const NICE_AGENT_TIMER_TR_DEFAULT = 25000   /* timer Tr, msecs (impl. defined) */
+const NICE_AGENT_TIMER_CONSENT_DEFAULT = 5000  /* consent checks, msecs (RFC 7675 sect 5.1) */
+const NICE_AGENT_TIMER_CONSENT_TIMEOUT = 30000 /* consent expiry, msecs (RFC 7675 sect 5.1) */
+const NICE_AGENT_MAX_CONSENT_CHECKS = 8 /* consent checks of a pair whose response is still awaited */
 const NICE_AGENT_MAX_CONNECTIVITY_CHECKS_DEFAULT = 100 /* see spec 5.7.3 (ID-19) */
 
 /* An upper limit to size of STUN packets handled (based on Ethernet
@@ -44,9 +47,6 @@ func NICE_AGENT_IS_COMPATIBLE_WITH_RFC5245_OR_OC2007R2(a *NiceAgent) bool {
  *
 */
 type NiceAgentRecvFunc 		func(agent *NiceAgent, stream_id uint, component_id uint,buf []byte, user_data []byte)
-type GatheringDoneCb		func(agent *NiceAgent, stream_id uint, data interface{})
-type NewSelectPairCb		func(agent *NiceAgent, stream_id uint, component_id uint, foundation []byte, rfoundation []byte, data interface{})
-type ComponentStateChangeCb func(agent *NiceAgent, stream_id uint, component_id uint, state uint, data interface{})
 
 
 type NiceAgent struct {
@@ -54,6 +54,8 @@ type NiceAgent struct {
 	full_mode					bool
 	stun_server_ip 				string
 	stun_server_port 			uint16
+	stun_username				string		/* long-term credentials of the STUN server, if it wants some */
+	stun_password				string
 	proxy_ip					string
 	proxy_port					uint16
 	proxy_type					NiceProxyType
@@ -73,50 +75,214 @@ type NiceAgent struct {
 	next_candidate_id			uint
 	next_stream_id				uint
 	rng 						*NiceRNG
+	tie_breaker					uint64		/* tie breaker (ICE sect 5.2 "Determining Role" ID-19) */
 	discovery_list				[]*CandidateDiscovery
+	refresh_list				[]*CandidateRefresh
+	triggered_check_queue		[]*CandidateCheckPair	/* checked before the others (ICE sect 7.2.1.4 ID-19) */
 	use_ice_trickle				bool
 
 	compatibility				NiceCompatibility	/* property: Compatibility mode */
 	use_ice_udp					bool
 	use_ice_tcp					bool
+	udp_mux						*NiceUdpMux		/* shared port of the UDP host candidates */
+	tcp_mux						*NiceTcpMux		/* shared port of the TCP passive host candidates */
 
-	timer 						*time.Timer
+	clock						Clock			/* time source of the timers */
+	reactor						*NiceReactor	/* runs the timers of the agent */
+	reactor_owned				bool			/* not one of the shared reactors */
+	discovery_timer_source		*NiceTimer		/* source of discovery timer */
+	conncheck_timer_source		*NiceTimer		/* source of conncheck timer */
+	keepalive_timer_source		*NiceTimer		/* source of keepalive timer */
+	consent_timer_source		*NiceTimer		/* source of consent freshness timer */
 
 	discovery_unsched_items		int
+	stun_server_compatibility	map[string]StunCompatibility	/* flavour of the STUN servers, once detected */
+	long_term_credentials		map[string]*StunLongTermCredentials	/* of the STUN and TURN servers, see agent_long_term_credentials() */
 
 	software_attribute 			string       /* SOFTWARE attribute */
 	reliable					bool         /* property: reliable */
 	keepalive_conncheck			bool
+	consent_freshness			bool		/* property: consent-freshness */
 
 	stun_addr					string
 	stun_port					uint16
 	controlling_mode			bool
 
-	gathering_done_db			GatheringDoneCb
-	new_selectpair_cb			NewSelectPairCb
-	componet_state_change_cb	ComponentStateChangeCb
+	closed						bool
+	close_done					chan struct{}	/* closed once the agent is */
+	connect_ctx					context.Context	/* of the TCP connects, cancelled by the close */
+	connect_cancel				context.CancelFunc
+
+	metrics						Metrics			/* NiceMetricsDiscard by default */
+	logger						*slog.Logger	/* NiceLogDiscard by default */
+	loggers						[NICE_LOG_LAST]*slog.Logger	/* of each subsystem */
+
+	events						*agent_events	/* created by Events() */
+	event_hook					func(event Event)	/* called with the agent lock held */
 }
 
 func NewNiceAgent() *NiceAgent {
 	a := &NiceAgent{}
 	a.rng = NewNiceRNG()
+	a.tie_breaker = a.rng.rng_generate_uint64()
 	a.use_ice_udp = true
 	a.full_mode = true	//default full_mode
+	a.nomination_mode = NICE_NOMINATION_MODE_AGGRESSIVE
+	a.clock = NiceSystemClock
+	a.reactor = nice_reactor_pool_get()
+	a.timer_ta = NICE_AGENT_TIMER_TA_DEFAULT
+	a.stun_max_retransmissions = STUN_TIMER_DEFAULT_MAX_RETRANSMISSIONS
+	a.stun_initial_timeout = STUN_TIMER_DEFAULT_TIMEOUT
+	a.stun_reliable_timeout = STUN_TIMER_DEFAULT_RELIABLE_TIMEOUT
+	a.stun_server_compatibility = make(map[string]StunCompatibility)
+	a.long_term_credentials = make(map[string]*StunLongTermCredentials)
+	a.connect_ctx, a.connect_cancel = context.WithCancel(context.Background())
+	a.metrics = NiceMetricsDiscard
+	a.metrics.AgentAdded()
+	a.priv_set_logger(NiceLogDiscard)
 	return a
 }
 
 func (this *NiceAgent) SetStunServer(addr string) {
 	this.stun_addr = addr
+	this.stun_server_ip = addr
 }
 
 func (this *NiceAgent) SetStunPort(port uint16) {
 	this.stun_port = port
 }
 
+/* The long-term credentials of the STUN server, which may challenge for them */
+func (this *NiceAgent) SetStunCredentials(username string, password string) {
+	this.stun_username = username
+	this.stun_password = password
+}
+
 func (this *NiceAgent) SetControllingMode(mode bool) {
 	this.controlling_mode = mode
 }
 
+/* Enables gathering and checking UDP candidates, on by default */
+func (this *NiceAgent) SetIceUdp(enable bool) {
+	this.use_ice_udp = enable
+}
+
+/* Enables ICE-TCP (RFC 6544) active, passive and simultaneous-open host
+ * candidates */
+func (this *NiceAgent) SetIceTcp(enable bool) {
+	this.use_ice_tcp = enable
+}
+
+/* Gathers the UDP host candidates on the port shared by @mux instead of
+ * one port per component. Must be set before gathering; the gathering
+ * fails with ErrUfragInUse if the ufrag set on a stream is used by
+ * another one on @mux */
+func (this *NiceAgent) SetUdpMux(mux *NiceUdpMux) {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+	this.udp_mux = mux
+}
+
+/* Listens for the ICE-TCP passive host candidates on the port shared by
+ * @mux. Must be set before gathering; the gathering fails with
+ * ErrUfragInUse if the ufrag set on a stream is used by another one on
+ * @mux */
+func (this *NiceAgent) SetTcpMux(mux *NiceTcpMux) {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+	this.tcp_mux = mux
+}
+
+/* Runs the timers of the agent on @clock instead of the wall clock, on a
+ * reactor of its own. Must be set before any stream is added */
+func (this *NiceAgent) SetClock(clock Clock) {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+	if clock == nil {
+		clock = NiceSystemClock
+	}
+	this.clock = clock
+	if this.reactor_owned {
+		this.reactor.nice_reactor_free()
+	}
+	if clock == NiceSystemClock {
+		this.reactor = nice_reactor_pool_get()
+		this.reactor_owned = false
+	} else {
+		this.reactor = NewNiceReactor(clock)
+		this.reactor_owned = true
+	}
+}
+
+/* Draws the credentials, foundations, tie-breaker and transaction ids of
+ * the agent from @rng, e.g. a seeded one for reproducible tests. Must be
+ * set before any stream is added */
+func (this *NiceAgent) SetRNG(rng *NiceRNG) {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+	if rng == nil {
+		rng = NewNiceRNG()
+	}
+	this.rng = rng
+	this.tie_breaker = rng.rng_generate_uint64()
+}
+
+/* Reports what the agent does to @metrics, to aggregate it with the
+ * other agents. The live agent, streams and components move from the
+ * previous Metrics to @metrics: removed from one, added to the other */
+func (this *NiceAgent) SetMetrics(metrics Metrics) {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+	if metrics == nil {
+		metrics = NiceMetricsDiscard
+	}
+	old := this.metrics
+	this.metrics = metrics
+
+	/* the agent is counted until its close is finished */
+	if this.close_done != nil {
+		select {
+		case <-this.close_done:
+			return
+		default:
+		}
+	}
+	for i := 0; i < len(this.streams); i++ {
+		stream := this.streams[i]
+		for j := 0; j < len(stream.components); j++ {
+			old.ComponentRemoved(stream.components[j].state)
+		}
+		old.StreamRemoved()
+	}
+	old.AgentRemoved()
+	metrics.AgentAdded()
+	for i := 0; i < len(this.streams); i++ {
+		stream := this.streams[i]
+		metrics.StreamAdded()
+		for j := 0; j < len(stream.components); j++ {
+			metrics.ComponentAdded(stream.components[j].state)
+		}
+	}
+}
+
+/* Logs what the agent does to @logger, see NiceLogSubsystem for the
+ * subsystems and NICE_LOG_LEVEL_TRACE for the STUN dumps */
+func (this *NiceAgent) SetLogger(logger *slog.Logger) {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+	if logger == nil {
+		logger = NiceLogDiscard
+	}
+	this.priv_set_logger(logger)
+}
+
+func (this *NiceAgent) priv_set_logger(logger *slog.Logger) {
+	this.logger = logger
+	for i := NiceLogSubsystem(0); i < NICE_LOG_LAST; i++ {
+		this.loggers[i] = logger.With(NICE_LOG_SUBSYSTEM_KEY, i.String())
+	}
+}
+
 func (this *NiceAgent) Nice_agent_add_stream(n_components uint) uint {
 	if n_components <= 0 {
 		return 0
@@ -124,16 +290,25 @@ func (this *NiceAgent) Nice_agent_add_stream(n_components uint) uint {
 
 	this.agent_mutex.Lock()
 	defer this.agent_mutex.Unlock()
+	if this.closed {
+		return 0
+	}
+	/* stream ids start at 1, 0 is never a valid stream */
+	this.next_stream_id++
 	stream := NewNiceStream(this.next_stream_id, n_components, this)
+	stun_agent_init(&stream.stun_agent, agent_to_stun_compatibility(this), agent_to_stun_usage_flags(this))
 
 	this.streams = append(this.streams, stream)
+	this.metrics.StreamAdded()
+	for i := 0; i < len(stream.components); i++ {
+		this.metrics.ComponentAdded(stream.components[i].state)
+	}
 	if this.reliable {
 		var i uint = 0
 		for i = 0; i < n_components; i++ {
 			c := stream.find_component_by_id(i + 1)
 			if c != nil {
-				//todo add pseudo tcp, but first we don't use pseudo tcp
-				//pseudo_tcp_socket_create (agent, stream, component);
+				pseudo_tcp_socket_create(this, stream, c)
 			}
 		}
 	}
@@ -143,6 +318,149 @@ func (this *NiceAgent) Nice_agent_add_stream(n_components uint) uint {
 	return stream.id
 }
 
+/**
+ * Nice_agent_remove_stream:
+ * @stream_id: The ID of the stream to remove
+ *
+ * Remove and free a previously created data stream from the agent: its
+ * checks and discoveries stop at once, and its sockets are closed once its
+ * TURN allocations are released.
+ *
+ * Returns: %FALSE if the stream does not exist
+ */
+func (this *NiceAgent) Nice_agent_remove_stream(stream_id uint) bool {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+	return priv_remove_stream(this, stream_id, nil)
+}
+
+/*
+ * Removes stream 'stream_id' and calls 'function', if any, once it is
+ * freed. Must be called with the agent lock held.
+ */
+func priv_remove_stream(agent *NiceAgent, stream_id uint, function func()) bool {
+	stream := agent.find_stream(stream_id)
+	if stream == nil {
+		return false
+	}
+
+	/* note: remove items with matching stream_ids from both lists */
+	conn_check_prune_stream(agent, stream)
+	discovery_prune_stream(agent, stream_id)
+
+	/* Remove the stream and signal its removal. */
+	for i := 0; i < len(agent.streams); i++ {
+		if agent.streams[i] == stream {
+			agent.streams = append(agent.streams[:i], agent.streams[i + 1:]...)
+			break
+		}
+	}
+	if len(agent.streams) == 0 {
+		agent_timeout_remove(&agent.keepalive_timer_source)
+		agent_timeout_remove(&agent.consent_timer_source)
+	}
+	for i := 0; i < len(stream.components); i++ {
+		agent.metrics.ComponentRemoved(stream.components[i].state)
+	}
+	agent.metrics.StreamRemoved()
+	agent_emit_event(agent, StreamRemovedEvent{StreamID: stream_id})
+
+	/* the relay sockets are needed until the allocations are released */
+	refresh_prune_stream_async(agent, stream, func() {
+		nice_stream_close(agent, stream)
+		if function != nil {
+			function()
+		}
+	})
+	return true
+}
+
+/**
+ * Nice_agent_close_async:
+ * @callback: Called once the agent is closed, may be nil
+ *
+ * Closes the agent: every stream is removed as with
+ * nice_agent_remove_stream(), its TURN allocations are released, then the
+ * timers of the agent stop and its Events() channel is closed. @callback
+ * runs in a goroutine of its own. The agent cannot be used anymore.
+ */
+func (this *NiceAgent) Nice_agent_close_async(callback func()) {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	if this.closed {
+		done := this.close_done
+		if callback != nil {
+			go func() {
+				<-done
+				callback()
+			}()
+		}
+		return
+	}
+	this.closed = true
+	this.close_done = make(chan struct{})
+	this.connect_cancel()
+
+	remaining := len(this.streams) + 1
+	on_stream_removed := func() {
+		remaining--
+		if remaining == 0 {
+			priv_agent_close_finish(this)
+			if callback != nil {
+				go callback()
+			}
+		}
+	}
+
+	ids := make([]uint, 0, len(this.streams))
+	for i := 0; i < len(this.streams); i++ {
+		ids = append(ids, this.streams[i].id)
+	}
+	for i := 0; i < len(ids); i++ {
+		priv_remove_stream(this, ids[i], on_stream_removed)
+	}
+	/* allocations left without a stream */
+	refresh_prune_agent_async(this, on_stream_removed)
+}
+
+/**
+ * Close:
+ * @ctx: Bounds the wait for the TURN servers
+ *
+ * Closes the agent with nice_agent_close_async() and waits until it is
+ * done. If @ctx ends first, the release of the TURN allocations goes on in
+ * the background and the error of @ctx is returned.
+ */
+func (this *NiceAgent) Close(ctx context.Context) error {
+	done := make(chan struct{})
+	this.Nice_agent_close_async(func() {
+		close(done)
+	})
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/* Stops what is left running once the streams are freed */
+func priv_agent_close_finish(agent *NiceAgent) {
+	agent_timeout_remove(&agent.discovery_timer_source)
+	agent_timeout_remove(&agent.conncheck_timer_source)
+	agent_timeout_remove(&agent.keepalive_timer_source)
+	agent_timeout_remove(&agent.consent_timer_source)
+	if agent.reactor_owned {
+		agent.reactor.nice_reactor_free()
+	}
+	if agent.events != nil {
+		agent.events.agent_events_close()
+	}
+	agent.metrics.AgentRemoved()
+	close(agent.close_done)
+}
+
 func (this *NiceAgent) agent_find_component(stream_id uint, component_id uint) (*NiceStream, *NiceComponent) {
 	stream := this.find_stream(stream_id)
 	if stream == nil {
@@ -179,7 +497,63 @@ func (this *NiceAgent) nice_agent_attach_recv(stream_id uint, component_id uint,
 		return false
 	}
 
+	/* a NiceConn of the component stops receiving */
+	c.conn = nil
 	c.nice_component_set_io_callback(recv_func, nil, nil)
+	if recv_func != nil && c.tcp != nil {
+		/* the data received while no callback was attached */
+		this.reactor.nice_reactor_invoke(func() {
+			agent_deliver_pseudo_tcp_data(this, stream_id, component_id)
+		})
+	}
+	return true
+}
+
+/**
+ * nice_agent_attach_dtls_recv:
+ * @stream_id: The ID of stream
+ * @component_id: The ID of the component
+ * @recv_func: The callback function to be called for every DTLS record
+ *
+ * Sets a callback receiving only the DTLS records (first byte 20 to 63, see
+ * RFC 7983) of the component instead of the callback of
+ * nice_agent_attach_recv(). A %NULL @recv_func hands them back to it.
+ *
+ * Returns: %TRUE on success, %FALSE if the stream or component IDs are invalid.
+ */
+func (this *NiceAgent) Nice_agent_attach_dtls_recv(stream_id uint, component_id uint, recv_func NiceAgentRecvFunc) bool {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	_, c := this.agent_find_component(stream_id, component_id)
+	if c == nil {
+		return false
+	}
+	c.dtls_callback = recv_func
+	return true
+}
+
+/**
+ * nice_agent_attach_rtp_recv:
+ * @stream_id: The ID of stream
+ * @component_id: The ID of the component
+ * @recv_func: The callback function to be called for every RTP or RTCP packet
+ *
+ * Sets a callback receiving only the RTP and RTCP packets (first byte 128 to
+ * 191, see RFC 7983) of the component instead of the callback of
+ * nice_agent_attach_recv(). A %NULL @recv_func hands them back to it.
+ *
+ * Returns: %TRUE on success, %FALSE if the stream or component IDs are invalid.
+ */
+func (this *NiceAgent) Nice_agent_attach_rtp_recv(stream_id uint, component_id uint, recv_func NiceAgentRecvFunc) bool {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	_, c := this.agent_find_component(stream_id, component_id)
+	if c == nil {
+		return false
+	}
+	c.rtp_callback = recv_func
 	return true
 }
 
@@ -195,11 +569,509 @@ func (this *NiceAgent) nice_agent_set_port_range(stream_id uint, component_id ui
 	c.max_port = max_port
 }
 
+/**
+ * nice_agent_set_relay_info:
+ * @stream_id: The ID of the stream
+ * @component_id: The ID of the component
+ * @server_ip: The IP address of the TURN server
+ * @server_port: The port of the TURN server
+ * @username: The TURN username to use for the allocate
+ * @password: The TURN password to use for the allocate
+ * @type: The type of relay to use
+ *
+ * Sets the settings for using a relay server during the candidate discovery.
+ * This may be called multiple times to add multiple relay servers to the
+ * discovery process; one TCP and one UDP, for example.
+ *
+ * Returns: %TRUE if the TURN settings were accepted.
+ */
+func (this *NiceAgent) Nice_agent_set_relay_info(stream_id uint, component_id uint, server_ip string, server_port int, username string, password string, typ NiceRelayType) bool {
+	if stream_id < 1 || component_id < 1 || server_ip == "" || server_port <= 0 || server_port > 0xffff {
+		return false
+	}
+	if typ < NICE_RELAY_TYPE_TURN_UDP || typ > NICE_RELAY_TYPE_TURN_TLS {
+		return false
+	}
+
+	ip := net.ParseIP(server_ip)
+	if ip == nil {
+		return false
+	}
+
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	_, c := this.agent_find_component(stream_id, component_id)
+	if c == nil {
+		return false
+	}
+
+	turn := &TurnServer{}
+	turn.server.ip = ip.String()
+	turn.server.port = server_port
+	turn.server.family = "ip4"
+	if ip.To4() == nil {
+		turn.server.family = "ip6"
+	}
+	turn.server.network = "udp"
+	if typ != NICE_RELAY_TYPE_TURN_UDP {
+		turn.server.network = "tcp"
+	}
+	turn.username = username
+	turn.password = password
+	turn.typ = typ
+	c.turn_servers = append(c.turn_servers, turn)
+	return true
+}
+
+/**
+ * nice_agent_set_remote_credentials:
+ * @stream_id: The ID of the stream
+ * @ufrag: the remote ufrag
+ * @pwd: the remote password
+ *
+ * Sets the remote credentials for stream @stream_id, used in the USERNAME
+ * and to check the MESSAGE-INTEGRITY of the connectivity checks.
+ *
+ * Returns: %TRUE on success, %FALSE on error.
+ */
+func (this *NiceAgent) nice_agent_set_remote_credentials(stream_id uint, ufrag string, pwd string) bool {
+	if stream_id < 1 || ufrag == "" || pwd == "" {
+		return false
+	}
+
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	stream := this.find_stream(stream_id)
+	if stream == nil {
+		return false
+	}
+	stream.remote_ufrag = ufrag
+	stream.remote_password = pwd
+	return true
+}
+
+/**
+ * nice_agent_set_remote_candidates:
+ * @stream_id: The ID of the stream the candidates are for
+ * @component_id: The ID of the component the candidates are for
+ * @candidates: The remote candidates
+ *
+ * Adds the remote candidates of the peer to the component and pairs them
+ * with the local candidates. Candidates already known are updated, and at
+ * most %NICE_AGENT_MAX_REMOTE_CANDIDATES are kept.
+ *
+ * Returns: The number of candidates added, negative on errors
+ */
+func (this *NiceAgent) nice_agent_set_remote_candidates(stream_id uint, component_id uint, candidates []*NiceCandidate) int {
+	if stream_id < 1 || component_id < 1 {
+		return -1
+	}
+
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	_, c := this.agent_find_component(stream_id, component_id)
+	if c == nil {
+		return -1
+	}
+
+	added := 0
+	for i := 0; i < len(candidates); i++ {
+		if priv_add_remote_candidate(this, stream_id, c, candidates[i]) {
+			added++
+		}
+	}
+	if added > 0 {
+		conn_check_schedule_next(this)
+	}
+	return added
+}
+
+/**
+ * Nice_agent_get_local_candidates:
+ * @stream_id: The ID of the stream
+ * @component_id: The ID of the component
+ *
+ * Retrieve from the agent the list of all local candidates
+ * for a stream's component
+ *
+ * Returns: copies of the local candidates, nil if the component does not
+ * exist
+ */
+func (this *NiceAgent) Nice_agent_get_local_candidates(stream_id uint, component_id uint) []*NiceCandidate {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	_, c := this.agent_find_component(stream_id, component_id)
+	if c == nil {
+		return nil
+	}
+	candidates := make([]*NiceCandidate, 0, len(c.local_candidates))
+	for i := 0; i < len(c.local_candidates); i++ {
+		candidates = append(candidates, nice_candidate_copy(c.local_candidates[i]))
+	}
+	return candidates
+}
+
+/**
+ * Nice_agent_get_remote_candidates:
+ * @stream_id: The ID of the stream
+ * @component_id: The ID of the component
+ *
+ * Get a list of the remote candidates set on a stream's component, the ones
+ * set with nice_agent_set_remote_candidates() and the peer reflexive ones
+ * discovered by the connectivity checks.
+ *
+ * Returns: copies of the remote candidates, nil if the component does not
+ * exist
+ */
+func (this *NiceAgent) Nice_agent_get_remote_candidates(stream_id uint, component_id uint) []*NiceCandidate {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	_, c := this.agent_find_component(stream_id, component_id)
+	if c == nil {
+		return nil
+	}
+	candidates := make([]*NiceCandidate, 0, len(c.remote_candidates))
+	for i := 0; i < len(c.remote_candidates); i++ {
+		candidates = append(candidates, nice_candidate_copy(c.remote_candidates[i]))
+	}
+	return candidates
+}
+
+/**
+ * Nice_agent_get_local_credentials:
+ * @stream_id: The ID of the stream
+ *
+ * Gets the local credentials for stream @stream_id, the generated ones
+ * unless nice_agent_set_local_credentials() replaced them.
+ *
+ * Returns: the ufrag and the password, and %TRUE on success, %FALSE on error.
+ */
+func (this *NiceAgent) Nice_agent_get_local_credentials(stream_id uint) (string, string, bool) {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	stream := this.find_stream(stream_id)
+	if stream == nil {
+		return "", "", false
+	}
+	return stream.local_ufrag, stream.local_password, true
+}
+
+/**
+ * Nice_agent_set_local_credentials:
+ * @stream_id: The ID of the stream
+ * @ufrag: the local ufrag, 4 to 256 ice-chars
+ * @pwd: the local password, 22 to 256 ice-chars
+ *
+ * Sets the local credentials for stream @stream_id, in place of the
+ * generated ones.
+ *
+ * This fails once ICE negotiation has started, and, when the agent shares
+ * a port through a #NiceUdpMux or #NiceTcpMux, once the gathering started,
+ * as the ufrag is what the mux tells the agents apart with.
+ *
+ * Returns: %TRUE on success, %FALSE on error.
+ */
+func (this *NiceAgent) Nice_agent_set_local_credentials(stream_id uint, ufrag string, pwd string) bool {
+	return priv_set_local_credentials(this, stream_id, ufrag, pwd) == nil
+}
+
+/*
+ * Sets the local credentials of the stream, see
+ * Nice_agent_set_local_credentials(). Returns why it could not.
+ */
+func priv_set_local_credentials(agent *NiceAgent, stream_id uint, ufrag string, pwd string) error {
+	if !nice_stream_credentials_are_valid(ufrag, pwd) {
+		return ErrInvalidArgument
+	}
+
+	agent.agent_mutex.Lock()
+	defer agent.agent_mutex.Unlock()
+
+	stream := agent.find_stream(stream_id)
+	if stream == nil {
+		return ErrNoSuchStream
+	}
+	if nice_stream_negotiation_started(stream) ||
+			(stream.gathering_started && (agent.udp_mux != nil || agent.tcp_mux != nil)) {
+		return ErrNegotiationStarted
+	}
+	stream.local_ufrag = ufrag
+	stream.local_password = pwd
+	stream.local_credentials_set = true
+	return nil
+}
+
+/**
+ * Nice_agent_get_selected_pair:
+ * @stream_id: The ID of the stream
+ * @component_id: The ID of the component
+ *
+ * Retreive the selected candidate pair for media transmission
+ * for a given stream's component.
+ *
+ * Returns: copies of the local and remote candidates of the pair, and
+ * %TRUE on success, %FALSE if there is no selected candidate pair
+ */
+func (this *NiceAgent) Nice_agent_get_selected_pair(stream_id uint, component_id uint) (*NiceCandidate, *NiceCandidate, bool) {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	_, c := this.agent_find_component(stream_id, component_id)
+	if c == nil || c.selected_pair.local == nil || c.selected_pair.remote == nil {
+		return nil, nil, false
+	}
+	return nice_candidate_copy(c.selected_pair.local), nice_candidate_copy(c.selected_pair.remote), true
+}
+
+/**
+ * Nice_agent_get_selected_socket:
+ * @stream_id: The ID of the stream
+ * @component_id: The ID of the component
+ *
+ * Retreive the local socket associated with the selected candidate pair
+ * for media transmission for a given stream's component.
+ *
+ * This is useful for adding ICE support to legacy applications that already
+ * have a protocol that maintains a connection. If the socket is duplicated
+ * before unrefing the agent, the application can take over and continue to use
+ * it. New applications are encouraged to use the built in libnice stream
+ * handling instead and let libnice handle the connection maintenance.
+ *
+ * Users of this method are encouraged to not use a TURN relay or any kind
+ * of proxy, as in this case, the socket will not be available to the
+ * application because the packets are encapsulated.
+ *
+ * Returns: the connection of the operating system, or nil if there is no
+ * selected candidate or if the selected candidate uses a relay, a proxy or
+ * a port shared with other agents
+ */
+func (this *NiceAgent) Nice_agent_get_selected_socket(stream_id uint, component_id uint) net.Conn {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	_, c := this.agent_find_component(stream_id, component_id)
+	if c == nil || c.selected_pair.local == nil {
+		return nil
+	}
+	return nice_socket_get_net_conn(c.nice_component_selected_socket())
+}
+
+/**
+ * Nice_agent_set_selected_pair:
+ * @stream_id: The ID of the stream
+ * @component_id: The ID of the component
+ * @lfoundation: The local foundation of the candidate to use
+ * @rfoundation: The remote foundation of the candidate to use
+ *
+ * Sets the selected candidate pair for media transmission
+ * for a given stream's component. Calling this function will
+ * disable all further ICE processing (connection check,
+ * state machine updates, etc) on the component. Note that keepalives
+ * will continue to be sent.
+ *
+ * Returns: %TRUE on success, %FALSE if the candidate pair cannot be found
+ */
+func (this *NiceAgent) Nice_agent_set_selected_pair(stream_id uint, component_id uint, lfoundation string, rfoundation string) bool {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	stream, component := this.agent_find_component(stream_id, component_id)
+	if component == nil {
+		return false
+	}
+
+	pair := priv_component_find_pair(this, stream, component, lfoundation, rfoundation)
+	if pair == nil {
+		return false
+	}
+	return priv_set_selected_pair(this, stream, component, pair)
+}
+
+/**
+ * Nice_agent_set_selected_remote_candidate:
+ * @stream_id: The ID of the stream
+ * @component_id: The ID of the component
+ * @candidate: The #NiceCandidate to select
+ *
+ * Sets the selected remote candidate for media transmission
+ * for a given stream's component. This is used to force the selection of
+ * a specific remote candidate even when connectivity checks are failing
+ * (e.g. non-ICE compatible candidates).
+ * Calling this function will disable all further ICE processing
+ * (connection check, state machine updates, etc) on the component. Note
+ * that keepalives will continue to be sent.
+ *
+ * Returns: %TRUE on success, %FALSE on failure
+ */
+func (this *NiceAgent) Nice_agent_set_selected_remote_candidate(stream_id uint, component_id uint, candidate *NiceCandidate) bool {
+	if candidate == nil || candidate.addr.ip == "" {
+		return false
+	}
+
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	stream, component := this.agent_find_component(stream_id, component_id)
+	if component == nil {
+		return false
+	}
+
+	local := component.nice_component_find_local_for_remote(this, candidate)
+	if local == nil {
+		return false
+	}
+
+	var remote *NiceCandidate
+	for i := 0; i < len(component.remote_candidates); i++ {
+		if nice_candidate_equal(component.remote_candidates[i], candidate) {
+			remote = component.remote_candidates[i]
+			break
+		}
+	}
+	if remote == nil {
+		remote = nice_candidate_copy(candidate)
+		remote.stream_id = stream_id
+		remote.component_id = component_id
+		remote.sockptr = nil
+		component.remote_candidates = append(component.remote_candidates, remote)
+	}
+
+	pair := priv_component_find_check_pair(this, stream, component, local, remote)
+	return priv_set_selected_pair(this, stream, component, pair)
+}
+
+/*
+ * Finds the pair of the local candidate of foundation 'lfoundation' and
+ * the remote candidate of foundation 'rfoundation'.
+ */
+func priv_component_find_pair(agent *NiceAgent, stream *NiceStream, component *NiceComponent, lfoundation string, rfoundation string) *CandidateCheckPair {
+	for i := 0; i < len(component.local_candidates); i++ {
+		local := component.local_candidates[i]
+		if string(local.foundation) != lfoundation {
+			continue
+		}
+		for j := 0; j < len(component.remote_candidates); j++ {
+			remote := component.remote_candidates[j]
+			if string(remote.foundation) != rfoundation {
+				continue
+			}
+			if local.transport != conn_check_match_transport(remote.transport) || !EqualFamily(local.addr, remote.addr) {
+				continue
+			}
+			return priv_component_find_check_pair(agent, stream, component, local, remote)
+		}
+	}
+	return nil
+}
+
+/*
+ * Returns the check pair of 'local' and 'remote', or a new one outside of
+ * the check list if they were never checked.
+ */
+func priv_component_find_check_pair(agent *NiceAgent, stream *NiceStream, component *NiceComponent, local *NiceCandidate, remote *NiceCandidate) *CandidateCheckPair {
+	for i := 0; i < len(stream.conncheck_list); i++ {
+		p := stream.conncheck_list[i]
+		if p.component_id == component.id && p.local == local && p.remote == remote {
+			return p
+		}
+	}
+
+	pair := NewCandidateCheckPair()
+	pair.stream_id = stream.id
+	pair.component_id = component.id
+	pair.local = local
+	pair.remote = remote
+	pair.sockptr = local.sockptr
+	pair.foundation = []byte(string(local.foundation) + ":" + string(remote.foundation))
+	pair.priority = agent.agent_candidate_pair_priority(local, remote)
+	return pair
+}
+
+/*
+ * Forces 'pair' as the selected pair of 'component', which stops being
+ * checked and goes to READY.
+ */
+func priv_set_selected_pair(agent *NiceAgent, stream *NiceStream, component *NiceComponent, pair *CandidateCheckPair) bool {
+	/* an ICE-TCP pair can only be selected once its connection is made,
+	 * by a check or by the peer */
+	sock := conn_check_get_connected_pair_socket(pair)
+	if sock == nil {
+		return false
+	}
+
+	if agent.reliable && !sock.is_reliable() && component.tcp != nil && component.tcp.pseudo_tcp_socket_is_closed() {
+		/* Failed to select the pair: the pseudo TCP connection is closed */
+		return false
+	}
+
+	/* step: stop connectivity checks (note: for the component only) */
+	conn_check_prune_component(agent, stream, component)
+
+	/* step: change component state; we could be in STATE_DISCONNECTED; skip
+	 * STATE_GATHERING and continue through the states to give client code a
+	 * nice logical progression. */
+	if component.state < NICE_COMPONENT_STATE_CONNECTING || component.state == NICE_COMPONENT_STATE_FAILED {
+		agent_signal_component_state_change(agent, stream.id, component.id, NICE_COMPONENT_STATE_CONNECTING)
+	}
+	if component.state < NICE_COMPONENT_STATE_CONNECTED {
+		agent_signal_component_state_change(agent, stream.id, component.id, NICE_COMPONENT_STATE_CONNECTED)
+	}
+
+	/* step: set the selected pair */
+	pair.state = NICE_CHECK_SUCCEEDED
+	pair.valid = true
+	pair.nominated = true
+	component.nice_component_update_selected_pair(pair, agent.clock.Now())
+	agent_signal_new_selected_pair(agent, stream.id, component.id, pair.local, pair.remote)
+	agent_signal_component_state_change(agent, stream.id, component.id, NICE_COMPONENT_STATE_READY)
+	conn_check_schedule_keepalive(agent)
+	return true
+}
+
+func priv_add_remote_candidate(agent *NiceAgent, stream_id uint, component *NiceComponent, candidate *NiceCandidate) bool {
+	if candidate == nil || candidate.addr.ip == "" {
+		return false
+	}
+
+	for i := 0; i < len(component.remote_candidates); i++ {
+		existing := component.remote_candidates[i]
+		if nice_candidate_equal(existing, candidate) {
+			/* the peer only updates what it knows better */
+			existing.priority = candidate.priority
+			if candidate.username != "" {
+				existing.username = candidate.username
+			}
+			if candidate.password != "" {
+				existing.password = candidate.password
+			}
+			return false
+		}
+	}
+	if len(component.remote_candidates) >= NICE_AGENT_MAX_REMOTE_CANDIDATES {
+		return false
+	}
+
+	remote := nice_candidate_copy(candidate)
+	remote.stream_id = stream_id
+	remote.component_id = component.id
+	remote.sockptr = nil
+	component.remote_candidates = append(component.remote_candidates, remote)
+	conn_check_add_for_remote_candidate(agent, stream_id, component, remote)
+	return true
+}
+
 const ADD_HOST_MIN = 0
 const ADD_HOST_UDP = ADD_HOST_MIN
 const ADD_HOST_TCP_ACTIVE = 1
 const ADD_HOST_TCP_PASSIVE = 2
-const ADD_HOST_MAX = ADD_HOST_UDP
+const ADD_HOST_TCP_SO = 3
+const ADD_HOST_MAX = ADD_HOST_TCP_SO
 
 func (this *NiceAgent) Nice_agent_gather_candidates(stream_id uint) error {
 	this.agent_mutex.Lock()
@@ -213,6 +1085,7 @@ func (this *NiceAgent) Nice_agent_gather_candidates(stream_id uint) error {
 	if stream.gathering_started {
 		return nil
 	}
+	stream.gathering_start = this.clock.Now()
 
 	/* if no local addresses added, generate them ourselves */
 	if this.local_addresses == nil {
@@ -230,7 +1103,7 @@ func (this *NiceAgent) Nice_agent_gather_candidates(stream_id uint) error {
 	for cid := 1; cid < len(stream.components) + 1; cid++ {
 		_, component := this.agent_find_component(stream_id, uint(cid))
 		if component == nil {
-			fmt.Println("nilnil")
+			nice_agent_log(this, NICE_LOG_DISCOVERY).Warn("component not found", "stream", stream_id, "component", cid)
 			continue
 		}
 		var found_local_address bool = false
@@ -241,7 +1114,6 @@ func (this *NiceAgent) Nice_agent_gather_candidates(stream_id uint) error {
 				var transport NiceCandidateTransport
 				var current_port int
 				var start_port	int
-				fmt.Println("add_type=", add_type)
 				if this.use_ice_udp == false && add_type == ADD_HOST_UDP {
 					continue
 				}
@@ -257,6 +1129,8 @@ func (this *NiceAgent) Nice_agent_gather_candidates(stream_id uint) error {
 					transport = NICE_CANDIDATE_TRANSPORT_TCP_ACTIVE
 				case ADD_HOST_TCP_PASSIVE:
 					transport = NICE_CANDIDATE_TRANSPORT_TCP_PASSIVE
+				case ADD_HOST_TCP_SO:
+					transport = NICE_CANDIDATE_TRANSPORT_TCP_SO
 				default:
 					transport = NICE_CANDIDATE_TRANSPORT_UDP
 				}
@@ -266,11 +1140,21 @@ func (this *NiceAgent) Nice_agent_gather_candidates(stream_id uint) error {
 					start_port = int(this.rng.rng_generate_int(uint(component.min_port), uint(component.max_port)))
 				}
 
+				/* TCP active candidates never listen, their port is
+				 * only chosen when connecting (RFC 6544 section 4.5) */
+				if transport == NICE_CANDIDATE_TRANSPORT_TCP_ACTIVE {
+					start_port = 0
+				}
+
+				if transport != NICE_CANDIDATE_TRANSPORT_UDP {
+					addr.network = "tcp"
+				}
+
 				current_port = start_port
-				addr.port = current_port
 				var host_candidate *NiceCandidate
 				var res HostCandidateResult = HOST_CANDIDATE_CANT_CREATE_SOCKET
 				for res == HOST_CANDIDATE_CANT_CREATE_SOCKET {
+					addr.port = current_port
 					host_candidate, res = this.discovery_add_local_host_candidate(stream.id, uint(cid), addr, transport)
 					if current_port > 0 {
 						current_port++
@@ -289,7 +1173,11 @@ func (this *NiceAgent) Nice_agent_gather_candidates(stream_id uint) error {
 					continue
 				} else if res == HOST_CANDIDATE_FAILED {
 					continue
+				} else if res == HOST_CANDIDATE_UFRAG_IN_USE {
+					return ErrUfragInUse
 				} else if res == HOST_CANDIDATE_CANT_CREATE_SOCKET {
+					nice_component_log(this, NICE_LOG_SOCKET, stream.id, uint(cid)).Warn("could not create the socket of a host candidate",
+						"addr", nice_address_to_string(addr), "transport", Nice_candidate_transport_to_string(transport))
 					continue
 				}
 
@@ -306,12 +1194,24 @@ func (this *NiceAgent) Nice_agent_gather_candidates(stream_id uint) error {
 					stun_server.port = s.Port
 					stun_server.ip = s.IP.String()
 					stun_server.family = "ip4"
+					stun_server.network = "udp"
 					stun_server.port = int(this.stun_port)
 					if EqualFamily(host_candidate.addr, stun_server) {
 						priv_add_new_candidate_discovery_stun(this, host_candidate.sockptr, stun_server, stream, uint(cid))
 					}
 				}
-				// todo discovery turn
+
+				/* relayed candidates are always allocated from the UDP host
+				 * candidate, TCP and TLS relays open their own connection */
+				if this.full_mode && component != nil && transport == NICE_CANDIDATE_TRANSPORT_UDP {
+					for i := 0; i < len(component.turn_servers); i++ {
+						turn := component.turn_servers[i]
+						if !EqualFamily(host_candidate.addr, turn.server) {
+							continue
+						}
+						priv_add_new_candidate_discovery_turn(this, host_candidate.sockptr, turn, stream, uint(cid))
+					}
+				}
 			}
 		}
 
@@ -339,5 +1239,7 @@ func (this *NiceAgent) Nice_agent_gather_candidates(stream_id uint) error {
 			agent_signal_new_candidate(this, candidate)
 		}
 	}
+	discovery_schedule(this)
+	agent_gathering_done(this)
 	return nil
 }
\ No newline at end of file
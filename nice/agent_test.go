@@ -0,0 +1,457 @@
+package nice
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+/*
+ * The data of a reliable agent nobody reads stays in its pseudo TCP
+ * receive buffer: the window closes and the sender blocks, instead of
+ * the receiver queueing without bound. Once read, all of it arrives in
+ * order.
+ */
+func TestPseudoTcpFlowControl(t *testing.T) {
+	a, b := test_conn_check_agents(t, true, false, WithReliable())
+	test_conn_check_wait_ready(t, a)
+	test_conn_check_wait_ready(t, b)
+
+	chunk := make([]byte, 1000)
+	total := 0
+	blocked := time.Time{}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		for i := 0; i < len(chunk); i++ {
+			chunk[i] = byte((total + i) % 251)
+		}
+		n, err := a.Component(1).Send(chunk)
+		if n > 0 {
+			total += n
+			blocked = time.Time{}
+			continue
+		}
+		if err != nil && err != ErrWouldBlock {
+			t.Fatal(err)
+		}
+		if blocked.IsZero() {
+			blocked = time.Now()
+		} else if time.Since(blocked) > 500 * time.Millisecond {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the sender never blocked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if total > PSEUDO_TCP_DEFAULT_RCV_BUF_SIZE + PSEUDO_TCP_DEFAULT_SND_BUF_SIZE {
+		t.Fatalf("%d bytes taken by a sender to a receiver that does not read", total)
+	}
+
+	nice_b := b.agent.agent
+	nice_b.agent_mutex.Lock()
+	_, component := nice_b.agent_find_component(b.ID(), 1)
+	buffered := len(component.tcp.rbuf)
+	nice_b.agent_mutex.Unlock()
+	if buffered > PSEUDO_TCP_DEFAULT_RCV_BUF_SIZE {
+		t.Fatalf("%d bytes buffered by the receiver", buffered)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+	received := 0
+	buf := make([]byte, 100)
+	for received < total {
+		message := &NiceInputMessage{buffers: [][]byte{buf}}
+		if _, err := nice_b.Nice_agent_recv_messages(ctx, b.ID(), 1, []*NiceInputMessage{message}); err != nil {
+			t.Fatalf("after %d of %d bytes: %v", received, total, err)
+		}
+		for i := 0; i < message.length; i++ {
+			if buf[i] != byte((received + i) % 251) {
+				t.Fatalf("byte %d corrupted", received + i)
+			}
+		}
+		received += message.length
+	}
+}
+
+/*
+ * Before a pair is selected, a reliable component keeps a bounded number
+ * of packets for its pseudo TCP socket; only those of the remote candidate
+ * of the selected pair are then fed to it.
+ */
+func TestPseudoTcpQueuedPackets(t *testing.T) {
+	agent := NewNiceAgent()
+	agent.reliable = true
+	defer agent.Close(context.Background())
+	id := agent.Nice_agent_add_stream(1)
+
+	agent.agent_mutex.Lock()
+	defer agent.agent_mutex.Unlock()
+	stream, component := agent.agent_find_component(id, 1)
+	callbacks := &PseudoTcpCallbacks{
+		WritePacket: func(tcp *PseudoTcpSocket, buf []byte, data interface{}) PseudoTcpWriteResult {
+			return WR_SUCCESS
+		},
+	}
+	component.tcp = pseudo_tcp_socket_new(0, callbacks, agent.clock)
+	var syn []byte
+	client := pseudo_tcp_socket_new(0, &PseudoTcpCallbacks{
+		WritePacket: func(tcp *PseudoTcpSocket, buf []byte, data interface{}) PseudoTcpWriteResult {
+			syn = append([]byte{}, buf...)
+			return WR_SUCCESS
+		},
+	}, agent.clock)
+	client.pseudo_tcp_socket_connect()
+
+	peer := NiceAddress{ip: "198.51.100.7", port: 5000, family: "ip4"}
+	other := NiceAddress{ip: "198.51.100.8", port: 5000, family: "ip4"}
+	for i := 0; i < NICE_COMPONENT_RECV_QUEUE_LEN + 10; i++ {
+		agent_recv_pseudo_tcp_packet(agent, stream, component, other, syn)
+	}
+	if len(component.queued_tcp_packets) != NICE_COMPONENT_RECV_QUEUE_LEN {
+		t.Fatalf("%d packets queued", len(component.queued_tcp_packets))
+	}
+
+	remote := nice_candidate_new(NICE_CANDIDATE_TYPE_HOST)
+	remote.addr = peer
+	component.selected_pair = CandidatePair{local: nice_candidate_new(NICE_CANDIDATE_TYPE_HOST), remote: remote}
+	process_queued_tcp_packets(agent, stream, component)
+	if len(component.queued_tcp_packets) != 0 || component.tcp.state != TCP_LISTEN {
+		t.Fatal("the packets of another address were fed")
+	}
+	agent_recv_pseudo_tcp_packet(agent, stream, component, other, syn)
+	if component.tcp.state != TCP_LISTEN {
+		t.Fatal("a packet of another address was fed")
+	}
+	agent_recv_pseudo_tcp_packet(agent, stream, component, peer, syn)
+	if component.tcp.state != TCP_SYN_RECEIVED {
+		t.Fatalf("state %v after the SYN of the peer", component.tcp.state)
+	}
+}
+
+/*
+ * An agent of one gathered UDP component, whose only remote candidate is
+ * @remote, and its events from then on.
+ */
+func test_selected_pair_stream(t *testing.T, remote Candidate) (<-chan Event, *Stream, Candidate) {
+	a, err := NewAgent(WithLocalAddresses("127.0.0.1"), WithIceTcp(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close(context.Background()) })
+	s, err := a.AddStream(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if err := s.Gather(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetRemoteCredentials("remoteufrag", "remotepassword0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Component(1).AddRemoteCandidates(remote); err != nil {
+		t.Fatal(err)
+	}
+	local, err := s.Component(1).LocalCandidates()
+	if err != nil || len(local) == 0 {
+		t.Fatalf("local candidates %v: %v", local, err)
+	}
+	return a.Events(), s, local[0]
+}
+
+/* Waits for the NewSelectedPair of the stream then its component going READY */
+func test_selected_pair_event(t *testing.T, events <-chan Event, s *Stream) NewSelectedPairEvent {
+	var selected *NewSelectedPairEvent
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			switch e := ev.(type) {
+			case NewSelectedPairEvent:
+				if e.StreamID == s.ID() && e.ComponentID == 1 {
+					selected = &e
+				}
+			case ComponentStateChangedEvent:
+				if e.StreamID != s.ID() || e.State != NICE_COMPONENT_STATE_READY {
+					break
+				}
+				if selected == nil {
+					t.Fatal("READY before the NewSelectedPair event")
+				}
+				return *selected
+			}
+		case <-timeout:
+			t.Fatal("no NewSelectedPair and READY events")
+		}
+	}
+}
+
+/*
+ * The pair of the foundations chosen out of band becomes the selected pair
+ * without a check; unknown foundations are refused.
+ */
+func TestSetSelectedPair(t *testing.T) {
+	remote := Candidate{Type: NICE_CANDIDATE_TYPE_HOST, Transport: NICE_CANDIDATE_TRANSPORT_UDP, Address: "127.0.0.1", Port: 9, Foundation: "remote", Priority: 1}
+	events, s, local := test_selected_pair_stream(t, remote)
+	c := s.Component(1)
+
+	if err := c.SetSelectedPair(local.Foundation, "unknown"); err != ErrInvalidArgument {
+		t.Fatalf("unknown remote foundation: %v", err)
+	}
+	if err := c.SetSelectedPair("unknown", remote.Foundation); err != ErrInvalidArgument {
+		t.Fatalf("unknown local foundation: %v", err)
+	}
+	if c.State() == NICE_COMPONENT_STATE_READY {
+		t.Fatal("READY without a selected pair")
+	}
+
+	if err := c.SetSelectedPair(local.Foundation, remote.Foundation); err != nil {
+		t.Fatal(err)
+	}
+	ev := test_selected_pair_event(t, events, s)
+	if ev.Local.Foundation != local.Foundation || ev.Remote.Port != remote.Port {
+		t.Fatalf("NewSelectedPair %v-%v", ev.Local, ev.Remote)
+	}
+	if c.State() != NICE_COMPONENT_STATE_READY {
+		t.Fatalf("component %s", Nice_component_state_to_string(c.State()))
+	}
+	l, r, err := c.SelectedPair()
+	if err != nil || l.Port != local.Port || r.Port != remote.Port {
+		t.Fatalf("selected %d-%d: %v", l.Port, r.Port, err)
+	}
+}
+
+/*
+ * A remote candidate forced as selected is added if unknown, paired with
+ * a local candidate of its family; one no local candidate can reach is
+ * refused.
+ */
+func TestSetSelectedRemoteCandidate(t *testing.T) {
+	events, s, local := test_selected_pair_stream(t, Candidate{Type: NICE_CANDIDATE_TYPE_HOST, Transport: NICE_CANDIDATE_TRANSPORT_UDP, Address: "127.0.0.1", Port: 9, Foundation: "remote", Priority: 1})
+	c := s.Component(1)
+
+	if err := c.SetSelectedRemoteCandidate(Candidate{Type: NICE_CANDIDATE_TYPE_HOST, Transport: NICE_CANDIDATE_TRANSPORT_UDP, Address: "::1", Port: 10}); err != ErrInvalidArgument {
+		t.Fatalf("remote candidate of another family: %v", err)
+	}
+	if err := c.SetSelectedRemoteCandidate(Candidate{Type: NICE_CANDIDATE_TYPE_HOST, Transport: NICE_CANDIDATE_TRANSPORT_UDP, Address: "not an address", Port: 10}); err != ErrInvalidArgument {
+		t.Fatalf("remote candidate of no address: %v", err)
+	}
+
+	forced := Candidate{Type: NICE_CANDIDATE_TYPE_HOST, Transport: NICE_CANDIDATE_TRANSPORT_UDP, Address: "127.0.0.1", Port: 11, Foundation: "forced"}
+	if err := c.SetSelectedRemoteCandidate(forced); err != nil {
+		t.Fatal(err)
+	}
+	ev := test_selected_pair_event(t, events, s)
+	if ev.Local.Port != local.Port || ev.Remote.Port != forced.Port {
+		t.Fatalf("NewSelectedPair %v-%v", ev.Local, ev.Remote)
+	}
+	if c.State() != NICE_COMPONENT_STATE_READY {
+		t.Fatalf("component %s", Nice_component_state_to_string(c.State()))
+	}
+	remotes, _ := c.RemoteCandidates()
+	if len(remotes) != 2 {
+		t.Fatalf("%d remote candidates", len(remotes))
+	}
+}
+
+/* A socket taking @room packets, then refusing them */
+type test_limited_socket struct {
+	NiceSockInterface
+	room			int
+	sent			[]string
+}
+
+func (this *test_limited_socket) send_messages(to *NiceAddress, messages []*NiceOutputMessage) error {
+	for i := 0; i < len(messages); i++ {
+		if this.room == 0 {
+			return errors.New("socket full")
+		}
+		this.room--
+		this.sent = append(this.sent, string(messages[i].buffers[0]))
+	}
+	return nil
+}
+
+/* A non-reliable component whose selected pair sends on @sock */
+func test_send_component(t *testing.T, sock NiceSockInterface) (*NiceAgent, uint) {
+	agent := NewNiceAgent()
+	t.Cleanup(func() { agent.Close(context.Background()) })
+	id := agent.Nice_agent_add_stream(1)
+	agent.agent_mutex.Lock()
+	defer agent.agent_mutex.Unlock()
+	_, component := agent.agent_find_component(id, 1)
+	local := nice_candidate_new(NICE_CANDIDATE_TYPE_HOST)
+	local.sockptr = sock
+	remote := nice_candidate_new(NICE_CANDIDATE_TYPE_HOST)
+	remote.addr = NiceAddress{ip: "198.51.100.7", port: 5000, network: "udp", family: "ip4"}
+	component.selected_pair = CandidatePair{local: local, remote: remote}
+	return agent, id
+}
+
+/*
+ * The non-blocking send of several packets counts those the socket took
+ * before refusing one, and fails only if it took none.
+ */
+func TestSendMessagesNonblockingPartial(t *testing.T) {
+	sock := &test_limited_socket{room: 2}
+	agent, id := test_send_component(t, sock)
+	messages := []*NiceOutputMessage{
+		{buffers: [][]byte{[]byte("one")}},
+		{buffers: [][]byte{[]byte("two")}},
+		{buffers: [][]byte{[]byte("three")}},
+	}
+
+	if n, err := agent.Nice_agent_send_messages_nonblocking(id, 1, nil); n != 0 || err != nil {
+		t.Fatalf("no message: %d, %v", n, err)
+	}
+	if n, err := agent.Nice_agent_send_messages_nonblocking(id, 1, messages); n != 2 || err != nil {
+		t.Fatalf("sent %d of 3 messages: %v", n, err)
+	}
+	if len(sock.sent) != 2 || sock.sent[0] != "one" || sock.sent[1] != "two" {
+		t.Fatalf("on the wire %q", sock.sent)
+	}
+	if n, err := agent.Nice_agent_send_messages_nonblocking(id, 1, messages[2:]); n != -1 || err == nil {
+		t.Fatalf("sent %d to a full socket: %v", n, err)
+	}
+	if n, err := agent.Nice_agent_send_messages_nonblocking(id, 2, messages); err == nil {
+		t.Fatalf("sent %d to no component", n)
+	}
+}
+
+/*
+ * The blocking receive returns once a packet is queued, and gives up at
+ * the deadline of its context.
+ */
+func TestRecvMessagesBlocking(t *testing.T) {
+	agent, id := test_send_component(t, &test_limited_socket{})
+	buf := make([]byte, 100)
+	var from NiceAddress
+	messages := []*NiceInputMessage{{buffers: [][]byte{buf}, from: &from}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if n, err := agent.Nice_agent_recv_messages(ctx, id, 1, messages); err != context.DeadlineExceeded {
+		t.Fatalf("received %d with nothing queued: %v", n, err)
+	}
+	if time.Since(start) < 50 * time.Millisecond {
+		t.Fatal("returned before the deadline")
+	}
+
+	peer := NiceAddress{ip: "198.51.100.7", port: 5000, network: "udp", family: "ip4"}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		agent.agent_mutex.Lock()
+		defer agent.agent_mutex.Unlock()
+		_, component := agent.agent_find_component(id, 1)
+		component.nice_component_queue_recv([]byte("hello"), peer)
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	n, err := agent.Nice_agent_recv_messages(ctx, id, 1, messages)
+	if n != 1 || err != nil {
+		t.Fatalf("received %d: %v", n, err)
+	}
+	if string(buf[:messages[0].length]) != "hello" || from.ip != peer.ip || from.port != peer.port {
+		t.Fatalf("received %q from %v", buf[:messages[0].length], from)
+	}
+
+	if n, err := agent.Nice_agent_recv_messages_nonblocking(id, 1, messages); err != NICE_AGENT_ERR_WOULD_BLOCK {
+		t.Fatalf("received %d from an empty queue: %v", n, err)
+	}
+}
+
+/*
+ * A reliable agent takes whole messages until its pseudo TCP send buffer
+ * has no room for the next one, then returns NICE_AGENT_ERR_WOULD_BLOCK.
+ */
+func TestSendMessagesNonblockingReliableFull(t *testing.T) {
+	a, b := test_conn_check_agents(t, true, false, WithReliable())
+	test_conn_check_wait_ready(t, a)
+	test_conn_check_wait_ready(t, b)
+	agent := a.agent.agent
+
+	const size = 1000
+	messages := make([]*NiceOutputMessage, 4)
+	for i := 0; i < len(messages); i++ {
+		messages[i] = &NiceOutputMessage{buffers: [][]byte{make([]byte, size / 2), make([]byte, size / 2)}}
+	}
+	taken := 0
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		n, err := agent.Nice_agent_send_messages_nonblocking(a.ID(), 1, messages)
+		if err == NICE_AGENT_ERR_WOULD_BLOCK {
+			break
+		}
+		if err != nil || n < 0 || n > len(messages) {
+			t.Fatalf("sent %d: %v", n, err)
+		}
+		taken += n
+		if time.Now().After(deadline) {
+			t.Fatal("the send buffer never filled")
+		}
+		if n == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if taken * size > PSEUDO_TCP_DEFAULT_RCV_BUF_SIZE + PSEUDO_TCP_DEFAULT_SND_BUF_SIZE {
+		t.Fatalf("%d messages taken by a sender to a receiver that does not read", taken)
+	}
+
+	agent.agent_mutex.Lock()
+	_, component := agent.agent_find_component(a.ID(), 1)
+	space := component.tcp.pseudo_tcp_socket_get_available_send_space()
+	agent.agent_mutex.Unlock()
+	if space >= size {
+		t.Fatalf("would block with room for %d bytes", space)
+	}
+}
+
+/* The construction flags that do not go with the dialect or each other */
+func TestAgentCheckOptions(t *testing.T) {
+	tests := []struct {
+		name			string
+		compatibility	NiceCompatibility
+		flags			NiceAgentOption
+		err				error
+	}{
+		{"rfc5245", NICE_COMPATIBILITY_RFC5245, 0, nil},
+		{"unknown dialect", NICE_COMPATIBILITY_LAST + 1, 0, NICE_AGENT_ERR_INVALID_OPTIONS},
+		{"reliable", NICE_COMPATIBILITY_RFC5245, NICE_AGENT_OPTION_RELIABLE, nil},
+		{"reliable lite", NICE_COMPATIBILITY_RFC5245, NICE_AGENT_OPTION_RELIABLE | NICE_AGENT_OPTION_LITE_MODE, NICE_AGENT_ERR_INVALID_OPTIONS},
+		{"regular nomination", NICE_COMPATIBILITY_RFC5245, NICE_AGENT_OPTION_REGULAR_NOMINATION, nil},
+		{"regular nomination oc2007r2", NICE_COMPATIBILITY_OC2007R2, NICE_AGENT_OPTION_REGULAR_NOMINATION, nil},
+		{"regular nomination google", NICE_COMPATIBILITY_GOOGLE, NICE_AGENT_OPTION_REGULAR_NOMINATION, NICE_AGENT_ERR_INVALID_OPTIONS},
+		{"regular nomination oc2007", NICE_COMPATIBILITY_OC2007, NICE_AGENT_OPTION_REGULAR_NOMINATION, NICE_AGENT_ERR_INVALID_OPTIONS},
+		{"trickle", NICE_COMPATIBILITY_RFC5245, NICE_AGENT_OPTION_ICE_TRICKLE, nil},
+		{"trickle msn", NICE_COMPATIBILITY_MSN, NICE_AGENT_OPTION_ICE_TRICKLE, NICE_AGENT_ERR_INVALID_OPTIONS},
+		{"renomination", NICE_COMPATIBILITY_RFC5245, NICE_AGENT_OPTION_SUPPORT_RENOMINATION, nil},
+		{"renomination wlm2009", NICE_COMPATIBILITY_WLM2009, NICE_AGENT_OPTION_SUPPORT_RENOMINATION, NICE_AGENT_ERR_INVALID_OPTIONS},
+		{"consent freshness", NICE_COMPATIBILITY_RFC5245, NICE_AGENT_OPTION_CONSENT_FRESHNESS, nil},
+		{"consent freshness lite", NICE_COMPATIBILITY_RFC5245, NICE_AGENT_OPTION_CONSENT_FRESHNESS | NICE_AGENT_OPTION_LITE_MODE, NICE_AGENT_ERR_INVALID_OPTIONS},
+		{"consent freshness oc2007r2", NICE_COMPATIBILITY_OC2007R2, NICE_AGENT_OPTION_CONSENT_FRESHNESS, NICE_AGENT_ERR_INVALID_OPTIONS},
+		{"consent freshness google", NICE_COMPATIBILITY_GOOGLE, NICE_AGENT_OPTION_CONSENT_FRESHNESS, NICE_AGENT_ERR_INVALID_OPTIONS},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent, err := Nice_agent_new_full(test.compatibility, test.flags)
+			if err != test.err {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+			if (agent == nil) != (err != nil) {
+				t.Fatalf("agent %v with error %v", agent, err)
+			}
+			if agent != nil {
+				agent.Close(context.Background())
+			}
+		})
+	}
+
+	if _, err := NewAgent(WithConsentFreshness(), WithLiteMode()); err != ErrInvalidOptions {
+		t.Fatalf("NewAgent of a lite agent with consent freshness: %v", err)
+	}
+}
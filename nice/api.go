@@ -0,0 +1,824 @@
+package nice
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+/*
+ * The exported API of the package: Agent, Stream, Component and Candidate
+ * are thin handles over the NiceAgent and its ids, every call goes through
+ * the nice_agent_* functions under the agent lock.
+ */
+
+var ErrNoSuchStream = errors.New("nice: no such stream")
+var ErrNoSuchComponent = errors.New("nice: no such component")
+var ErrInvalidArgument = errors.New("nice: invalid argument")
+var ErrComponentFailed = errors.New("nice: component failed")
+var ErrAgentClosed = errors.New("nice: agent closed")
+var ErrNoSelectedPair = errors.New("nice: no selected pair")
+var ErrNegotiationStarted = errors.New("nice: negotiation started")
+
+/* The local ufrag set on a stream is used by another stream on the UDP or
+ * TCP mux, see SetLocalCredentials() */
+var ErrUfragInUse = errors.New("nice: ufrag in use on the mux")
+
+/* Returned by NewAgent() for options which do not go together, see
+ * NICE_AGENT_ERR_INVALID_OPTIONS */
+var ErrInvalidOptions = NICE_AGENT_ERR_INVALID_OPTIONS
+
+/* Returned by the non-blocking sends and receives, see NICE_AGENT_ERR_WOULD_BLOCK */
+var ErrWouldBlock = NICE_AGENT_ERR_WOULD_BLOCK
+
+/*
+ * An AgentOption configures an Agent in NewAgent(), in place of the
+ * NiceAgentOption flags of nice_agent_new_full().
+ */
+type AgentOption func(agent *NiceAgent) error
+
+/* The ICE dialect, RFC 5245 by default */
+func WithCompatibility(compatibility NiceCompatibility) AgentOption {
+	return func(agent *NiceAgent) error {
+		if compatibility > NICE_COMPATIBILITY_LAST {
+			return ErrInvalidArgument
+		}
+		agent.compatibility = compatibility
+		return nil
+	}
+}
+
+/* Whether the agent starts in the controlling role */
+func WithControlling(controlling bool) AgentOption {
+	return func(agent *NiceAgent) error {
+		agent.controlling_mode = controlling
+		agent.saved_controlling_mode = controlling
+		return nil
+	}
+}
+
+/* Reliable mode: PseudoTCP over the UDP pairs, see NICE_AGENT_OPTION_RELIABLE */
+func WithReliable() AgentOption {
+	return func(agent *NiceAgent) error {
+		agent.reliable = true
+		return nil
+	}
+}
+
+/* ICE lite: host candidates only and no checks of our own */
+func WithLiteMode() AgentOption {
+	return func(agent *NiceAgent) error {
+		agent.full_mode = false
+		return nil
+	}
+}
+
+/* Trickle ICE: remote candidates may keep coming after the checks started */
+func WithTrickle() AgentOption {
+	return func(agent *NiceAgent) error {
+		agent.use_ice_trickle = true
+		return nil
+	}
+}
+
+/* Regular nomination instead of the aggressive default */
+func WithRegularNomination() AgentOption {
+	return func(agent *NiceAgent) error {
+		agent.nomination_mode = NICE_NOMINATION_MODE_REGULAR
+		return nil
+	}
+}
+
+/* Renomination through the NOMINATION STUN attribute */
+func WithRenomination() AgentOption {
+	return func(agent *NiceAgent) error {
+		agent.support_renomination = true
+		return nil
+	}
+}
+
+/*
+ * Consent freshness (RFC 7675): the selected pairs are checked every 5s,
+ * and fail with a ConsentLostEvent once the peer answered none of the
+ * checks for 30s. RFC 5245 only, see NICE_AGENT_OPTION_CONSENT_FRESHNESS.
+ */
+func WithConsentFreshness() AgentOption {
+	return func(agent *NiceAgent) error {
+		agent.consent_freshness = true
+		return nil
+	}
+}
+
+/* The STUN server used to discover the server reflexive candidates */
+func WithStunServer(ip string, port uint16) AgentOption {
+	return func(agent *NiceAgent) error {
+		if net.ParseIP(ip) == nil || port == 0 {
+			return ErrInvalidArgument
+		}
+		agent.SetStunServer(ip)
+		agent.SetStunPort(port)
+		return nil
+	}
+}
+
+/* The long-term credentials of the STUN server of WithStunServer() */
+func WithStunCredentials(username string, password string) AgentOption {
+	return func(agent *NiceAgent) error {
+		if username == "" {
+			return ErrInvalidArgument
+		}
+		agent.SetStunCredentials(username, password)
+		return nil
+	}
+}
+
+/* Gathers on these local addresses instead of all the interfaces */
+func WithLocalAddresses(ips ...string) AgentOption {
+	return func(agent *NiceAgent) error {
+		for i := 0; i < len(ips); i++ {
+			ip := net.ParseIP(ips[i])
+			if ip == nil {
+				return ErrInvalidArgument
+			}
+			var addr NiceAddress
+			addr.ip = ip.String()
+			addr.network = "udp"
+			addr.family = "ip4"
+			if ip.To4() == nil {
+				addr.family = "ip6"
+			}
+			agent.local_addresses = append(agent.local_addresses, addr)
+		}
+		return nil
+	}
+}
+
+/* Whether UDP candidates are gathered, on by default */
+func WithIceUdp(enable bool) AgentOption {
+	return func(agent *NiceAgent) error {
+		agent.use_ice_udp = enable
+		return nil
+	}
+}
+
+/* Whether ICE-TCP candidates are gathered, off by default */
+func WithIceTcp(enable bool) AgentOption {
+	return func(agent *NiceAgent) error {
+		agent.use_ice_tcp = enable
+		return nil
+	}
+}
+
+/* Shares the UDP host port with the other agents of @mux */
+func WithUdpMux(mux *NiceUdpMux) AgentOption {
+	return func(agent *NiceAgent) error {
+		agent.udp_mux = mux
+		return nil
+	}
+}
+
+/* Shares the ICE-TCP passive port with the other agents of @mux */
+func WithTcpMux(mux *NiceTcpMux) AgentOption {
+	return func(agent *NiceAgent) error {
+		agent.tcp_mux = mux
+		return nil
+	}
+}
+
+/* The time source of the timers of the agent, see SetClock() */
+func WithClock(clock Clock) AgentOption {
+	return func(agent *NiceAgent) error {
+		if clock == nil {
+			return ErrInvalidArgument
+		}
+		agent.SetClock(clock)
+		return nil
+	}
+}
+
+/* The random source of the agent, see SetRNG() */
+func WithRNG(rng *NiceRNG) AgentOption {
+	return func(agent *NiceAgent) error {
+		if rng == nil {
+			return ErrInvalidArgument
+		}
+		agent.SetRNG(rng)
+		return nil
+	}
+}
+
+/* Where the agent reports its metrics, see SetMetrics() */
+func WithMetrics(metrics Metrics) AgentOption {
+	return func(agent *NiceAgent) error {
+		if metrics == nil {
+			return ErrInvalidArgument
+		}
+		agent.SetMetrics(metrics)
+		return nil
+	}
+}
+
+/* Where the agent logs, see SetLogger() */
+func WithLogger(logger *slog.Logger) AgentOption {
+	return func(agent *NiceAgent) error {
+		if logger == nil {
+			return ErrInvalidArgument
+		}
+		agent.SetLogger(logger)
+		return nil
+	}
+}
+
+/*
+ * Agent is an ICE agent. Every event of the underlying NiceAgent wakes up
+ * the callers waiting on a state change.
+ */
+type Agent struct {
+	agent			*NiceAgent
+	mutex			sync.Mutex
+	changed			chan struct{}
+}
+
+/*
+ * Stream is a media stream of an Agent, the unit the credentials and
+ * gathering apply to.
+ */
+type Stream struct {
+	agent			*Agent
+	id				uint
+}
+
+/*
+ * Component is a component of a Stream, one flow of packets with its own
+ * candidates and selected pair.
+ */
+type Component struct {
+	stream			*Stream
+	id				uint
+}
+
+/*
+ * Candidate describes a local or remote candidate, as exchanged with the
+ * peer through the signalling.
+ */
+type Candidate struct {
+	Type			NiceCandidateType
+	Transport		NiceCandidateTransport
+	Address			string
+	Port			int
+	BaseAddress		string
+	BasePort		int
+	Priority		uint32
+	Foundation		string
+	StreamID		uint
+	ComponentID		uint
+	Username		string
+	Password		string
+}
+
+func NewAgent(opts ...AgentOption) (*Agent, error) {
+	agent := NewNiceAgent()
+	for i := 0; i < len(opts); i++ {
+		if err := opts[i](agent); err != nil {
+			agent.Nice_agent_close_async(nil)
+			return nil, err
+		}
+	}
+	if err := agent_check_options(agent); err != nil {
+		agent.Nice_agent_close_async(nil)
+		return nil, ErrInvalidOptions
+	}
+
+	a := &Agent{}
+	a.agent = agent
+	a.changed = make(chan struct{})
+	agent.event_hook = func(event Event) {
+		a.notify()
+	}
+	return a, nil
+}
+
+/* Wakes up the callers of wait(), may be called with the agent lock held */
+func (this *Agent) notify() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	close(this.changed)
+	this.changed = make(chan struct{})
+}
+
+/*
+ * Waits until @cond, which runs with the agent lock held, is done or @ctx
+ * is cancelled.
+ */
+func (this *Agent) wait(ctx context.Context, cond func() (bool, error)) error {
+	for {
+		this.mutex.Lock()
+		changed := this.changed
+		this.mutex.Unlock()
+
+		this.agent.agent_mutex.Lock()
+		done, err := cond()
+		this.agent.agent_mutex.Unlock()
+		if done {
+			return err
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+/* The events of the agent, see NiceAgent.Events() */
+func (this *Agent) Events() <-chan Event {
+	return this.agent.Events()
+}
+
+/* Adds a stream of @n_components components */
+func (this *Agent) AddStream(n_components int) (*Stream, error) {
+	if n_components < 1 {
+		return nil, ErrInvalidArgument
+	}
+	id := this.agent.Nice_agent_add_stream(uint(n_components))
+	if id == 0 {
+		if this.closed() {
+			return nil, ErrAgentClosed
+		}
+		return nil, errors.New("nice: could not add the stream")
+	}
+	return &Stream{agent: this, id: id}, nil
+}
+
+/* Removes the stream @id, see nice_agent_remove_stream() */
+func (this *Agent) RemoveStream(id uint) error {
+	if !this.agent.Nice_agent_remove_stream(id) {
+		return ErrNoSuchStream
+	}
+	return nil
+}
+
+/* Closes the agent, see NiceAgent.Close() */
+func (this *Agent) Close(ctx context.Context) error {
+	return this.agent.Close(ctx)
+}
+
+func (this *Agent) closed() bool {
+	this.agent.agent_mutex.Lock()
+	defer this.agent.agent_mutex.Unlock()
+	return this.agent.closed
+}
+
+/* A snapshot of the candidates and candidate pairs of all the streams */
+func (this *Agent) Stats() Stats {
+	return this.agent.Stats(0)
+}
+
+/* Returns the stream @id, nil if there is none */
+func (this *Agent) Stream(id uint) *Stream {
+	this.agent.agent_mutex.Lock()
+	defer this.agent.agent_mutex.Unlock()
+	if this.agent.find_stream(id) == nil {
+		return nil
+	}
+	return &Stream{agent: this, id: id}
+}
+
+func (this *Stream) ID() uint {
+	return this.id
+}
+
+/* Returns the component @id, nil if there is none */
+func (this *Stream) Component(id uint) *Component {
+	this.agent.agent.agent_mutex.Lock()
+	defer this.agent.agent.agent_mutex.Unlock()
+	_, c := this.agent.agent.agent_find_component(this.id, id)
+	if c == nil {
+		return nil
+	}
+	return &Component{stream: this, id: id}
+}
+
+/*
+ * Gathers the local candidates of the stream and waits until the
+ * gathering is done or @ctx is cancelled.
+ */
+func (this *Stream) Gather(ctx context.Context) error {
+	if err := this.agent.agent.Nice_agent_gather_candidates(this.id); err != nil {
+		return err
+	}
+	return this.agent.wait(ctx, func() (bool, error) {
+		stream := this.agent.agent.find_stream(this.id)
+		if stream == nil {
+			return true, ErrNoSuchStream
+		}
+		return !stream.gathering, nil
+	})
+}
+
+/* A snapshot of the candidates and candidate pairs of the stream */
+func (this *Stream) Stats() Stats {
+	return this.agent.agent.Stats(this.id)
+}
+
+/* The ufrag and password of the stream, to send to the peer */
+func (this *Stream) LocalCredentials() (string, string, error) {
+	ufrag, pwd, ok := this.agent.agent.Nice_agent_get_local_credentials(this.id)
+	if !ok {
+		return "", "", ErrNoSuchStream
+	}
+	return ufrag, pwd, nil
+}
+
+/*
+ * Replaces the generated ufrag and password of the stream, before the
+ * negotiation starts (ErrNegotiationStarted after). The ufrag is 4 to 256
+ * ice-chars, the password 22 to 256.
+ */
+func (this *Stream) SetLocalCredentials(ufrag string, pwd string) error {
+	return priv_set_local_credentials(this.agent.agent, this.id, ufrag, pwd)
+}
+
+/* The local candidates of all the components of the stream */
+func (this *Stream) LocalCandidates() ([]Candidate, error) {
+	return this.candidates(this.agent.agent.Nice_agent_get_local_candidates)
+}
+
+/* The remote candidates of all the components of the stream */
+func (this *Stream) RemoteCandidates() ([]Candidate, error) {
+	return this.candidates(this.agent.agent.Nice_agent_get_remote_candidates)
+}
+
+func (this *Stream) candidates(get func(stream_id uint, component_id uint) []*NiceCandidate) ([]Candidate, error) {
+	agent := this.agent.agent
+	agent.agent_mutex.Lock()
+	stream := agent.find_stream(this.id)
+	if stream == nil {
+		agent.agent_mutex.Unlock()
+		return nil, ErrNoSuchStream
+	}
+	n_components := len(stream.components)
+	agent.agent_mutex.Unlock()
+
+	candidates := make([]Candidate, 0)
+	for i := 1; i <= n_components; i++ {
+		list := get(this.id, uint(i))
+		for j := 0; j < len(list); j++ {
+			candidates = append(candidates, candidate_from_nice(list[j]))
+		}
+	}
+	return candidates, nil
+}
+
+/* The ufrag and password the peer sent */
+func (this *Stream) SetRemoteCredentials(ufrag string, pwd string) error {
+	if !this.agent.agent.nice_agent_set_remote_credentials(this.id, ufrag, pwd) {
+		return ErrInvalidArgument
+	}
+	return nil
+}
+
+func (this *Component) ID() uint {
+	return this.id
+}
+
+func (this *Component) Stream() *Stream {
+	return this.stream
+}
+
+func (this *Component) nice_agent() *NiceAgent {
+	return this.stream.agent.agent
+}
+
+/* Restricts the ports of the host candidates, before gathering */
+func (this *Component) SetPortRange(min_port int, max_port int) error {
+	if min_port < 0 || max_port > 0xffff || min_port > max_port {
+		return ErrInvalidArgument
+	}
+	this.nice_agent().nice_agent_set_port_range(this.stream.id, this.id, min_port, max_port)
+	return nil
+}
+
+/* Adds a TURN server to allocate a relayed candidate on, before gathering */
+func (this *Component) SetRelay(ip string, port int, username string, password string, typ NiceRelayType) error {
+	if !this.nice_agent().Nice_agent_set_relay_info(this.stream.id, this.id, ip, port, username, password, typ) {
+		return ErrInvalidArgument
+	}
+	return nil
+}
+
+/*
+ * Allocates a session on the Google relay of @url, NICE_GOOGLE_RELAY_URL
+ * if empty, with the relay @token of the XMPP session, and relays the
+ * component through it. The agent must be in NICE_COMPATIBILITY_GOOGLE.
+ */
+func (this *Component) SetGoogleRelay(ctx context.Context, url string, token string) error {
+	if url == "" {
+		url = NICE_GOOGLE_RELAY_URL
+	}
+	relay, err := Nice_google_relay_allocate(ctx, nil, url, token)
+	if err != nil {
+		return err
+	}
+	if !this.nice_agent().Nice_agent_set_google_relay(this.stream.id, this.id, relay) {
+		return ErrInvalidArgument
+	}
+	return nil
+}
+
+/* The current state of the component */
+func (this *Component) State() NiceComponentState {
+	agent := this.nice_agent()
+	agent.agent_mutex.Lock()
+	defer agent.agent_mutex.Unlock()
+	_, c := agent.agent_find_component(this.stream.id, this.id)
+	if c == nil {
+		return NICE_COMPONENT_STATE_FAILED
+	}
+	return c.state
+}
+
+/* The local candidates gathered so far */
+func (this *Component) LocalCandidates() ([]Candidate, error) {
+	return this.candidates(this.nice_agent().Nice_agent_get_local_candidates(this.stream.id, this.id))
+}
+
+/*
+ * The remote candidates, the ones the peer sent and the peer reflexive
+ * ones the checks discovered.
+ */
+func (this *Component) RemoteCandidates() ([]Candidate, error) {
+	return this.candidates(this.nice_agent().Nice_agent_get_remote_candidates(this.stream.id, this.id))
+}
+
+func (this *Component) candidates(list []*NiceCandidate) ([]Candidate, error) {
+	if list == nil {
+		return nil, ErrNoSuchComponent
+	}
+	candidates := make([]Candidate, 0, len(list))
+	for i := 0; i < len(list); i++ {
+		candidates = append(candidates, candidate_from_nice(list[i]))
+	}
+	return candidates, nil
+}
+
+/*
+ * Adds the candidates the peer sent and pairs them with the local ones.
+ * Returns how many were new.
+ */
+func (this *Component) AddRemoteCandidates(candidates ...Candidate) (int, error) {
+	list := make([]*NiceCandidate, 0, len(candidates))
+	for i := 0; i < len(candidates); i++ {
+		c, err := candidates[i].nice_candidate()
+		if err != nil {
+			return 0, err
+		}
+		list = append(list, c)
+	}
+	n := this.nice_agent().nice_agent_set_remote_candidates(this.stream.id, this.id, list)
+	if n < 0 {
+		return 0, ErrNoSuchComponent
+	}
+	return n, nil
+}
+
+/*
+ * Sets the function receiving the packets of the component, replacing the
+ * Conn of the component if there is one.
+ */
+func (this *Component) OnReceive(recv func(buf []byte)) error {
+	var recv_func NiceAgentRecvFunc
+	if recv != nil {
+		recv_func = func(agent *NiceAgent, stream_id uint, component_id uint, buf []byte, user_data []byte) {
+			recv(buf)
+		}
+	}
+	if !this.nice_agent().nice_agent_attach_recv(this.stream.id, this.id, recv_func, nil) {
+		return ErrNoSuchComponent
+	}
+	return nil
+}
+
+/* The local and remote candidates of the selected pair */
+func (this *Component) SelectedPair() (Candidate, Candidate, error) {
+	agent := this.nice_agent()
+	agent.agent_mutex.Lock()
+	defer agent.agent_mutex.Unlock()
+	_, c := agent.agent_find_component(this.stream.id, this.id)
+	if c == nil {
+		return Candidate{}, Candidate{}, ErrNoSuchComponent
+	}
+	if c.selected_pair.local == nil || c.selected_pair.remote == nil {
+		return Candidate{}, Candidate{}, ErrNoSelectedPair
+	}
+	return candidate_from_nice(c.selected_pair.local), candidate_from_nice(c.selected_pair.remote), nil
+}
+
+/* The socket of the selected pair, see nice_agent_get_selected_socket() */
+func (this *Component) SelectedSocket() (net.Conn, error) {
+	conn := this.nice_agent().Nice_agent_get_selected_socket(this.stream.id, this.id)
+	if conn == nil {
+		return nil, ErrNoSelectedPair
+	}
+	return conn, nil
+}
+
+/*
+ * Forces the pair of the local and remote candidates of these foundations,
+ * chosen out of band: the checks of the component stop and it goes READY.
+ */
+func (this *Component) SetSelectedPair(local_foundation string, remote_foundation string) error {
+	if !this.nice_agent().Nice_agent_set_selected_pair(this.stream.id, this.id, local_foundation, remote_foundation) {
+		return ErrInvalidArgument
+	}
+	return nil
+}
+
+/*
+ * Forces @remote, paired with the best matching local candidate, as the
+ * selected pair: the checks of the component stop and it goes READY.
+ */
+func (this *Component) SetSelectedRemoteCandidate(remote Candidate) error {
+	c, err := remote.nice_candidate()
+	if err != nil {
+		return err
+	}
+	if !this.nice_agent().Nice_agent_set_selected_remote_candidate(this.stream.id, this.id, c) {
+		return ErrInvalidArgument
+	}
+	return nil
+}
+
+/*
+ * Sends @buf on the selected pair of the component. A reliable agent may
+ * take only part of it, and returns ErrWouldBlock when its send buffer is
+ * full.
+ */
+func (this *Component) Send(buf []byte) (int, error) {
+	n, err := this.nice_agent().Nice_agent_send(this.stream.id, this.id, buf)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+/*
+ * A message for SendMessages(): one packet, or a piece of the stream of a
+ * reliable agent, gathered from its buffers.
+ */
+type OutputMessage struct {
+	Buffers			[][]byte
+}
+
+/*
+ * A message for RecvMessages(): the received data is scattered over the
+ * buffers, Length and From are set on return.
+ */
+type InputMessage struct {
+	Buffers			[][]byte
+	Length			int
+	From			net.Addr
+}
+
+/*
+ * Sends @messages without blocking, see nice_agent_send_messages_nonblocking().
+ * Returns how many were sent, which may be less than len(@messages), or
+ * ErrWouldBlock if none could be.
+ */
+func (this *Component) SendMessages(messages []OutputMessage) (int, error) {
+	list := make([]*NiceOutputMessage, len(messages))
+	for i := 0; i < len(messages); i++ {
+		list[i] = &NiceOutputMessage{buffers: messages[i].Buffers}
+	}
+	n, err := this.nice_agent().Nice_agent_send_messages_nonblocking(this.stream.id, this.id, list)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+/*
+ * Receives into @messages, waiting until there is data or @ctx is done.
+ * Only works while no receive callback is attached, neither with
+ * OnReceive() nor by Conn(). Returns the number of messages filled.
+ */
+func (this *Component) RecvMessages(ctx context.Context, messages []InputMessage) (int, error) {
+	list := make([]*NiceInputMessage, len(messages))
+	from := make([]NiceAddress, len(messages))
+	for i := 0; i < len(messages); i++ {
+		list[i] = &NiceInputMessage{buffers: messages[i].Buffers, from: &from[i]}
+	}
+	agent := this.nice_agent()
+	n, err := agent.Nice_agent_recv_messages(ctx, this.stream.id, this.id, list)
+	if err != nil {
+		return 0, err
+	}
+
+	local, _, _ := agent.Nice_agent_get_selected_pair(this.stream.id, this.id)
+	for i := 0; i < n; i++ {
+		messages[i].Length = list[i].length
+		if local != nil && local.transport != NICE_CANDIDATE_TRANSPORT_UDP {
+			messages[i].From = nice_address_to_tcp_addr(from[i])
+		} else {
+			messages[i].From = nice_address_to_udp_addr(from[i])
+		}
+	}
+	return n, nil
+}
+
+/* Receives one message into @buf, see RecvMessages() */
+func (this *Component) Recv(ctx context.Context, buf []byte) (int, error) {
+	messages := []InputMessage{{Buffers: [][]byte{buf}}}
+	if _, err := this.RecvMessages(ctx, messages); err != nil {
+		return 0, err
+	}
+	return messages[0].Length, nil
+}
+
+/* The net.Conn of the component, see NiceConn */
+func (this *Component) Conn() (net.Conn, error) {
+	return this.nice_agent().Conn(this.stream.id, this.id)
+}
+
+/*
+ * Waits until the component is connected, and returns its net.Conn. Fails
+ * with ErrComponentFailed if the checks failed, or the error of @ctx.
+ */
+func (this *Component) Connect(ctx context.Context) (net.Conn, error) {
+	agent := this.nice_agent()
+	err := this.stream.agent.wait(ctx, func() (bool, error) {
+		_, c := agent.agent_find_component(this.stream.id, this.id)
+		if c == nil {
+			return true, ErrNoSuchComponent
+		}
+		switch c.state {
+		case NICE_COMPONENT_STATE_CONNECTED, NICE_COMPONENT_STATE_READY:
+			return true, nil
+		case NICE_COMPONENT_STATE_FAILED:
+			return true, ErrComponentFailed
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return this.Conn()
+}
+
+func candidate_from_nice(c *NiceCandidate) Candidate {
+	var cand Candidate
+	cand.Type = c.typ
+	cand.Transport = c.transport
+	cand.Address = c.addr.ip
+	cand.Port = c.addr.port
+	cand.BaseAddress = c.base_addr.ip
+	cand.BasePort = c.base_addr.port
+	cand.Priority = c.priority
+	cand.Foundation = string(c.foundation)
+	cand.StreamID = c.stream_id
+	cand.ComponentID = c.component_id
+	cand.Username = c.username
+	cand.Password = c.password
+	return cand
+}
+
+func (this Candidate) nice_candidate() (*NiceCandidate, error) {
+	ip := net.ParseIP(this.Address)
+	if ip == nil || this.Port < 0 || this.Port > 0xffff {
+		return nil, ErrInvalidArgument
+	}
+	if this.Type < NICE_CANDIDATE_TYPE_HOST || this.Type > NICE_CANDIDATE_TYPE_RELAYED {
+		return nil, ErrInvalidArgument
+	}
+	if this.Transport < NICE_CANDIDATE_TRANSPORT_UDP || this.Transport > NICE_CANDIDATE_TRANSPORT_TCP_SO {
+		return nil, ErrInvalidArgument
+	}
+
+	c := nice_candidate_new(this.Type)
+	c.transport = this.Transport
+	c.addr.ip = ip.String()
+	c.addr.port = this.Port
+	c.addr.family = "ip4"
+	if ip.To4() == nil {
+		c.addr.family = "ip6"
+	}
+	c.addr.network = "udp"
+	if this.Transport != NICE_CANDIDATE_TRANSPORT_UDP {
+		c.addr.network = "tcp"
+	}
+	c.base_addr = c.addr
+	if base := net.ParseIP(this.BaseAddress); base != nil {
+		c.base_addr.ip = base.String()
+		c.base_addr.port = this.BasePort
+	}
+	c.priority = this.Priority
+	c.foundation = []byte(this.Foundation)
+	c.stream_id = this.StreamID
+	c.component_id = this.ComponentID
+	c.username = this.Username
+	c.password = this.Password
+	return c, nil
+}
@@ -1,6 +1,10 @@
 package nice
 
+import "bytes"
+
 const NICE_CANDIDATE_MAX_FOUNDATION  = (32+1)
+/* Length of the foundations generated for the local candidates */
+const NICE_CANDIDATE_FOUNDATION_LEN  = 8
 /**
  * NiceCandidateType:
  * @NICE_CANDIDATE_TYPE_HOST: A host candidate
@@ -19,6 +23,29 @@ const (
 	NICE_CANDIDATE_TYPE_RELAYED
 )
 
+/**
+ * Nice_candidate_type_to_string:
+ * @type: a #NiceCandidateType
+ *
+ * Useful for debugging functions, just returns a static string with the
+ * candidate type.
+ *
+ * Returns: a static string with the candidate type
+ */
+func Nice_candidate_type_to_string(typ NiceCandidateType) string {
+	switch typ {
+	case NICE_CANDIDATE_TYPE_HOST:
+		return "host"
+	case NICE_CANDIDATE_TYPE_SERVER_REFLEXIVE:
+		return "srflx"
+	case NICE_CANDIDATE_TYPE_PEER_REFLEXIVE:
+		return "prflx"
+	case NICE_CANDIDATE_TYPE_RELAYED:
+		return "relay"
+	}
+	return "invalid"
+}
+
 /**
  * NiceCandidateTransport:
  * @NICE_CANDIDATE_TRANSPORT_UDP: UDP transport
@@ -37,6 +64,29 @@ const (
 	NICE_CANDIDATE_TRANSPORT_TCP_SO
 )
 
+/**
+ * Nice_candidate_transport_to_string:
+ * @transport: a #NiceCandidateTransport
+ *
+ * Useful for debugging functions, just returns a static string with the
+ * candidate transport.
+ *
+ * Returns: a static string with the candidate transport
+ */
+func Nice_candidate_transport_to_string(transport NiceCandidateTransport) string {
+	switch transport {
+	case NICE_CANDIDATE_TRANSPORT_UDP:
+		return "udp"
+	case NICE_CANDIDATE_TRANSPORT_TCP_ACTIVE:
+		return "tcp-active"
+	case NICE_CANDIDATE_TRANSPORT_TCP_PASSIVE:
+		return "tcp-passive"
+	case NICE_CANDIDATE_TRANSPORT_TCP_SO:
+		return "tcp-so"
+	}
+	return "invalid"
+}
+
 /**
  * NiceRelayType:
  * @NICE_RELAY_TYPE_TURN_UDP: A TURN relay using UDP
@@ -124,7 +174,7 @@ func nice_candidate_copy(cand *NiceCandidate) *NiceCandidate {
 	c.priority = cand.priority
 	c.stream_id = cand.stream_id
 	c.component_id = cand.component_id
-	c.foundation = make([]byte, len(c.foundation))
+	c.foundation = make([]byte, len(cand.foundation))
 	copy(c.foundation, cand.foundation)
 	c.username = cand.username
 	c.password = cand.password
@@ -332,10 +382,34 @@ func priv_assign_foundation (agent *NiceAgent, candidate *NiceCandidate) {
 					if n.password != "" {
 						candidate.password = n.password
 					}
+					return
+				}
+			}
+		}
+	}
+
+	candidate.foundation = priv_generate_foundation(agent)
+}
+
+/*
+ * Generates a random foundation, made of ice-chars, that no local
+ * candidate of the agent uses yet.
+ */
+func priv_generate_foundation(agent *NiceAgent) []byte {
+again:
+	foundation := agent.rng.nice_rng_generate_bytes_print(NICE_CANDIDATE_FOUNDATION_LEN)
+	for i := 0; i < len(agent.streams); i++ {
+		stream := agent.streams[i]
+		for j := 0; j < len(stream.components); j++ {
+			component := stream.components[j]
+			for k := 0; k < len(component.local_candidates); k++ {
+				if bytes.Equal(component.local_candidates[k].foundation, foundation) {
+					goto again
 				}
 			}
 		}
 	}
+	return foundation
 }
 
 /*
@@ -0,0 +1,23 @@
+package nice
+
+/*
+ * The CANDIDATE-IDENTIFIER of [MS-ICE2] 2.2.2.1: the foundation of the
+ * local candidate of the check.
+ */
+type StunCandidateIdentifierAttrValue struct {
+	identifier			string
+}
+
+func (this StunCandidateIdentifierAttrValue) Encode(stream *DataStream) error {
+	stream.WriteString(this.identifier)
+	return nil
+}
+
+func (this *StunCandidateIdentifierAttrValue) Decode(stream *DataStream) error {
+	this.identifier = string(stream.ReadLeftBytes())
+	return nil
+}
+
+func (this StunCandidateIdentifierAttrValue) GetSize() uint16 {
+	return uint16(len(this.identifier))
+}
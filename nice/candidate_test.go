@@ -0,0 +1,41 @@
+package nice
+
+import (
+	"testing"
+)
+
+/*
+ * A copy keeps the foundation of the candidate, in a slice of its own,
+ * and leaves out its TURN server.
+ */
+func TestCandidateCopy(t *testing.T) {
+	cand := nice_candidate_new(NICE_CANDIDATE_TYPE_RELAYED)
+	cand.transport = NICE_CANDIDATE_TRANSPORT_UDP
+	cand.addr = NiceAddress{ip: "203.0.113.1", port: 4000, network: "udp", family: "ip4"}
+	cand.priority = 12345
+	cand.stream_id = 1
+	cand.component_id = 2
+	cand.foundation = []byte("42")
+	cand.username = "ufrag"
+	cand.password = "password"
+	cand.turn = &TurnServer{username: "user"}
+
+	c := nice_candidate_copy(cand)
+	if string(c.foundation) != "42" {
+		t.Fatalf("foundation %q", c.foundation)
+	}
+	c.foundation[0] = '7'
+	if string(cand.foundation) != "42" {
+		t.Fatal("the copy shares the foundation of the candidate")
+	}
+	if c.addr != cand.addr || c.priority != cand.priority || c.stream_id != 1 || c.component_id != 2 ||
+		c.username != cand.username || c.password != cand.password {
+		t.Fatalf("copy %+v", c)
+	}
+	if c.turn != nil {
+		t.Fatal("the TURN server was copied")
+	}
+	if nice_candidate_copy(nil) != nil {
+		t.Fatal("copy of no candidate")
+	}
+}
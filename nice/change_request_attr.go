@@ -0,0 +1,35 @@
+package nice
+
+import "encoding/binary"
+
+/*
+ * The flags of CHANGE-REQUEST (RFC 3489 section 11.2.4), asking a classic
+ * STUN server to answer from its other address or port. CHANGED-ADDRESS
+ * and SOURCE-ADDRESS are encoded as MAPPED-ADDRESS.
+ */
+const (
+	STUN_CHANGE_REQUEST_CHANGE_IP	=	0x04
+	STUN_CHANGE_REQUEST_CHANGE_PORT	=	0x02
+)
+
+type StunChangeRequestAttrValue struct {
+	flags			uint32
+}
+
+func (this StunChangeRequestAttrValue) Encode(stream *DataStream) error {
+	stream.WriteUInt32(this.flags, binary.BigEndian)
+	return nil
+}
+
+func (this *StunChangeRequestAttrValue) Decode(stream *DataStream) error {
+	v, err := stream.ReadInt32(binary.BigEndian)
+	if err != nil {
+		return err
+	}
+	this.flags = uint32(v)
+	return nil
+}
+
+func (this StunChangeRequestAttrValue) GetSize() uint16 {
+	return 4
+}
@@ -0,0 +1,35 @@
+package nice
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/* The channel numbers of the TURN ChannelData (RFC 5766 section 11) */
+const (
+	STUN_CHANNEL_NUMBER_MIN = 0x4000
+	STUN_CHANNEL_NUMBER_MAX = 0x7FFF
+)
+
+type StunChannelNumberAttrValue struct {
+	channel			uint16	/* followed by 2 bytes RFFU */
+}
+
+func (this StunChannelNumberAttrValue) Encode(stream *DataStream) error {
+	stream.WriteUInt16(this.channel, binary.BigEndian)
+	stream.WriteBytes([]byte{0, 0})
+	return nil
+}
+
+func (this *StunChannelNumberAttrValue) Decode(stream *DataStream) error {
+	b := stream.ReadLeftBytes()
+	if len(b) != 4 {
+		return errors.New("invalid channel number attr")
+	}
+	this.channel = binary.BigEndian.Uint16(b[0:2])
+	return nil
+}
+
+func (this StunChannelNumberAttrValue) GetSize() uint16 {
+	return 4
+}
@@ -0,0 +1,35 @@
+package nice
+
+import "time"
+
+/*
+ * Clock is the time source of the timers of an agent: the Ta pacing of the
+ * checks and discoveries, the STUN retransmissions, the keepalives, the
+ * pseudo TCP clock, and the consent and TURN refreshes. The default is the
+ * wall clock; see the fakeclock package for a clock moved by hand in tests.
+ */
+type Clock interface {
+	/* The current time */
+	Now() time.Time
+	/* Calls @f once @d elapsed, as time.AfterFunc() */
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+/* A pending call of Clock.AfterFunc(), with the semantics of time.Timer */
+type ClockTimer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type nice_system_clock struct{}
+
+func (nice_system_clock) Now() time.Time {
+	return time.Now()
+}
+
+func (nice_system_clock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return time.AfterFunc(d, f)
+}
+
+/* The wall clock, used by the agents unless SetClock() is called */
+var NiceSystemClock Clock = nice_system_clock{}
@@ -0,0 +1,302 @@
+package nice_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"go-licode/nice"
+	"go-licode/nice/fakeclock"
+)
+
+/* A UDP socket on the loopback that counts the STUN messages of a type */
+type test_peer struct {
+	conn			*net.UDPConn
+}
+
+func new_test_peer(t *testing.T) *test_peer {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &test_peer{conn: conn}
+}
+
+func (this *test_peer) port() int {
+	return this.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+/*
+ * Counts the STUN messages of @typ received until nothing came for
+ * @quiet of real time: the sends of the fake clock timers are not
+ * synchronous with Advance() once they go through the sockets.
+ */
+func (this *test_peer) count(typ uint16, quiet time.Duration) int {
+	n := 0
+	buf := make([]byte, 1500)
+	for {
+		this.conn.SetReadDeadline(time.Now().Add(quiet))
+		l, _, err := this.conn.ReadFromUDP(buf)
+		if err != nil {
+			return n
+		}
+		if l >= 20 && binary.BigEndian.Uint16(buf[0:2]) == typ {
+			n++
+		}
+	}
+}
+
+const test_stun_binding_request = 0x0001
+const test_stun_binding_indication = 0x0011
+
+/* Moves @clock to @offset after @start */
+func test_advance_to(clock *fakeclock.Clock, start time.Time, offset time.Duration) {
+	clock.Set(start.Add(offset))
+}
+
+/*
+ * The Binding requests to the STUN server are sent again after 200ms,
+ * then 400ms, doubling. A server that did not answer the RFC 5389 request
+ * by its second retransmission is asked again in RFC 3489, with a timer
+ * starting over from 200ms.
+ */
+func TestStunRetransmitBackoff(t *testing.T) {
+	server := new_test_peer(t)
+	start := time.Unix(1000, 0)
+	clock := fakeclock.New(start)
+	agent, err := nice.NewAgent(nice.WithClock(clock),
+			nice.WithLocalAddresses("127.0.0.1"),
+			nice.WithStunServer("127.0.0.1", uint16(server.port())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close(context.Background())
+	stream, err := agent.AddStream(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go stream.Gather(ctx)
+
+	steps := []struct {
+		offset		time.Duration
+		sent		int
+	}{
+		{0, 1},
+		{190 * time.Millisecond, 0},
+		{210 * time.Millisecond, 1},
+		{590 * time.Millisecond, 0},
+		{610 * time.Millisecond, 1},
+		{1390 * time.Millisecond, 0},
+		{1410 * time.Millisecond, 1},	/* RFC 3489 */
+		{1590 * time.Millisecond, 0},
+		{1610 * time.Millisecond, 1},
+		{1990 * time.Millisecond, 0},
+		{2010 * time.Millisecond, 1},
+		{2790 * time.Millisecond, 0},
+		{2810 * time.Millisecond, 1},
+	}
+	for i := 0; i < len(steps); i++ {
+		test_advance_to(clock, start, steps[i].offset)
+		quiet := 50 * time.Millisecond
+		if i == 0 {
+			/* the gathering starts on its own goroutine */
+			quiet = 500 * time.Millisecond
+		}
+		if n := server.count(test_stun_binding_request, quiet); n != steps[i].sent {
+			t.Fatalf("%v: %d requests, expected %d", steps[i].offset, n, steps[i].sent)
+		}
+	}
+}
+
+/*
+ * A pair the peer never answers fails once its check ran out of
+ * retransmissions: 200ms doubled 7 times, 51s after the first check.
+ */
+func TestConnCheckTimeout(t *testing.T) {
+	peer := new_test_peer(t)
+	start := time.Unix(1000, 0)
+	clock := fakeclock.New(start)
+	agent, err := nice.NewAgent(nice.WithClock(clock),
+			nice.WithLocalAddresses("127.0.0.1"),
+			nice.WithControlling(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close(context.Background())
+	stream, err := agent.AddStream(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Gather(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SetRemoteCredentials("peer", "peerpasswordpeerpassword"); err != nil {
+		t.Fatal(err)
+	}
+	component := stream.Component(1)
+	_, err = component.AddRemoteCandidates(nice.Candidate{
+		Type: nice.NICE_CANDIDATE_TYPE_HOST,
+		Transport: nice.NICE_CANDIDATE_TRANSPORT_UDP,
+		Address: "127.0.0.1",
+		Port: peer.port(),
+		Priority: 1,
+		Foundation: "1",
+		StreamID: stream.ID(),
+		ComponentID: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := peer.count(test_stun_binding_request, 200 * time.Millisecond); n != 1 {
+		t.Fatalf("%d checks, expected 1", n)
+	}
+
+	test_advance_to(clock, start, 50 * time.Second)
+	if n := peer.count(test_stun_binding_request, 50 * time.Millisecond); n != 7 {
+		t.Fatalf("%d retransmissions, expected 7", n)
+	}
+	if state := component.State(); state == nice.NICE_COMPONENT_STATE_FAILED {
+		t.Fatal("failed before the last retransmission timed out")
+	}
+	test_advance_to(clock, start, 52 * time.Second)
+	if state := component.State(); state != nice.NICE_COMPONENT_STATE_FAILED {
+		t.Fatalf("state %v, expected FAILED", state)
+	}
+}
+
+/*
+ * Once a pair is selected, a Binding indication keeps its bindings
+ * alive every Tr, 25s.
+ */
+func TestKeepaliveInterval(t *testing.T) {
+	peer := new_test_peer(t)
+	start := time.Unix(1000, 0)
+	clock := fakeclock.New(start)
+	agent, err := nice.NewAgent(nice.WithClock(clock),
+			nice.WithLocalAddresses("127.0.0.1"),
+			nice.WithControlling(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close(context.Background())
+	stream, err := agent.AddStream(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Gather(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	remote := nice.Candidate{
+		Type: nice.NICE_CANDIDATE_TYPE_HOST,
+		Transport: nice.NICE_CANDIDATE_TRANSPORT_UDP,
+		Address: "127.0.0.1",
+		Port: peer.port(),
+		Priority: 1,
+		Foundation: "1",
+		StreamID: stream.ID(),
+		ComponentID: 1,
+	}
+	component := stream.Component(1)
+	if err := component.SetSelectedRemoteCandidate(remote); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		offset		time.Duration
+		sent		int
+	}{
+		{24 * time.Second, 0},
+		{26 * time.Second, 1},
+		{49 * time.Second, 0},
+		{51 * time.Second, 1},
+	}
+	for i := 0; i < len(steps); i++ {
+		test_advance_to(clock, start, steps[i].offset)
+		if n := peer.count(test_stun_binding_indication, 50 * time.Millisecond); n != steps[i].sent {
+			t.Fatalf("%v: %d keepalives, expected %d", steps[i].offset, n, steps[i].sent)
+		}
+	}
+}
+
+/*
+ * With consent freshness, a selected pair is checked every 4 to 6s; once
+ * the peer answered none of the checks for 30s the consent is lost and
+ * the component fails.
+ */
+func TestConsentLost(t *testing.T) {
+	peer := new_test_peer(t)
+	start := time.Unix(1000, 0)
+	clock := fakeclock.New(start)
+	agent, err := nice.NewAgent(nice.WithClock(clock),
+			nice.WithLocalAddresses("127.0.0.1"),
+			nice.WithControlling(true),
+			nice.WithConsentFreshness())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close(context.Background())
+	events := agent.Events()
+	stream, err := agent.AddStream(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Gather(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SetRemoteCredentials("peer", "peerpasswordpeerpassword"); err != nil {
+		t.Fatal(err)
+	}
+	component := stream.Component(1)
+	err = component.SetSelectedRemoteCandidate(nice.Candidate{
+		Type: nice.NICE_CANDIDATE_TYPE_HOST,
+		Transport: nice.NICE_CANDIDATE_TRANSPORT_UDP,
+		Address: "127.0.0.1",
+		Port: peer.port(),
+		Priority: 1,
+		Foundation: "1",
+		StreamID: stream.ID(),
+		ComponentID: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := 0
+	for s := 1; s < 30; s++ {
+		test_advance_to(clock, start, time.Duration(s) * time.Second)
+		checks += peer.count(test_stun_binding_request, 50 * time.Millisecond)
+	}
+	if checks < 4 || checks > 7 {
+		t.Fatalf("%d consent checks in 29s", checks)
+	}
+	if state := component.State(); state != nice.NICE_COMPONENT_STATE_READY {
+		t.Fatalf("state %v before the consent expired", state)
+	}
+
+	for s := 30; s <= 36; s++ {
+		test_advance_to(clock, start, time.Duration(s) * time.Second)
+		peer.count(test_stun_binding_request, 50 * time.Millisecond)
+	}
+	if state := component.State(); state != nice.NICE_COMPONENT_STATE_FAILED {
+		t.Fatalf("state %v, expected FAILED", state)
+	}
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-events:
+			if lost, ok := event.(nice.ConsentLostEvent); ok {
+				if lost.StreamID != stream.ID() || lost.ComponentID != 1 {
+					t.Fatalf("consent lost on %d/%d", lost.StreamID, lost.ComponentID)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("no ConsentLostEvent")
+		}
+	}
+}
@@ -1,34 +1,36 @@
 package nice
 
-/* A pair of a socket and the GSource which polls it from the main loop. All
- * GSources in a Component must be attached to the same main context:
- * component->ctx.
- *
- * Socket must be non-NULL, but source may be NULL if it has been detached.
+import "time"
+
+/* A socket attached to a component, whose packets are read by the receive
+ * loop of the socket and handed to component_io_cb().
  *
- * The Component is stored so this may be used as the user data for a GSource
- * callback. */
+ * The Component is stored so this may be used as the user data of the
+ * receive callback. */
 type  SocketSource struct {
 	socket 		NiceSockInterface
-	//GSource *source;//todo
 	component 	*NiceComponent
 }
 
 type CandidatePairKeepalive struct {
-//GSource *tick_source;//todo
 	stream_id		uint
 	component_id	uint
 	timer 			StunTimer
 	stun_buffer		[]byte
 	stun_message	*StunMessage
+	consent_checks	[]*StunMessage	/* awaiting a response, the oldest first */
+	consent_received	time.Time	/* of the last response to a consent check */
 }
 
 type CandidatePair struct {
 	local			*NiceCandidate
 	remote			*NiceCandidate
+	sockptr			NiceSockInterface	/* socket of the pair, local->sockptr if nil */
 	priority		uint64
 	prflx_priority	uint32
 	keepalive		CandidatePairKeepalive
+	nominated		bool
+	stats			*nice_pair_stats	/* those of the check pair it was selected from */
 }
 
 type IncomingCheck struct {
@@ -48,27 +50,410 @@ type NiceComponent struct {
 	local_candidates	[]*NiceCandidate
 	remote_candidates	[]*NiceCandidate
 	valid_candidates	[]*NiceCandidate
-	socket_sources		*SocketSource
+	socket_sources		[]*SocketSource
 	socket_sources_age	uint
 	incoming_checks		[]*IncomingCheck
 	turn_servers		[]*TurnServer
 	selected_pair		CandidatePair
 	io_callback			NiceAgentRecvFunc   /* function called on io cb */
+	dtls_callback		NiceAgentRecvFunc   /* DTLS records, io_callback if unset */
+	rtp_callback		NiceAgentRecvFunc   /* RTP and RTCP, io_callback if unset */
+	conn				*NiceConn			/* owns io_callback when set */
+
+	tcp					*PseudoTcpSocket
+	tcp_clock			*NiceTimer
+	queued_tcp_packets	[]*NiceInputMessage	/* received before the pair got selected */
+
+	recv_queue			[]*NiceInputMessage	/* received while no io_callback is attached */
+	recv_signal			chan struct{}		/* closed when there is more to receive */
 
 	min_port			int
 	max_port			int
+
+	connecting_since	time.Time	/* since the checks started, until READY */
 }
 
+/* Number of packets a component keeps for nice_agent_recv_messages() */
+const NICE_COMPONENT_RECV_QUEUE_LEN = 256
+
 func NewNiceComponent(agent *NiceAgent, stream *NiceStream, id uint) *NiceComponent {
 	return &NiceComponent{
 		agent:agent,
 		stream:stream,
 		id:id,
+		state:NICE_COMPONENT_STATE_DISCONNECTED,
 		min_port:1,
 		max_port:65535,
 	}
 }
 
+/* Size of the buffer a socket source receives into, big enough for any
+ * UDP datagram or RFC 4571 frame */
+const MAX_BUFFER_SIZE = (1 << 16) - 1
+
+/*
+ * Starts polling @nicesock for this component. Listening ICE-TCP sockets
+ * get an accept loop whose connections are attached in turn, unconnected
+ * TCP active sockets are only remembered. Must be called with the agent
+ * lock held.
+ */
+func (this *NiceComponent) nice_component_attach_socket(nicesock NiceSockInterface) {
+	if nicesock == nil {
+		return
+	}
+
+	for i := 0; i < len(this.socket_sources); i++ {
+		if this.socket_sources[i].socket == nicesock {
+			return
+		}
+	}
+
+	source := &SocketSource{socket: nicesock, component: this}
+	this.socket_sources = append(this.socket_sources, source)
+	this.socket_sources_age++
+
+	switch sock := nicesock.(type) {
+	case *TcpPassiveSocket:
+		go sock.accept_loop(this.nice_component_accept_cb)
+	case *TcpSoSocket:
+		go sock.accept_loop(this.nice_component_accept_cb)
+	case *TcpMuxSocket:
+		go sock.accept_loop(this.nice_component_accept_cb)
+	case *TcpActiveSocket:
+	default:
+		go source.socket_source_recv_loop()
+	}
+}
+
+/*
+ * Stops polling @nicesock and closes it. Must be called with the agent
+ * lock held.
+ */
+func (this *NiceComponent) nice_component_detach_socket(nicesock NiceSockInterface) {
+	for i := 0; i < len(this.socket_sources); i++ {
+		if this.socket_sources[i].socket == nicesock {
+			this.socket_sources = append(this.socket_sources[:i], this.socket_sources[i+1:]...)
+			this.socket_sources_age++
+			break
+		}
+	}
+	nicesock.close()
+}
+
+/*
+ * Closes the sockets, the pseudo TCP connection and the NiceConn of the
+ * component, whose stream is being removed. Must be called with the agent
+ * lock held.
+ */
+func (this *NiceComponent) nice_component_close(agent *NiceAgent) {
+	agent_timeout_remove(&this.tcp_clock)
+	if this.tcp != nil {
+		this.tcp.pseudo_tcp_socket_close(true)
+		this.tcp = nil
+	}
+	if this.conn != nil {
+		this.conn.nice_conn_close_unlocked()
+		this.conn = nil
+	}
+
+	sources := this.socket_sources
+	this.socket_sources = nil
+	this.socket_sources_age++
+	for i := 0; i < len(sources); i++ {
+		sources[i].socket.close()
+	}
+	for i := 0; i < len(this.local_candidates); i++ {
+		if this.local_candidates[i].sockptr != nil {
+			this.local_candidates[i].sockptr.close()
+		}
+	}
+
+	this.io_callback = nil
+	this.dtls_callback = nil
+	this.rtp_callback = nil
+	this.selected_pair = CandidatePair{}
+	this.incoming_checks = nil
+	this.queued_tcp_packets = nil
+	this.recv_queue = nil
+	/* wakes the receivers up, to find the component gone */
+	this.nice_component_recv_signal()
+}
+
+/*
+ * Makes @pair the selected pair of the component, with the consent of the
+ * peer as of @now. Must be called with the agent lock held.
+ */
+func (this *NiceComponent) nice_component_update_selected_pair(pair *CandidateCheckPair, now time.Time) {
+	this.selected_pair.local = pair.local
+	this.selected_pair.remote = pair.remote
+	this.selected_pair.sockptr = pair.sockptr
+	this.selected_pair.priority = pair.priority
+	this.selected_pair.prflx_priority = pair.prflx_priority
+	this.selected_pair.keepalive = CandidatePairKeepalive{stream_id: pair.stream_id, component_id: pair.component_id, consent_received: now}
+	this.selected_pair.nominated = pair.nominated
+	this.selected_pair.stats = &pair.stats
+}
+
+/*
+ * The socket the data of the selected pair goes through, nil if there is
+ * no selected pair.
+ */
+func (this *NiceComponent) nice_component_selected_socket() NiceSockInterface {
+	if this.selected_pair.sockptr != nil {
+		return this.selected_pair.sockptr
+	}
+	if this.selected_pair.local != nil {
+		return this.selected_pair.local.sockptr
+	}
+	return nil
+}
+
+/*
+ * Picks the local candidate to pair with @remote, the one giving the pair
+ * of highest priority.
+ */
+func (this *NiceComponent) nice_component_find_local_for_remote(agent *NiceAgent, remote *NiceCandidate) *NiceCandidate {
+	var local *NiceCandidate
+	var max_priority uint64 = 0
+	for i := 0; i < len(this.local_candidates); i++ {
+		tmp := this.local_candidates[i]
+		if tmp.transport != conn_check_match_transport(remote.transport) || !EqualFamily(tmp.addr, remote.addr) {
+			continue
+		}
+		/* note: see conn_check_add_for_candidate_pair() */
+		if tmp.transport == NICE_CANDIDATE_TRANSPORT_TCP_PASSIVE {
+			continue
+		}
+		priority := agent.agent_candidate_pair_priority(tmp, remote)
+		if local == nil || priority > max_priority {
+			max_priority = priority
+			local = tmp
+		}
+	}
+	return local
+}
+
+func (this *NiceComponent) nice_component_accept_cb(listener NiceSockInterface, sock *TcpBsdSocket) {
+	this.agent.agent_mutex.Lock()
+	defer this.agent.agent_mutex.Unlock()
+	this.nice_component_attach_socket(sock)
+}
+
+func (this *SocketSource) socket_source_recv_loop() {
+	var from NiceAddress
+	buf := make([]byte, MAX_BUFFER_SIZE)
+	msg := &NiceInputMessage{buffers: [][]byte{buf}, from: &from}
+	msgs := []*NiceInputMessage{msg}
+
+	for {
+		if err := this.socket.recv_messages(msgs); err != nil {
+			break
+		}
+		if msg.length == 0 {
+			continue
+		}
+		component_io_cb(this, buf[:msg.length], from)
+	}
+
+	agent := this.component.agent
+	agent.agent_mutex.Lock()
+	conn_check_prune_socket(agent, this.component.stream, this.component, this.socket)
+	this.component.nice_component_detach_socket(this.socket)
+	agent.agent_mutex.Unlock()
+}
+
+/*
+ * NicePacketClass:
+ * @NICE_PACKET_CLASS_OTHER: Anything the other classes do not match
+ * @NICE_PACKET_CLASS_STUN: A STUN message, first byte 0-3
+ * @NICE_PACKET_CLASS_ZRTP: A ZRTP packet, first byte 16-19
+ * @NICE_PACKET_CLASS_DTLS: A DTLS record, first byte 20-63
+ * @NICE_PACKET_CLASS_TURN_CHANNEL: A TURN ChannelData message, first byte
+ * 64-79
+ * @NICE_PACKET_CLASS_RTP: A RTP or RTCP packet, first byte 128-191
+ *
+ * The kinds of packets multiplexed on a component, told apart by their
+ * first byte as described in RFC 7983 section 7.
+ */
+type NicePacketClass int
+const (
+	NICE_PACKET_CLASS_OTHER NicePacketClass = iota
+	NICE_PACKET_CLASS_STUN
+	NICE_PACKET_CLASS_ZRTP
+	NICE_PACKET_CLASS_DTLS
+	NICE_PACKET_CLASS_TURN_CHANNEL
+	NICE_PACKET_CLASS_RTP
+)
+
+func nice_packet_classify(buf []byte) NicePacketClass {
+	if len(buf) == 0 {
+		return NICE_PACKET_CLASS_OTHER
+	}
+	b := buf[0]
+	switch {
+	case b <= 3:
+		return NICE_PACKET_CLASS_STUN
+	case b >= 16 && b <= 19:
+		return NICE_PACKET_CLASS_ZRTP
+	case b >= 20 && b <= 63:
+		return NICE_PACKET_CLASS_DTLS
+	case b >= 64 && b <= 79:
+		return NICE_PACKET_CLASS_TURN_CHANNEL
+	case b >= 128 && b <= 191:
+		return NICE_PACKET_CLASS_RTP
+	}
+	return NICE_PACKET_CLASS_OTHER
+}
+
+/*
+ * Whether @buf is a STUN message in the dialect of the checks of
+ * @component, or the answer of a classic STUN or MS-TURN server to one of
+ * its discoveries: neither has the magic cookie.
+ */
+func priv_component_is_stun(component *NiceComponent, buf []byte) bool {
+	aligned := !priv_component_no_aligned_attributes(component)
+	if stun_message_validate(buf, true, aligned) {
+		return true
+	}
+	if !stun_message_validate(buf, false, aligned) {
+		return false
+	}
+	return component.stream.stun_agent.compatibility == STUN_COMPATIBILITY_RFC3489 ||
+		discovery_find_stun_agent(component.agent, component.stream.id, component.id, stun_agent_no_cookie)
+}
+
+/*
+ * The relay socket of @component whose allocation is on the TURN server
+ * @from, through its base socket @nicesock, or nil.
+ */
+func nice_component_find_turn_socket(component *NiceComponent, nicesock NiceSockInterface, from NiceAddress) *UdpTurnSocket {
+	for i := 0; i < len(component.local_candidates); i++ {
+		turnsock, ok := component.local_candidates[i].sockptr.(*UdpTurnSocket)
+		if ok && turnsock.base == nicesock && turnsock.server.ip == from.ip && turnsock.server.port == from.port {
+			return turnsock
+		}
+	}
+	return nil
+}
+
+/*
+ * Whether the STUN messages of @component may have unaligned attributes,
+ * from the peer or from the server of one of its discoveries.
+ */
+func priv_component_no_aligned_attributes(component *NiceComponent) bool {
+	return stun_agent_no_aligned(&component.stream.stun_agent) ||
+		discovery_find_stun_agent(component.agent, component.stream.id, component.id, stun_agent_no_aligned)
+}
+
+/*
+ * Delivers a packet received on one of the component's sockets. The
+ * ChannelData and Data indications of the TURN server of a relayed
+ * candidate are first unwrapped, as received from the peer on the relay
+ * socket. STUN is kept by the agent, DTLS and RTP/RTCP go to their own
+ * callback when one is attached, and everything else to the io callback.
+ */
+func component_io_cb(source *SocketSource, buf []byte, from NiceAddress) {
+	component := source.component
+	agent := component.agent
+
+	agent.agent_mutex.Lock()
+	nicesock := source.socket
+	if turnsock := nice_component_find_turn_socket(component, nicesock, from); turnsock != nil {
+		if peer, data, ok := nice_udp_turn_socket_parse_recv(turnsock, from, buf); ok {
+			nicesock, from, buf = turnsock, peer, data
+		}
+	}
+	stream_id := component.stream.id
+	class := nice_packet_classify(buf)
+	if class == NICE_PACKET_CLASS_STUN && priv_component_is_stun(component, buf) {
+		/* parsed aligned, but signed and fingerprinted as sent */
+		aligned := buf
+		if priv_component_no_aligned_attributes(component) {
+			aligned = stun_message_align(buf)
+		}
+		agent_recv_stun(agent, component.stream, component, nicesock, from, aligned, buf)
+		agent.agent_mutex.Unlock()
+		return
+	}
+
+	if class != NICE_PACKET_CLASS_STUN && class != NICE_PACKET_CLASS_TURN_CHANNEL {
+		nice_component_stats_received(agent, component, from, len(buf))
+	}
+
+	if agent.reliable && !nicesock.is_reliable() {
+		/* the component carries a pseudo TCP connection, only the in
+		 * order byte stream is delivered */
+		agent_recv_pseudo_tcp_packet(agent, component.stream, component, from, buf)
+		agent.agent_mutex.Unlock()
+
+		agent_deliver_pseudo_tcp_data(agent, stream_id, component.id)
+		return
+	}
+
+	var callback NiceAgentRecvFunc
+	switch class {
+	case NICE_PACKET_CLASS_STUN:
+		/* not a valid STUN message, ICE traffic is never handed up */
+	case NICE_PACKET_CLASS_TURN_CHANNEL:
+		/* ChannelData of no channel of ours */
+	case NICE_PACKET_CLASS_DTLS:
+		callback = component.dtls_callback
+	case NICE_PACKET_CLASS_RTP:
+		callback = component.rtp_callback
+	}
+	if callback == nil && class != NICE_PACKET_CLASS_STUN && class != NICE_PACKET_CLASS_TURN_CHANNEL {
+		callback = component.io_callback
+		if callback == nil {
+			component.nice_component_queue_recv(buf, from)
+		}
+	}
+	agent.agent_mutex.Unlock()
+
+	if callback != nil {
+		callback(agent, stream_id, component.id, buf, nil)
+	}
+}
+
+/*
+ * Keeps a packet received while no io callback is attached, for
+ * nice_agent_recv_messages(). Once NICE_COMPONENT_RECV_QUEUE_LEN are
+ * waiting, newer packets are dropped as the network would.
+ * Must be called with the agent lock held.
+ */
+func (this *NiceComponent) nice_component_queue_recv(buf []byte, from NiceAddress) {
+	if len(this.recv_queue) >= NICE_COMPONENT_RECV_QUEUE_LEN {
+		return
+	}
+	/* the socket reuses its buffer for the next packet */
+	packet := &NiceInputMessage{buffers: [][]byte{append([]byte{}, buf...)}, from: &from, length: len(buf)}
+	this.recv_queue = append(this.recv_queue, packet)
+	this.nice_component_recv_signal()
+}
+
+/*
+ * Wakes up the receivers waiting on the channel of
+ * nice_component_recv_wait().
+ * Must be called with the agent lock held.
+ */
+func (this *NiceComponent) nice_component_recv_signal() {
+	if this.recv_signal != nil {
+		close(this.recv_signal)
+		this.recv_signal = nil
+	}
+}
+
+/*
+ * Returns a channel closed once there may be more to receive on the
+ * component, or once it is closed.
+ * Must be called with the agent lock held.
+ */
+func (this *NiceComponent) nice_component_recv_wait() <-chan struct{} {
+	if this.recv_signal == nil {
+		this.recv_signal = make(chan struct{})
+	}
+	return this.recv_signal
+}
+
 func (this *NiceComponent) nice_component_set_io_callback(recv_func NiceAgentRecvFunc, user_data interface{}, recv_messages *NiceInputMessage) error {
 	this.io_callback = recv_func
 	return nil
@@ -0,0 +1,348 @@
+package nice
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/* Number of received packets a NiceConn of a non-reliable agent keeps
+ * until they are read */
+const NICE_CONN_RECV_QUEUE_LEN = 256
+
+/*
+ * A read or write deadline on the clock of the agent: 'done' is closed
+ * once it has passed, and replaced when it is moved to the future again.
+ */
+type nice_conn_deadline struct {
+	mutex			sync.Mutex
+	clock			Clock
+	timer			ClockTimer
+	done			chan struct{}
+}
+
+func new_nice_conn_deadline(clock Clock) *nice_conn_deadline {
+	return &nice_conn_deadline{clock: clock, done: make(chan struct{})}
+}
+
+func (this *nice_conn_deadline) set(t time.Time) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.timer != nil {
+		this.timer.Stop()
+		this.timer = nil
+	}
+	select {
+	case <-this.done:
+		this.done = make(chan struct{})
+	default:
+	}
+
+	if t.IsZero() {
+		return
+	}
+	d := t.Sub(this.clock.Now())
+	if d <= 0 {
+		close(this.done)
+		return
+	}
+	done := this.done
+	this.timer = this.clock.AfterFunc(d, func() {
+		this.mutex.Lock()
+		defer this.mutex.Unlock()
+		if this.done == done {
+			close(done)
+		}
+	})
+}
+
+func (this *nice_conn_deadline) wait() <-chan struct{} {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.done
+}
+
+/*
+ * NiceConn is a net.Conn over the selected pair of a component. Each Read
+ * returns one received packet (truncated to the buffer, as for a UDP
+ * socket) and each Write sends one with nice_agent_send(). On a reliable
+ * agent, Read returns the next bytes of the stream, read from the pseudo
+ * TCP socket as nice_agent_recv_messages() does, and Write blocks until
+ * the whole buffer is queued, the connection is closed or the write
+ * deadline passes. The deadlines follow the Clock of the agent. The
+ * addresses follow the selected pair when it changes.
+ *
+ * The connection takes over the io callback of the component: attaching
+ * another callback with nice_agent_attach_recv() stops its reads, and
+ * closing it detaches its callback.
+ */
+type NiceConn struct {
+	agent			*NiceAgent
+	stream_id		uint
+	component_id	uint
+	queue			chan []byte
+	writable		chan struct{}	/* the pseudo TCP send buffer has room */
+	done			chan struct{}
+	close_once		sync.Once
+	read_deadline	*nice_conn_deadline
+	write_deadline	*nice_conn_deadline
+}
+
+/**
+ * Conn:
+ * @stream_id: The ID of the stream
+ * @component_id: The ID of the component
+ *
+ * Returns the #NiceConn of the component, creating it on the first call.
+ * Data can only be written once the component has a selected pair.
+ *
+ * Returns: the connection, or an error if the component does not exist
+ */
+func (this *NiceAgent) Conn(stream_id uint, component_id uint) (net.Conn, error) {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	_, c := this.agent_find_component(stream_id, component_id)
+	if c == nil {
+		return nil, errors.New("could not find the component")
+	}
+	if c.conn != nil {
+		return c.conn, nil
+	}
+
+	conn := &NiceConn{}
+	conn.agent = this
+	conn.stream_id = stream_id
+	conn.component_id = component_id
+	conn.queue = make(chan []byte, NICE_CONN_RECV_QUEUE_LEN)
+	conn.writable = make(chan struct{}, 1)
+	conn.done = make(chan struct{})
+	conn.read_deadline = new_nice_conn_deadline(this.clock)
+	conn.write_deadline = new_nice_conn_deadline(this.clock)
+
+	c.conn = conn
+	if this.reliable {
+		/* Read takes the stream from the pseudo TCP socket itself */
+		c.nice_component_set_io_callback(nil, nil, nil)
+	} else {
+		c.nice_component_set_io_callback(conn.nice_conn_recv_cb, nil, nil)
+	}
+	return conn, nil
+}
+
+/* The packets of a non-reliable agent */
+func (this *NiceConn) nice_conn_recv_cb(agent *NiceAgent, stream_id uint, component_id uint, buf []byte, user_data []byte) {
+	/* the socket reuses its buffer for the next packet */
+	packet := append([]byte{}, buf...)
+	select {
+	case this.queue <- packet:
+	case <-this.done:
+	default:
+		/* the reader is late, drop as the network would */
+	}
+}
+
+/*
+ * Wakes up the Write blocked on the send buffer of the reliable agent.
+ * Called with the agent lock held.
+ */
+func (this *NiceConn) nice_conn_writable() {
+	select {
+	case this.writable <- struct{}{}:
+	default:
+	}
+}
+
+func (this *NiceConn) Read(b []byte) (int, error) {
+	select {
+	case <-this.done:
+		return 0, io.EOF
+	default:
+	}
+	if this.agent.reliable {
+		return this.read_stream(b)
+	}
+
+	/* what was received before the deadline passed is still read */
+	select {
+	case packet := <-this.queue:
+		return copy(b, packet), nil
+	default:
+	}
+
+	select {
+	case packet := <-this.queue:
+		return copy(b, packet), nil
+	case <-this.done:
+		return 0, io.EOF
+	case <-this.read_deadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+/*
+ * Reads the stream of a reliable agent: what does not fit in @b stays in
+ * the pseudo TCP socket for the next Read, and its window holds the peer
+ * back while nobody reads.
+ */
+func (this *NiceConn) read_stream(b []byte) (int, error) {
+	message := &NiceInputMessage{buffers: [][]byte{b}}
+	for {
+		this.agent.agent_mutex.Lock()
+		_, c := this.agent.agent_find_component(this.stream_id, this.component_id)
+		if c == nil {
+			this.agent.agent_mutex.Unlock()
+			return 0, io.EOF
+		}
+		err := NICE_AGENT_ERR_WOULD_BLOCK
+		if c.conn == this {
+			_, err = nice_agent_recv_messages_unlocked(this.agent, c, []*NiceInputMessage{message})
+		}
+		wait := c.nice_component_recv_wait()
+		this.agent.agent_mutex.Unlock()
+
+		if err == nil {
+			return message.length, nil
+		}
+		if err != NICE_AGENT_ERR_WOULD_BLOCK {
+			return 0, err
+		}
+
+		/* what was received before the deadline passed is still read */
+		select {
+		case <-wait:
+		case <-this.done:
+			return 0, io.EOF
+		case <-this.read_deadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (this *NiceConn) Write(b []byte) (int, error) {
+	select {
+	case <-this.done:
+		return 0, net.ErrClosed
+	case <-this.write_deadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	if !this.agent.reliable {
+		n, err := this.agent.Nice_agent_send(this.stream_id, this.component_id, b)
+		if err != nil {
+			return 0, err
+		}
+		if n < len(b) {
+			return n, io.ErrShortWrite
+		}
+		return n, nil
+	}
+
+	written := 0
+	for written < len(b) {
+		n, err := this.agent.Nice_agent_send(this.stream_id, this.component_id, b[written:])
+		if err == nil {
+			written += n
+			if n > 0 {
+				continue
+			}
+		} else if err != NICE_AGENT_ERR_WOULD_BLOCK {
+			return written, err
+		}
+
+		select {
+		case <-this.writable:
+		case <-this.done:
+			return written, net.ErrClosed
+		case <-this.write_deadline.wait():
+			return written, os.ErrDeadlineExceeded
+		}
+	}
+	return written, nil
+}
+
+/*
+ * Closes the connection and detaches it from the component, whose
+ * candidates and pair are left untouched.
+ */
+func (this *NiceConn) Close() error {
+	this.nice_conn_close_unlocked()
+
+	this.agent.agent_mutex.Lock()
+	defer this.agent.agent_mutex.Unlock()
+	_, c := this.agent.agent_find_component(this.stream_id, this.component_id)
+	if c != nil && c.conn == this {
+		c.conn = nil
+		c.nice_component_set_io_callback(nil, nil, nil)
+	}
+	return nil
+}
+
+/*
+ * Ends the reads and writes of the connection, without detaching it from
+ * its component. Does not take the agent lock.
+ */
+func (this *NiceConn) nice_conn_close_unlocked() {
+	this.close_once.Do(func() {
+		close(this.done)
+	})
+}
+
+func (this *NiceConn) selected_pair() CandidatePair {
+	this.agent.agent_mutex.Lock()
+	defer this.agent.agent_mutex.Unlock()
+	_, c := this.agent.agent_find_component(this.stream_id, this.component_id)
+	if c == nil {
+		return CandidatePair{}
+	}
+	return c.selected_pair
+}
+
+func nice_conn_candidate_addr(candidate *NiceCandidate, addr NiceAddress) net.Addr {
+	if candidate == nil {
+		return &net.UDPAddr{}
+	}
+	if candidate.transport == NICE_CANDIDATE_TRANSPORT_UDP {
+		return nice_address_to_udp_addr(addr)
+	}
+	return nice_address_to_tcp_addr(addr)
+}
+
+/* The base address of the local candidate of the selected pair */
+func (this *NiceConn) LocalAddr() net.Addr {
+	pair := this.selected_pair()
+	if pair.local == nil {
+		return &net.UDPAddr{}
+	}
+	return nice_conn_candidate_addr(pair.local, pair.local.base_addr)
+}
+
+/* The address of the remote candidate of the selected pair */
+func (this *NiceConn) RemoteAddr() net.Addr {
+	pair := this.selected_pair()
+	if pair.remote == nil {
+		return &net.UDPAddr{}
+	}
+	return nice_conn_candidate_addr(pair.remote, pair.remote.addr)
+}
+
+func (this *NiceConn) SetDeadline(t time.Time) error {
+	this.read_deadline.set(t)
+	this.write_deadline.set(t)
+	return nil
+}
+
+func (this *NiceConn) SetReadDeadline(t time.Time) error {
+	this.read_deadline.set(t)
+	return nil
+}
+
+func (this *NiceConn) SetWriteDeadline(t time.Time) error {
+	this.write_deadline.set(t)
+	return nil
+}
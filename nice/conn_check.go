@@ -1,8 +1,12 @@
 package nice
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
 	"time"
-	"fmt"
 )
 
 const NICE_CANDIDATE_PAIR_MAX_FOUNDATION = NICE_CANDIDATE_MAX_FOUNDATION*2
@@ -21,7 +25,7 @@ const NICE_CANDIDATE_PAIR_MAX_FOUNDATION = NICE_CANDIDATE_MAX_FOUNDATION*2
 type NiceCheckState = int
 const (
 	_ NiceCheckState 	= 	iota
-	NICE_CHECK_WAITING 	= 	1
+	NICE_CHECK_WAITING
 	NICE_CHECK_IN_PROGRESS
 	NICE_CHECK_SUCCEEDED
 	NICE_CHECK_FAILED
@@ -33,7 +37,9 @@ type StunTransaction struct {
 	next_tick	time.Time	//GTimeVal next_tick;       /* next tick timestamp */
 	timer 		StunTimer
 	buffer		[STUN_MAX_MESSAGE_SIZE_IPV6]byte
+	buffer_len	int
 	message 	*StunMessage
+	sent		time.Time	/* last (re)transmission, for the round trip time */
 }
 
 type CandidateCheckPair struct {
@@ -49,11 +55,13 @@ type CandidateCheckPair struct {
 	use_candidate_on_next_check	bool
 	mark_nominated_on_response_arrival	bool
 	retransmit		bool
+	connecting		bool		/* the ICE-TCP connection of the pair is being made */
 	discovered_pair *CandidateCheckPair
 	succeeded_pair	*CandidateCheckPair
 	priority		uint64
 	prflx_priority	uint32
 	stun_transactions	[]*StunTransaction
+	stats			nice_pair_stats
 }
 
 func NewCandidateCheckPair() *CandidateCheckPair {
@@ -141,11 +149,1402 @@ func conn_check_add_for_candidate_pair(agent *NiceAgent, stream_id uint, compone
 	}
 
 	if local.transport == conn_check_match_transport(remote.transport) && EqualFamily(local.addr, remote.addr) {
-
+		priv_conn_check_add_for_candidate_pair_matched(agent, stream_id, component, local, remote, NICE_CHECK_FROZEN)
+		ret = true
 	}
 	return ret
 }
 
+/*
+ * Forms new candidate pairs by matching the new remote candidate
+ * 'remote' with all existing local candidates of 'component'.
+ *
+ * @return number of checks added
+ */
+func conn_check_add_for_remote_candidate(agent *NiceAgent, stream_id uint, component *NiceComponent, remote *NiceCandidate) int {
+	var added int = 0
+	for i := 0; i < len(component.local_candidates); i++ {
+		local := component.local_candidates[i]
+		if agent.force_relay && local.typ != NICE_CANDIDATE_TYPE_RELAYED {
+			continue
+		}
+		/* the peer reflexive candidates only pair with the remote
+		 * candidate whose check discovered them */
+		if local.typ == NICE_CANDIDATE_TYPE_PEER_REFLEXIVE {
+			continue
+		}
+		if conn_check_add_for_candidate_pair(agent, stream_id, component, local, remote) {
+			added++
+		}
+	}
+	return added
+}
+
+/*
+ * Returns the socket a check on 'pair' must be sent with, nil while it is
+ * being connected. For a local ICE-TCP active or simultaneous-open
+ * candidate, the connection to the remote candidate is created in the
+ * background by priv_conn_check_connect(), the check is sent once it is
+ * established. The connection then replaces the pair socket, so that
+ * later checks and data reuse it.
+ */
+func conn_check_get_pair_socket(agent *NiceAgent, component *NiceComponent, pair *CandidateCheckPair) NiceSockInterface {
+	remote := pair.remote.addr
+	switch sock := pair.sockptr.(type) {
+	case *TcpActiveSocket:
+		priv_conn_check_connect(agent, pair, func(ctx context.Context) (*TcpBsdSocket, error) {
+			return nice_tcp_active_socket_connect(ctx, sock, remote)
+		})
+		return nil
+	case *TcpSoSocket:
+		if c := sock.find_connection(&remote); c != nil {
+			/* the peer connected to us first */
+			pair.sockptr = c
+			return c
+		}
+		priv_conn_check_connect(agent, pair, func(ctx context.Context) (*TcpBsdSocket, error) {
+			return nice_tcp_so_socket_connect(ctx, sock, remote)
+		})
+		return nil
+	}
+	return pair.sockptr
+}
+
+/*
+ * Returns the socket of 'pair' if it can send at once, nil for the ICE-TCP
+ * pairs whose connection is not made yet.
+ */
+func conn_check_get_connected_pair_socket(pair *CandidateCheckPair) NiceSockInterface {
+	switch sock := pair.sockptr.(type) {
+	case *TcpActiveSocket:
+		return nil
+	case *TcpSoSocket:
+		c := sock.find_connection(&pair.remote.addr)
+		if c == nil {
+			return nil
+		}
+		pair.sockptr = c
+		return c
+	}
+	return pair.sockptr
+}
+
+/*
+ * Runs @connect in a goroutine of its own, the pair staying in progress
+ * meanwhile, then sends the check of @pair on the new connection. The
+ * connect is cancelled when the agent is closed, and its connection
+ * dropped if the pair was pruned in between.
+ * Must be called with the agent lock held.
+ */
+func priv_conn_check_connect(agent *NiceAgent, pair *CandidateCheckPair, connect func(ctx context.Context) (*TcpBsdSocket, error)) {
+	if pair.connecting {
+		return
+	}
+	pair.connecting = true
+	pair.state = NICE_CHECK_IN_PROGRESS
+	ctx := agent.connect_ctx
+
+	go func() {
+		conn, err := connect(ctx)
+
+		agent.agent_mutex.Lock()
+		defer agent.agent_mutex.Unlock()
+		pair.connecting = false
+		stream, component := agent.agent_find_component(pair.stream_id, pair.component_id)
+		if agent.closed || stream == nil || component == nil || !priv_conn_check_list_has_pair(stream, pair) {
+			if conn != nil {
+				conn.close()
+			}
+			return
+		}
+		if err != nil {
+			nice_component_log(agent, NICE_LOG_SOCKET, pair.stream_id, pair.component_id).Warn("could not connect the pair", nice_pair_log_attr(pair), "error", err)
+			pair.state = NICE_CHECK_FAILED
+			priv_update_check_list_failed_components(agent, stream)
+			return
+		}
+
+		pair.sockptr = conn
+		component.nice_component_attach_socket(conn)
+		if conn_check_send(agent, pair) != 0 {
+			pair.state = NICE_CHECK_FAILED
+			priv_update_check_list_failed_components(agent, stream)
+		}
+	}()
+}
+
+/* Whether @pair is still in the check list of @stream */
+func priv_conn_check_list_has_pair(stream *NiceStream, pair *CandidateCheckPair) bool {
+	for i := 0; i < len(stream.conncheck_list); i++ {
+		if stream.conncheck_list[i] == pair {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Sends a connectivity check over candidate pair 'pair'.
+ *
+ * @return zero on success, -1 on error
+ */
+func conn_check_send(agent *NiceAgent, pair *CandidateCheckPair) int {
+	stream, component := agent.agent_find_component(pair.stream_id, pair.component_id)
+	if stream == nil || component == nil {
+		return -1
+	}
+
+	sock := conn_check_get_pair_socket(agent, component, pair)
+	if sock == nil {
+		/* sent once connected */
+		return 0
+	}
+
+	use_candidate := priv_conn_check_use_candidate(agent, pair)
+	msg := priv_conn_check_build_request(agent, stream, pair, use_candidate, false)
+	buf, err := stun_agent_finish_message_short_term(&stream.stun_agent, msg, priv_get_password(agent, stream, pair.remote, false))
+	if err != nil {
+		return -1
+	}
+	if use_candidate {
+		/* the pair is nominated once the peer answers */
+		pair.mark_nominated_on_response_arrival = true
+		pair.use_candidate_on_next_check = false
+	}
+
+	transaction := &StunTransaction{}
+	transaction.message = msg
+	transaction.buffer_len = copy(transaction.buffer[:], buf)
+	if sock.is_reliable() {
+		stun_timer_start_reliable(&transaction.timer, agent.clock, agent.stun_reliable_timeout)
+	} else {
+		stun_timer_start(&transaction.timer, agent.clock, agent.stun_initial_timeout, agent.stun_max_retransmissions)
+	}
+	transaction.next_tick = transaction.timer.deadline
+	pair.stun_transactions = append([]*StunTransaction{transaction}, pair.stun_transactions...)
+	pair.state = NICE_CHECK_IN_PROGRESS
+
+	nice_log_stun(nice_agent_log(agent, NICE_LOG_CONNCHECK), "sending STUN request", pair.stream_id, pair.component_id, pair.remote.addr, buf)
+	out := &NiceOutputMessage{buffers: [][]byte{buf}}
+	if err := sock.send_messages(&pair.remote.addr, []*NiceOutputMessage{out}); err != nil {
+		nice_component_log(agent, NICE_LOG_SOCKET, pair.stream_id, pair.component_id).Warn("could not send a check", nice_pair_log_attr(pair), "error", err)
+		return -1
+	}
+	transaction.sent = agent.clock.Now()
+	pair.stats.requests_sent++
+	pair.stats.last_request_sent = transaction.sent
+
+	if agent.compatibility == NICE_COMPATIBILITY_OC2007R2 && stream.stun_agent.ms_ice2_send_legacy_connchecks {
+		priv_conn_check_send_legacy(agent, stream, pair, sock, use_candidate)
+	}
+	return 0
+}
+
+/*
+ * Whether the next check on @pair nominates it: all the checks of a
+ * controlling agent in aggressive nomination, the one which follows the
+ * success of the pair in regular nomination.
+ */
+func priv_conn_check_use_candidate(agent *NiceAgent, pair *CandidateCheckPair) bool {
+	if !agent.controlling_mode || !NICE_AGENT_IS_COMPATIBLE_WITH_RFC5245_OR_OC2007R2(agent) {
+		return false
+	}
+	if agent.nomination_mode == NICE_NOMINATION_MODE_AGGRESSIVE {
+		return true
+	}
+	return pair.use_candidate_on_next_check
+}
+
+/*
+ * Builds the Binding request of a check on @pair, in the dialect of the
+ * agent. The ICE dialects (RFC 5245 and [MS-ICE2]) add the PRIORITY of the
+ * local candidate as a peer reflexive one, the role of the agent with its
+ * tie-breaker, and USE-CANDIDATE if @use_candidate. The @legacy MS-ICE2
+ * checks are those of the OC2007R2 peers which predate [MS-ICE2], without
+ * its attributes.
+ *
+ * The request is signed by stun_agent_finish_message_short_term() with
+ * the password of the peer, see priv_get_password(): the Google checks
+ * alone go unsigned, their USERNAME is all the authentication there is.
+ */
+func priv_conn_check_build_request(agent *NiceAgent, stream *NiceStream, pair *CandidateCheckPair, use_candidate bool, legacy bool) *StunMessage {
+	msg := NewStunMessage(STUN_REQUEST, STUN_BINDING)
+	msg.messageHeader.transactionId = agent.rng.rng_generate_transaction_id()
+	stun_agent_prepare_message(&stream.stun_agent, msg)
+	if stun_agent_no_cookie(&stream.stun_agent) {
+		/* no magic cookie, the transaction id takes the 16 bytes */
+		msg.magicCookie = nil
+	}
+
+	if agent.compatibility == NICE_COMPATIBILITY_RFC5245 || agent.compatibility == NICE_COMPATIBILITY_WLM2009 ||
+			agent.compatibility == NICE_COMPATIBILITY_OC2007R2 {
+		msg.AddAttr(StunAttr{
+			header: StunAttrHeader{typ: STUN_ATTRIBUTE_PRIORITY},
+			value:  &StunPriorityAttrValue{priority: pair.prflx_priority},
+		})
+		if use_candidate {
+			msg.AddAttr(StunAttr{
+				header: StunAttrHeader{typ: STUN_ATTRIBUTE_USE_CANDIDATE},
+				value:  &StunUseCandidateAttrValue{},
+			})
+		}
+		var role StunAttributeType = STUN_ATTRIBUTE_ICE_CONTROLLED
+		if agent.controlling_mode {
+			role = STUN_ATTRIBUTE_ICE_CONTROLLING
+		}
+		msg.AddAttr(StunAttr{
+			header: StunAttrHeader{typ: role},
+			value:  &StunIceControlAttrValue{tie_breaker: agent.tie_breaker},
+		})
+	}
+
+	msg.AddAttr(StunAttr{
+		header: StunAttrHeader{typ: STUN_ATTRIBUTE_USERNAME},
+		value:  &StunUsernameAttrValue{username: priv_create_username(agent, stream, pair.local, pair.remote, false)},
+	})
+
+	if agent.compatibility == NICE_COMPATIBILITY_OC2007R2 && !legacy {
+		msg.AddAttr(StunAttr{
+			header: StunAttrHeader{typ: STUN_ATTRIBUTE_CANDIDATE_IDENTIFIER},
+			value:  &StunCandidateIdentifierAttrValue{identifier: string(pair.local.foundation)},
+		})
+		msg.AddAttr(StunAttr{
+			header: StunAttrHeader{typ: STUN_ATTRIBUTE_MS_IMPLEMENTATION_VERSION},
+			value:  &StunMsImplementationVersionAttrValue{version: STUN_MSICE2_IMPLEMENTATION_VERSION},
+		})
+	}
+	return msg
+}
+
+/*
+ * Sends the legacy twin of the check just sent on @pair, until the peer
+ * shows it speaks [MS-ICE2]. It is not retransmitted, and the first of the
+ * two responses concludes the check.
+ */
+func priv_conn_check_send_legacy(agent *NiceAgent, stream *NiceStream, pair *CandidateCheckPair, sock NiceSockInterface, use_candidate bool) {
+	msg := priv_conn_check_build_request(agent, stream, pair, use_candidate, true)
+	buf, err := stun_agent_finish_message_short_term(&stream.stun_agent, msg, priv_get_password(agent, stream, pair.remote, false))
+	if err != nil {
+		return
+	}
+
+	transaction := &StunTransaction{}
+	transaction.message = msg
+	transaction.buffer_len = copy(transaction.buffer[:], buf)
+	nice_log_stun(nice_agent_log(agent, NICE_LOG_CONNCHECK), "sending legacy STUN request", pair.stream_id, pair.component_id, pair.remote.addr, buf)
+	out := &NiceOutputMessage{buffers: [][]byte{buf}}
+	if sock.send_messages(&pair.remote.addr, []*NiceOutputMessage{out}) != nil {
+		return
+	}
+	transaction.sent = agent.clock.Now()
+	/* after the check itself, which stays the one retransmitted */
+	pair.stun_transactions = append(pair.stun_transactions[:1], append([]*StunTransaction{transaction}, pair.stun_transactions[1:]...)...)
+}
+
+/*
+ * Schedules the connectivity checks of the agent: the checks are paced by
+ * the Ta timer, and the selected pairs are kept alive every Tr.
+ * Must be called with the agent lock held.
+ */
+func conn_check_schedule_next(agent *NiceAgent) {
+	if agent.conncheck_timer_source == nil {
+		/* step: call once imediately */
+		if priv_conn_check_tick_unlocked(agent) {
+			agent_timeout_add(agent, &agent.conncheck_timer_source, agent.timer_ta, priv_conn_check_tick_unlocked)
+		}
+	}
+
+	conn_check_schedule_keepalive(agent)
+}
+
+/* Starts the keepalives of the selected pairs, if they are not running */
+func conn_check_schedule_keepalive(agent *NiceAgent) {
+	if agent.keepalive_timer_source == nil {
+		agent_timeout_add(agent, &agent.keepalive_timer_source, NICE_AGENT_TIMER_TR_DEFAULT, priv_conn_keepalive_tick_unlocked)
+	}
+	if agent.consent_freshness && agent.consent_timer_source == nil {
+		agent_timeout_add(agent, &agent.consent_timer_source, priv_conn_consent_interval(agent), priv_conn_consent_tick_unlocked)
+	}
+}
+
+/*
+ * Timer callback that handles initiating and managing connectivity
+ * checks (paced by the Ta timer).
+ *
+ * This function is designed for the agent_timeout_add() interface.
+ *
+ * @return will return FALSE when no more pending timers.
+ */
+func priv_conn_check_tick_unlocked(agent *NiceAgent) bool {
+	keep_timer_going := false
+
+	for i := 0; i < len(agent.streams); i++ {
+		if priv_conn_check_tick_stream(agent, agent.streams[i]) {
+			keep_timer_going = true
+		}
+	}
+
+	/* step: start one new check per tick, over all the check lists, the
+	 * triggered ones first */
+	if pair := priv_conn_check_next_triggered(agent); pair != nil {
+		priv_conn_check_initiate(agent, pair)
+		keep_timer_going = true
+	} else {
+		for i := 0; i < len(agent.streams); i++ {
+			pair := priv_conn_check_next_pair(agent.streams[i])
+			if pair != nil {
+				priv_conn_check_initiate(agent, pair)
+				keep_timer_going = true
+				break
+			}
+		}
+	}
+
+	for i := 0; i < len(agent.streams); i++ {
+		stream := agent.streams[i]
+		priv_update_check_list_failed_components(agent, stream)
+		for j := 0; j < len(stream.components); j++ {
+			priv_conn_check_regular_nomination(agent, stream, stream.components[j])
+		}
+	}
+	return keep_timer_going || len(agent.triggered_check_queue) > 0
+}
+
+/*
+ * Retransmits the checks of 'stream' whose STUN timer expired, and fails
+ * the pairs whose transaction timed out.
+ *
+ * @return TRUE while the stream has checks left to run
+ */
+func priv_conn_check_tick_stream(agent *NiceAgent, stream *NiceStream) bool {
+	keep_timer_going := false
+
+	for i := 0; i < len(stream.conncheck_list); i++ {
+		p := stream.conncheck_list[i]
+		switch p.state {
+		case NICE_CHECK_WAITING, NICE_CHECK_FROZEN:
+			keep_timer_going = true
+		case NICE_CHECK_IN_PROGRESS:
+			if p.connecting {
+				keep_timer_going = true
+				continue
+			}
+			if len(p.stun_transactions) == 0 {
+				p.state = NICE_CHECK_FAILED
+				continue
+			}
+			transaction := p.stun_transactions[0]
+			switch stun_timer_refresh(&transaction.timer) {
+			case STUN_USAGE_TIMER_RETURN_TIMEOUT:
+				/* case: error, abort processing */
+				nice_component_log(agent, NICE_LOG_CONNCHECK, p.stream_id, p.component_id).Debug("check timed out", nice_pair_log_attr(p))
+				p.state = NICE_CHECK_FAILED
+				p.stun_transactions = nil
+			case STUN_USAGE_TIMER_RETURN_RETRANSMIT:
+				/* case: not ready, so schedule a new timeout */
+				transaction.next_tick = transaction.timer.deadline
+				nice_log_stun(nice_agent_log(agent, NICE_LOG_CONNCHECK), "retransmitting STUN request", p.stream_id, p.component_id, p.remote.addr, transaction.buffer[:transaction.buffer_len])
+				out := &NiceOutputMessage{buffers: [][]byte{transaction.buffer[:transaction.buffer_len]}}
+				if err := p.sockptr.send_messages(&p.remote.addr, []*NiceOutputMessage{out}); err != nil {
+					nice_component_log(agent, NICE_LOG_SOCKET, p.stream_id, p.component_id).Warn("could not send a check", nice_pair_log_attr(p), "error", err)
+					p.state = NICE_CHECK_FAILED
+					p.stun_transactions = nil
+					continue
+				}
+				transaction.sent = agent.clock.Now()
+				p.stats.retransmissions_sent++
+				agent.metrics.StunRetransmission()
+				p.stats.last_request_sent = transaction.sent
+				keep_timer_going = true
+			case STUN_USAGE_TIMER_RETURN_SUCCESS:
+				keep_timer_going = true
+			}
+		}
+	}
+	return keep_timer_going
+}
+
+/*
+ * Returns the pair the next check of 'stream' must be sent on: the first
+ * waiting pair of the check list, ordered by priority, or else the first
+ * frozen one, which gets unfrozen.
+ */
+func priv_conn_check_next_pair(stream *NiceStream) *CandidateCheckPair {
+	for i := 0; i < len(stream.conncheck_list); i++ {
+		if stream.conncheck_list[i].state == NICE_CHECK_WAITING {
+			return stream.conncheck_list[i]
+		}
+	}
+	for i := 0; i < len(stream.conncheck_list); i++ {
+		p := stream.conncheck_list[i]
+		if p.state == NICE_CHECK_FROZEN {
+			p.state = NICE_CHECK_WAITING
+			return p
+		}
+	}
+	return nil
+}
+
+/*
+ * Initiates a new connectivity check for a ICE candidate pair.
+ */
+func priv_conn_check_initiate(agent *NiceAgent, pair *CandidateCheckPair) {
+	_, component := agent.agent_find_component(pair.stream_id, pair.component_id)
+	if component == nil {
+		pair.state = NICE_CHECK_FAILED
+		return
+	}
+
+	if component.state < NICE_COMPONENT_STATE_CONNECTING || component.state == NICE_COMPONENT_STATE_FAILED {
+		agent_signal_component_state_change(agent, pair.stream_id, pair.component_id, NICE_COMPONENT_STATE_CONNECTING)
+	}
+
+	if conn_check_send(agent, pair) != 0 {
+		pair.state = NICE_CHECK_FAILED
+	}
+}
+
+/*
+ * Moves the components of 'stream' whose pairs all failed to the FAILED
+ * state, once the peer has no more candidate to give.
+ */
+func priv_update_check_list_failed_components(agent *NiceAgent, stream *NiceStream) {
+	if !stream.peer_gathering_done {
+		return
+	}
+	for i := 0; i < len(agent.discovery_list); i++ {
+		if agent.discovery_list[i].stream_id == stream.id && !agent.discovery_list[i].done {
+			return
+		}
+	}
+
+	for i := 0; i < len(stream.components); i++ {
+		component := stream.components[i]
+		if component.selected_pair.local != nil || component.state == NICE_COMPONENT_STATE_FAILED {
+			continue
+		}
+
+		pairs := 0
+		failed := 0
+		for j := 0; j < len(stream.conncheck_list); j++ {
+			p := stream.conncheck_list[j]
+			if p.component_id != component.id {
+				continue
+			}
+			pairs++
+			if p.state == NICE_CHECK_FAILED {
+				failed++
+			}
+		}
+		if pairs > 0 && pairs == failed {
+			agent_signal_component_state_change(agent, stream.id, component.id, NICE_COMPONENT_STATE_FAILED)
+		}
+	}
+}
+
+/*
+ * Timer callback that sends a Binding indication on the selected pair of
+ * every component, so that the NAT bindings on its path stay open
+ * (ICE 10, "Keepalives").
+ *
+ * This function is designed for the agent_timeout_add() interface.
+ *
+ * @return will return FALSE when the agent has no stream left.
+ */
+func priv_conn_keepalive_tick_unlocked(agent *NiceAgent) bool {
+	for i := 0; i < len(agent.streams); i++ {
+		stream := agent.streams[i]
+		for j := 0; j < len(stream.components); j++ {
+			component := stream.components[j]
+			if component.selected_pair.local == nil || component.selected_pair.remote == nil {
+				continue
+			}
+
+			sock := component.nice_component_selected_socket()
+			if sock == nil {
+				continue
+			}
+
+			msg := NewStunMessage(STUN_INDICATION, STUN_BINDING)
+			msg.messageHeader.transactionId = agent.rng.rng_generate_transaction_id()
+			stun_agent_prepare_message(&stream.stun_agent, msg)
+			ds := NewDataStream(make([]byte, 0))
+			if err := msg.Encode(ds); err != nil {
+				continue
+			}
+			out := &NiceOutputMessage{buffers: [][]byte{ds.Data()}}
+			sock.send_messages(&component.selected_pair.remote.addr, []*NiceOutputMessage{out})
+		}
+	}
+	return len(agent.streams) > 0
+}
+
+/*
+ * The interval to the next consent checks: NICE_AGENT_TIMER_CONSENT_DEFAULT
+ * randomized to between 0.8 and 1.2 times its value (RFC 7675 sect 5.1).
+ */
+func priv_conn_consent_interval(agent *NiceAgent) uint {
+	return agent.rng.rng_generate_int(NICE_AGENT_TIMER_CONSENT_DEFAULT * 4 / 5, NICE_AGENT_TIMER_CONSENT_DEFAULT * 6 / 5)
+}
+
+/*
+ * Timer callback of the consent freshness (RFC 7675): checks the selected
+ * pair of every component again, and fails those whose peer answered none
+ * of the checks for NICE_AGENT_TIMER_CONSENT_TIMEOUT. The data stops there,
+ * the pair is unselected.
+ *
+ * This function is designed for the agent_timeout_add() interface.
+ *
+ * @return will return FALSE when the agent has no stream left.
+ */
+func priv_conn_consent_tick_unlocked(agent *NiceAgent) bool {
+	now := agent.clock.Now()
+	for i := 0; i < len(agent.streams); i++ {
+		stream := agent.streams[i]
+		for j := 0; j < len(stream.components); j++ {
+			component := stream.components[j]
+			if component.selected_pair.local == nil || component.selected_pair.remote == nil {
+				continue
+			}
+
+			keepalive := &component.selected_pair.keepalive
+			if now.Sub(keepalive.consent_received) >= NICE_AGENT_TIMER_CONSENT_TIMEOUT * time.Millisecond {
+				agent_signal_consent_lost(agent, stream.id, component.id)
+				component.selected_pair = CandidatePair{}
+				agent_signal_component_state_change(agent, stream.id, component.id, NICE_COMPONENT_STATE_FAILED)
+				continue
+			}
+			priv_conn_consent_send(agent, stream, component)
+		}
+	}
+	if len(agent.streams) == 0 {
+		return false
+	}
+	agent_timeout_add(agent, &agent.consent_timer_source, priv_conn_consent_interval(agent), priv_conn_consent_tick_unlocked)
+	return true
+}
+
+/*
+ * Sends a consent check on the selected pair of @component: a Binding
+ * request signed like the connectivity checks, without USE-CANDIDATE.
+ */
+func priv_conn_consent_send(agent *NiceAgent, stream *NiceStream, component *NiceComponent) {
+	sock := component.nice_component_selected_socket()
+	if sock == nil {
+		return
+	}
+	selected := &component.selected_pair
+	pair := &CandidateCheckPair{
+		stream_id: stream.id,
+		component_id: component.id,
+		local: selected.local,
+		remote: selected.remote,
+		prflx_priority: selected.prflx_priority,
+	}
+	msg := priv_conn_check_build_request(agent, stream, pair, false, false)
+	buf, err := stun_agent_finish_message_short_term(&stream.stun_agent, msg, priv_get_password(agent, stream, selected.remote, false))
+	if err != nil {
+		return
+	}
+
+	keepalive := &selected.keepalive
+	if len(keepalive.consent_checks) == NICE_AGENT_MAX_CONSENT_CHECKS {
+		keepalive.consent_checks = keepalive.consent_checks[1:]
+	}
+	keepalive.consent_checks = append(keepalive.consent_checks, msg)
+
+	nice_log_stun(nice_agent_log(agent, NICE_LOG_CONNCHECK), "sending consent check", stream.id, component.id, selected.remote.addr, buf)
+	out := &NiceOutputMessage{buffers: [][]byte{buf}}
+	if err := sock.send_messages(&selected.remote.addr, []*NiceOutputMessage{out}); err != nil {
+		nice_component_log(agent, NICE_LOG_SOCKET, stream.id, component.id).Debug("could not send a consent check", "error", err)
+		return
+	}
+	if selected.stats != nil {
+		selected.stats.requests_sent++
+		selected.stats.last_request_sent = agent.clock.Now()
+	}
+}
+
+/*
+ * Renews the consent of the selected pair of @component with the response
+ * @buf to one of its consent checks, once it came from the remote
+ * candidate with the MESSAGE-INTEGRITY of the peer (RFC 7675 sect 5.1).
+ * An error response gives no consent.
+ *
+ * Returns: %FALSE if @buf answers none of the consent checks
+ */
+func priv_conn_consent_handle_response(agent *NiceAgent, stream *NiceStream, component *NiceComponent, from NiceAddress, buf []byte, raw []byte) bool {
+	selected := &component.selected_pair
+	keepalive := &selected.keepalive
+	index := -1
+	for i := 0; i < len(keepalive.consent_checks); i++ {
+		if stun_message_matches_transaction_id(buf, keepalive.consent_checks[i]) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return false
+	}
+
+	if !priv_pair_stats_from(selected.remote, from) {
+		nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Debug("consent response from another address",
+			"from", nice_address_to_string(from))
+		return true
+	}
+	key := priv_get_password(agent, stream, selected.remote, false)
+	code := stun_message_get_error_code(buf)
+	if key != nil && agent.compatibility != NICE_COMPATIBILITY_GOOGLE {
+		has_integrity := stun_message_find_attribute(buf, STUN_ATTRIBUTE_MESSAGE_INTEGRITY) != nil
+		if (has_integrity || code < 0) && !stun_message_check_integrity(raw, key, stun_agent_no_cookie(&stream.stun_agent), !stun_agent_no_aligned(&stream.stun_agent)) {
+			nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Warn("consent response with a wrong message integrity",
+				"from", nice_address_to_string(from))
+			agent.metrics.StunAuthFailure()
+			return true
+		}
+	}
+
+	keepalive.consent_checks = append(keepalive.consent_checks[:index], keepalive.consent_checks[index + 1:]...)
+	if code >= 0 {
+		nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Debug("consent check failed", "code", code)
+		return true
+	}
+	now := agent.clock.Now()
+	keepalive.consent_received = now
+	if selected.stats != nil {
+		selected.stats.responses_received++
+		selected.stats.last_response_received = now
+	}
+	return true
+}
+
+/*
+ * Stops the checks of 'stream', and the Ta timer once no stream has a
+ * check left.
+ */
+func conn_check_prune_stream(agent *NiceAgent, stream *NiceStream) {
+	stream.conncheck_list = nil
+	priv_conn_check_stop_if_idle(agent)
+}
+
+/*
+ * Stops the checks of 'component' only, whose pair was chosen by other
+ * means.
+ */
+func conn_check_prune_component(agent *NiceAgent, stream *NiceStream, component *NiceComponent) {
+	list := stream.conncheck_list[:0]
+	for i := 0; i < len(stream.conncheck_list); i++ {
+		if stream.conncheck_list[i].component_id != component.id {
+			list = append(list, stream.conncheck_list[i])
+		}
+	}
+	for i := len(list); i < len(stream.conncheck_list); i++ {
+		stream.conncheck_list[i] = nil
+	}
+	stream.conncheck_list = list
+	priv_conn_check_stop_if_idle(agent)
+}
+
+func priv_conn_check_stop_if_idle(agent *NiceAgent) {
+	for i := 0; i < len(agent.streams); i++ {
+		if len(agent.streams[i].conncheck_list) > 0 {
+			return
+		}
+	}
+	agent_timeout_remove(&agent.conncheck_timer_source)
+}
+
+/*
+ * Removes all the references to 'sock' once it got closed: the pairs
+ * checked over it, and the accepted connection kept by its ICE-TCP
+ * listener.
+ */
+func conn_check_prune_socket(agent *NiceAgent, stream *NiceStream, component *NiceComponent, sock NiceSockInterface) {
+	if tcp, ok := sock.(*TcpBsdSocket); ok {
+		for i := 0; i < len(component.socket_sources); i++ {
+			switch listener := component.socket_sources[i].socket.(type) {
+			case *TcpPassiveSocket:
+				listener.remove_connection(tcp)
+			case *TcpSoSocket:
+				listener.remove_connection(tcp)
+			case *TcpMuxSocket:
+				listener.remove_connection(tcp)
+			}
+		}
+	}
+
+	if component.selected_pair.local != nil && component.nice_component_selected_socket() == sock {
+		component.selected_pair = CandidatePair{}
+	}
+
+	list := stream.conncheck_list[:0]
+	for i := 0; i < len(stream.conncheck_list); i++ {
+		p := stream.conncheck_list[i]
+		if p.component_id == component.id && p.sockptr == sock {
+			continue
+		}
+		list = append(list, p)
+	}
+	stream.conncheck_list = list
+}
+
+/*
+ * Handles the STUN message @buf received from @from on @nicesock for the
+ * connectivity checks of @component: answers the checks of the peer and
+ * matches the responses to ours, and to the consent checks of the
+ * selected pair, by their transaction id (ICE sect 7.1.3 and 7.2 ID-19).
+ * @buf is parsed, @raw is the message as received, see
+ * agent_recv_stun().
+ *
+ * Returns: %FALSE if @buf is neither a check nor the response to one
+ * Must be called with the agent lock held.
+ */
+func conn_check_handle_inbound_stun(agent *NiceAgent, stream *NiceStream, component *NiceComponent, nicesock NiceSockInterface, from NiceAddress, buf []byte, raw []byte) bool {
+	if stun_message_has_fingerprint(raw) && !stun_message_check_fingerprint(raw) {
+		nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Debug("STUN message with a wrong fingerprint dropped",
+			"from", nice_address_to_string(from))
+		return true
+	}
+
+	if stun_message_is_binding_request(buf) {
+		priv_conn_check_handle_request(agent, stream, component, nicesock, from, buf, raw)
+		return true
+	}
+	if stun_message_is_binding_response(buf) {
+		if priv_conn_consent_handle_response(agent, stream, component, from, buf, raw) {
+			return true
+		}
+		return priv_conn_check_handle_response(agent, stream, component, from, buf, raw)
+	}
+	return false
+}
+
+/*
+ * Answers the check @buf of the peer, after its USERNAME and its
+ * MESSAGE-INTEGRITY, then schedules the triggered check of its pair.
+ */
+func priv_conn_check_handle_request(agent *NiceAgent, stream *NiceStream, component *NiceComponent, nicesock NiceSockInterface, from NiceAddress, buf []byte, raw []byte) {
+	username := stun_message_find_attribute(buf, STUN_ATTRIBUTE_USERNAME)
+	if username == nil {
+		nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Debug("check without username",
+			"from", nice_address_to_string(from))
+		priv_conn_check_send_error(agent, component, nicesock, from, buf, STUN_ERROR_BAD_REQUEST, nil)
+		return
+	}
+	if !priv_check_inbound_username(agent, stream, component, username) {
+		nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Warn("check with a wrong username",
+			"from", nice_address_to_string(from), "username", string(username))
+		agent.metrics.StunAuthFailure()
+		priv_conn_check_send_error(agent, component, nicesock, from, buf, STUN_ERROR_UNAUTHORIZED, nil)
+		return
+	}
+
+	local := priv_conn_check_find_local(agent, stream, component, nicesock, username)
+	key := priv_get_password(agent, stream, local, true)
+	if key != nil && agent.compatibility != NICE_COMPATIBILITY_GOOGLE {
+		if stun_message_find_attribute(buf, STUN_ATTRIBUTE_MESSAGE_INTEGRITY) == nil {
+			nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Debug("check without message integrity",
+				"from", nice_address_to_string(from))
+			priv_conn_check_send_error(agent, component, nicesock, from, buf, STUN_ERROR_BAD_REQUEST, nil)
+			return
+		}
+		if !stun_message_check_integrity(raw, key, stun_agent_no_cookie(&stream.stun_agent), !stun_agent_no_aligned(&stream.stun_agent)) {
+			nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Warn("check with a wrong message integrity",
+				"from", nice_address_to_string(from))
+			agent.metrics.StunAuthFailure()
+			priv_conn_check_send_error(agent, component, nicesock, from, buf, STUN_ERROR_UNAUTHORIZED, nil)
+			return
+		}
+	}
+
+	if muxsock, ok := nicesock.(*UdpMuxSocket); ok {
+		/* the peer knows the password, its packets are ours */
+		nice_udp_mux_socket_bind(muxsock, from)
+	}
+
+	agent_signal_initial_binding_request_received(agent, stream)
+	priv_check_ms_ice2_peer(agent, stream, component, buf)
+
+	if !priv_conn_check_resolve_role_conflict(agent, buf) {
+		nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Debug("role conflict, the peer switches",
+			"from", nice_address_to_string(from))
+		priv_conn_check_send_error(agent, component, nicesock, from, buf, STUN_ERROR_ROLE_CONFLICT, key)
+		return
+	}
+
+	sent := priv_conn_check_send_response(agent, component, nicesock, from, buf, key)
+
+	if local == nil {
+		/* no candidate of ours to pair, the peer learnt its mapping anyway */
+		return
+	}
+	remote := priv_conn_check_learn_remote(agent, stream, component, local, nicesock, from, buf, username)
+	if remote == nil {
+		return
+	}
+	use_candidate := stun_message_find_attribute(buf, STUN_ATTRIBUTE_USE_CANDIDATE) != nil
+	priv_conn_check_schedule_triggered(agent, stream, component, local, remote, use_candidate)
+	if sent {
+		/* counted once the pair of the check exists */
+		conn_check_stats_response_sent(agent, stream, component, nicesock, from)
+	}
+}
+
+/*
+ * Matches the response @buf to the check it answers, and moves its pair
+ * to SUCCEEDED, or FAILED on an error (ICE sect 7.1.3 ID-19). A 487 (Role
+ * Conflict) switches our role and checks the pair again instead.
+ *
+ * Returns: %FALSE if @buf answers none of our checks
+ */
+func priv_conn_check_handle_response(agent *NiceAgent, stream *NiceStream, component *NiceComponent, from NiceAddress, buf []byte, raw []byte) bool {
+	var pair *CandidateCheckPair
+	var transaction *StunTransaction
+	for i := 0; i < len(stream.conncheck_list) && pair == nil; i++ {
+		p := stream.conncheck_list[i]
+		if p.component_id != component.id {
+			continue
+		}
+		for j := 0; j < len(p.stun_transactions); j++ {
+			if stun_message_matches_transaction_id(buf, p.stun_transactions[j].message) {
+				pair = p
+				transaction = p.stun_transactions[j]
+				break
+			}
+		}
+	}
+	if pair == nil {
+		return false
+	}
+
+	/* the responses are signed with the password of the peer, but for
+	 * the errors which do not know it */
+	key := priv_get_password(agent, stream, pair.remote, false)
+	code := stun_message_get_error_code(buf)
+	if key != nil && agent.compatibility != NICE_COMPATIBILITY_GOOGLE {
+		has_integrity := stun_message_find_attribute(buf, STUN_ATTRIBUTE_MESSAGE_INTEGRITY) != nil
+		if (has_integrity || code < 0) && !stun_message_check_integrity(raw, key, stun_agent_no_cookie(&stream.stun_agent), !stun_agent_no_aligned(&stream.stun_agent)) {
+			nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Warn("check response with a wrong message integrity",
+				nice_pair_log_attr(pair))
+			agent.metrics.StunAuthFailure()
+			return true
+		}
+	}
+
+	conn_check_stats_response_received(agent, pair, transaction)
+
+	/* the retransmissions of the check, and its legacy twin, are over */
+	pair.stun_transactions = nil
+
+	if code == int(STUN_ERROR_ROLE_CONFLICT) {
+		/* the peer keeps its role: switch ours, unless another check
+		 * already did, and check again (ICE sect 7.1.3.1 ID-19) */
+		sent_controlling := stun_message_has_attr(transaction.message, STUN_ATTRIBUTE_ICE_CONTROLLING)
+		if sent_controlling == agent.controlling_mode {
+			priv_conn_check_switch_role(agent, !agent.controlling_mode)
+		}
+		pair.state = NICE_CHECK_WAITING
+		priv_conn_check_queue_triggered(agent, pair)
+		conn_check_schedule_next(agent)
+		return true
+	}
+	if code >= 0 {
+		if code == int(STUN_ERROR_UNAUTHORIZED) {
+			/* the peer does not take our credentials */
+			nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Warn("check rejected as unauthorized",
+				"from", nice_address_to_string(from))
+			agent.metrics.StunAuthFailure()
+		} else {
+			nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Debug("check failed",
+				nice_pair_log_attr(pair), "code", code)
+		}
+		pair.state = NICE_CHECK_FAILED
+		priv_update_check_list_failed_components(agent, stream)
+		return true
+	}
+
+	/* the response must come from where the check went (ICE sect
+	 * 7.1.3.1 ID-19) */
+	if !priv_pair_stats_from(pair.remote, from) {
+		nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Debug("check response from another address",
+			nice_pair_log_attr(pair), "from", nice_address_to_string(from))
+		pair.state = NICE_CHECK_FAILED
+		priv_update_check_list_failed_components(agent, stream)
+		return true
+	}
+
+	valid := pair
+	if mapped, ok := stun_message_find_mapped_addr(buf); ok {
+		valid = priv_conn_check_discover_local(agent, stream, component, pair, mapped)
+	}
+	pair.state = NICE_CHECK_SUCCEEDED
+	valid.valid = true
+	if valid != pair {
+		pair.discovered_pair = valid
+		valid.succeeded_pair = pair
+	}
+	nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Debug("check succeeded", nice_pair_log_attr(valid))
+	priv_conn_check_unfreeze_related(stream, pair)
+
+	/* the pairs of the dialects without nomination are nominated as
+	 * soon as they work */
+	if pair.mark_nominated_on_response_arrival || pair.nominated || !NICE_AGENT_IS_COMPATIBLE_WITH_RFC5245_OR_OC2007R2(agent) {
+		pair.mark_nominated_on_response_arrival = false
+		valid.nominated = true
+	}
+
+	if component.state < NICE_COMPONENT_STATE_CONNECTED || component.state == NICE_COMPONENT_STATE_FAILED {
+		agent_signal_component_state_change(agent, stream.id, component.id, NICE_COMPONENT_STATE_CONNECTED)
+	}
+	if valid.nominated {
+		priv_conn_check_select_pair(agent, stream, component, valid)
+	} else {
+		priv_conn_check_regular_nomination(agent, stream, component)
+	}
+	return true
+}
+
+/* Whether @msg carries an attribute of type @typ */
+func stun_message_has_attr(msg *StunMessage, typ StunAttributeType) bool {
+	for i := 0; i < len(msg.attrs); i++ {
+		if msg.attrs[i].header.typ == typ {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * The local candidate a check of the peer received on @nicesock is for:
+ * that of the socket, of the ICE-TCP listener which accepted the
+ * connection, or of the pair which made it. With the credentials per
+ * candidate of MSN and OC2007, the one @username names.
+ */
+func priv_conn_check_find_local(agent *NiceAgent, stream *NiceStream, component *NiceComponent, nicesock NiceSockInterface, username []byte) *NiceCandidate {
+	for i := 0; i < len(component.local_candidates); i++ {
+		c := component.local_candidates[i]
+		if c.typ == NICE_CANDIDATE_TYPE_PEER_REFLEXIVE || !priv_conn_check_local_socket(c, nicesock) {
+			continue
+		}
+		if (agent.compatibility == NICE_COMPATIBILITY_MSN || agent.compatibility == NICE_COMPATIBILITY_OC2007) &&
+				!bytes.HasPrefix(username, []byte(priv_decode_username(c.username) + ":")) {
+			continue
+		}
+		return c
+	}
+	for i := 0; i < len(stream.conncheck_list); i++ {
+		p := stream.conncheck_list[i]
+		if p.component_id == component.id && p.sockptr == nicesock {
+			return p.local
+		}
+	}
+	return nil
+}
+
+/* Whether @nicesock is the socket of @candidate, or a connection its
+ * ICE-TCP listener accepted */
+func priv_conn_check_local_socket(candidate *NiceCandidate, nicesock NiceSockInterface) bool {
+	if candidate.sockptr == nicesock {
+		return true
+	}
+	tcp, ok := nicesock.(*TcpBsdSocket)
+	if !ok {
+		return false
+	}
+	var listener *TcpPassiveSocket
+	switch sock := candidate.sockptr.(type) {
+	case *TcpPassiveSocket:
+		listener = sock
+	case *TcpSoSocket:
+		listener = sock.TcpPassiveSocket
+	case *TcpMuxSocket:
+		listener = sock.TcpPassiveSocket
+	default:
+		return false
+	}
+	return listener.find_connection(&tcp.remote_addr) == tcp
+}
+
+/*
+ * Returns the remote candidate the check @buf comes from, learnt as a peer
+ * reflexive candidate of the PRIORITY of the check if it is unknown (ICE
+ * sect 7.2.1.3 ID-19).
+ */
+func priv_conn_check_learn_remote(agent *NiceAgent, stream *NiceStream, component *NiceComponent, local *NiceCandidate, nicesock NiceSockInterface, from NiceAddress, buf []byte, username []byte) *NiceCandidate {
+	transport := conn_check_match_transport(local.transport)
+	for i := 0; i < len(component.remote_candidates); i++ {
+		r := component.remote_candidates[i]
+		if r.transport == transport && priv_pair_stats_from(r, from) {
+			return r
+		}
+	}
+	if len(component.remote_candidates) >= NICE_AGENT_MAX_REMOTE_CANDIDATES {
+		return nil
+	}
+
+	remote := nice_candidate_new(NICE_CANDIDATE_TYPE_PEER_REFLEXIVE)
+	remote.transport = transport
+	remote.stream_id = stream.id
+	remote.component_id = component.id
+	remote.addr = from
+	remote.base_addr = from
+	if priority := stun_message_find_attribute(buf, STUN_ATTRIBUTE_PRIORITY); len(priority) == 4 {
+		remote.priority = binary.BigEndian.Uint32(priority)
+	} else {
+		remote.priority = agent_candidate_priority(agent, remote, false)
+	}
+	remote.foundation = priv_generate_foundation(agent)
+
+	/* the dialects with credentials per candidate: ours to the peer
+	 * take its part of the USERNAME */
+	switch agent.compatibility {
+	case NICE_COMPATIBILITY_GOOGLE:
+		remote.username = string(username[len(local.username):])
+	case NICE_COMPATIBILITY_MSN, NICE_COMPATIBILITY_OC2007:
+		if i := bytes.IndexByte(username, ':'); i >= 0 {
+			remote.username = base64.StdEncoding.EncodeToString(username[i + 1:])
+		}
+		for i := 0; i < len(component.remote_candidates); i++ {
+			if component.remote_candidates[i].username == remote.username {
+				remote.password = component.remote_candidates[i].password
+				break
+			}
+		}
+	}
+	if local.transport != NICE_CANDIDATE_TRANSPORT_UDP {
+		/* the connection the peer made, see priv_add_new_check_pair() */
+		remote.sockptr = nicesock
+	}
+
+	component.remote_candidates = append(component.remote_candidates, remote)
+	nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Debug("new peer reflexive remote candidate",
+		"addr", nice_address_to_string(from), "priority", remote.priority)
+	return remote
+}
+
+/*
+ * Schedules the triggered check of the pair of @local and @remote, which
+ * the peer just checked (ICE sect 7.2.1.4 ID-19). The controlled agent
+ * selects the pair the peer nominated with @use_candidate once it works
+ * both ways (ICE sect 7.2.1.5 ID-19).
+ */
+func priv_conn_check_schedule_triggered(agent *NiceAgent, stream *NiceStream, component *NiceComponent, local *NiceCandidate, remote *NiceCandidate, use_candidate bool) {
+	var pair *CandidateCheckPair
+	for i := 0; i < len(stream.conncheck_list); i++ {
+		p := stream.conncheck_list[i]
+		if p.component_id == component.id && p.local == local && p.remote == remote {
+			pair = p
+			break
+		}
+	}
+	if pair == nil {
+		pair = priv_conn_check_add_for_candidate_pair_matched(agent, stream.id, component, local, remote, NICE_CHECK_WAITING)
+	}
+	if use_candidate && !agent.controlling_mode {
+		pair.nominated = true
+	}
+
+	switch pair.state {
+	case NICE_CHECK_SUCCEEDED, NICE_CHECK_DISCOVERED:
+		if pair.nominated {
+			valid := pair
+			if pair.discovered_pair != nil {
+				valid = pair.discovered_pair
+			}
+			valid.nominated = true
+			priv_conn_check_select_pair(agent, stream, component, valid)
+		}
+	case NICE_CHECK_IN_PROGRESS:
+		/* the response to our check will do */
+	default:
+		pair.state = NICE_CHECK_WAITING
+		priv_conn_check_queue_triggered(agent, pair)
+		conn_check_schedule_next(agent)
+	}
+}
+
+/* Queues the triggered check of @pair, sent before the ordinary ones */
+func priv_conn_check_queue_triggered(agent *NiceAgent, pair *CandidateCheckPair) {
+	for i := 0; i < len(agent.triggered_check_queue); i++ {
+		if agent.triggered_check_queue[i] == pair {
+			return
+		}
+	}
+	agent.triggered_check_queue = append(agent.triggered_check_queue, pair)
+}
+
+/*
+ * Takes the next triggered check to send, skipping the pairs pruned
+ * meanwhile.
+ */
+func priv_conn_check_next_triggered(agent *NiceAgent) *CandidateCheckPair {
+	for len(agent.triggered_check_queue) > 0 {
+		pair := agent.triggered_check_queue[0]
+		agent.triggered_check_queue = agent.triggered_check_queue[1:]
+		stream := agent.find_stream(pair.stream_id)
+		if stream != nil && pair.state == NICE_CHECK_WAITING && priv_conn_check_list_has_pair(stream, pair) {
+			return pair
+		}
+	}
+	return nil
+}
+
+/*
+ * Resolves the conflict of roles the ICE-CONTROLLING or ICE-CONTROLLED
+ * attribute of the check @buf of the peer may show, with the tie-breakers
+ * (ICE sect 7.2.1.1 ID-19): the agent of the larger one is controlling.
+ *
+ * Returns: %FALSE if the peer must switch instead, the check is then
+ * answered with a 487 (Role Conflict) error
+ */
+func priv_conn_check_resolve_role_conflict(agent *NiceAgent, buf []byte) bool {
+	if agent.compatibility != NICE_COMPATIBILITY_RFC5245 && agent.compatibility != NICE_COMPATIBILITY_WLM2009 &&
+			agent.compatibility != NICE_COMPATIBILITY_OC2007R2 {
+		return true
+	}
+
+	if agent.controlling_mode {
+		value := stun_message_find_attribute(buf, STUN_ATTRIBUTE_ICE_CONTROLLING)
+		if len(value) != 8 {
+			return true
+		}
+		if agent.tie_breaker >= binary.BigEndian.Uint64(value) {
+			return false
+		}
+		priv_conn_check_switch_role(agent, false)
+	} else {
+		value := stun_message_find_attribute(buf, STUN_ATTRIBUTE_ICE_CONTROLLED)
+		if len(value) != 8 {
+			return true
+		}
+		if agent.tie_breaker < binary.BigEndian.Uint64(value) {
+			return false
+		}
+		priv_conn_check_switch_role(agent, true)
+	}
+	return true
+}
+
+/*
+ * Switches the role of the agent after a role conflict. The priorities of
+ * the pairs depend on it: the check lists are sorted again.
+ */
+func priv_conn_check_switch_role(agent *NiceAgent, controlling bool) {
+	nice_agent_log(agent, NICE_LOG_CONNCHECK).Info("role conflict, switching role", "controlling", controlling)
+	agent.controlling_mode = controlling
+	for i := 0; i < len(agent.streams); i++ {
+		stream := agent.streams[i]
+		list := stream.conncheck_list
+		stream.conncheck_list = nil
+		for j := 0; j < len(list); j++ {
+			list[j].priority = agent.agent_candidate_pair_priority(list[j].local, list[j].remote)
+			stream.conncheck_list = InsertSorted(stream.conncheck_list, list[j])
+		}
+	}
+}
+
+/*
+ * Returns the valid pair of the check of @pair, whose response saw us at
+ * @mapped: @pair itself, or the pair of the peer reflexive local
+ * candidate it discovered (ICE sect 7.1.3.2.1 and 7.1.3.2.2 ID-19).
+ */
+func priv_conn_check_discover_local(agent *NiceAgent, stream *NiceStream, component *NiceComponent, pair *CandidateCheckPair, mapped NiceAddress) *CandidateCheckPair {
+	var local *NiceCandidate
+	for i := 0; i < len(component.local_candidates); i++ {
+		c := component.local_candidates[i]
+		if c.transport != pair.local.transport || c.addr.ip != mapped.ip {
+			continue
+		}
+		/* the port of an active ICE-TCP connection is not the one of
+		 * its candidate */
+		if c.addr.port == mapped.port || c.transport == NICE_CANDIDATE_TRANSPORT_TCP_ACTIVE {
+			local = c
+			break
+		}
+	}
+	if local == pair.local {
+		return pair
+	}
+
+	if local == nil {
+		local = nice_candidate_new(NICE_CANDIDATE_TYPE_PEER_REFLEXIVE)
+		local.transport = pair.local.transport
+		local.stream_id = stream.id
+		local.component_id = component.id
+		local.addr = mapped
+		local.addr.network = pair.local.addr.network
+		local.base_addr = pair.local.base_addr
+		local.priority = pair.prflx_priority
+		local.username = pair.local.username
+		local.password = pair.local.password
+		local.sockptr = pair.local.sockptr
+		priv_assign_foundation(agent, local)
+		component.local_candidates = append(component.local_candidates, local)
+		nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Debug("new peer reflexive local candidate",
+			"addr", nice_address_to_string(mapped), "priority", local.priority)
+	}
+
+	for i := 0; i < len(stream.conncheck_list); i++ {
+		p := stream.conncheck_list[i]
+		if p.component_id == component.id && p.local == local && p.remote == pair.remote {
+			return p
+		}
+	}
+	valid := priv_add_new_check_pair(agent, stream.id, component, local, pair.remote, NICE_CHECK_DISCOVERED)
+	valid.sockptr = pair.sockptr
+	return valid
+}
+
+/*
+ * Unfreezes the pairs of @stream which have the foundation of @pair, now
+ * that it succeeded (ICE sect 7.1.3.2.3 ID-19).
+ */
+func priv_conn_check_unfreeze_related(stream *NiceStream, pair *CandidateCheckPair) {
+	for i := 0; i < len(stream.conncheck_list); i++ {
+		p := stream.conncheck_list[i]
+		if p.state == NICE_CHECK_FROZEN && string(p.foundation) == string(pair.foundation) {
+			p.state = NICE_CHECK_WAITING
+		}
+	}
+}
+
+/*
+ * Selects the nominated @pair for @component if it has a higher priority
+ * than the current selected pair, and concludes the component to READY
+ * (ICE sect 8.1.2 ID-19). The pairs of lower priority not checked yet are
+ * cancelled.
+ */
+func priv_conn_check_select_pair(agent *NiceAgent, stream *NiceStream, component *NiceComponent, pair *CandidateCheckPair) {
+	if component.selected_pair.local != nil && component.selected_pair.priority >= pair.priority {
+		return
+	}
+	if conn_check_get_connected_pair_socket(pair) == nil {
+		return
+	}
+
+	for i := 0; i < len(stream.conncheck_list); i++ {
+		p := stream.conncheck_list[i]
+		if p.component_id == component.id && p.priority < pair.priority &&
+				(p.state == NICE_CHECK_WAITING || p.state == NICE_CHECK_FROZEN) {
+			p.state = NICE_CHECK_FAILED
+		}
+	}
+
+	if component.state < NICE_COMPONENT_STATE_CONNECTED || component.state == NICE_COMPONENT_STATE_FAILED {
+		agent_signal_component_state_change(agent, stream.id, component.id, NICE_COMPONENT_STATE_CONNECTED)
+	}
+	component.nice_component_update_selected_pair(pair, agent.clock.Now())
+	agent_signal_new_selected_pair(agent, stream.id, component.id, pair.local, pair.remote)
+	agent_signal_component_state_change(agent, stream.id, component.id, NICE_COMPONENT_STATE_READY)
+	conn_check_schedule_keepalive(agent)
+}
+
+/*
+ * In regular nomination, the controlling agent nominates the valid pair of
+ * highest priority of @component once no pair of higher priority may
+ * still succeed, by checking it again with USE-CANDIDATE (ICE sect 8.1.1.1
+ * ID-19).
+ */
+func priv_conn_check_regular_nomination(agent *NiceAgent, stream *NiceStream, component *NiceComponent) {
+	if !agent.controlling_mode || agent.nomination_mode != NICE_NOMINATION_MODE_REGULAR ||
+			!NICE_AGENT_IS_COMPATIBLE_WITH_RFC5245_OR_OC2007R2(agent) || component.selected_pair.local != nil {
+		return
+	}
+
+	for i := 0; i < len(stream.conncheck_list); i++ {
+		p := stream.conncheck_list[i]
+		if p.component_id != component.id {
+			continue
+		}
+		if p.use_candidate_on_next_check || p.mark_nominated_on_response_arrival {
+			/* the nomination is under way */
+			return
+		}
+		switch p.state {
+		case NICE_CHECK_WAITING, NICE_CHECK_FROZEN, NICE_CHECK_IN_PROGRESS:
+			return
+		case NICE_CHECK_SUCCEEDED:
+			nice_component_log(agent, NICE_LOG_CONNCHECK, stream.id, component.id).Debug("nominating pair", nice_pair_log_attr(p))
+			p.use_candidate_on_next_check = true
+			p.state = NICE_CHECK_WAITING
+			priv_conn_check_queue_triggered(agent, p)
+			conn_check_schedule_next(agent)
+			return
+		}
+	}
+}
+
+/*
+ * Answers the check @req of the peer received from @from with a Binding
+ * success response telling @from back: in XOR-MAPPED-ADDRESS, or in the
+ * MAPPED-ADDRESS of the dialects without magic cookie. It is signed with
+ * @key, the local password, and fingerprinted like the checks.
+ */
+func priv_conn_check_send_response(agent *NiceAgent, component *NiceComponent, nicesock NiceSockInterface, from NiceAddress, req []byte, key []byte) bool {
+	msg := priv_conn_check_build_reply(component.stream, req, STUN_RESPONSE)
+
+	ip := net.ParseIP(from.ip)
+	family := MAPPED_ADDRESS_FAMILY(MAPPED_ADDRESS_FAMILY_IPV6)
+	if ip.To4() != nil {
+		ip = ip.To4()
+		family = MAPPED_ADDRESS_FAMILY_IPV4
+	}
+	if msg.magicCookie != nil {
+		value := NewStunXorMappedAddressAttrValue(family, uint16(from.port), ip)
+		value.SetMagicCookie(msg.magicCookie)
+		value.SetTransactionId(msg.messageHeader.transactionId)
+		msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_XOR_MAPPED_ADDRESS}, value: value})
+	} else {
+		value := NewStunMappedAddressAttrValue(family, uint16(from.port), ip)
+		msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_MAPPED_ADDRESS}, value: value})
+	}
+	if username := stun_message_find_attribute(req, STUN_ATTRIBUTE_USERNAME); username != nil && msg.magicCookie == nil {
+		/* the RFC 3489 dialects echo the USERNAME of the check */
+		msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_USERNAME}, value: &StunUsernameAttrValue{username: string(username)}})
+	}
+	return priv_conn_check_send_reply(agent, component, nicesock, from, msg, key)
+}
+
+/*
+ * Answers the check @req of the peer with the error @code, signed with
+ * @key if it is not nil.
+ */
+func priv_conn_check_send_error(agent *NiceAgent, component *NiceComponent, nicesock NiceSockInterface, from NiceAddress, req []byte, code StunError, key []byte) {
+	msg := priv_conn_check_build_reply(component.stream, req, STUN_ERROR)
+	msg.AddAttr(StunAttr{
+		header: StunAttrHeader{typ: STUN_ATTRIBUTE_ERROR_CODE},
+		value:  &StunErrorCodeAttrValue{code: int(code), reason: stun_strerror(code)},
+	})
+	priv_conn_check_send_reply(agent, component, nicesock, from, msg, key)
+}
+
+/* The reply of class @class to the Binding request @req, of its transaction */
+func priv_conn_check_build_reply(stream *NiceStream, req []byte, class StunClass) *StunMessage {
+	msg := NewStunMessage(class, STUN_BINDING)
+	msg.messageHeader.transactionId = stun_message_transaction_id(req)
+	stun_agent_prepare_message(&stream.stun_agent, msg)
+	if !stun_message_has_cookie(req) {
+		msg.magicCookie = nil
+	}
+	return msg
+}
+
+/* Sends the reply @msg to a check of the peer, returns whether it went */
+func priv_conn_check_send_reply(agent *NiceAgent, component *NiceComponent, nicesock NiceSockInterface, from NiceAddress, msg *StunMessage, key []byte) bool {
+	buf, err := stun_agent_finish_message_short_term(&component.stream.stun_agent, msg, key)
+	if err != nil {
+		return false
+	}
+	nice_log_stun(nice_agent_log(agent, NICE_LOG_CONNCHECK), "sending STUN response", component.stream.id, component.id, from, buf)
+	out := &NiceOutputMessage{buffers: [][]byte{buf}}
+	if err := nicesock.send_messages(&from, []*NiceOutputMessage{out}); err != nil {
+		nice_component_log(agent, NICE_LOG_SOCKET, component.stream.id, component.id).Warn("could not answer a check",
+			"to", nice_address_to_string(from), "error", err)
+		return false
+	}
+	return true
+}
+
 func priv_conn_check_add_for_candidate_pair_matched(agent *NiceAgent, stream_id uint, component *NiceComponent, local *NiceCandidate, remote *NiceCandidate, initial_state NiceCheckState) *CandidateCheckPair {
 	var pair *CandidateCheckPair
 
@@ -197,7 +1596,7 @@ func priv_add_new_check_pair(agent *NiceAgent,stream_id uint, component *NiceCom
 	pair.priority = agent.agent_candidate_pair_priority(local, remote)
 
 	pair.state = initial_state
-	fmt.Println("agent creating a new pair")
+	nice_component_log(agent, NICE_LOG_CONNCHECK, stream_id, component.id).Debug("new pair", nice_pair_log_attr(pair))
 	pair.prflx_priority = ensure_unique_prflx_priority (stream, component, local.priority, peer_reflexive_candidate_priority (agent, local))
 
 	stream.conncheck_list = InsertSorted(stream.conncheck_list, pair)
@@ -212,25 +1611,113 @@ func priv_add_new_check_pair(agent *NiceAgent,stream_id uint, component *NiceCom
 	return pair
 }
 
+/*
+ * The USERNAME of the checks between @local and @remote: the credentials
+ * of the candidates if they have some, of the stream otherwise. Ours carry
+ * the remote credentials first, the @inbound checks of the peer ours.
+ */
+func priv_create_username(agent *NiceAgent, stream *NiceStream, local *NiceCandidate, remote *NiceCandidate, inbound bool) string {
+	local_username := stream.local_ufrag
+	remote_username := stream.remote_ufrag
+	if local != nil && local.username != "" {
+		local_username = local.username
+	}
+	if remote != nil && remote.username != "" {
+		remote_username = remote.username
+	}
+
+	if inbound {
+		return priv_gen_username(agent, local_username, remote_username)
+	}
+	return priv_gen_username(agent, remote_username, local_username)
+}
+
+func priv_gen_username(agent *NiceAgent, username1 string, username2 string) string {
+	switch agent.compatibility {
+	case NICE_COMPATIBILITY_GOOGLE:
+		/* the two 16 characters usernames, without separator */
+		return username1 + username2
+	case NICE_COMPATIBILITY_MSN, NICE_COMPATIBILITY_OC2007:
+		/* the candidate usernames are base64, the check carries them
+		 * decoded */
+		return priv_decode_username(username1) + ":" + priv_decode_username(username2)
+	}
+	return username1 + ":" + username2
+}
+
+/*
+ * The password of the checks between the agent and the @candidate of the
+ * peer, or the @local one: the password of the candidate if it has one, of
+ * the stream otherwise. The MSN and OC2007 passwords are used decoded, and
+ * the Google checks are not signed.
+ *
+ * Returns: the key of the MESSAGE-INTEGRITY, nil if there is none
+ */
+func priv_get_password(agent *NiceAgent, stream *NiceStream, candidate *NiceCandidate, local bool) []byte {
+	if agent.compatibility == NICE_COMPATIBILITY_GOOGLE {
+		return nil
+	}
+	password := stream.remote_password
+	if local {
+		password = stream.local_password
+	}
+	if candidate != nil && candidate.password != "" {
+		password = candidate.password
+	}
+	if password == "" {
+		return nil
+	}
+	if agent.compatibility == NICE_COMPATIBILITY_MSN || agent.compatibility == NICE_COMPATIBILITY_OC2007 {
+		return []byte(priv_decode_username(password))
+	}
+	return []byte(password)
+}
+
+/* The base64 @username of an MSN or OC2007 candidate, decoded */
+func priv_decode_username(username string) string {
+	decoded, err := base64.StdEncoding.DecodeString(username)
+	if err != nil {
+		return username
+	}
+	return string(decoded)
+}
+
+/*
+ * Whether @username, from the USERNAME of a check of the peer, names one
+ * of the local credentials of @component.
+ */
+func priv_check_inbound_username(agent *NiceAgent, stream *NiceStream, component *NiceComponent, username []byte) bool {
+	if agent.compatibility == NICE_COMPATIBILITY_GOOGLE {
+		/* the peer may check from a candidate we do not know yet, only
+		 * our part of the username can be checked */
+		for i := 0; i < len(component.local_candidates); i++ {
+			u := component.local_candidates[i].username
+			if u != "" && bytes.HasPrefix(username, []byte(u)) && len(username) > len(u) {
+				return true
+			}
+		}
+		return false
+	}
+	if agent.compatibility == NICE_COMPATIBILITY_MSN || agent.compatibility == NICE_COMPATIBILITY_OC2007 {
+		for i := 0; i < len(component.local_candidates); i++ {
+			u := component.local_candidates[i].username
+			if u != "" && bytes.HasPrefix(username, []byte(priv_decode_username(u) + ":")) {
+				return true
+			}
+		}
+		return false
+	}
+	return bytes.HasPrefix(username, []byte(stream.local_ufrag + ":"))
+}
+
 func peer_reflexive_candidate_priority(agent *NiceAgent, local_candidate *NiceCandidate) uint32  {
 	var candidate_priority *NiceCandidate = nice_candidate_new (NICE_CANDIDATE_TYPE_PEER_REFLEXIVE)
-	var priority uint32
 
 	candidate_priority.transport = local_candidate.transport
 	candidate_priority.component_id = local_candidate.component_id
 	candidate_priority.base_addr = local_candidate.addr
 
-	if agent.compatibility == NICE_COMPATIBILITY_GOOGLE {
-		priority = nice_candidate_jingle_priority (candidate_priority)
-	} else if agent.compatibility == NICE_COMPATIBILITY_MSN || agent.compatibility == NICE_COMPATIBILITY_OC2007 {
-		priority = nice_candidate_msn_priority (candidate_priority)
-	} else if agent.compatibility == NICE_COMPATIBILITY_OC2007R2 {
-		priority = nice_candidate_ms_ice_priority (candidate_priority, agent.reliable, false)
-	} else {
-		priority = nice_candidate_ice_priority (candidate_priority, agent.reliable, false)
-	}
-
-	return priority
+	return agent_candidate_priority(agent, candidate_priority, false)
 }
 
 
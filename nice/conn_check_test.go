@@ -0,0 +1,335 @@
+package nice
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func test_conn_check_pair(t *testing.T, agent *NiceAgent) (*NiceStream, *CandidateCheckPair) {
+	id := agent.Nice_agent_add_stream(1)
+	stream, _ := agent.agent_find_component(id, 1)
+	if stream == nil {
+		t.Fatal("no stream")
+	}
+	stream.local_ufrag = "lufr"
+	stream.local_password = "local-password-0123456"
+	stream.remote_ufrag = "rufr"
+	stream.remote_password = "remote-password-012345"
+
+	pair := &CandidateCheckPair{}
+	pair.stream_id = id
+	pair.component_id = 1
+	pair.local = nice_candidate_new(NICE_CANDIDATE_TYPE_HOST)
+	pair.remote = nice_candidate_new(NICE_CANDIDATE_TYPE_HOST)
+	pair.prflx_priority = 0x6e0001ff
+	return stream, pair
+}
+
+/*
+ * A check of the controlling agent carries PRIORITY, USE-CANDIDATE and
+ * ICE-CONTROLLING, signed with the remote password and fingerprinted.
+ */
+func TestConnCheckBuildRequest(t *testing.T) {
+	agent := NewNiceAgent()
+	agent.controlling_mode = true
+	agent.tie_breaker = 0x0102030405060708
+	stream, pair := test_conn_check_pair(t, agent)
+
+	msg := priv_conn_check_build_request(agent, stream, pair, true, false)
+	buf, err := stun_agent_finish_message_short_term(&stream.stun_agent, msg, priv_get_password(agent, stream, pair.remote, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := stun_message_find_attribute(buf, STUN_ATTRIBUTE_PRIORITY); len(v) != 4 || binary.BigEndian.Uint32(v) != pair.prflx_priority {
+		t.Fatalf("PRIORITY % x", v)
+	}
+	if v := stun_message_find_attribute(buf, STUN_ATTRIBUTE_USE_CANDIDATE); v == nil {
+		t.Fatal("no USE-CANDIDATE")
+	}
+	if v := stun_message_find_attribute(buf, STUN_ATTRIBUTE_ICE_CONTROLLING); len(v) != 8 || binary.BigEndian.Uint64(v) != agent.tie_breaker {
+		t.Fatalf("ICE-CONTROLLING % x", v)
+	}
+	if v := stun_message_find_attribute(buf, STUN_ATTRIBUTE_USERNAME); string(v) != "rufr:lufr" {
+		t.Fatalf("USERNAME %q", v)
+	}
+	if !stun_message_check_integrity(buf, []byte(stream.remote_password), false, true) {
+		t.Fatal("bad MESSAGE-INTEGRITY")
+	}
+	if stun_message_check_integrity(buf, []byte(stream.local_password), false, true) {
+		t.Fatal("MESSAGE-INTEGRITY checks with the wrong key")
+	}
+	if !stun_message_check_fingerprint(buf) {
+		t.Fatal("bad FINGERPRINT")
+	}
+}
+
+/* The controlled agent does not nominate, and says so in its checks */
+func TestConnCheckBuildRequestControlled(t *testing.T) {
+	agent := NewNiceAgent()
+	agent.controlling_mode = false
+	stream, pair := test_conn_check_pair(t, agent)
+
+	msg := priv_conn_check_build_request(agent, stream, pair, false, false)
+	buf, err := stun_agent_finish_message_short_term(&stream.stun_agent, msg, priv_get_password(agent, stream, pair.remote, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stun_message_find_attribute(buf, STUN_ATTRIBUTE_USE_CANDIDATE) != nil {
+		t.Fatal("USE-CANDIDATE from the controlled agent")
+	}
+	if stun_message_find_attribute(buf, STUN_ATTRIBUTE_ICE_CONTROLLING) != nil ||
+			stun_message_find_attribute(buf, STUN_ATTRIBUTE_ICE_CONTROLLED) == nil {
+		t.Fatal("the check does not carry ICE-CONTROLLED")
+	}
+}
+
+/* Google checks carry neither the ICE attributes nor MESSAGE-INTEGRITY */
+func TestConnCheckBuildRequestGoogle(t *testing.T) {
+	agent := NewNiceAgent()
+	agent.compatibility = NICE_COMPATIBILITY_GOOGLE
+	stream, pair := test_conn_check_pair(t, agent)
+	stun_agent_init(&stream.stun_agent, agent_to_stun_compatibility(agent), agent_to_stun_usage_flags(agent))
+
+	msg := priv_conn_check_build_request(agent, stream, pair, true, false)
+	buf, err := stun_agent_finish_message_short_term(&stream.stun_agent, msg, priv_get_password(agent, stream, pair.remote, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range []StunAttributeType{STUN_ATTRIBUTE_PRIORITY, STUN_ATTRIBUTE_USE_CANDIDATE, STUN_ATTRIBUTE_MESSAGE_INTEGRITY} {
+		if stun_message_find_attribute(buf, typ) != nil {
+			t.Fatalf("Google check with attribute %#04x", typ)
+		}
+	}
+}
+
+/* Two agents on the loopback, of one UDP component each, ready to check */
+func test_conn_check_agents(t *testing.T, controlling_a bool, controlling_b bool, opts ...AgentOption) (*Stream, *Stream) {
+	streams := make([]*Stream, 2)
+	for i, controlling := range []bool{controlling_a, controlling_b} {
+		a, err := NewAgent(append([]AgentOption{WithControlling(controlling), WithLocalAddresses("127.0.0.1"), WithIceTcp(false)}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { a.Close(context.Background()) })
+		s, err := a.AddStream(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		err = s.Gather(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams[i] = s
+	}
+
+	for i := 0; i < 2; i++ {
+		local, peer := streams[i], streams[1 - i]
+		ufrag, pwd, err := peer.LocalCredentials()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := local.SetRemoteCredentials(ufrag, pwd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		candidates, err := streams[1 - i].LocalCandidates()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := streams[i].Component(1).AddRemoteCandidates(candidates...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return streams[0], streams[1]
+}
+
+/* Waits until the component of @s is READY */
+func test_conn_check_wait_ready(t *testing.T, s *Stream) {
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Component(1).State() != NICE_COMPONENT_STATE_READY {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream %d still %s", s.ID(), Nice_component_state_to_string(s.Component(1).State()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/* The checks of the two agents select the same pair, and data flows */
+func TestConnCheckAgentsConnect(t *testing.T) {
+	a, b := test_conn_check_agents(t, true, false)
+	test_conn_check_wait_ready(t, a)
+	test_conn_check_wait_ready(t, b)
+
+	la, ra, err := a.Component(1).SelectedPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, rb, err := b.Component(1).SelectedPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if la.Port != rb.Port || ra.Port != lb.Port {
+		t.Fatalf("selected %d-%d and %d-%d", la.Port, ra.Port, lb.Port, rb.Port)
+	}
+
+	got := make(chan string, 1)
+	b.Component(1).OnReceive(func(buf []byte) {
+		select {
+		case got <- string(buf):
+		default:
+		}
+	})
+	if _, err := a.Component(1).Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-got:
+		if s != "hello" {
+			t.Fatalf("received %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+	}
+}
+
+/* Two controlling agents: the tie-breakers settle who switches */
+func TestConnCheckRoleConflict(t *testing.T) {
+	a, b := test_conn_check_agents(t, true, true)
+	test_conn_check_wait_ready(t, a)
+	test_conn_check_wait_ready(t, b)
+
+	na, nb := a.agent.agent, b.agent.agent
+	na.agent_mutex.Lock()
+	controlling_a, tie_breaker_a := na.controlling_mode, na.tie_breaker
+	na.agent_mutex.Unlock()
+	nb.agent_mutex.Lock()
+	controlling_b, tie_breaker_b := nb.controlling_mode, nb.tie_breaker
+	nb.agent_mutex.Unlock()
+	if controlling_a == controlling_b {
+		t.Fatal("both agents kept the same role")
+	}
+	if controlling_a != (tie_breaker_a > tie_breaker_b) {
+		t.Fatal("the agent of the smaller tie-breaker stayed controlling")
+	}
+}
+
+/* In regular nomination, a valid pair is checked again to be nominated */
+func TestConnCheckRegularNomination(t *testing.T) {
+	a, b := test_conn_check_agents(t, true, false, WithRegularNomination())
+	test_conn_check_wait_ready(t, a)
+	test_conn_check_wait_ready(t, b)
+}
+
+/* A check of the peer in the role @controlling, of tie-breaker @tie_breaker */
+func test_conn_check_role_request(t *testing.T, controlling bool, tie_breaker uint64) []byte {
+	msg := NewStunMessage(STUN_REQUEST, STUN_BINDING)
+	msg.messageHeader.transactionId = test_stun_transaction_id()
+	var typ StunAttributeType = STUN_ATTRIBUTE_ICE_CONTROLLED
+	if controlling {
+		typ = STUN_ATTRIBUTE_ICE_CONTROLLING
+	}
+	msg.AddAttr(StunAttr{header: StunAttrHeader{typ: typ}, value: &StunIceControlAttrValue{tie_breaker: tie_breaker}})
+	return test_stun_encode(t, msg)
+}
+
+/*
+ * Of two agents in the same role, the one of the larger tie-breaker is
+ * controlling (ICE sect 7.2.1.1 ID-19): it answers 487, or the other one
+ * switches.
+ */
+func TestConnCheckRoleConflictTieBreaker(t *testing.T) {
+	for _, c := range []struct {
+		controlling		bool
+		peer			uint64
+		answer			bool	/* the check is answered, not with 487 */
+		switched		bool
+	}{
+		{true, 100, false, false},
+		{true, 99, false, false},
+		{true, 101, true, true},
+		{false, 100, true, true},
+		{false, 99, true, true},
+		{false, 101, false, false},
+	} {
+		agent := NewNiceAgent()
+		agent.controlling_mode = c.controlling
+		agent.tie_breaker = 100
+		buf := test_conn_check_role_request(t, c.controlling, c.peer)
+		if answer := priv_conn_check_resolve_role_conflict(agent, buf); answer != c.answer {
+			t.Errorf("controlling %v, tie-breakers 100/%d: answered %v", c.controlling, c.peer, answer)
+		}
+		if switched := agent.controlling_mode != c.controlling; switched != c.switched {
+			t.Errorf("controlling %v, tie-breakers 100/%d: switched %v", c.controlling, c.peer, switched)
+		}
+	}
+}
+
+/*
+ * The answers of the peer to the consent checks renew the consent of the
+ * selected pair, a response with a wrong MESSAGE-INTEGRITY does not; an
+ * expired consent unselects the pair and fails the component.
+ */
+func TestConsentFreshnessRenewal(t *testing.T) {
+	a, b := test_conn_check_agents(t, true, false, WithConsentFreshness())
+	test_conn_check_wait_ready(t, a)
+	test_conn_check_wait_ready(t, b)
+
+	agent := a.agent.agent
+	agent.agent_mutex.Lock()
+	stream, component := agent.agent_find_component(a.ID(), 1)
+	expiring := agent.clock.Now().Add(-29 * time.Second)
+	component.selected_pair.keepalive.consent_received = expiring
+	priv_conn_consent_send(agent, stream, component)
+	checks := component.selected_pair.keepalive.consent_checks
+	forged := NewStunMessage(STUN_RESPONSE, STUN_BINDING)
+	forged.messageHeader.transactionId = checks[len(checks) - 1].messageHeader.transactionId
+	buf, err := stun_agent_finish_message_short_term(&stream.stun_agent, forged, []byte("wrongpasswordwrongpassword"))
+	if err != nil {
+		agent.agent_mutex.Unlock()
+		t.Fatal(err)
+	}
+	if !priv_conn_consent_handle_response(agent, stream, component, component.selected_pair.remote.addr, buf, buf) ||
+			!component.selected_pair.keepalive.consent_received.Equal(expiring) {
+		agent.agent_mutex.Unlock()
+		t.Fatal("consent renewed by a forged response")
+	}
+	agent.agent_mutex.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		agent.agent_mutex.Lock()
+		renewed := component.selected_pair.keepalive.consent_received.After(expiring)
+		agent.agent_mutex.Unlock()
+		if renewed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("consent not renewed by the peer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var lost []Event
+	agent.agent_mutex.Lock()
+	defer agent.agent_mutex.Unlock()
+	agent.event_hook = func(event Event) {
+		if _, ok := event.(ConsentLostEvent); ok {
+			lost = append(lost, event)
+		}
+	}
+	stats := component.selected_pair.stats
+	component.selected_pair.keepalive.consent_received = agent.clock.Now().Add(-NICE_AGENT_TIMER_CONSENT_TIMEOUT * time.Millisecond)
+	priv_conn_consent_tick_unlocked(agent)
+	if len(lost) != 1 || component.state != NICE_COMPONENT_STATE_FAILED || component.selected_pair.local != nil {
+		t.Fatalf("%d consent lost events, state %s", len(lost), Nice_component_state_to_string(component.state))
+	}
+	if stats.consent_expired.IsZero() {
+		t.Fatal("no consent expiry in the stats")
+	}
+}
@@ -0,0 +1,236 @@
+package nice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+/*
+ * The deadlines follow the clock of the agent, and a Read past its
+ * deadline still returns what was received before.
+ */
+func TestNiceConnDeadlineClock(t *testing.T) {
+	clock := &test_clock{now: time.Unix(1000, 0)}
+	agent := NewNiceAgent()
+	agent.SetClock(clock)
+	defer agent.Close(context.Background())
+	id := agent.Nice_agent_add_stream(1)
+	c, err := agent.Conn(id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := c.(*NiceConn)
+	buf := make([]byte, 16)
+
+	/* long past on the wall clock, ahead on the agent one */
+	conn.SetReadDeadline(clock.now.Add(time.Hour))
+	select {
+	case <-conn.read_deadline.wait():
+		t.Fatal("deadline passed on the wall clock")
+	default:
+	}
+
+	conn.nice_conn_recv_cb(agent, id, 1, []byte("hello"), nil)
+	conn.SetReadDeadline(clock.now.Add(-time.Second))
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("read of a received packet: %q, %v", buf[:n], err)
+	}
+	if _, err := conn.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past the deadline: %v", err)
+	}
+}
+
+/*
+ * Two pseudo TCP sockets in memory, the first one the connection of the
+ * component of @agent. test_pseudo_tcp_pump() delivers their packets.
+ */
+type test_pseudo_tcp_link struct {
+	client			*PseudoTcpSocket
+	server			*PseudoTcpSocket
+	to_client		[][]byte
+	to_server		[][]byte
+}
+
+func test_pseudo_tcp_pump(link *test_pseudo_tcp_link) {
+	for len(link.to_client) > 0 || len(link.to_server) > 0 {
+		to_client, to_server := link.to_client, link.to_server
+		link.to_client, link.to_server = nil, nil
+		for i := 0; i < len(to_server); i++ {
+			link.server.pseudo_tcp_socket_notify_packet(to_server[i])
+		}
+		for i := 0; i < len(to_client); i++ {
+			link.client.pseudo_tcp_socket_notify_packet(to_client[i])
+		}
+	}
+}
+
+/* A reliable Write waits for room in the send buffer, instead of a short write */
+func TestNiceConnReliableWriteBlocks(t *testing.T) {
+	agent := NewNiceAgent()
+	agent.reliable = true
+	defer agent.Close(context.Background())
+	id := agent.Nice_agent_add_stream(1)
+
+	agent.agent_mutex.Lock()
+	stream, component := agent.agent_find_component(id, 1)
+	link := &test_pseudo_tcp_link{}
+	link.client = pseudo_tcp_socket_new(0, &PseudoTcpCallbacks{
+		PseudoTcpWritable: func(tcp *PseudoTcpSocket, data interface{}) {
+			agent_signal_reliable_transport_writable(agent, id, 1)
+		},
+		WritePacket: func(tcp *PseudoTcpSocket, buf []byte, data interface{}) PseudoTcpWriteResult {
+			link.to_server = append(link.to_server, append([]byte{}, buf...))
+			return WR_SUCCESS
+		},
+	}, agent.clock)
+	link.server = pseudo_tcp_socket_new(0, &PseudoTcpCallbacks{
+		WritePacket: func(tcp *PseudoTcpSocket, buf []byte, data interface{}) PseudoTcpWriteResult {
+			link.to_client = append(link.to_client, append([]byte{}, buf...))
+			return WR_SUCCESS
+		},
+	}, agent.clock)
+	component.tcp = link.client
+	link.client.pseudo_tcp_socket_connect()
+	test_pseudo_tcp_pump(link)
+	size := 4 * link.client.pseudo_tcp_socket_get_available_send_space()
+	agent.agent_mutex.Unlock()
+
+	c, err := agent.Conn(id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	type result struct {
+		n				int
+		err				error
+	}
+	written := make(chan result, 1)
+	go func() {
+		n, err := c.Write(make([]byte, size))
+		written <- result{n, err}
+	}()
+
+	received := 0
+	buf := make([]byte, MAX_BUFFER_SIZE)
+	for {
+		select {
+		case r := <-written:
+			if r.err != nil || r.n != size {
+				t.Fatalf("wrote %d of %d: %v", r.n, size, r.err)
+			}
+			return
+		case <-time.After(5 * time.Millisecond):
+		}
+		agent.agent_mutex.Lock()
+		for {
+			n, err := link.server.pseudo_tcp_socket_recv(buf)
+			if err != nil || n <= 0 {
+				break
+			}
+			received += n
+		}
+		link.client.pseudo_tcp_socket_notify_clock()
+		link.server.pseudo_tcp_socket_notify_clock()
+		test_pseudo_tcp_pump(link)
+		adjust_tcp_clock(agent, stream, component)
+		agent.agent_mutex.Unlock()
+	}
+}
+
+/*
+ * A reliable Read loses nothing: more chunks than the packet queue holds,
+ * read back through a buffer smaller than each of them, arrive whole and
+ * in order.
+ */
+func TestNiceConnReliableReadSmallBuffer(t *testing.T) {
+	agent := NewNiceAgent()
+	agent.reliable = true
+	defer agent.Close(context.Background())
+	id := agent.Nice_agent_add_stream(1)
+
+	c, err := agent.Conn(id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.agent_mutex.Lock()
+	stream, component := agent.agent_find_component(id, 1)
+	link := &test_pseudo_tcp_link{}
+	link.client = pseudo_tcp_socket_new(0, &PseudoTcpCallbacks{
+		user_data: component,
+		PseudoTcpReadable: pseudo_tcp_socket_readable,
+		WritePacket: func(tcp *PseudoTcpSocket, buf []byte, data interface{}) PseudoTcpWriteResult {
+			link.to_server = append(link.to_server, append([]byte{}, buf...))
+			return WR_SUCCESS
+		},
+	}, agent.clock)
+	link.server = pseudo_tcp_socket_new(0, &PseudoTcpCallbacks{
+		WritePacket: func(tcp *PseudoTcpSocket, buf []byte, data interface{}) PseudoTcpWriteResult {
+			link.to_client = append(link.to_client, append([]byte{}, buf...))
+			return WR_SUCCESS
+		},
+	}, agent.clock)
+	component.tcp = link.client
+	link.client.pseudo_tcp_socket_connect()
+	test_pseudo_tcp_pump(link)
+	agent.agent_mutex.Unlock()
+
+	const chunks = 2 * NICE_CONN_RECV_QUEUE_LEN
+	data := make([]byte, chunks * 1000)
+	for i := 0; i < len(data); i++ {
+		data[i] = byte(i % 251)
+	}
+	read := make(chan error, 1)
+	go func() {
+		c.SetReadDeadline(time.Now().Add(10 * time.Second))
+		buf := make([]byte, 100)
+		received := 0
+		for received < len(data) {
+			n, err := c.Read(buf)
+			if err != nil {
+				read <- err
+				return
+			}
+			for i := 0; i < n; i++ {
+				if buf[i] != data[received + i] {
+					read <- fmt.Errorf("byte %d corrupted", received + i)
+					return
+				}
+			}
+			received += n
+		}
+		read <- nil
+	}()
+
+	sent := 0
+	for {
+		select {
+		case err := <-read:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		case <-time.After(time.Millisecond):
+		}
+		agent.agent_mutex.Lock()
+		for sent < len(data) {
+			end := sent + 1000
+			if end > len(data) {
+				end = len(data)
+			}
+			n, err := link.server.pseudo_tcp_socket_send(data[sent:end])
+			if err != nil || n <= 0 {
+				break
+			}
+			sent += n
+		}
+		link.client.pseudo_tcp_socket_notify_clock()
+		link.server.pseudo_tcp_socket_notify_clock()
+		test_pseudo_tcp_pump(link)
+		adjust_tcp_clock(agent, stream, component)
+		agent.agent_mutex.Unlock()
+	}
+}
@@ -9,10 +9,13 @@ const STUN_MESSAGE_TRANS_ID_LEN = 16
 const STUN_AGENT_MAX_SAVED_IDS 	= 	200
 
 const STUN_MESSAGE_TYPE_LEN 	= 	2
+const STUN_MESSAGE_HEADER_LENGTH = 20
 
 const STUN_MAGIC_COOKIE 		= 0x2112A442
 const STUN_MAGIC_COOKIE_LEN		= 4
 const STUN_MAX_MESSAGE_SIZE_IPV6 = 1280
 
 const NICE_STREAM_DEF_UFRAG		= 4 + 1
-const NICE_STREAM_DEF_PWD     	= 22 + 1   /* pwd + NULL */
\ No newline at end of file
+const NICE_STREAM_DEF_PWD     	= 22 + 1   /* pwd + NULL */
+const NICE_STREAM_MAX_UFRAG		= 256 + 1  /* ufrag + NULL */
+const NICE_STREAM_MAX_PWD		= 256 + 1  /* pwd + NULL */
\ No newline at end of file
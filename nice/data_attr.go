@@ -0,0 +1,20 @@
+package nice
+
+/* The DATA of the TURN Send and Data indications (RFC 5766 section 14.4) */
+type StunDataAttrValue struct {
+	data			[]byte
+}
+
+func (this StunDataAttrValue) Encode(stream *DataStream) error {
+	stream.WriteBytes(this.data)
+	return nil
+}
+
+func (this *StunDataAttrValue) Decode(stream *DataStream) error {
+	this.data = stream.ReadLeftBytes()
+	return nil
+}
+
+func (this StunDataAttrValue) GetSize() uint16 {
+	return uint16(len(this.data))
+}
@@ -1,8 +1,8 @@
 package nice
 
 import (
+	"bytes"
 	"encoding/base64"
-	"fmt"
 )
 
 type HostCandidateResult int
@@ -12,8 +12,12 @@ const (
 	HOST_CANDIDATE_FAILED
 	HOST_CANDIDATE_CANT_CREATE_SOCKET
 	HOST_CANDIDATE_REDUNDANT
+	HOST_CANDIDATE_UFRAG_IN_USE
 )
 
+/* Number of ufrags tried for a stream whose ufrag is in use on a mux */
+const NICE_AGENT_MUX_UFRAG_ATTEMPTS = 8
+
 type CandidateDiscovery struct {
 	typ 				NiceCandidateType
 	nicesock			NiceSockInterface
@@ -30,12 +34,329 @@ type CandidateDiscovery struct {
 	stun_message 		*StunMessage
 	stun_resp_buffer 	[]byte
 	stun_resp_message	*StunMessage
+	detect_flavour		bool	/* the server may only speak RFC 3489 */
+	connecting			bool	/* to a TCP relay, see priv_discovery_turn_connect() */
+	creds				*StunLongTermCredentials	/* nil if the server wants none */
+	auth_retries		int
+	ms_connection_id	[]byte		/* MS-SEQUENCE-NUMBER of the MS-TURN Allocate */
+	ms_sequence_num		uint32
 }
 
 func NewCandidateDiscovery() *CandidateDiscovery {
 	return &CandidateDiscovery{}
 }
 
+/*
+ * The TURN allocation of a relayed candidate, refreshed before its LIFETIME
+ * runs out until the stream is removed, and then released with a Refresh
+ * of lifetime 0.
+ */
+type CandidateRefresh struct {
+	nicesock			NiceSockInterface
+	server				NiceAddress	/* TURN server address */
+	stream_id			uint
+	component_id		uint
+	candidate			*NiceCandidate	/* the relayed candidate */
+	turn				*TurnServer
+	stun_agent			StunAgent
+	timer				StunTimer
+	stun_buffer			[]byte
+	stun_message		*StunMessage
+	tick_source			*NiceTimer	/* retransmissions of the Refresh */
+	timer_source		*NiceTimer	/* the next Refresh */
+	disposing			bool
+	destroy_cb			func()
+	ms_connection_id	[]byte		/* MS-SEQUENCE-NUMBER of the MS-TURN allocation, from its Allocate */
+	ms_sequence_num		uint32
+	creds				*StunLongTermCredentials	/* those of the Allocate */
+	auth_retries		int
+}
+
+/*
+ * Removes the candidate discoveries of stream 'stream_id' which are
+ * still running.
+ */
+func discovery_prune_stream(agent *NiceAgent, stream_id uint) {
+	list := agent.discovery_list[:0]
+	for i := 0; i < len(agent.discovery_list); i++ {
+		cand := agent.discovery_list[i]
+		if cand.stream_id == stream_id {
+			if !cand.pending && !cand.connecting && agent.discovery_unsched_items > 0 {
+				agent.discovery_unsched_items--
+			}
+			continue
+		}
+		list = append(list, cand)
+	}
+	for i := len(list); i < len(agent.discovery_list); i++ {
+		agent.discovery_list[i] = nil
+	}
+	agent.discovery_list = list
+
+	if len(agent.discovery_list) == 0 {
+		agent_timeout_remove(&agent.discovery_timer_source)
+	}
+}
+
+/*
+ * Releases the TURN allocations of stream 'stream' with a Refresh of
+ * lifetime 0 (RFC 5766 section 7), and calls 'function' once the server
+ * answered or the Refreshes timed out, with the agent lock held.
+ */
+func refresh_prune_stream_async(agent *NiceAgent, stream *NiceStream, function func()) {
+	var pruned []*CandidateRefresh
+	for i := 0; i < len(agent.refresh_list); i++ {
+		cand := agent.refresh_list[i]
+		if cand.stream_id == stream.id && !cand.disposing {
+			pruned = append(pruned, cand)
+		}
+	}
+	refresh_prune_async(agent, pruned, function)
+}
+
+/*
+ * Releases all the TURN allocations of the agent, see
+ * refresh_prune_stream_async().
+ */
+func refresh_prune_agent_async(agent *NiceAgent, function func()) {
+	var pruned []*CandidateRefresh
+	for i := 0; i < len(agent.refresh_list); i++ {
+		if !agent.refresh_list[i].disposing {
+			pruned = append(pruned, agent.refresh_list[i])
+		}
+	}
+	refresh_prune_async(agent, pruned, function)
+}
+
+func refresh_prune_async(agent *NiceAgent, refreshes []*CandidateRefresh, function func()) {
+	if len(refreshes) == 0 {
+		function()
+		return
+	}
+
+	remaining := len(refreshes)
+	on_refresh_removed := func() {
+		remaining--
+		if remaining == 0 {
+			function()
+		}
+	}
+	for i := 0; i < len(refreshes); i++ {
+		refreshes[i].destroy_cb = on_refresh_removed
+		refresh_release(agent, refreshes[i])
+	}
+}
+
+/*
+ * The default LIFETIME of the TURN allocations (RFC 5766 section 2.2), in
+ * seconds, and how long before it runs out they are refreshed.
+ */
+const (
+	NICE_TURN_DEFAULT_LIFETIME = 600
+	NICE_TURN_REFRESH_MARGIN = 60
+)
+
+/*
+ * Refreshes the allocation of 'cand' once 'lifetime' seconds, less a
+ * margin, have passed.
+ */
+func refresh_schedule(agent *NiceAgent, cand *CandidateRefresh, lifetime uint32) {
+	delay := lifetime / 2
+	if lifetime > 2 * NICE_TURN_REFRESH_MARGIN {
+		delay = lifetime - NICE_TURN_REFRESH_MARGIN
+	}
+	agent_timeout_add(agent, &cand.timer_source, uint(delay) * 1000, func(agent *NiceAgent) bool {
+		cand.auth_retries = 0
+		priv_refresh_send_request(agent, cand)
+		return false
+	})
+}
+
+/*
+ * Sends the Refresh of lifetime 0 of 'cand', retransmitted until it is
+ * answered or times out.
+ */
+func refresh_release(agent *NiceAgent, cand *CandidateRefresh) {
+	cand.disposing = true
+	agent_timeout_remove(&cand.timer_source)
+	priv_refresh_send_request(agent, cand)
+}
+
+/*
+ * Sends the Refresh of 'cand', of lifetime 0 once it is disposing, of the
+ * default lifetime of the server before.
+ */
+func priv_refresh_send_request(agent *NiceAgent, cand *CandidateRefresh) {
+	ms_turn := agent.compatibility == NICE_COMPATIBILITY_OC2007 || agent.compatibility == NICE_COMPATIBILITY_OC2007R2
+	var method StunMethod = STUN_REFRESH
+	if ms_turn {
+		/* MS-TURN has no Refresh, an Allocate of lifetime 0 releases */
+		method = STUN_ALLOCATE
+	}
+	msg := NewStunMessage(STUN_REQUEST, method)
+	msg.messageHeader.transactionId = agent.rng.rng_generate_transaction_id()
+	stun_agent_prepare_message(&cand.stun_agent, msg)
+	if ms_turn {
+		/* no magic cookie in MS-TURN */
+		msg.magicCookie = nil
+		msg.AddAttr(StunAttr{
+			header: StunAttrHeader{typ: STUN_ATTRIBUTE_MS_VERSION},
+			value:  &StunMsVersionAttrValue{version: STUN_MS_TURN_VERSION},
+		})
+	}
+	if cand.disposing {
+		msg.AddAttr(StunAttr{
+			header: StunAttrHeader{typ: STUN_ATTRIBUTE_LIFETIME},
+			value:  &StunLifetimeAttrValue{lifetime: 0},
+		})
+	}
+	if cand.turn != nil && cand.turn.username != "" && !stun_agent_uses_long_term_credentials(&cand.stun_agent, cand.creds) {
+		/* the long-term credentials carry their own USERNAME */
+		msg.AddAttr(StunAttr{
+			header: StunAttrHeader{typ: STUN_ATTRIBUTE_USERNAME},
+			value:  &StunUsernameAttrValue{username: cand.turn.username},
+		})
+	}
+	if ms_turn && cand.ms_connection_id != nil {
+		/* the connection of the Allocate goes on */
+		cand.ms_sequence_num++
+		msg.AddAttr(StunAttr{
+			header: StunAttrHeader{typ: STUN_ATTRIBUTE_MS_SEQUENCE_NUMBER},
+			value:  &StunMsSequenceNumberAttrValue{connection_id: cand.ms_connection_id, sequence_number: cand.ms_sequence_num},
+		})
+	}
+
+	buf, err := stun_agent_finish_message(&cand.stun_agent, msg, cand.creds)
+	if err != nil {
+		refresh_free(agent, cand)
+		return
+	}
+	cand.stun_message = msg
+	cand.stun_buffer = buf
+
+	if cand.nicesock.is_reliable() {
+		stun_timer_start_reliable(&cand.timer, agent.clock, agent.stun_reliable_timeout)
+	} else {
+		stun_timer_start(&cand.timer, agent.clock, agent.stun_initial_timeout, agent.stun_max_retransmissions)
+	}
+	if !priv_refresh_send(agent, cand) {
+		refresh_free(agent, cand)
+		return
+	}
+	agent_timeout_add(agent, &cand.tick_source, stun_timer_remainder(&cand.timer), func(agent *NiceAgent) bool {
+		return priv_refresh_tick_unlocked(agent, cand)
+	})
+}
+
+func priv_refresh_send(agent *NiceAgent, cand *CandidateRefresh) bool {
+	nice_log_stun(nice_agent_log(agent, NICE_LOG_TURN), "sending TURN refresh", cand.stream_id, cand.component_id, cand.server, cand.stun_buffer)
+	out := &NiceOutputMessage{buffers: [][]byte{cand.stun_buffer}}
+	if err := cand.nicesock.send_messages(&cand.server, []*NiceOutputMessage{out}); err != nil {
+		nice_component_log(agent, NICE_LOG_SOCKET, cand.stream_id, cand.component_id).Warn("could not send the TURN refresh",
+			"server", nice_address_to_string(cand.server), "error", err)
+		return false
+	}
+	return true
+}
+
+func priv_refresh_tick_unlocked(agent *NiceAgent, cand *CandidateRefresh) bool {
+	switch stun_timer_refresh(&cand.timer) {
+	case STUN_USAGE_TIMER_RETURN_TIMEOUT:
+		/* the server is gone, the allocation expires on its own */
+		if cand.disposing {
+			nice_component_log(agent, NICE_LOG_TURN, cand.stream_id, cand.component_id).Debug("TURN release timed out",
+				"server", nice_address_to_string(cand.server))
+		} else {
+			nice_component_log(agent, NICE_LOG_TURN, cand.stream_id, cand.component_id).Warn("TURN refresh timed out",
+				"server", nice_address_to_string(cand.server))
+			agent.metrics.TurnAllocationError()
+		}
+		refresh_free(agent, cand)
+		return false
+	case STUN_USAGE_TIMER_RETURN_RETRANSMIT:
+		agent.metrics.StunRetransmission()
+		if !priv_refresh_send(agent, cand) {
+			refresh_free(agent, cand)
+			return false
+		}
+	}
+	/* run again when the timer is due */
+	agent_timeout_add(agent, &cand.tick_source, stun_timer_remainder(&cand.timer), func(agent *NiceAgent) bool {
+		return priv_refresh_tick_unlocked(agent, cand)
+	})
+	return true
+}
+
+/*
+ * Matches a STUN response to a pending Refresh, sent again if the server
+ * asks for it with a new NONCE. A Refresh of lifetime 0 is then done; the
+ * others schedule the next one from the LIFETIME granted. See
+ * agent_recv_stun() for @raw.
+ *
+ * @return TRUE if the message was a Refresh response
+ */
+func refresh_handle_inbound_stun(agent *NiceAgent, buf []byte, raw []byte) bool {
+	if len(buf) < STUN_MESSAGE_HEADER_LENGTH || !stun_message_is_response(buf) {
+		return false
+	}
+	/* the magic cookie takes the first bytes of the transaction id */
+	tid := buf[4 + STUN_MAGIC_COOKIE_LEN:STUN_MESSAGE_HEADER_LENGTH]
+	for i := 0; i < len(agent.refresh_list); i++ {
+		cand := agent.refresh_list[i]
+		if cand.stun_message == nil || cand.tick_source == nil ||
+			!bytes.Equal((*cand.stun_message.messageHeader.transactionId)[STUN_MAGIC_COOKIE_LEN:], tid) {
+			continue
+		}
+		log := nice_component_log(agent, NICE_LOG_TURN, cand.stream_id, cand.component_id)
+		if !stun_agent_check_response(&cand.stun_agent, raw) {
+			log.Warn("TURN refresh response with a wrong MESSAGE-INTEGRITY", "server", nice_address_to_string(cand.server))
+			agent.metrics.StunAuthFailure()
+			return true
+		}
+		agent_timeout_remove(&cand.tick_source)
+
+		code := stun_message_get_error_code(buf)
+		if cand.auth_retries < NICE_DISCOVERY_MAX_AUTH_RETRIES &&
+			stun_agent_update_long_term_credentials(&cand.stun_agent, cand.creds, buf, stun_message_has_integrity(cand.stun_message)) {
+			cand.auth_retries++
+			priv_refresh_send_request(agent, cand)
+			return true
+		}
+		if cand.disposing {
+			refresh_free(agent, cand)
+			return true
+		}
+		if code >= 0 {
+			log.Warn("TURN refresh rejected", "server", nice_address_to_string(cand.server), "code", code)
+			agent.metrics.TurnAllocationError()
+			refresh_free(agent, cand)
+			return true
+		}
+		refresh_schedule(agent, cand, stun_message_get_lifetime(buf))
+		return true
+	}
+	return false
+}
+
+/*
+ * Forgets 'cand' and signals its removal to whoever released it.
+ */
+func refresh_free(agent *NiceAgent, cand *CandidateRefresh) {
+	agent_timeout_remove(&cand.tick_source)
+	agent_timeout_remove(&cand.timer_source)
+	for i := 0; i < len(agent.refresh_list); i++ {
+		if agent.refresh_list[i] == cand {
+			agent.refresh_list = append(agent.refresh_list[:i], agent.refresh_list[i + 1:]...)
+			break
+		}
+	}
+	if cand.destroy_cb != nil {
+		destroy_cb := cand.destroy_cb
+		cand.destroy_cb = nil
+		destroy_cb()
+	}
+}
+
 func (this *NiceAgent)discovery_add_local_host_candidate(
 										stream_id uint,
 										component_id uint,
@@ -49,40 +370,143 @@ func (this *NiceAgent)discovery_add_local_host_candidate(
 	candidate := nice_candidate_new(NICE_CANDIDATE_TYPE_HOST)
 	candidate.transport = transport
 	candidate.stream_id = stream_id
+	candidate.component_id = component_id
 	candidate.addr = address
 	candidate.base_addr = address
 
-	if this.compatibility == NICE_COMPATIBILITY_GOOGLE {
-		candidate.priority = nice_candidate_jingle_priority(candidate)
-	} else if this.compatibility == NICE_COMPATIBILITY_MSN || this.compatibility == NICE_COMPATIBILITY_OC2007 {
-		candidate.priority = nice_candidate_msn_priority(candidate)
-	} else if this.compatibility == NICE_COMPATIBILITY_OC2007R2 {
-		candidate.priority = nice_candidate_ms_ice_priority(candidate, this.reliable, false)
-	} else {
-		candidate.priority = nice_candidate_ice_priority(candidate, this.reliable, false)
-	}
+	candidate.priority = agent_candidate_priority(this, candidate, false)
 
 	candidate.priority = ensure_unique_priority(s, c, candidate.priority)
 	this.priv_generate_candidate_credentials(candidate)
 	priv_assign_foundation(this, candidate)
 
 	var nicesock NiceSockInterface
-	if transport == NICE_CANDIDATE_TRANSPORT_UDP {
-		nicesock = nice_udp_bsd_socket_new(address)
-		if nicesock == nil {
-			fmt.Println("nice_udp_bsd_socket_new failed")
-			return nil, HOST_CANDIDATE_FAILED
+	switch transport {
+	case NICE_CANDIDATE_TRANSPORT_UDP:
+		if this.udp_mux != nil {
+			var muxsock *UdpMuxSocket
+			err := priv_mux_socket_new(this, s, candidate, func(ufrag string) error {
+				var err error
+				muxsock, err = this.udp_mux.nice_udp_mux_socket_new(address, ufrag, s, c.id, this.clock,
+					stun_timer_transaction_timeout(this.stun_initial_timeout, this.stun_max_retransmissions))
+				return err
+			})
+			if err == ErrUfragInUse {
+				return nil, HOST_CANDIDATE_UFRAG_IN_USE
+			}
+			if err != nil {
+				return nil, HOST_CANDIDATE_CANT_CREATE_SOCKET
+			}
+			nicesock = muxsock
+			address.port = muxsock.local_addr.port
+			break
 		}
-	} else {
+		udpsock := nice_udp_bsd_socket_new(address)
+		if udpsock == nil {
+			return nil, HOST_CANDIDATE_CANT_CREATE_SOCKET
+		}
+		nicesock = udpsock
+		address.port = udpsock.local_addr.port
+	case NICE_CANDIDATE_TRANSPORT_TCP_ACTIVE:
+		/* the connection is only created when a check is sent on a pair,
+		 * see conn_check_get_pair_socket() */
+		nicesock = nice_tcp_active_socket_new(address)
+	case NICE_CANDIDATE_TRANSPORT_TCP_PASSIVE:
+		if this.tcp_mux != nil {
+			var muxsock *TcpMuxSocket
+			err := priv_mux_socket_new(this, s, candidate, func(ufrag string) error {
+				var err error
+				muxsock, err = this.tcp_mux.nice_tcp_mux_socket_new(address, ufrag, s, c.id, priv_get_password(this, s, candidate, true), &s.stun_agent)
+				return err
+			})
+			if err == ErrUfragInUse {
+				return nil, HOST_CANDIDATE_UFRAG_IN_USE
+			}
+			if err != nil {
+				return nil, HOST_CANDIDATE_CANT_CREATE_SOCKET
+			}
+			nicesock = muxsock
+			address.port = muxsock.local_addr.port
+			break
+		}
+		tcpsock := nice_tcp_passive_socket_new(address)
+		if tcpsock == nil {
+			return nil, HOST_CANDIDATE_CANT_CREATE_SOCKET
+		}
+		nicesock = tcpsock
+		address.port = tcpsock.local_addr.port
+	case NICE_CANDIDATE_TRANSPORT_TCP_SO:
+		tcpsock := nice_tcp_so_socket_new(address)
+		if tcpsock == nil {
+			return nil, HOST_CANDIDATE_CANT_CREATE_SOCKET
+		}
+		nicesock = tcpsock
+		address.port = tcpsock.local_addr.port
+	default:
 		return nil, HOST_CANDIDATE_FAILED
 	}
 
 	candidate.sockptr = nicesock
 	candidate.addr = address
 	candidate.base_addr = address
+
+	if !priv_add_local_candidate_pruned(this, stream_id, c, candidate) {
+		nicesock.close()
+		return nil, HOST_CANDIDATE_REDUNDANT
+	}
+	c.nice_component_attach_socket(nicesock)
 	return candidate, HOST_CANDIDATE_SUCCESS
 }
 
+/*
+ * Creates the socket of @candidate, of @stream, on a mux with @create,
+ * given the local ufrag which identifies its packets there: that of the
+ * candidate in the dialects which have one, of the stream otherwise.
+ * When another stream uses it on the mux, a new one is generated unless
+ * it was set by nice_agent_set_local_credentials() or the sockets of the
+ * stream on a mux already use it.
+ *
+ * Returns: the error of @create, ErrUfragInUse if no free ufrag was found
+ */
+func priv_mux_socket_new(agent *NiceAgent, stream *NiceStream, candidate *NiceCandidate, create func(ufrag string) error) error {
+	for i := 1; ; i++ {
+		ufrag := stream.local_ufrag
+		switch agent.compatibility {
+		case NICE_COMPATIBILITY_GOOGLE:
+			ufrag = candidate.username
+		case NICE_COMPATIBILITY_MSN, NICE_COMPATIBILITY_OC2007:
+			ufrag = priv_decode_username(candidate.username)
+		}
+		err := create(ufrag)
+		if err != ErrUfragInUse || i == NICE_AGENT_MUX_UFRAG_ATTEMPTS {
+			return err
+		}
+
+		if candidate.username != "" {
+			agent.priv_generate_candidate_credentials(candidate)
+		} else if stream.local_credentials_set || priv_stream_on_mux(stream) {
+			return err
+		} else {
+			stream.local_ufrag = string(agent.rng.nice_rng_generate_bytes_print(NICE_STREAM_DEF_UFRAG - 1))
+		}
+		nice_agent_log(agent, NICE_LOG_DISCOVERY).Debug("ufrag in use on the mux, trying another one", "stream", stream.id)
+	}
+}
+
+/* Whether a local candidate of @stream has its socket on a mux */
+func priv_stream_on_mux(stream *NiceStream) bool {
+	for i := 0; i < len(stream.components); i++ {
+		component := stream.components[i]
+		for j := 0; j < len(component.local_candidates); j++ {
+			switch component.local_candidates[j].sockptr.(type) {
+			case *UdpMuxSocket, *TcpMuxSocket:
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (this *NiceAgent) priv_generate_candidate_credentials (candidate *NiceCandidate) {
 	if (this.compatibility == NICE_COMPATIBILITY_MSN || this.compatibility == NICE_COMPATIBILITY_OC2007) {
 		username := this.rng.rng_generate_bytes(32)
@@ -126,18 +550,13 @@ func priv_add_local_candidate_pruned(agent *NiceAgent, stream_id uint, component
 
 func discovery_schedule(agent *NiceAgent)  {
 	if agent.discovery_unsched_items > 0 {
-		var res bool = false
-		if agent.timer == nil {
+		if agent.discovery_timer_source == nil {
 			/* step: run first iteration immediately */
-			res = priv_discovery_tick_unlocked(agent)
-			_ = res
+			res := priv_discovery_tick_unlocked(agent)
+			if res {
+				agent_timeout_add(agent, &agent.discovery_timer_source, agent.timer_ta, priv_discovery_tick_unlocked)
+			}
 		}
-		// todo
-		//if res {
-		//	agent_timeout_add_with_context (agent, &agent->discovery_timer_source,
-		//		"Candidate discovery tick", agent->timer_ta,
-		//		priv_discovery_tick_agent_locked, NULL);
-		//}
 	}
 }
 
@@ -146,37 +565,451 @@ func discovery_schedule(agent *NiceAgent)  {
  * processes (paced by the Ta timer), and handles running of the
  * existing discovery processes.
  *
- * This function is designed for the g_timeout_add() interface.
+ * This function is designed for the agent_timeout_add() interface.
  *
  * @return will return FALSE when no more pending timers.
 */
 func priv_discovery_tick_unlocked(agent *NiceAgent) bool {
 	var not_done bool = false
-	var buffer_len uint32 = 0
+	var need_pacing bool = false
 
-	for i := len(agent.discovery_list) - 1; i >= 0; i-- {
+	for i := 0; i < len(agent.discovery_list); i++ {
 		cand := agent.discovery_list[i]
-		if !cand.pending {
-			cand.pending = true
-		}
 
-		if agent.discovery_unsched_items > 0 {
-			agent.discovery_unsched_items--
+		if cand.connecting {
+			/* scheduled once connected */
+			not_done = true
+			continue
 		}
 
-		if cand.typ == NICE_CANDIDATE_TYPE_SERVER_REFLEXIVE || cand.typ == NICE_CANDIDATE_TYPE_RELAYED {
+		if !cand.pending && !need_pacing {
+			cand.pending = true
+			need_pacing = true
+
+			if agent.discovery_unsched_items > 0 {
+				agent.discovery_unsched_items--
+			}
+
 			s, c := agent.agent_find_component(cand.stream_id, cand.component_id)
 			if s != nil && c != nil {
 				if c.state == NICE_COMPONENT_STATE_DISCONNECTED || c.state == NICE_COMPONENT_STATE_FAILED {
 					agent_signal_component_state_change(agent, cand.stream_id, cand.component_id, NICE_COMPONENT_STATE_GATHERING)
 				}
+			}
 
-				if cand.typ == NICE_CANDIDATE_TYPE_SERVER_REFLEXIVE {
-
+			if !priv_discovery_send_request(agent, cand) {
+				cand.done = true
+			}
+		} else if cand.pending && !cand.done {
+			switch stun_timer_refresh(&cand.timer) {
+			case STUN_USAGE_TIMER_RETURN_TIMEOUT:
+				if cand.detect_flavour && cand.stun_agent.compatibility != STUN_COMPATIBILITY_RFC3489 {
+					/* some classic servers drop the requests with a
+					 * magic cookie, try once more without */
+					nice_component_log(agent, NICE_LOG_DISCOVERY, cand.stream_id, cand.component_id).Debug("no answer from the STUN server, retrying with RFC 3489",
+						"server", nice_address_to_string(cand.server))
+					cand.stun_agent.compatibility = STUN_COMPATIBILITY_RFC3489
+					if !priv_discovery_send_request(agent, cand) {
+						cand.done = true
+					}
+					break
+				}
+				nice_component_log(agent, priv_discovery_log_subsystem(cand), cand.stream_id, cand.component_id).Warn("no answer from the server",
+					"server", nice_address_to_string(cand.server))
+				if cand.typ == NICE_CANDIDATE_TYPE_RELAYED {
+					agent.metrics.TurnAllocationError()
+				}
+				cand.done = true
+			case STUN_USAGE_TIMER_RETURN_RETRANSMIT:
+				agent.metrics.StunRetransmission()
+				if !priv_discovery_send(agent, cand) {
+					cand.done = true
 				}
 			}
 		}
 
+		if !cand.done {
+			not_done = true
+		}
+	}
+
+	if !not_done {
+		agent_gathering_done(agent)
+		return false
+	}
+	return true
+}
+
+/*
+ * The retransmissions of the RFC 5389 Binding request to a server of
+ * unknown flavour, before trying RFC 3489 instead. RFC 5389 servers answer
+ * both flavours.
+ */
+const NICE_DISCOVERY_DETECT_RETRANSMISSIONS = 2
+
+/*
+ * The requests sent again with the REALM and NONCE of a 401 or 438 error,
+ * so that a server changing its NONCE on every request cannot loop.
+ */
+const NICE_DISCOVERY_MAX_AUTH_RETRIES = 3
+
+func priv_discovery_log_subsystem(cand *CandidateDiscovery) NiceLogSubsystem {
+	if cand.typ == NICE_CANDIDATE_TYPE_RELAYED {
+		return NICE_LOG_TURN
+	}
+	return NICE_LOG_DISCOVERY
+}
+
+/*
+ * Sends a new request to the server of @cand, in the flavour of its
+ * StunAgent: a Binding for a server reflexive candidate, in RFC 5389 or
+ * in RFC 3489 whose 128 bits of transaction id are all random, with no
+ * magic cookie; an Allocate for a relayed one, in RFC 5766, MS-TURN or
+ * the dialect of the Google relays. Once the server challenged the
+ * credentials of @cand, they go with the request.
+ *
+ * @return FALSE if it could not be sent
+ */
+func priv_discovery_send_request(agent *NiceAgent, cand *CandidateDiscovery) bool {
+	var method StunMethod = STUN_BINDING
+	if cand.typ == NICE_CANDIDATE_TYPE_RELAYED {
+		method = STUN_ALLOCATE
+	}
+	msg := NewStunMessage(STUN_REQUEST, method)
+	msg.messageHeader.transactionId = agent.rng.rng_generate_transaction_id()
+	stun_agent_prepare_message(&cand.stun_agent, msg)
+	switch cand.stun_agent.compatibility {
+	case STUN_COMPATIBILITY_RFC3489:
+		msg.magicCookie = nil
+		if method == STUN_ALLOCATE {
+			/* the Google relays: the MAGIC-COOKIE of the early TURN
+			 * drafts, and the USERNAME of the relay session */
+			msg.AddAttr(StunAttr{
+				header: StunAttrHeader{typ: STUN_ATTRIBUTE_MAGIC_COOKIE},
+				value:  &StunTurnMagicCookieAttrValue{cookie: STUN_TURN_MAGIC_COOKIE},
+			})
+			msg.AddAttr(StunAttr{
+				header: StunAttrHeader{typ: STUN_ATTRIBUTE_USERNAME},
+				value:  &StunUsernameAttrValue{username: cand.turn.username},
+			})
+			break
+		}
+		/* as the classic clients do, ask for the answer from the
+		 * address and port the request was sent to */
+		msg.AddAttr(StunAttr{
+			header: StunAttrHeader{typ: STUN_ATTRIBUTE_CHANGE_REQUEST},
+			value:  &StunChangeRequestAttrValue{flags: 0},
+		})
+	case STUN_COMPATIBILITY_OC2007:
+		/* no magic cookie in MS-TURN */
+		msg.magicCookie = nil
+		msg.AddAttr(StunAttr{
+			header: StunAttrHeader{typ: STUN_ATTRIBUTE_MS_VERSION},
+			value:  &StunMsVersionAttrValue{version: STUN_MS_TURN_VERSION},
+		})
+		if method == STUN_ALLOCATE {
+			/* the connection of the allocation, numbered by each of
+			 * its requests, the Refreshes included */
+			if cand.ms_connection_id == nil {
+				cand.ms_connection_id = agent.rng.rng_generate_bytes(STUN_MS_CONNECTION_ID_LEN)
+			}
+			cand.ms_sequence_num++
+			msg.AddAttr(StunAttr{
+				header: StunAttrHeader{typ: STUN_ATTRIBUTE_MS_SEQUENCE_NUMBER},
+				value:  &StunMsSequenceNumberAttrValue{connection_id: cand.ms_connection_id, sequence_number: cand.ms_sequence_num},
+			})
+		}
+	default:
+		if method == STUN_ALLOCATE {
+			msg.AddAttr(StunAttr{
+				header: StunAttrHeader{typ: STUN_ATTRIBUTE_REQUESTED_TRANSPORT},
+				value:  &StunRequestedTransportAttrValue{protocol: STUN_REQUESTED_TRANSPORT_UDP},
+			})
+		}
+	}
+
+	buf, err := stun_agent_finish_message(&cand.stun_agent, msg, cand.creds)
+	if err != nil {
+		return false
+	}
+	cand.stun_message = msg
+	cand.stun_buffer = buf
+
+	max_retransmissions := agent.stun_max_retransmissions
+	if cand.detect_flavour && cand.stun_agent.compatibility != STUN_COMPATIBILITY_RFC3489 &&
+		max_retransmissions > NICE_DISCOVERY_DETECT_RETRANSMISSIONS {
+		max_retransmissions = NICE_DISCOVERY_DETECT_RETRANSMISSIONS
+	}
+	if cand.nicesock.is_reliable() {
+		stun_timer_start_reliable(&cand.timer, agent.clock, agent.stun_reliable_timeout)
+	} else {
+		stun_timer_start(&cand.timer, agent.clock, agent.stun_initial_timeout, max_retransmissions)
+	}
+	return priv_discovery_send(agent, cand)
+}
+
+func priv_discovery_send(agent *NiceAgent, cand *CandidateDiscovery) bool {
+	nice_log_stun(nice_agent_log(agent, priv_discovery_log_subsystem(cand)), "sending STUN request", cand.stream_id, cand.component_id, cand.server, cand.stun_buffer)
+	out := &NiceOutputMessage{buffers: [][]byte{cand.stun_buffer}}
+	if err := cand.nicesock.send_messages(&cand.server, []*NiceOutputMessage{out}); err != nil {
+		nice_component_log(agent, NICE_LOG_SOCKET, cand.stream_id, cand.component_id).Warn("could not send the STUN request",
+			"server", nice_address_to_string(cand.server), "error", err)
+		return false
+	}
+	return true
+}
+
+/*
+ * Whether a discovery, or a release, of @component_id waits for the
+ * answer of a server whose StunAgent is matched by @match.
+ */
+func discovery_find_stun_agent(agent *NiceAgent, stream_id uint, component_id uint, match func(stun_agent *StunAgent) bool) bool {
+	for i := 0; i < len(agent.discovery_list); i++ {
+		cand := agent.discovery_list[i]
+		if cand.stream_id == stream_id && cand.component_id == component_id &&
+			cand.pending && !cand.done && match(&cand.stun_agent) {
+			return true
+		}
+	}
+	for i := 0; i < len(agent.refresh_list); i++ {
+		cand := agent.refresh_list[i]
+		if cand.stream_id == stream_id && cand.component_id == component_id &&
+			cand.disposing && match(&cand.stun_agent) {
+			return true
+		}
 	}
 	return false
-}
\ No newline at end of file
+}
+
+/*
+ * Matches a STUN response to a pending discovery of @component. A Binding
+ * response gives the server reflexive candidate, an Allocate one the
+ * relayed candidate, see priv_discovery_turn_allocated(). A 401 or 438
+ * error sends the request again, with the REALM and NONCE it gave.
+ *
+ * RFC 3489 servers only answer with MAPPED-ADDRESS, which is how they are
+ * told from RFC 5389 ones; the flavour is then kept for the other
+ * discoveries on the same server. See agent_recv_stun() for @raw.
+ *
+ * @return TRUE if the message was a discovery response
+ */
+func discovery_handle_inbound_stun(agent *NiceAgent, stream *NiceStream, component *NiceComponent, from NiceAddress, buf []byte, raw []byte) bool {
+	if !stun_message_is_response(buf) {
+		return false
+	}
+	/* the magic cookie takes the first bytes of the transaction id */
+	tid := buf[4 + STUN_MAGIC_COOKIE_LEN:STUN_MESSAGE_HEADER_LENGTH]
+	var cand *CandidateDiscovery
+	for i := 0; i < len(agent.discovery_list); i++ {
+		d := agent.discovery_list[i]
+		if d.stream_id == stream.id && d.component_id == component.id &&
+			d.pending && !d.done && d.stun_message != nil &&
+			bytes.Equal((*d.stun_message.messageHeader.transactionId)[STUN_MAGIC_COOKIE_LEN:], tid) {
+			cand = d
+			break
+		}
+	}
+	if cand == nil {
+		return false
+	}
+	nice_log_stun(nice_agent_log(agent, priv_discovery_log_subsystem(cand)), "received STUN response", stream.id, component.id, from, buf)
+	log := nice_component_log(agent, priv_discovery_log_subsystem(cand), stream.id, component.id)
+
+	if !stun_agent_check_response(&cand.stun_agent, raw) {
+		/* not from the server, wait for the real answer */
+		log.Warn("STUN response with a wrong MESSAGE-INTEGRITY", "from", nice_address_to_string(from))
+		agent.metrics.StunAuthFailure()
+		return true
+	}
+
+	code := stun_message_get_error_code(buf)
+	if (code == STUN_ERROR_UNAUTHORIZED || code == STUN_ERROR_STALE_NONCE) && cand.auth_retries < NICE_DISCOVERY_MAX_AUTH_RETRIES &&
+		stun_agent_update_long_term_credentials(&cand.stun_agent, cand.creds, buf, stun_message_has_integrity(cand.stun_message)) {
+		cand.auth_retries++
+		log.Debug("STUN request challenged, sending it again", "server", nice_address_to_string(cand.server), "code", code)
+		if priv_discovery_send_request(agent, cand) {
+			return true
+		}
+	}
+	cand.done = true
+
+	if code >= 0 {
+		log.Warn("STUN request rejected", "server", nice_address_to_string(cand.server), "code", code)
+		if code == STUN_ERROR_UNAUTHORIZED {
+			agent.metrics.StunAuthFailure()
+		}
+		if cand.typ == NICE_CANDIDATE_TYPE_RELAYED {
+			agent.metrics.TurnAllocationError()
+		}
+		agent_gathering_done(agent)
+		return true
+	}
+
+	if cand.typ == NICE_CANDIDATE_TYPE_RELAYED {
+		priv_discovery_turn_allocated(agent, stream, component, cand, buf)
+		agent_gathering_done(agent)
+		return true
+	}
+
+	mapped, ok := stun_message_find_xor_addr(buf, STUN_ATTRIBUTE_XOR_MAPPED_ADDRESS)
+	compatibility := STUN_COMPATIBILITY_RFC5389
+	if !ok {
+		mapped, ok = stun_message_find_addr(buf, STUN_ATTRIBUTE_MAPPED_ADDRESS)
+		compatibility = STUN_COMPATIBILITY_RFC3489
+	}
+	if !ok {
+		log.Warn("STUN binding response without mapped address", "server", nice_address_to_string(cand.server))
+		agent_gathering_done(agent)
+		return true
+	}
+	if cand.detect_flavour {
+		agent.stun_server_compatibility[nice_address_to_string(cand.server)] = compatibility
+	}
+	if compatibility == STUN_COMPATIBILITY_RFC3489 {
+		attrs := []interface{}{"server", nice_address_to_string(cand.server)}
+		if changed, ok := stun_message_find_addr(buf, STUN_ATTRIBUTE_CHANGED_ADDRESS); ok {
+			attrs = append(attrs, "changed", nice_address_to_string(changed))
+		}
+		if source, ok := stun_message_find_addr(buf, STUN_ATTRIBUTE_SOURCE_ADDRESS); ok {
+			attrs = append(attrs, "source", nice_address_to_string(source))
+		}
+		log.Debug("RFC 3489 STUN server", attrs...)
+	}
+
+	mapped.network = cand.server.network
+	discovery_add_server_reflexive_candidate(agent, stream, component, mapped, cand.nicesock)
+	agent_gathering_done(agent)
+	return true
+}
+
+/*
+ * Adds the relayed candidate of the Allocate success response @buf to
+ * @cand, and the server reflexive candidate the TURN server saw. The
+ * allocation is kept in the refresh list, refreshed before its LIFETIME
+ * runs out and released with the stream; the candidate relays through its
+ * own socket, see UdpTurnSocket.
+ */
+func priv_discovery_turn_allocated(agent *NiceAgent, stream *NiceStream, component *NiceComponent, cand *CandidateDiscovery, buf []byte) {
+	var relayed, mapped NiceAddress
+	var ok, mapped_ok bool
+	switch cand.stun_agent.compatibility {
+	case STUN_COMPATIBILITY_OC2007:
+		/* MS-TURN gives the relayed address in MAPPED-ADDRESS */
+		relayed, ok = stun_message_find_addr(buf, STUN_ATTRIBUTE_MAPPED_ADDRESS)
+		mapped, mapped_ok = stun_message_find_xor_addr(buf, STUN_ATTRIBUTE_MS_XOR_MAPPED_ADDRESS)
+	case STUN_COMPATIBILITY_RFC3489:
+		/* and so do the Google relays, with no reflexive address */
+		relayed, ok = stun_message_find_addr(buf, STUN_ATTRIBUTE_MAPPED_ADDRESS)
+	default:
+		relayed, ok = stun_message_find_xor_addr(buf, STUN_ATTRIBUTE_XOR_RELAYED_ADDRESS)
+		mapped, mapped_ok = stun_message_find_xor_addr(buf, STUN_ATTRIBUTE_XOR_MAPPED_ADDRESS)
+	}
+	if !ok {
+		nice_component_log(agent, NICE_LOG_TURN, stream.id, component.id).Warn("TURN allocate response without relayed address",
+			"server", nice_address_to_string(cand.server))
+		agent.metrics.TurnAllocationError()
+		return
+	}
+
+	if mapped_ok && cand.turn.typ == NICE_RELAY_TYPE_TURN_UDP {
+		/* the reflexive address of a TCP relay is of no use to UDP */
+		mapped.network = "udp"
+		discovery_add_server_reflexive_candidate(agent, stream, component, mapped, cand.nicesock)
+	}
+	relayed.network = "udp"
+	relaysock := nice_udp_turn_socket_new(agent, stream.id, component.id, cand.nicesock, cand.server, relayed, &cand.stun_agent, cand.creds, cand.turn.username)
+
+	if cand.stun_agent.compatibility == STUN_COMPATIBILITY_RFC3489 {
+		/* the Google relays keep the session for as long as it is used,
+		 * with neither Refresh nor release */
+		if discovery_add_relay_candidate(agent, stream, component, relayed, relaysock, cand.turn) == nil {
+			relaysock.close()
+		}
+		return
+	}
+
+	refresh := &CandidateRefresh{}
+	refresh.nicesock = cand.nicesock
+	refresh.server = cand.server
+	refresh.stream_id = stream.id
+	refresh.component_id = component.id
+	refresh.turn = cand.turn
+	refresh.stun_agent = cand.stun_agent
+	refresh.creds = cand.creds
+	refresh.ms_connection_id = cand.ms_connection_id
+	refresh.ms_sequence_num = cand.ms_sequence_num
+	if connection_id, sequence_num, ok := stun_message_find_ms_sequence_number(buf); ok {
+		/* as the server numbered the connection */
+		refresh.ms_connection_id = connection_id
+		refresh.ms_sequence_num = sequence_num
+	}
+	agent.refresh_list = append(agent.refresh_list, refresh)
+	refresh_schedule(agent, refresh, stun_message_get_lifetime(buf))
+
+	refresh.candidate = discovery_add_relay_candidate(agent, stream, component, relayed, relaysock, cand.turn)
+	if refresh.candidate == nil {
+		relaysock.close()
+	}
+}
+
+/*
+ * Adds the relayed candidate @address allocated on @turn, of the relay
+ * socket @nicesock, and signals it.
+ */
+func discovery_add_relay_candidate(agent *NiceAgent, stream *NiceStream, component *NiceComponent, address NiceAddress, nicesock NiceSockInterface, turn *TurnServer) *NiceCandidate {
+	candidate := nice_candidate_new(NICE_CANDIDATE_TYPE_RELAYED)
+	candidate.transport = NICE_CANDIDATE_TRANSPORT_UDP
+	candidate.stream_id = stream.id
+	candidate.component_id = component.id
+	candidate.addr = address
+	candidate.base_addr = address
+	candidate.turn = turn
+	candidate.sockptr = nicesock
+
+	candidate.priority = agent_candidate_priority(agent, candidate, false)
+	candidate.priority = ensure_unique_priority(stream, component, candidate.priority)
+	agent.priv_generate_candidate_credentials(candidate)
+	priv_assign_foundation(agent, candidate)
+
+	if !priv_add_local_candidate_pruned(agent, stream.id, component, candidate) {
+		return nil
+	}
+	agent_signal_new_candidate(agent, candidate)
+	return candidate
+}
+
+/*
+ * Adds the server reflexive candidate @address of the host candidate
+ * using @nicesock, and signals it.
+ */
+func discovery_add_server_reflexive_candidate(agent *NiceAgent, stream *NiceStream, component *NiceComponent, address NiceAddress, nicesock NiceSockInterface) *NiceCandidate {
+	var base *NiceCandidate
+	for i := 0; i < len(component.local_candidates); i++ {
+		if component.local_candidates[i].typ == NICE_CANDIDATE_TYPE_HOST && component.local_candidates[i].sockptr == nicesock {
+			base = component.local_candidates[i]
+			break
+		}
+	}
+	if base == nil {
+		return nil
+	}
+
+	candidate := nice_candidate_new(NICE_CANDIDATE_TYPE_SERVER_REFLEXIVE)
+	candidate.transport = base.transport
+	candidate.stream_id = stream.id
+	candidate.component_id = component.id
+	candidate.addr = address
+	candidate.base_addr = base.addr
+	candidate.sockptr = nicesock
+
+	candidate.priority = agent_candidate_priority(agent, candidate, false)
+	candidate.priority = ensure_unique_priority(stream, component, candidate.priority)
+	agent.priv_generate_candidate_credentials(candidate)
+	priv_assign_foundation(agent, candidate)
+
+	if !priv_add_local_candidate_pruned(agent, stream.id, component, candidate) {
+		return nil
+	}
+	agent_signal_new_candidate(agent, candidate)
+	return candidate
+}
@@ -0,0 +1,81 @@
+package nice
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+/*
+ * A server which drops the requests with a magic cookie is asked again in
+ * RFC 3489: a Binding with no cookie, whose answer in MAPPED-ADDRESS gives
+ * the server reflexive candidate, and the flavour of the server is kept
+ * for its next discoveries.
+ */
+func TestDiscoveryDetectRfc3489(t *testing.T) {
+	srv, server, base := test_turn_server(t)
+	agent := NewNiceAgent()
+	defer test_turn_close(agent)
+	clock := &test_clock{now: time.Unix(1000, 0)}
+	agent.clock = clock
+	id := agent.Nice_agent_add_stream(1)
+	agent.agent_mutex.Lock()
+	defer agent.agent_mutex.Unlock()
+	stream, component := agent.agent_find_component(id, 1)
+	host := nice_candidate_new(NICE_CANDIDATE_TYPE_HOST)
+	host.transport = NICE_CANDIDATE_TRANSPORT_UDP
+	host.addr = NiceAddress{ip: "127.0.0.1", network: "udp", family: "ip4"}
+	host.sockptr = base
+	component.local_candidates = append(component.local_candidates, host)
+
+	priv_add_new_candidate_discovery_stun(agent, base, server, stream, 1)
+	cand := agent.discovery_list[len(agent.discovery_list) - 1]
+	if !cand.detect_flavour {
+		t.Fatal("the flavour of an unknown server is not detected")
+	}
+	priv_discovery_tick_unlocked(agent)
+
+	/* the RFC 5389 request and its retransmissions go unanswered */
+	var req []byte
+	for i := 0; ; i++ {
+		req = test_turn_read(t, srv)
+		if !stun_message_has_cookie(req) {
+			break
+		}
+		if i > NICE_DISCOVERY_DETECT_RETRANSMISSIONS {
+			t.Fatalf("still %d requests with a cookie", i + 1)
+		}
+		clock.now = clock.now.Add(time.Minute)
+		priv_discovery_tick_unlocked(agent)
+	}
+	if !stun_message_is_stun_rfc3489(req) || stun_message_find_attribute(req, STUN_ATTRIBUTE_CHANGE_REQUEST) == nil {
+		t.Fatalf("not a classic Binding request: % x", req)
+	}
+
+	msg := NewStunMessage(STUN_RESPONSE, STUN_BINDING)
+	msg.magicCookie = nil
+	msg.messageHeader.transactionId = stun_message_transaction_id(req)
+	msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_MAPPED_ADDRESS}, value: NewStunMappedAddressAttrValue(MAPPED_ADDRESS_FAMILY_IPV4, 6000, net.IPv4(203, 0, 113, 5).To4())})
+	resp := test_stun_encode(t, msg)
+	if !discovery_handle_inbound_stun(agent, stream, component, server, resp, resp) {
+		t.Fatal("the RFC 3489 answer is not handled")
+	}
+	if compatibility, ok := agent.stun_server_compatibility[nice_address_to_string(server)]; !ok || compatibility != STUN_COMPATIBILITY_RFC3489 {
+		t.Fatalf("server flavour %v, %v", compatibility, ok)
+	}
+	var srflx *NiceCandidate
+	for _, c := range component.local_candidates {
+		if c.typ == NICE_CANDIDATE_TYPE_SERVER_REFLEXIVE {
+			srflx = c
+		}
+	}
+	if srflx == nil || srflx.addr.ip != "203.0.113.5" || srflx.addr.port != 6000 {
+		t.Fatalf("server reflexive candidate %v", srflx)
+	}
+
+	priv_add_new_candidate_discovery_stun(agent, base, server, stream, 1)
+	next := agent.discovery_list[len(agent.discovery_list) - 1]
+	if next.detect_flavour || next.stun_agent.compatibility != STUN_COMPATIBILITY_RFC3489 {
+		t.Fatal("the flavour of the server is detected again")
+	}
+}
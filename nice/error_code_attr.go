@@ -0,0 +1,57 @@
+package nice
+
+import "errors"
+
+/*
+ * The ERROR-CODE of an error response (RFC 5389 section 15.6): the class
+ * of the code in its hundreds, its number in the last two digits, then a
+ * reason phrase.
+ */
+type StunErrorCodeAttrValue struct {
+	code		int
+	reason		string
+}
+
+func (this StunErrorCodeAttrValue) Encode(stream *DataStream) error {
+	stream.WriteBytes([]byte{0, 0, byte(this.code / 100), byte(this.code % 100)})
+	stream.WriteBytes([]byte(this.reason))
+	return nil
+}
+
+func (this *StunErrorCodeAttrValue) Decode(stream *DataStream) error {
+	b := stream.ReadLeftBytes()
+	if len(b) < 4 {
+		return errors.New("invalid error code attr")
+	}
+	this.code = int(b[2] & 0x07) * 100 + int(b[3])
+	this.reason = string(b[4:])
+	return nil
+}
+
+func (this StunErrorCodeAttrValue) GetSize() uint16 {
+	return 4 + uint16(len(this.reason))
+}
+
+/*
+ * The reason phrase of the STUN error @code, as the ERROR-CODE of the
+ * responses carries it.
+ */
+func stun_strerror(code StunError) string {
+	switch code {
+	case STUN_ERROR_TRY_ALTERNATE:
+		return "Try alternate server"
+	case STUN_ERROR_BAD_REQUEST:
+		return "Bad request"
+	case STUN_ERROR_UNAUTHORIZED:
+		return "Unauthorized"
+	case STUN_ERROR_UNKNOWN_ATTRIBUTE:
+		return "Unknown Attribute"
+	case STUN_ERROR_STALE_NONCE:
+		return "Stale Nonce"
+	case STUN_ERROR_ROLE_CONFLICT:
+		return "Role conflict"
+	case STUN_ERROR_SERVER_ERROR:
+		return "Server Error"
+	}
+	return "Unknown error"
+}
@@ -0,0 +1,222 @@
+package nice
+
+import "sync"
+
+/* Capacity of the channel returned by Events() */
+const NICE_AGENT_EVENT_CHANNEL_LEN = 64
+
+/* Events kept while the reader of Events() is late, newer ones are dropped */
+const NICE_AGENT_MAX_PENDING_EVENTS = 4096
+
+/*
+ * Event is a signal of the agent, read from NiceAgent.Events(). The
+ * concrete types are the *Event structs below.
+ */
+type Event interface {
+	Stream() uint
+}
+
+/* A local candidate was gathered */
+type NewCandidateEvent struct {
+	StreamID		uint
+	ComponentID		uint
+	Candidate		Candidate
+}
+
+/* The gathering of the stream is done */
+type GatheringDoneEvent struct {
+	StreamID		uint
+}
+
+/* A component changed state */
+type ComponentStateChangedEvent struct {
+	StreamID		uint
+	ComponentID		uint
+	State			NiceComponentState
+}
+
+/* A component selected a new pair */
+type NewSelectedPairEvent struct {
+	StreamID		uint
+	ComponentID		uint
+	Local			Candidate
+	Remote			Candidate
+}
+
+/* The first Binding request of the peer was received on the stream */
+type InitialBindingRequestReceivedEvent struct {
+	StreamID		uint
+}
+
+/* The stream was removed, by nice_agent_remove_stream() or when closing */
+type StreamRemovedEvent struct {
+	StreamID		uint
+}
+
+/* The peer stopped answering the consent checks of the selected pair */
+type ConsentLostEvent struct {
+	StreamID		uint
+	ComponentID		uint
+}
+
+/*
+ * The pseudo TCP connection of a reliable component is open, or its send
+ * buffer has room again after a send returned NICE_AGENT_ERR_WOULD_BLOCK
+ */
+type ReliableTransportWritableEvent struct {
+	StreamID		uint
+	ComponentID		uint
+}
+
+func (this NewCandidateEvent) Stream() uint { return this.StreamID }
+func (this GatheringDoneEvent) Stream() uint { return this.StreamID }
+func (this ComponentStateChangedEvent) Stream() uint { return this.StreamID }
+func (this NewSelectedPairEvent) Stream() uint { return this.StreamID }
+func (this InitialBindingRequestReceivedEvent) Stream() uint { return this.StreamID }
+func (this StreamRemovedEvent) Stream() uint { return this.StreamID }
+func (this ConsentLostEvent) Stream() uint { return this.StreamID }
+func (this ReliableTransportWritableEvent) Stream() uint { return this.StreamID }
+
+/*
+ * The events of an agent. They are queued in order while the agent lock is
+ * held and handed to the channel by a goroutine of their own, so a slow
+ * reader never blocks the agent: once NICE_AGENT_MAX_PENDING_EVENTS are
+ * waiting, newer events are dropped and counted.
+ */
+type agent_events struct {
+	mutex			sync.Mutex
+	pending			[]Event
+	dropped			uint64
+	wakeup			chan struct{}
+	done			chan struct{}
+	close_once		sync.Once
+	channel			chan Event
+}
+
+/**
+ * Events:
+ *
+ * Returns the channel of the events of the agent, the same one for every
+ * call. Only the events emitted after the first call are delivered, and
+ * the channel is closed once the agent is.
+ */
+func (this *NiceAgent) Events() <-chan Event {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	if this.events == nil {
+		e := &agent_events{}
+		e.wakeup = make(chan struct{}, 1)
+		e.done = make(chan struct{})
+		e.channel = make(chan Event, NICE_AGENT_EVENT_CHANNEL_LEN)
+		this.events = e
+		go e.dispatch()
+		if this.closed && this.close_done != nil {
+			select {
+			case <-this.close_done:
+				e.agent_events_close()
+			default:
+			}
+		}
+	}
+	return this.events.channel
+}
+
+/* Number of events dropped because the reader of Events() was too late */
+func (this *NiceAgent) EventsDropped() uint64 {
+	this.agent_mutex.Lock()
+	e := this.events
+	this.agent_mutex.Unlock()
+	if e == nil {
+		return 0
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.dropped
+}
+
+/*
+ * Queues @event for Events(). Must be called with the agent lock held.
+ */
+func agent_emit_event(agent *NiceAgent, event Event) {
+	if agent.event_hook != nil {
+		agent.event_hook(event)
+	}
+
+	e := agent.events
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	if len(e.pending) >= NICE_AGENT_MAX_PENDING_EVENTS {
+		e.dropped++
+		e.mutex.Unlock()
+		return
+	}
+	e.pending = append(e.pending, event)
+	e.mutex.Unlock()
+
+	select {
+	case e.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+/* Stops the delivery; the pending events which still fit in the channel
+ * are handed to it, the others are dropped */
+func (this *agent_events) agent_events_close() {
+	this.close_once.Do(func() {
+		close(this.done)
+	})
+}
+
+func (this *agent_events) dispatch() {
+	defer close(this.channel)
+	for {
+		select {
+		case <-this.wakeup:
+		case <-this.done:
+			this.flush(nil)
+			return
+		}
+
+		for {
+			this.mutex.Lock()
+			if len(this.pending) == 0 {
+				this.mutex.Unlock()
+				break
+			}
+			event := this.pending[0]
+			this.pending[0] = nil
+			this.pending = this.pending[1:]
+			this.mutex.Unlock()
+
+			select {
+			case this.channel <- event:
+			case <-this.done:
+				this.flush(event)
+				return
+			}
+		}
+	}
+}
+
+/* Hands @first, if any, then the pending events to the channel for as
+ * long as it does not block */
+func (this *agent_events) flush(first Event) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	pending := this.pending
+	if first != nil {
+		pending = append([]Event{first}, pending...)
+	}
+	this.pending = nil
+	for i := 0; i < len(pending); i++ {
+		select {
+		case this.channel <- pending[i]:
+		default:
+			this.dropped += uint64(len(pending) - i)
+			return
+		}
+	}
+}
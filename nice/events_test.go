@@ -0,0 +1,72 @@
+package nice
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+/*
+ * A reader of Events() that is late never blocks the agent: the events
+ * are kept in order up to NICE_AGENT_MAX_PENDING_EVENTS, the newer ones
+ * are dropped and counted, and the queue takes events again once read.
+ */
+func TestEventsPendingLimit(t *testing.T) {
+	agent := NewNiceAgent()
+	defer agent.Close(context.Background())
+	events := agent.Events()
+	emit := func(from int, to int) {
+		agent.agent_mutex.Lock()
+		for i := from; i < to; i++ {
+			agent_emit_event(agent, StreamRemovedEvent{StreamID: uint(i)})
+		}
+		agent.agent_mutex.Unlock()
+	}
+
+	/* the channel fills up, and one more waits for room in it */
+	emit(0, NICE_AGENT_EVENT_CHANNEL_LEN + 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		agent.events.mutex.Lock()
+		pending := len(agent.events.pending)
+		agent.events.mutex.Unlock()
+		if pending == 0 && len(events) == NICE_AGENT_EVENT_CHANNEL_LEN {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d events pending, %d in the channel", pending, len(events))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	const extra = 100
+	delivered := NICE_AGENT_EVENT_CHANNEL_LEN + 1 + NICE_AGENT_MAX_PENDING_EVENTS
+	emit(NICE_AGENT_EVENT_CHANNEL_LEN + 1, delivered + extra)
+	if dropped := agent.EventsDropped(); dropped != extra {
+		t.Fatalf("%d events dropped, expected %d", dropped, extra)
+	}
+
+	for i := 0; i < delivered; i++ {
+		select {
+		case event := <-events:
+			if id := event.Stream(); id != uint(i) {
+				t.Fatalf("event %d received as %d", id, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %d never received", i)
+		}
+	}
+
+	emit(delivered + extra, delivered + extra + 1)
+	select {
+	case event := <-events:
+		if id := event.Stream(); id != uint(delivered + extra) {
+			t.Fatalf("event %d received once drained", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event once drained")
+	}
+	if dropped := agent.EventsDropped(); dropped != extra {
+		t.Fatalf("%d events dropped, expected %d", dropped, extra)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * Package fakeclock is a nice.Clock moved by hand, for tests of the
+ * retransmissions, pacing and timeouts of an agent that run in
+ * milliseconds without sleeping:
+ *
+ *	clock := fakeclock.New(time.Unix(0, 0))
+ *	agent, _ := nice.NewAgent(nice.WithClock(clock))
+ *	...
+ *	clock.Advance(200 * time.Millisecond)	// first retransmission
+ *
+ * The functions of AfterFunc() run synchronously in Advance() and Set(),
+ * in the order of their deadlines, so the timers of the agent have run
+ * when they return.
+ */
+package fakeclock
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go-licode/nice"
+)
+
+type Clock struct {
+	mutex			sync.Mutex
+	now				time.Time
+	timers			[]*Timer
+	seq				uint64		/* orders the timers of the same deadline */
+}
+
+type Timer struct {
+	clock			*Clock
+	deadline		time.Time
+	seq				uint64
+	f				func()
+	pending			bool
+}
+
+/* Creates a clock reading @now until it is moved */
+func New(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+func (this *Clock) Now() time.Time {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.now
+}
+
+func (this *Clock) AfterFunc(d time.Duration, f func()) nice.ClockTimer {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	t := &Timer{clock: this, f: f}
+	this.schedule(t, d)
+	return t
+}
+
+/* Number of timers waiting for the clock to move */
+func (this *Clock) Pending() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return len(this.timers)
+}
+
+/* Moves the clock forward by @d, running the timers due on the way */
+func (this *Clock) Advance(d time.Duration) {
+	this.mutex.Lock()
+	target := this.now.Add(d)
+	this.mutex.Unlock()
+	this.Set(target)
+}
+
+/*
+ * Moves the clock to @t, running the timers due on the way. Each timer
+ * runs with the clock at its deadline; the timers they start are run too
+ * if they are due before @t. The clock never goes backwards.
+ */
+func (this *Clock) Set(t time.Time) {
+	for {
+		this.mutex.Lock()
+		if len(this.timers) == 0 || this.timers[0].deadline.After(t) {
+			if t.After(this.now) {
+				this.now = t
+			}
+			this.mutex.Unlock()
+			return
+		}
+		timer := this.timers[0]
+		this.timers = this.timers[1:]
+		timer.pending = false
+		if timer.deadline.After(this.now) {
+			this.now = timer.deadline
+		}
+		this.mutex.Unlock()
+
+		timer.f()
+	}
+}
+
+/* Must be called with the clock lock held */
+func (this *Clock) schedule(t *Timer, d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	this.seq++
+	t.seq = this.seq
+	t.deadline = this.now.Add(d)
+	t.pending = true
+
+	i := sort.Search(len(this.timers), func(i int) bool {
+		o := this.timers[i]
+		return o.deadline.After(t.deadline) || (o.deadline.Equal(t.deadline) && o.seq > t.seq)
+	})
+	this.timers = append(this.timers, nil)
+	copy(this.timers[i + 1:], this.timers[i:])
+	this.timers[i] = t
+}
+
+/* Must be called with the clock lock held */
+func (this *Clock) unschedule(t *Timer) bool {
+	if !t.pending {
+		return false
+	}
+	for i := 0; i < len(this.timers); i++ {
+		if this.timers[i] == t {
+			this.timers = append(this.timers[:i], this.timers[i + 1:]...)
+			break
+		}
+	}
+	t.pending = false
+	return true
+}
+
+func (this *Timer) Stop() bool {
+	this.clock.mutex.Lock()
+	defer this.clock.mutex.Unlock()
+	return this.clock.unschedule(this)
+}
+
+func (this *Timer) Reset(d time.Duration) bool {
+	this.clock.mutex.Lock()
+	defer this.clock.mutex.Unlock()
+	active := this.clock.unschedule(this)
+	this.clock.schedule(this, d)
+	return active
+}
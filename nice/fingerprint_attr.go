@@ -1,5 +1,71 @@
 package nice
 
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+/* XOR-ed with the CRC-32 of the FINGERPRINT, "STUN" in ASCII */
+const STUN_FINGERPRINT_XOR = 0x5354554e
+
+/* The length of the value of FINGERPRINT */
+const STUN_FINGERPRINT_LEN = 4
+
+/*
+ * The FINGERPRINT of RFC 5389 section 15.5: the CRC-32 of the message up
+ * to the attribute, XOR-ed with STUN_FINGERPRINT_XOR. It is always the
+ * last attribute.
+ */
 type StunFingerPrintAttrValue struct {
+	crc				uint32
+}
+
+func (this StunFingerPrintAttrValue) Encode(stream *DataStream) error {
+	stream.WriteUInt32(this.crc, binary.BigEndian)
+	return nil
+}
+
+func (this *StunFingerPrintAttrValue) Decode(stream *DataStream) error {
+	v, err := stream.ReadInt32(binary.BigEndian)
+	if err != nil {
+		return err
+	}
+	this.crc = uint32(v)
+	return nil
+}
+
+func (this StunFingerPrintAttrValue) GetSize() uint16 {
+	return STUN_FINGERPRINT_LEN
+}
+
+/*
+ * The FINGERPRINT of the STUN message @buf, which ends right before it:
+ * the length in the header must already count the attribute.
+ */
+func stun_fingerprint(buf []byte) uint32 {
+	return crc32.ChecksumIEEE(buf) ^ STUN_FINGERPRINT_XOR
+}
+
+/*
+ * Checks the FINGERPRINT of the STUN message @buf.
+ *
+ * Returns: %FALSE if @buf does not end with a FINGERPRINT or a wrong one
+ */
+func stun_message_check_fingerprint(buf []byte) bool {
+	offset := len(buf) - 4 - STUN_FINGERPRINT_LEN
+	if offset < STUN_MESSAGE_HEADER_LENGTH {
+		return false
+	}
+	if StunAttributeType(binary.BigEndian.Uint16(buf[offset:offset + 2])) != STUN_ATTRIBUTE_FINGERPRINT ||
+			binary.BigEndian.Uint16(buf[offset + 2:offset + 4]) != STUN_FINGERPRINT_LEN {
+		return false
+	}
+	return stun_fingerprint(buf[:offset]) == binary.BigEndian.Uint32(buf[offset + 4:])
+}
 
+/* Whether the STUN message @buf ends with a FINGERPRINT */
+func stun_message_has_fingerprint(buf []byte) bool {
+	offset := len(buf) - 4 - STUN_FINGERPRINT_LEN
+	return offset >= STUN_MESSAGE_HEADER_LENGTH &&
+		StunAttributeType(binary.BigEndian.Uint16(buf[offset:offset + 2])) == STUN_ATTRIBUTE_FINGERPRINT
 }
@@ -0,0 +1,142 @@
+package nice
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+ * The relays of Google Talk are allocated over HTTP: the client asks the
+ * relay server for a session with the relay token of its XMPP session, and
+ * gets back the address of the relay and the credentials of the TURN
+ * allocations, one "key=value" per line:
+ *
+ *	relay.ip=74.125.39.127
+ *	relay.udp_port=19295
+ *	relay.tcp_port=19294
+ *	relay.ssltcp_port=443
+ *	username=...
+ *	password=...
+ *
+ * The allocations then use the Google dialect of TURN, see
+ * priv_add_new_candidate_discovery_turn().
+ */
+const NICE_GOOGLE_RELAY_URL = "https://relay.google.com/create_session"
+
+var NICE_GOOGLE_RELAY_ERR_RESPONSE = errors.New("nice google relay session response is not valid")
+
+type NiceGoogleRelay struct {
+	ip				string
+	udp_port		int		/* 0 if the relay has none */
+	tcp_port		int
+	ssltcp_port		int
+	username		string
+	password		string
+}
+
+/**
+ * Nice_google_relay_allocate:
+ * @ctx: cancels the request
+ * @client: the HTTP client, http.DefaultClient if nil
+ * @url: the session URL, NICE_GOOGLE_RELAY_URL for the Google relays
+ * @token: the relay token of the XMPP session
+ *
+ * Allocates a session on a Google relay, to be given to
+ * nice_agent_set_google_relay(). Must not be called with the agent lock
+ * held.
+ *
+ * Returns: the relay session
+ */
+func Nice_google_relay_allocate(ctx context.Context, client *http.Client, url string, token string) (*NiceGoogleRelay, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	/* the old relays read the first header, the current ones the second */
+	req.Header.Set("X-Talk-Google-Relay-Auth", token)
+	req.Header.Set("X-Google-Relay-Auth", token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("nice google relay session: " + resp.Status)
+	}
+	return nice_google_relay_parse(resp.Body)
+}
+
+func nice_google_relay_parse(r io.Reader) (*NiceGoogleRelay, error) {
+	relay := &NiceGoogleRelay{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found {
+			continue
+		}
+		var err error
+		switch key {
+		case "relay.ip":
+			relay.ip = value
+		case "relay.udp_port":
+			relay.udp_port, err = strconv.Atoi(value)
+		case "relay.tcp_port":
+			relay.tcp_port, err = strconv.Atoi(value)
+		case "relay.ssltcp_port":
+			relay.ssltcp_port, err = strconv.Atoi(value)
+		case "username":
+			relay.username = value
+		case "password":
+			relay.password = value
+		}
+		if err != nil {
+			return nil, NICE_GOOGLE_RELAY_ERR_RESPONSE
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if relay.ip == "" || relay.username == "" ||
+		(relay.udp_port == 0 && relay.tcp_port == 0 && relay.ssltcp_port == 0) {
+		return nil, NICE_GOOGLE_RELAY_ERR_RESPONSE
+	}
+	return relay, nil
+}
+
+/**
+ * nice_agent_set_google_relay:
+ * @stream_id: The ID of the stream
+ * @component_id: The ID of the component
+ * @relay: the session from nice_google_relay_allocate()
+ *
+ * Sets the UDP, TCP and SSL-TCP ports of the Google relay session @relay
+ * as the relays of the component, see nice_agent_set_relay_info(). Only
+ * the agents in NICE_COMPATIBILITY_GOOGLE speak to the Google relays.
+ *
+ * Returns: %TRUE if the relay settings were accepted.
+ */
+func (this *NiceAgent) Nice_agent_set_google_relay(stream_id uint, component_id uint, relay *NiceGoogleRelay) bool {
+	if relay == nil || this.compatibility != NICE_COMPATIBILITY_GOOGLE {
+		return false
+	}
+	ports := []int{relay.udp_port, relay.tcp_port, relay.ssltcp_port}
+	types := []NiceRelayType{NICE_RELAY_TYPE_TURN_UDP, NICE_RELAY_TYPE_TURN_TCP, NICE_RELAY_TYPE_TURN_TLS}
+	for i := 0; i < len(ports); i++ {
+		if ports[i] == 0 {
+			continue
+		}
+		if !this.Nice_agent_set_relay_info(stream_id, component_id, relay.ip, ports[i], relay.username, relay.password, types[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,30 @@
+package nice
+
+import "encoding/binary"
+
+/*
+ * The ICE-CONTROLLING and ICE-CONTROLLED of ICE (RFC 5245 section 19.1):
+ * the role the agent sending the check thinks it has, and its tie-breaker
+ * to resolve the conflicts of roles.
+ */
+type StunIceControlAttrValue struct {
+	tie_breaker		uint64
+}
+
+func (this StunIceControlAttrValue) Encode(stream *DataStream) error {
+	stream.WriteInt64(int64(this.tie_breaker), binary.BigEndian)
+	return nil
+}
+
+func (this *StunIceControlAttrValue) Decode(stream *DataStream) error {
+	v, err := stream.ReadInt64(binary.BigEndian)
+	if err != nil {
+		return err
+	}
+	this.tie_breaker = uint64(v)
+	return nil
+}
+
+func (this StunIceControlAttrValue) GetSize() uint16 {
+	return 8
+}
@@ -0,0 +1,37 @@
+package nice
+
+import "encoding/binary"
+
+type StunLifetimeAttrValue struct {
+	lifetime		uint32		/* seconds */
+}
+
+func (this StunLifetimeAttrValue) Encode(stream *DataStream) error {
+	stream.WriteUInt32(this.lifetime, binary.BigEndian)
+	return nil
+}
+
+func (this *StunLifetimeAttrValue) Decode(stream *DataStream) error {
+	v, err := stream.ReadInt32(binary.BigEndian)
+	if err != nil {
+		return err
+	}
+	this.lifetime = uint32(v)
+	return nil
+}
+
+func (this StunLifetimeAttrValue) GetSize() uint16 {
+	return 4
+}
+
+/*
+ * The LIFETIME of the TURN response @buf, in seconds, or the default one
+ * if it has none.
+ */
+func stun_message_get_lifetime(buf []byte) uint32 {
+	value := stun_message_find_attribute(buf, STUN_ATTRIBUTE_LIFETIME)
+	if len(value) != 4 {
+		return NICE_TURN_DEFAULT_LIFETIME
+	}
+	return binary.BigEndian.Uint32(value)
+}
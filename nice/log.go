@@ -0,0 +1,168 @@
+package nice
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/binary"
+	"log/slog"
+)
+
+/*
+ * The subsystems of the agent. Their records carry the name of the
+ * subsystem in the NICE_LOG_SUBSYSTEM_KEY attribute, which
+ * NewNiceLogFilter() filters on.
+ */
+type NiceLogSubsystem int
+
+const (
+	NICE_LOG_AGENT NiceLogSubsystem = iota
+	NICE_LOG_DISCOVERY
+	NICE_LOG_CONNCHECK
+	NICE_LOG_TURN
+	NICE_LOG_SOCKET
+	NICE_LOG_LAST
+)
+
+var nice_log_subsystem_names = [NICE_LOG_LAST]string{"agent", "discovery", "conncheck", "turn", "socket"}
+
+func (this NiceLogSubsystem) String() string {
+	if this < 0 || this >= NICE_LOG_LAST {
+		return "invalid"
+	}
+	return nice_log_subsystem_names[this]
+}
+
+const NICE_LOG_SUBSYSTEM_KEY = "subsystem"
+
+/* Below slog.LevelDebug: the dumps of the STUN messages sent and received */
+const NICE_LOG_LEVEL_TRACE = slog.LevelDebug - 4
+
+/* The logger of the agents which have none, dropping everything */
+var NiceLogDiscard = slog.New(nice_log_discard{})
+
+type nice_log_discard struct{}
+
+func (nice_log_discard) Enabled(ctx context.Context, level slog.Level) bool { return false }
+func (nice_log_discard) Handle(ctx context.Context, record slog.Record) error { return nil }
+func (this nice_log_discard) WithAttrs(attrs []slog.Attr) slog.Handler { return this }
+func (this nice_log_discard) WithGroup(name string) slog.Handler { return this }
+
+/*
+ * Returns a handler passing to @handler the records of the subsystems
+ * named in @levels at or above their level, and the other records at or
+ * above @level, e.g. to trace the checks only:
+ *
+ *	nice.NewNiceLogFilter(handler, slog.LevelInfo, map[string]slog.Leveler{
+ *		"conncheck": nice.NICE_LOG_LEVEL_TRACE,
+ *	})
+ */
+func NewNiceLogFilter(handler slog.Handler, level slog.Leveler, levels map[string]slog.Leveler) slog.Handler {
+	return &nice_log_filter{handler: handler, level: level, levels: levels}
+}
+
+type nice_log_filter struct {
+	handler			slog.Handler
+	level			slog.Leveler
+	levels			map[string]slog.Leveler
+	subsystem		string		/* from WithAttrs(), "" if not known yet */
+	grouped			bool		/* later attributes are not the subsystem */
+}
+
+func (this *nice_log_filter) subsystem_level(subsystem string) slog.Level {
+	if l, ok := this.levels[subsystem]; ok {
+		return l.Level()
+	}
+	return this.level.Level()
+}
+
+func (this *nice_log_filter) Enabled(ctx context.Context, level slog.Level) bool {
+	if this.subsystem != "" {
+		return level >= this.subsystem_level(this.subsystem) && this.handler.Enabled(ctx, level)
+	}
+	/* the subsystem may be in the record, let Handle() decide */
+	min := this.level.Level()
+	for _, l := range this.levels {
+		if l.Level() < min {
+			min = l.Level()
+		}
+	}
+	return level >= min && this.handler.Enabled(ctx, level)
+}
+
+func (this *nice_log_filter) Handle(ctx context.Context, record slog.Record) error {
+	subsystem := this.subsystem
+	if subsystem == "" && !this.grouped {
+		record.Attrs(func(attr slog.Attr) bool {
+			if attr.Key == NICE_LOG_SUBSYSTEM_KEY {
+				subsystem = attr.Value.String()
+				return false
+			}
+			return true
+		})
+	}
+	if record.Level < this.subsystem_level(subsystem) {
+		return nil
+	}
+	return this.handler.Handle(ctx, record)
+}
+
+func (this *nice_log_filter) WithAttrs(attrs []slog.Attr) slog.Handler {
+	f := *this
+	f.handler = this.handler.WithAttrs(attrs)
+	if !this.grouped {
+		for i := 0; i < len(attrs); i++ {
+			if attrs[i].Key == NICE_LOG_SUBSYSTEM_KEY {
+				f.subsystem = attrs[i].Value.String()
+			}
+		}
+	}
+	return &f
+}
+
+func (this *nice_log_filter) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return this
+	}
+	f := *this
+	f.handler = this.handler.WithGroup(name)
+	f.grouped = true
+	return &f
+}
+
+/* The logger of @subsystem of the agent */
+func nice_agent_log(agent *NiceAgent, subsystem NiceLogSubsystem) *slog.Logger {
+	return agent.loggers[subsystem]
+}
+
+/* The logger of @subsystem, with the stream and component attributes */
+func nice_component_log(agent *NiceAgent, subsystem NiceLogSubsystem, stream_id uint, component_id uint) *slog.Logger {
+	return agent.loggers[subsystem].With("stream", stream_id, "component", component_id)
+}
+
+/* The attribute describing @pair in the records */
+func nice_pair_log_attr(pair *CandidateCheckPair) slog.Attr {
+	return slog.Group("pair",
+		"local", nice_address_to_string(pair.local.addr),
+		"remote", nice_address_to_string(pair.remote.addr),
+		"foundation", string(pair.foundation))
+}
+
+/* Dumps the STUN message @buf sent to or received from @addr, at trace level */
+func nice_log_stun(logger *slog.Logger, msg string, stream_id uint, component_id uint, addr NiceAddress, buf []byte) {
+	ctx := context.Background()
+	if !logger.Enabled(ctx, NICE_LOG_LEVEL_TRACE) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.Uint64("stream", uint64(stream_id)),
+		slog.Uint64("component", uint64(component_id)),
+		slog.String("addr", nice_address_to_string(addr)),
+	}
+	if len(buf) >= STUN_MESSAGE_HEADER_LENGTH {
+		attrs = append(attrs, slog.Group("stun",
+			"type", binary.BigEndian.Uint16(buf[0:2]),
+			"transaction", hex.EncodeToString(buf[8:STUN_MESSAGE_HEADER_LENGTH])))
+	}
+	attrs = append(attrs, slog.String("dump", hex.EncodeToString(buf)))
+	logger.LogAttrs(ctx, NICE_LOG_LEVEL_TRACE, msg, attrs...)
+}
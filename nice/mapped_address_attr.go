@@ -3,6 +3,7 @@ package nice
 import (
 	"encoding/binary"
 	"errors"
+	"net"
 )
 
 type MAPPED_ADDRESS_FAMILY byte
@@ -69,4 +70,33 @@ func (this *StunMappedAddressAttrValue) Decode(stream *DataStream) (err error) {
 		return
 	}
 	return
-}
\ No newline at end of file
+}
+/*
+ * Returns the address of the MAPPED-ADDRESS style attribute of type 'typ'
+ * of the STUN message 'buf' (RFC 5389 section 15.1).
+ */
+func stun_message_find_addr(buf []byte, typ StunAttributeType) (NiceAddress, bool) {
+	var addr NiceAddress
+	value := stun_message_find_attribute(buf, typ)
+	if len(value) != 8 && len(value) != 20 {
+		return addr, false
+	}
+	switch MAPPED_ADDRESS_FAMILY(value[1]) {
+	case MAPPED_ADDRESS_FAMILY_IPV4:
+		if len(value) != 8 {
+			return addr, false
+		}
+		addr.family = "ip4"
+	case MAPPED_ADDRESS_FAMILY_IPV6:
+		if len(value) != 20 {
+			return addr, false
+		}
+		addr.family = "ip6"
+	default:
+		return addr, false
+	}
+	addr.port = int(binary.BigEndian.Uint16(value[2:4]))
+	addr.ip = net.IP(value[4:]).String()
+	addr.network = "udp"
+	return addr, true
+}
@@ -10,13 +10,15 @@ func (this *StunMessageIntegrityAttrValue) SetData(d []byte) {
 }
 
 func (this StunMessageIntegrityAttrValue) Encode(stream *DataStream) error {
+	stream.WriteBytes(this.hmac)
 	return nil
 }
 
 func (this *StunMessageIntegrityAttrValue) Decode(stream *DataStream) error {
+	this.hmac = stream.ReadLeftBytes()
 	return nil
 }
 
 func (this StunMessageIntegrityAttrValue) GetSize() uint16 {
-	return 20
-}
\ No newline at end of file
+	return STUN_MESSAGE_INTEGRITY_LEN
+}
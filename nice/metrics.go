@@ -0,0 +1,49 @@
+package nice
+
+import "time"
+
+/*
+ * Metrics receives what the agents do, for a metrics system to aggregate
+ * it across all of them: the metrics package exports it for Prometheus.
+ * The methods are called with the agent lock held, they must be quick and
+ * must not call the agent.
+ */
+type Metrics interface {
+	AgentAdded()
+	AgentRemoved()
+	StreamAdded()
+	StreamRemoved()
+	/* the live components, by state */
+	ComponentAdded(state NiceComponentState)
+	ComponentRemoved(state NiceComponentState)
+	ComponentStateChanged(old_state NiceComponentState, new_state NiceComponentState)
+	/* from nice_agent_gather_candidates() to the end of the gathering */
+	GatheringDone(duration time.Duration)
+	/* from CONNECTING to READY */
+	Connected(duration time.Duration)
+	SelectedPair(local NiceCandidateType, remote NiceCandidateType)
+	StunRetransmission()
+	/* a check with a wrong USERNAME, or an answer 401 to ours */
+	StunAuthFailure()
+	/* the relay could not be reached */
+	TurnAllocationError()
+}
+
+/* The Metrics of the agents which have none, dropping everything */
+var NiceMetricsDiscard Metrics = nice_metrics_discard{}
+
+type nice_metrics_discard struct{}
+
+func (nice_metrics_discard) AgentAdded() {}
+func (nice_metrics_discard) AgentRemoved() {}
+func (nice_metrics_discard) StreamAdded() {}
+func (nice_metrics_discard) StreamRemoved() {}
+func (nice_metrics_discard) ComponentAdded(state NiceComponentState) {}
+func (nice_metrics_discard) ComponentRemoved(state NiceComponentState) {}
+func (nice_metrics_discard) ComponentStateChanged(old_state NiceComponentState, new_state NiceComponentState) {}
+func (nice_metrics_discard) GatheringDone(duration time.Duration) {}
+func (nice_metrics_discard) Connected(duration time.Duration) {}
+func (nice_metrics_discard) SelectedPair(local NiceCandidateType, remote NiceCandidateType) {}
+func (nice_metrics_discard) StunRetransmission() {}
+func (nice_metrics_discard) StunAuthFailure() {}
+func (nice_metrics_discard) TurnAllocationError() {}
@@ -0,0 +1,266 @@
+/*
+ * Package metrics aggregates the nice.Metrics of the agents of a process
+ * and exports them in the text format of Prometheus, without depending on
+ * its client library:
+ *
+ *	registry := metrics.NewRegistry()
+ *	registry.Register(mux)	// GET /metrics on the existing HTTP server
+ *	agent, _ := nice.NewAgent(nice.WithMetrics(registry))
+ *
+ * The exported series are:
+ *
+ *	nice_agents, nice_streams			live agents and streams
+ *	nice_components{state}				live components by state
+ *	nice_gathering_duration_seconds		histogram of the gathering times
+ *	nice_connect_duration_seconds		histogram of CONNECTING to READY
+ *	nice_selected_pairs_total{local_type,remote_type}
+ *	nice_stun_retransmissions_total
+ *	nice_stun_auth_failures_total
+ *	nice_turn_allocation_errors_total
+ */
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go-licode/nice"
+)
+
+/* The path Register() serves the metrics on */
+const DEFAULT_PATH = "/metrics"
+
+/* The upper bounds of the buckets of the duration histograms, in seconds */
+var DurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type histogram struct {
+	counts			[]uint64	/* per bucket of DurationBuckets, not cumulated */
+	count			uint64
+	sum				float64
+}
+
+type pair_types struct {
+	local			nice.NiceCandidateType
+	remote			nice.NiceCandidateType
+}
+
+/*
+ * Registry is a nice.Metrics shared by any number of agents, and an
+ * http.Handler serving their metrics.
+ */
+type Registry struct {
+	mutex				sync.Mutex
+	agents				int64
+	streams				int64
+	components			map[nice.NiceComponentState]int64
+	gathering			histogram
+	connect				histogram
+	selected_pairs		map[pair_types]uint64
+	stun_retransmissions	uint64
+	stun_auth_failures		uint64
+	turn_allocation_errors	uint64
+}
+
+func NewRegistry() *Registry {
+	r := &Registry{}
+	r.components = make(map[nice.NiceComponentState]int64)
+	r.selected_pairs = make(map[pair_types]uint64)
+	r.gathering.counts = make([]uint64, len(DurationBuckets))
+	r.connect.counts = make([]uint64, len(DurationBuckets))
+	return r
+}
+
+func (this *Registry) AgentAdded() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.agents++
+}
+
+func (this *Registry) AgentRemoved() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.agents--
+}
+
+func (this *Registry) StreamAdded() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.streams++
+}
+
+func (this *Registry) StreamRemoved() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.streams--
+}
+
+func (this *Registry) ComponentAdded(state nice.NiceComponentState) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.components[state]++
+}
+
+func (this *Registry) ComponentRemoved(state nice.NiceComponentState) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.components[state]--
+}
+
+func (this *Registry) ComponentStateChanged(old_state nice.NiceComponentState, new_state nice.NiceComponentState) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.components[old_state]--
+	this.components[new_state]++
+}
+
+func (this *Registry) GatheringDone(duration time.Duration) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.gathering.observe(duration)
+}
+
+func (this *Registry) Connected(duration time.Duration) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.connect.observe(duration)
+}
+
+func (this *Registry) SelectedPair(local nice.NiceCandidateType, remote nice.NiceCandidateType) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.selected_pairs[pair_types{local, remote}]++
+}
+
+func (this *Registry) StunRetransmission() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.stun_retransmissions++
+}
+
+func (this *Registry) StunAuthFailure() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.stun_auth_failures++
+}
+
+func (this *Registry) TurnAllocationError() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.turn_allocation_errors++
+}
+
+func (this *histogram) observe(duration time.Duration) {
+	seconds := duration.Seconds()
+	for i := 0; i < len(DurationBuckets); i++ {
+		if seconds <= DurationBuckets[i] {
+			this.counts[i]++
+			break
+		}
+	}
+	this.count++
+	this.sum += seconds
+}
+
+/* Serves the metrics on DEFAULT_PATH of @mux, http.DefaultServeMux if nil */
+func (this *Registry) Register(mux *http.ServeMux) {
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	mux.Handle(DEFAULT_PATH, this)
+}
+
+func (this *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	this.WriteTo(w)
+}
+
+/* Writes the metrics to @w in the text format of Prometheus */
+func (this *Registry) WriteTo(w io.Writer) (int64, error) {
+	this.mutex.Lock()
+	var buf bufferedWriter
+	buf.w = bufio.NewWriter(w)
+
+	buf.header("nice_agents", "gauge", "Live ICE agents.")
+	buf.printf("nice_agents %d\n", this.agents)
+	buf.header("nice_streams", "gauge", "Live streams of the ICE agents.")
+	buf.printf("nice_streams %d\n", this.streams)
+
+	buf.header("nice_components", "gauge", "Live components of the ICE agents, by state.")
+	for state := nice.NICE_COMPONENT_STATE_DISCONNECTED; state < nice.NICE_COMPONENT_STATE_LAST; state++ {
+		buf.printf("nice_components{state=%q} %d\n", nice.Nice_component_state_to_string(state), this.components[state])
+	}
+
+	this.gathering.write(&buf, "nice_gathering_duration_seconds", "Time to gather the local candidates of a stream.")
+	this.connect.write(&buf, "nice_connect_duration_seconds", "Time from the start of the checks of a component to READY.")
+
+	buf.header("nice_selected_pairs_total", "counter", "Selected candidate pairs, by local and remote candidate type.")
+	pairs := make([]pair_types, 0, len(this.selected_pairs))
+	for p := range this.selected_pairs {
+		pairs = append(pairs, p)
+	}
+	sort.Slice(pairs, func(i int, j int) bool {
+		return pairs[i].local < pairs[j].local || (pairs[i].local == pairs[j].local && pairs[i].remote < pairs[j].remote)
+	})
+	for i := 0; i < len(pairs); i++ {
+		buf.printf("nice_selected_pairs_total{local_type=%q,remote_type=%q} %d\n",
+			nice.Nice_candidate_type_to_string(pairs[i].local), nice.Nice_candidate_type_to_string(pairs[i].remote), this.selected_pairs[pairs[i]])
+	}
+
+	buf.header("nice_stun_retransmissions_total", "counter", "STUN requests retransmitted by the ICE agents.")
+	buf.printf("nice_stun_retransmissions_total %d\n", this.stun_retransmissions)
+	buf.header("nice_stun_auth_failures_total", "counter", "STUN checks whose credentials were rejected.")
+	buf.printf("nice_stun_auth_failures_total %d\n", this.stun_auth_failures)
+	buf.header("nice_turn_allocation_errors_total", "counter", "TURN relays which could not be allocated.")
+	buf.printf("nice_turn_allocation_errors_total %d\n", this.turn_allocation_errors)
+	this.mutex.Unlock()
+
+	if buf.err == nil {
+		buf.err = buf.w.Flush()
+	}
+	return buf.n, buf.err
+}
+
+func (this *histogram) write(buf *bufferedWriter, name string, help string) {
+	buf.header(name, "histogram", help)
+	var cumulated uint64
+	for i := 0; i < len(DurationBuckets); i++ {
+		cumulated += this.counts[i]
+		buf.printf("%s_bucket{le=\"%g\"} %d\n", name, DurationBuckets[i], cumulated)
+	}
+	buf.printf("%s_bucket{le=\"+Inf\"} %d\n", name, this.count)
+	buf.printf("%s_sum %s\n", name, format_float(this.sum))
+	buf.printf("%s_count %d\n", name, this.count)
+}
+
+func format_float(f float64) string {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return "NaN"
+	}
+	return fmt.Sprintf("%g", f)
+}
+
+/* Keeps the first error and the number of bytes written */
+type bufferedWriter struct {
+	w				*bufio.Writer
+	n				int64
+	err				error
+}
+
+func (this *bufferedWriter) printf(format string, args ...interface{}) {
+	if this.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(this.w, format, args...)
+	this.n += int64(n)
+	this.err = err
+}
+
+func (this *bufferedWriter) header(name string, typ string, help string) {
+	this.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
@@ -0,0 +1,71 @@
+package nice
+
+import (
+	"context"
+	"testing"
+)
+
+/* The gauges of a Metrics: the live agents, streams and components */
+type test_metrics struct {
+	nice_metrics_discard
+	agents			int
+	streams			int
+	components		map[NiceComponentState]int
+}
+
+func new_test_metrics() *test_metrics {
+	return &test_metrics{components: make(map[NiceComponentState]int)}
+}
+
+func (this *test_metrics) AgentAdded() { this.agents++ }
+func (this *test_metrics) AgentRemoved() { this.agents-- }
+func (this *test_metrics) StreamAdded() { this.streams++ }
+func (this *test_metrics) StreamRemoved() { this.streams-- }
+func (this *test_metrics) ComponentAdded(state NiceComponentState) { this.components[state]++ }
+func (this *test_metrics) ComponentRemoved(state NiceComponentState) { this.components[state]-- }
+func (this *test_metrics) ComponentStateChanged(old_state NiceComponentState, new_state NiceComponentState) {
+	this.components[old_state]--
+	this.components[new_state]++
+}
+
+func (this *test_metrics) check(t *testing.T, agents int, streams int, components int) {
+	t.Helper()
+	n := 0
+	for state, c := range this.components {
+		if c < 0 {
+			t.Fatalf("%d components %s", c, Nice_component_state_to_string(state))
+		}
+		n += c
+	}
+	if this.agents != agents || this.streams != streams || n != components {
+		t.Fatalf("%d agents, %d streams and %d components, expected %d, %d and %d",
+			this.agents, this.streams, n, agents, streams, components)
+	}
+}
+
+/*
+ * The agent, streams and components move to the Metrics set while they
+ * live, and a closed agent is in none.
+ */
+func TestSetMetricsMovesGauges(t *testing.T) {
+	first := new_test_metrics()
+	agent := NewNiceAgent()
+	agent.SetMetrics(first)
+	agent.Nice_agent_add_stream(2)
+	first.check(t, 1, 1, 2)
+
+	second := new_test_metrics()
+	agent.SetMetrics(second)
+	first.check(t, 0, 0, 0)
+	second.check(t, 1, 1, 2)
+
+	if err := agent.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	second.check(t, 0, 0, 0)
+
+	third := new_test_metrics()
+	agent.SetMetrics(third)
+	second.check(t, 0, 0, 0)
+	third.check(t, 0, 0, 0)
+}
@@ -0,0 +1,28 @@
+package nice
+
+import "encoding/binary"
+
+/* The version of MS-ICE2 of the checks, see [MS-ICE2] 2.2.2.2 */
+const STUN_MSICE2_IMPLEMENTATION_VERSION = 2
+
+type StunMsImplementationVersionAttrValue struct {
+	version			uint32
+}
+
+func (this StunMsImplementationVersionAttrValue) Encode(stream *DataStream) error {
+	stream.WriteUInt32(this.version, binary.BigEndian)
+	return nil
+}
+
+func (this *StunMsImplementationVersionAttrValue) Decode(stream *DataStream) error {
+	v, err := stream.ReadInt32(binary.BigEndian)
+	if err != nil {
+		return err
+	}
+	this.version = uint32(v)
+	return nil
+}
+
+func (this StunMsImplementationVersionAttrValue) GetSize() uint16 {
+	return 4
+}
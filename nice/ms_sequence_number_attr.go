@@ -0,0 +1,59 @@
+package nice
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/* Length of the connection id of the MS-SEQUENCE-NUMBER of MS-TURN */
+const STUN_MS_CONNECTION_ID_LEN = 20
+
+/*
+ * The MS-SEQUENCE-NUMBER of [MS-TURN] 2.2.2.3: the requests on an
+ * allocation carry its connection id and a number incremented by each one.
+ */
+type StunMsSequenceNumberAttrValue struct {
+	connection_id		[]byte
+	sequence_number		uint32
+}
+
+func (this StunMsSequenceNumberAttrValue) Encode(stream *DataStream) error {
+	if len(this.connection_id) != STUN_MS_CONNECTION_ID_LEN {
+		return errors.New("invalid ms connection id len")
+	}
+	stream.WriteBytes(this.connection_id)
+	stream.WriteUInt32(this.sequence_number, binary.BigEndian)
+	return nil
+}
+
+func (this *StunMsSequenceNumberAttrValue) Decode(stream *DataStream) error {
+	var err error
+	this.connection_id, err = stream.ReadBytes(STUN_MS_CONNECTION_ID_LEN)
+	if err != nil {
+		return err
+	}
+	v, err := stream.ReadInt32(binary.BigEndian)
+	if err != nil {
+		return err
+	}
+	this.sequence_number = uint32(v)
+	return nil
+}
+
+func (this StunMsSequenceNumberAttrValue) GetSize() uint16 {
+	return STUN_MS_CONNECTION_ID_LEN + 4
+}
+
+/*
+ * The connection id and sequence number of the MS-SEQUENCE-NUMBER of the
+ * STUN message 'buf'.
+ */
+func stun_message_find_ms_sequence_number(buf []byte) ([]byte, uint32, bool) {
+	value := stun_message_find_attribute(buf, STUN_ATTRIBUTE_MS_SEQUENCE_NUMBER)
+	if len(value) != STUN_MS_CONNECTION_ID_LEN + 4 {
+		return nil, 0, false
+	}
+	connection_id := make([]byte, STUN_MS_CONNECTION_ID_LEN)
+	copy(connection_id, value)
+	return connection_id, binary.BigEndian.Uint32(value[STUN_MS_CONNECTION_ID_LEN:]), true
+}
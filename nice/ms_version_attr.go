@@ -0,0 +1,28 @@
+package nice
+
+import "encoding/binary"
+
+/* The version of MS-TURN the client speaks, see [MS-TURN] 2.2.2.1 */
+const STUN_MS_TURN_VERSION = 1
+
+type StunMsVersionAttrValue struct {
+	version			uint32
+}
+
+func (this StunMsVersionAttrValue) Encode(stream *DataStream) error {
+	stream.WriteUInt32(this.version, binary.BigEndian)
+	return nil
+}
+
+func (this *StunMsVersionAttrValue) Decode(stream *DataStream) error {
+	v, err := stream.ReadInt32(binary.BigEndian)
+	if err != nil {
+		return err
+	}
+	this.version = uint32(v)
+	return nil
+}
+
+func (this StunMsVersionAttrValue) GetSize() uint16 {
+	return 4
+}
@@ -0,0 +1,20 @@
+package nice
+
+/* The NONCE of the long-term credentials (RFC 5389 section 15.8) */
+type StunNonceAttrValue struct {
+	nonce			string
+}
+
+func (this StunNonceAttrValue) Encode(stream *DataStream) error {
+	stream.WriteBytes([]byte(this.nonce))
+	return nil
+}
+
+func (this *StunNonceAttrValue) Decode(stream *DataStream) error {
+	this.nonce = string(stream.ReadLeftBytes())
+	return nil
+}
+
+func (this StunNonceAttrValue) GetSize() uint16 {
+	return uint16(len(this.nonce))
+}
@@ -0,0 +1,29 @@
+package nice
+
+import "encoding/binary"
+
+/*
+ * The PRIORITY of ICE (RFC 5245 section 19.1): the priority the local
+ * candidate of the check would have as a peer reflexive candidate.
+ */
+type StunPriorityAttrValue struct {
+	priority		uint32
+}
+
+func (this StunPriorityAttrValue) Encode(stream *DataStream) error {
+	stream.WriteUInt32(this.priority, binary.BigEndian)
+	return nil
+}
+
+func (this *StunPriorityAttrValue) Decode(stream *DataStream) error {
+	v, err := stream.ReadInt32(binary.BigEndian)
+	if err != nil {
+		return err
+	}
+	this.priority = uint32(v)
+	return nil
+}
+
+func (this StunPriorityAttrValue) GetSize() uint16 {
+	return 4
+}
@@ -0,0 +1,298 @@
+package nice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+/*
+ * Implementation of the pseudo-SSL handshake used by Google Talk and
+ * Microsoft Office Communicator relays to look like TLS to the middle
+ * boxes between the client and the relay on port 443. Once the fake
+ * handshake is done, the wrapped socket is used in clear.
+ */
+
+/**
+ * NicePseudoSSLSocketCompatibility:
+ * @NICE_PSEUDOSSL_SOCKET_COMPATIBILITY_GOOGLE: Use the pseudossl handshake of
+ * Google Talk relays
+ * @NICE_PSEUDOSSL_SOCKET_COMPATIBILITY_MSOC: Use the pseudossl handshake of
+ * Microsoft Office Communicator relays
+ */
+type NicePseudoSSLSocketCompatibility int
+const (
+	_ NicePseudoSSLSocketCompatibility = iota
+	NICE_PSEUDOSSL_SOCKET_COMPATIBILITY_GOOGLE
+	NICE_PSEUDOSSL_SOCKET_COMPATIBILITY_MSOC
+)
+
+var SSL_SERVER_GOOGLE_HANDSHAKE = []byte{
+	0x16,                                           // handshake message
+	0x03, 0x01,                                     // SSL 3.1
+	0x00, 0x4a,                                     // handshake size
+	0x02,                                           // SERVER_HELLO
+	0x00, 0x00, 0x46,                               // length
+	0x03, 0x01,                                     // SSL 3.1
+	0x42, 0x85, 0x45, 0xa7, 0x27, 0xa9, 0x5d, 0xa0, // server random
+	0xb3, 0xc5, 0xe7, 0x53, 0xda, 0x48, 0x2b, 0x3f,
+	0xc6, 0x5a, 0xca, 0x89, 0xc1, 0x58, 0x52, 0xa1,
+	0x78, 0x3c, 0x5b, 0x17, 0x46, 0x00, 0x85, 0x3f,
+	0x20,                                           // session id len
+	0x0e, 0xd3, 0x06, 0x72, 0x5b, 0x5b, 0x1b, 0x5f, // session id
+	0x15, 0xac, 0x13, 0xf9, 0x88, 0x53, 0x9d, 0x9b,
+	0xe8, 0x3d, 0x7b, 0x0c, 0x30, 0x32, 0x6e, 0x38,
+	0x4d, 0xa2, 0x75, 0x57, 0x41, 0x6c, 0x34, 0x5c,
+	0x00, 0x04,                                     // RSA/RC4-128/MD5
+	0x00,                                           // null compression
+}
+
+var SSL_CLIENT_GOOGLE_HANDSHAKE = []byte{
+	0x80, 0x46,                                           // msg len
+	0x01,                                                 // CLIENT_HELLO
+	0x03, 0x01,                                           // SSL 3.1
+	0x00, 0x2d,                                           // ciphersuite len
+	0x00, 0x00,                                           // session id len
+	0x00, 0x10,                                           // challenge len
+	0x01, 0x00, 0x80, 0x03, 0x00, 0x80, 0x07, 0x00, 0xc0, // ciphersuites
+	0x06, 0x00, 0x40, 0x02, 0x00, 0x80, 0x04, 0x00, 0x80,
+	0x00, 0x00, 0x04, 0x00, 0xfe, 0xff, 0x00, 0x00, 0x0a,
+	0x00, 0xfe, 0xfe, 0x00, 0x00, 0x09, 0x00, 0x00, 0x64,
+	0x00, 0x00, 0x62, 0x00, 0x00, 0x03, 0x00, 0x00, 0x06,
+	0x1f, 0x17, 0x0c, 0xa6, 0x2f, 0x00, 0x78, 0xfc,       // challenge
+	0x46, 0x55, 0x2e, 0xb1, 0x83, 0x39, 0xf1, 0xea,
+}
+
+/*
+ * The MS-OC edge relays expect a TLS 1.0 record carrying a ClientHello
+ * and answer with a ServerHello record of their own, whose random and
+ * session id change for every connection: only its framing is checked.
+ */
+var SSL_CLIENT_MSOC_HANDSHAKE = []byte{
+	0x16,                                           // handshake message
+	0x03, 0x01,                                     // TLS 1.0
+	0x00, 0x2d,                                     // record size
+	0x01,                                           // CLIENT_HELLO
+	0x00, 0x00, 0x29,                               // length
+	0x03, 0x01,                                     // TLS 1.0
+	0xc0, 0x1e, 0x6b, 0x8d, 0x3f, 0x61, 0x2d, 0x0a, // client random
+	0x53, 0x9a, 0x47, 0x6e, 0xd4, 0x22, 0x8b, 0x91,
+	0x17, 0x0c, 0xfe, 0x35, 0x74, 0xa8, 0x4b, 0x20,
+	0xe9, 0x63, 0x0d, 0x58, 0xb2, 0x1f, 0x96, 0x4c,
+	0x00,                                           // session id len
+	0x00, 0x02,                                     // ciphersuites len
+	0x00, 0x04,                                     // RSA/RC4-128/MD5
+	0x01, 0x00,                                     // null compression
+}
+
+const SSL_RECORD_HEADER_LEN = 5
+const SSL_RECORD_TYPE_HANDSHAKE = 0x16
+const SSL_HANDSHAKE_TYPE_SERVER_HELLO = 0x02
+
+var PSEUDOSSL_ERR_HANDSHAKE = errors.New("pseudossl: unexpected server handshake")
+
+type pseudossl_queued_message struct {
+	to				*NiceAddress
+	messages		[]*NiceOutputMessage
+}
+
+/*
+ * PseudoSslSocket wraps a connected TCP socket to a relay. The client
+ * handshake is written as soon as the socket is created; everything sent
+ * before the server handshake is received is queued, and the first bytes
+ * received are consumed by the handshake.
+ */
+type PseudoSslSocket struct {
+	base			NiceSockInterface
+	compatibility	NicePseudoSSLSocketCompatibility
+	mutex			sync.Mutex
+	handshaken		bool
+	response		[]byte
+	leftover		[]byte
+	send_queue		[]pseudossl_queued_message
+	writable_cb		NiceSocketWritableCb
+}
+
+func NewPseudoSslSocket(base NiceSockInterface, compatibility NicePseudoSSLSocketCompatibility) *PseudoSslSocket {
+	s := &PseudoSslSocket{}
+	s.base = base
+	s.compatibility = compatibility
+
+	hello := SSL_CLIENT_GOOGLE_HANDSHAKE
+	if compatibility == NICE_PSEUDOSSL_SOCKET_COMPATIBILITY_MSOC {
+		hello = SSL_CLIENT_MSOC_HANDSHAKE
+	}
+	out := &NiceOutputMessage{buffers: [][]byte{hello}}
+	if err := base.send_messages(nil, []*NiceOutputMessage{out}); err != nil {
+		return nil
+	}
+	return s
+}
+
+/**
+ * nice_pseudossl_socket_new:
+ * @base_socket: The connected TCP socket to the relay
+ * @compatibility: The handshake flavour the relay expects
+ *
+ * Wraps @base_socket and starts the fake handshake on it.
+ *
+ * Returns: the new socket, %NULL if the client handshake could not be sent
+ */
+func nice_pseudossl_socket_new(base NiceSockInterface, compatibility NicePseudoSSLSocketCompatibility) *PseudoSslSocket {
+	return NewPseudoSslSocket(base, compatibility)
+}
+
+/*
+ * Returns how many bytes of 'response' the server handshake takes, or 0
+ * when more bytes are needed to know.
+ */
+func (this *PseudoSslSocket) server_handshake_len() int {
+	if this.compatibility == NICE_PSEUDOSSL_SOCKET_COMPATIBILITY_GOOGLE {
+		if len(this.response) < len(SSL_SERVER_GOOGLE_HANDSHAKE) {
+			return 0
+		}
+		return len(SSL_SERVER_GOOGLE_HANDSHAKE)
+	}
+
+	if len(this.response) < SSL_RECORD_HEADER_LEN {
+		return 0
+	}
+	l := SSL_RECORD_HEADER_LEN + int(binary.BigEndian.Uint16(this.response[3:5]))
+	if len(this.response) < l {
+		return 0
+	}
+	return l
+}
+
+func (this *PseudoSslSocket) server_handshake_valid(handshake []byte) bool {
+	if this.compatibility == NICE_PSEUDOSSL_SOCKET_COMPATIBILITY_GOOGLE {
+		return bytes.Equal(handshake, SSL_SERVER_GOOGLE_HANDSHAKE)
+	}
+
+	return len(handshake) > SSL_RECORD_HEADER_LEN &&
+		handshake[0] == SSL_RECORD_TYPE_HANDSHAKE &&
+		handshake[1] == 0x03 && handshake[2] == 0x01 &&
+		handshake[SSL_RECORD_HEADER_LEN] == SSL_HANDSHAKE_TYPE_SERVER_HELLO
+}
+
+/*
+ * Reads from the base socket until the whole server handshake arrived,
+ * then flushes the queued messages.
+ */
+func (this *PseudoSslSocket) recv_handshake() error {
+	var from NiceAddress
+	buf := make([]byte, MAX_BUFFER_SIZE)
+	msg := &NiceInputMessage{buffers: [][]byte{buf}, from: &from}
+
+	for {
+		l := this.server_handshake_len()
+		if l > 0 {
+			if !this.server_handshake_valid(this.response[:l]) {
+				return PSEUDOSSL_ERR_HANDSHAKE
+			}
+			if l < len(this.response) {
+				this.leftover = append([]byte{}, this.response[l:]...)
+			}
+			this.response = nil
+			break
+		}
+
+		if err := this.base.recv_messages([]*NiceInputMessage{msg}); err != nil {
+			return err
+		}
+		this.response = append(this.response, buf[:msg.length]...)
+	}
+
+	this.mutex.Lock()
+	this.handshaken = true
+	queue := this.send_queue
+	this.send_queue = nil
+	this.mutex.Unlock()
+
+	for i := 0; i < len(queue); i++ {
+		if err := this.base.send_messages(queue[i].to, queue[i].messages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *PseudoSslSocket) recv_messages(recv_msgs []*NiceInputMessage) error {
+	this.mutex.Lock()
+	handshaken := this.handshaken
+	this.mutex.Unlock()
+
+	if !handshaken {
+		if err := this.recv_handshake(); err != nil {
+			return err
+		}
+	}
+
+	if len(this.leftover) > 0 && len(recv_msgs) > 0 && len(recv_msgs[0].buffers) > 0 {
+		msg := recv_msgs[0]
+		n := copy(msg.buffers[0], this.leftover)
+		this.leftover = this.leftover[n:]
+		msg.length = n
+		for i := 1; i < len(recv_msgs); i++ {
+			recv_msgs[i].length = 0
+		}
+		return nil
+	}
+	return this.base.recv_messages(recv_msgs)
+}
+
+func (this *PseudoSslSocket) send_messages(to *NiceAddress, messages []*NiceOutputMessage) error {
+	this.mutex.Lock()
+	if !this.handshaken {
+		/* copy, the caller may reuse its buffers */
+		queued := make([]*NiceOutputMessage, len(messages))
+		for i := 0; i < len(messages); i++ {
+			m := &NiceOutputMessage{}
+			for j := 0; j < len(messages[i].buffers); j++ {
+				m.buffers = append(m.buffers, append([]byte{}, messages[i].buffers[j]...))
+			}
+			queued[i] = m
+		}
+		var dst *NiceAddress
+		if to != nil {
+			addr := *to
+			dst = &addr
+		}
+		this.send_queue = append(this.send_queue, pseudossl_queued_message{to: dst, messages: queued})
+		this.mutex.Unlock()
+		return nil
+	}
+	this.mutex.Unlock()
+	return this.base.send_messages(to, messages)
+}
+
+func (this *PseudoSslSocket) send_messages_reliable(to *NiceAddress, messages []*NiceOutputMessage) error {
+	return this.send_messages(to, messages)
+}
+
+func (this *PseudoSslSocket) is_reliable() bool {
+	return this.base.is_reliable()
+}
+
+func (this *PseudoSslSocket) can_send(addr *NiceAddress) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.handshaken && this.base.can_send(addr)
+}
+
+func (this *PseudoSslSocket) set_writable_callback(cb NiceSocketWritableCb) {
+	this.writable_cb = cb
+}
+
+func (this *PseudoSslSocket) is_based_on(ohter *NiceSocket) bool {
+	return this.base.is_based_on(ohter)
+}
+
+func (this *PseudoSslSocket) get_type() NiceSocketType {
+	return NICE_SOCKET_TYPE_PSEUDOSSL
+}
+
+func (this *PseudoSslSocket) close() {
+	this.base.close()
+}
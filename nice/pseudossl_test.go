@@ -0,0 +1,128 @@
+package nice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func test_pseudossl_read(t *testing.T, srv net.Conn, n int) []byte {
+	buf := make([]byte, n)
+	srv.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(srv, buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func test_pseudossl_recv(sock *PseudoSslSocket) ([]byte, error) {
+	buf := make([]byte, MAX_BUFFER_SIZE)
+	msg := &NiceInputMessage{buffers: [][]byte{buf}}
+	if err := sock.recv_messages([]*NiceInputMessage{msg}); err != nil {
+		return nil, err
+	}
+	return buf[:msg.length], nil
+}
+
+/* The handshakes are framed by their own length fields */
+func TestPseudoSslHandshakeLengths(t *testing.T) {
+	if l := 2 + int(binary.BigEndian.Uint16(SSL_CLIENT_GOOGLE_HANDSHAKE[0:2]) & 0x7fff); l != len(SSL_CLIENT_GOOGLE_HANDSHAKE) {
+		t.Fatalf("Google client hello of %d bytes, framed as %d", len(SSL_CLIENT_GOOGLE_HANDSHAKE), l)
+	}
+	for _, hello := range [][]byte{SSL_SERVER_GOOGLE_HANDSHAKE, SSL_CLIENT_MSOC_HANDSHAKE} {
+		if l := SSL_RECORD_HEADER_LEN + int(binary.BigEndian.Uint16(hello[3:5])); l != len(hello) {
+			t.Fatalf("record of %d bytes, framed as %d", len(hello), l)
+		}
+		if l := SSL_RECORD_HEADER_LEN + 4 + int(hello[7]) << 8 + int(hello[8]); l != len(hello) {
+			t.Fatalf("handshake of %d bytes, framed as %d", len(hello), l)
+		}
+	}
+}
+
+/*
+ * The client hello is the first thing on the wire; what is sent before
+ * the server hello is held back, and what follows the server hello in
+ * the same reads comes out as data.
+ */
+func TestPseudoSslExchange(t *testing.T) {
+	msoc_hello := []byte{
+		0x16, 0x03, 0x01, 0x00, 0x26,
+		0x02, 0x00, 0x00, 0x22, 0x03, 0x01,
+	}
+	msoc_hello = append(msoc_hello, bytes.Repeat([]byte{0x5a}, 32)...)
+	tests := []struct {
+		name			string
+		compatibility	NicePseudoSSLSocketCompatibility
+		client			[]byte
+		server			[]byte
+	}{
+		{"google", NICE_PSEUDOSSL_SOCKET_COMPATIBILITY_GOOGLE, SSL_CLIENT_GOOGLE_HANDSHAKE, SSL_SERVER_GOOGLE_HANDSHAKE},
+		{"oc2007", NICE_PSEUDOSSL_SOCKET_COMPATIBILITY_MSOC, SSL_CLIENT_MSOC_HANDSHAKE, msoc_hello},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base, srv := test_turn_tcp_conn(t)
+			sock := nice_pseudossl_socket_new(base, test.compatibility)
+			if sock == nil {
+				t.Fatal("no socket")
+			}
+			if hello := test_pseudossl_read(t, srv, len(test.client)); !bytes.Equal(hello, test.client) {
+				t.Fatalf("client hello\n% x\nwant\n% x", hello, test.client)
+			}
+
+			if err := sock.send_messages(nil, []*NiceOutputMessage{{buffers: [][]byte{[]byte("early")}}}); err != nil {
+				t.Fatal(err)
+			}
+			if sock.can_send(nil) {
+				t.Fatal("writable before the server hello")
+			}
+
+			/* the server hello in two segments, data behind it */
+			half := len(test.server) / 2
+			srv.Write(test.server[:half])
+			time.Sleep(10 * time.Millisecond)
+			srv.Write(append(append([]byte{}, test.server[half:]...), "data"...))
+			data, err := test_pseudossl_recv(sock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "data" {
+				t.Fatalf("received %q after the handshake", data)
+			}
+			if early := test_pseudossl_read(t, srv, 5); string(early) != "early" {
+				t.Fatalf("queued %q", early)
+			}
+		})
+	}
+}
+
+/* A server hello other than the expected one fails the socket */
+func TestPseudoSslServerMismatch(t *testing.T) {
+	google := append([]byte{}, SSL_SERVER_GOOGLE_HANDSHAKE...)
+	google[len(google) - 1] ^= 0xff
+	tests := []struct {
+		name			string
+		compatibility	NicePseudoSSLSocketCompatibility
+		server			[]byte
+	}{
+		{"google", NICE_PSEUDOSSL_SOCKET_COMPATIBILITY_GOOGLE, google},
+		{"oc2007 alert", NICE_PSEUDOSSL_SOCKET_COMPATIBILITY_MSOC, []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x28}},
+		{"oc2007 client hello", NICE_PSEUDOSSL_SOCKET_COMPATIBILITY_MSOC, SSL_CLIENT_MSOC_HANDSHAKE},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base, srv := test_turn_tcp_conn(t)
+			sock := nice_pseudossl_socket_new(base, test.compatibility)
+			if sock == nil {
+				t.Fatal("no socket")
+			}
+			srv.Write(test.server)
+			if _, err := test_pseudossl_recv(sock); err != PSEUDOSSL_ERR_HANDSHAKE {
+				t.Fatalf("server hello % x: %v", test.server, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,1189 @@
+package nice
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+/**
+ * SECTION:pseudotcp
+ * @short_description: Pseudo TCP implementation
+ * @include: pseudotcp.h
+ * @stability: Stable
+ *
+ * The #PseudoTcpSocket is an object implementing a Pseudo Tcp Socket for use
+ * over UDP.
+ * The socket will implement a subset of the TCP stack to allow for a reliable
+ * transport over non-reliable sockets (such as UDP).
+ *
+ * The segment format, the CONNECT control segment and the timers follow the
+ * libjingle pseudo TCP implementation that libnice also uses, so a reliable
+ * go-licode agent can talk to a reliable libnice agent.
+ */
+
+/**
+ * PseudoTcpState:
+ * @TCP_LISTEN: The socket's initial state. The socket isn't connected and is
+ * listening for an incoming connection
+ * @TCP_SYN_SENT: The socket has sent a connection request (SYN) packet and is
+ * waiting for an answer
+ * @TCP_SYN_RECEIVED: The socket has received a connection request (SYN) packet.
+ * @TCP_ESTABLISHED: The socket is connected
+ * @TCP_CLOSED: The socket has been closed
+ * @TCP_FIN_WAIT_1: The socket has been closed locally but not remotely
+ * @TCP_FIN_WAIT_2: The socket has been closed locally but not remotely
+ * @TCP_CLOSING: The socket has been closed locally and remotely
+ * @TCP_TIME_WAIT: The socket has been closed locally and remotely
+ * @TCP_CLOSE_WAIT: The socket has been closed remotely but not locally
+ * @TCP_LAST_ACK: The socket has been closed locally and remotely
+ *
+ * An enum representing the state of the #PseudoTcpSocket. These states
+ * correspond to the TCP states in RFC 793.
+ */
+type PseudoTcpState int
+const (
+	TCP_LISTEN PseudoTcpState = iota
+	TCP_SYN_SENT
+	TCP_SYN_RECEIVED
+	TCP_ESTABLISHED
+	TCP_CLOSED
+	TCP_FIN_WAIT_1
+	TCP_FIN_WAIT_2
+	TCP_CLOSING
+	TCP_TIME_WAIT
+	TCP_CLOSE_WAIT
+	TCP_LAST_ACK
+)
+
+/**
+ * PseudoTcpWriteResult:
+ * @WR_SUCCESS: The write operation was successful
+ * @WR_TOO_LARGE: The socket type requires that message be sent atomically
+ * and the size of the message to be sent made this impossible.
+ * @WR_FAIL: There was an error sending the message
+ *
+ * An enum representing the result value of the write operation requested by
+ * the #PseudoTcpSocket.
+ */
+type PseudoTcpWriteResult int
+const (
+	WR_SUCCESS PseudoTcpWriteResult = iota
+	WR_TOO_LARGE
+	WR_FAIL
+)
+
+/**
+ * PseudoTcpCallbacks:
+ * @user_data: A user defined pointer to be passed to the callbacks
+ * @PseudoTcpOpened: The #PseudoTcpSocket is now connected
+ * @PseudoTcpReadable: The socket is readable
+ * @PseudoTcpWritable: The socket is writable
+ * @PseudoTcpClosed: The socket was closed (both sides)
+ * @WritePacket: This callback is called when the socket needs to send data.
+ *
+ * A structure containing callbacks functions that will be called by the
+ * #PseudoTcpSocket when some events happen. All the callbacks are invoked
+ * synchronously from the #PseudoTcpSocket call that triggered them.
+ */
+type PseudoTcpCallbacks struct {
+	user_data			interface{}
+	PseudoTcpOpened		func(tcp *PseudoTcpSocket, data interface{})
+	PseudoTcpReadable	func(tcp *PseudoTcpSocket, data interface{})
+	PseudoTcpWritable	func(tcp *PseudoTcpSocket, data interface{})
+	PseudoTcpClosed		func(tcp *PseudoTcpSocket, err error, data interface{})
+	WritePacket			func(tcp *PseudoTcpSocket, buf []byte, data interface{}) PseudoTcpWriteResult
+}
+
+var PSEUDO_TCP_ERR_WOULD_BLOCK = errors.New("pseudo tcp operation would block")
+var PSEUDO_TCP_ERR_NOT_CONNECTED = errors.New("pseudo tcp socket is not connected")
+var PSEUDO_TCP_ERR_CONNECTION_RESET = errors.New("pseudo tcp connection reset by peer")
+var PSEUDO_TCP_ERR_TIMED_OUT = errors.New("pseudo tcp connection timed out")
+var PSEUDO_TCP_ERR_PIPE = errors.New("pseudo tcp socket is shut down for writing")
+
+/* Standard MTUs, used as starting points for the MSS */
+const PSEUDO_TCP_MAX_PACKET = 65535
+const PSEUDO_TCP_MIN_PACKET = 296
+const PSEUDO_TCP_DEFAULT_MTU = 1400
+
+const PSEUDO_TCP_IP_HEADER_SIZE = 20
+const PSEUDO_TCP_UDP_HEADER_SIZE = 8
+/* TODO: Make JINGLE_HEADER_SIZE transparent to this code? */
+const PSEUDO_TCP_JINGLE_HEADER_SIZE = 64
+
+/*
+ * Segment header, all fields in network byte order:
+ *
+ *  0: conversation number (32)
+ *  4: sequence number (32)
+ *  8: acknowledgement number (32)
+ * 12: reserved (8), flags (8), receive window (16)
+ * 16: timestamp value (32)
+ * 20: timestamp echo reply (32)
+ */
+const PSEUDO_TCP_HEADER_SIZE = 24
+const PSEUDO_TCP_PACKET_OVERHEAD = PSEUDO_TCP_HEADER_SIZE + PSEUDO_TCP_UDP_HEADER_SIZE +
+	PSEUDO_TCP_IP_HEADER_SIZE + PSEUDO_TCP_JINGLE_HEADER_SIZE
+
+const PSEUDO_TCP_FLAG_FIN = 0x01
+const PSEUDO_TCP_FLAG_CTL = 0x02
+const PSEUDO_TCP_FLAG_RST = 0x04
+
+const PSEUDO_TCP_CTL_CONNECT = 0
+
+/* Timers, in milliseconds */
+const PSEUDO_TCP_MIN_RTO = 250
+const PSEUDO_TCP_DEF_RTO = 3000
+const PSEUDO_TCP_MAX_RTO = 60000
+const PSEUDO_TCP_DEF_ACK_DELAY = 100
+const PSEUDO_TCP_DEFAULT_TIMEOUT = 4000
+/* shortened 2*MSL, the peer is on the other side of a single ICE pair */
+const PSEUDO_TCP_TIME_WAIT_TIMEOUT = 1000
+
+/* A connection is dropped after that many retransmissions of a segment */
+const PSEUDO_TCP_MAX_RETRANSMISSIONS = 15
+
+const PSEUDO_TCP_DEFAULT_RCV_BUF_SIZE = 60 * 1024
+const PSEUDO_TCP_DEFAULT_SND_BUF_SIZE = 90 * 1024
+
+type pseudo_tcp_segment struct {
+	seq			uint32
+	len			uint32
+	xmit		uint
+	flags		uint8
+}
+
+type pseudo_tcp_rsegment struct {
+	seq			uint32
+	data		[]byte
+}
+
+type PseudoTcpSocket struct {
+	callbacks		PseudoTcpCallbacks
+	conv			uint32
+	state			PseudoTcpState
+	err				error
+	clock			Clock
+	start			time.Time
+
+	read_enable		bool
+	write_enable	bool
+	outgoing		bool
+	shutdown_write	bool
+	fin_queued		bool
+	fin_seq			uint32
+
+	/* incoming data */
+	rbuf			[]byte
+	rbuf_len		uint32
+	rlist			[]pseudo_tcp_rsegment
+	rcv_nxt			uint32
+	rcv_wnd			uint32
+	rcv_fin			bool
+	lastrecv		uint32
+
+	/* outgoing data */
+	sbuf			[]byte
+	sbuf_len		uint32
+	slist			[]*pseudo_tcp_segment
+	snd_una			uint32
+	snd_nxt			uint32
+	snd_wnd			uint32
+	lastsend		uint32
+	mss				uint32
+	mtu				uint32
+
+	/* timestamps */
+	ts_recent		uint32
+	ts_lastack		uint32
+	t_ack			uint32
+	rto_base		uint32
+	time_wait_base	uint32
+
+	/* round-trip calculation */
+	rx_rttvar		uint32
+	rx_srtt			uint32
+	rx_rto			uint32
+
+	/* congestion control */
+	cwnd			uint32
+	ssthresh		uint32
+	dup_acks		uint32
+	recover			uint32
+	ack_delay		uint32
+}
+
+/**
+ * pseudo_tcp_socket_new:
+ * @conversation: The conversation id for the socket.
+ * @callbacks: A pointer to the #PseudoTcpCallbacks structure for getting
+ * notified of the #PseudoTcpSocket events.
+ * @clock: The #Clock of the timestamps, NiceSystemClock if nil
+ *
+ * Creates a new #PseudoTcpSocket for the specified conversation
+ *
+ * <note>
+   <para>
+     The @conversation must be the same on both sides of a connection
+   </para>
+ </note>
+ *
+ * Returns: The new #PseudoTcpSocket object, %NULL on error
+ */
+func pseudo_tcp_socket_new(conversation uint32, callbacks *PseudoTcpCallbacks, clock Clock) *PseudoTcpSocket {
+	if clock == nil {
+		clock = NiceSystemClock
+	}
+	s := &PseudoTcpSocket{}
+	s.callbacks = *callbacks
+	s.conv = conversation
+	s.state = TCP_LISTEN
+	s.clock = clock
+	s.start = clock.Now()
+
+	s.rbuf_len = PSEUDO_TCP_DEFAULT_RCV_BUF_SIZE
+	s.sbuf_len = PSEUDO_TCP_DEFAULT_SND_BUF_SIZE
+	s.rcv_wnd = s.rbuf_len
+	s.snd_wnd = 1
+
+	s.mtu = PSEUDO_TCP_DEFAULT_MTU
+	s.mss = PSEUDO_TCP_MIN_PACKET - PSEUDO_TCP_PACKET_OVERHEAD
+	s.cwnd = 2 * s.mss
+	s.ssthresh = s.rbuf_len
+
+	s.rx_rto = PSEUDO_TCP_DEF_RTO
+	s.ack_delay = PSEUDO_TCP_DEF_ACK_DELAY
+
+	now := s.get_current_time()
+	s.lastsend = now
+	s.lastrecv = now
+	return s
+}
+
+func (this *PseudoTcpSocket) get_current_time() uint32 {
+	return uint32(this.clock.Now().Sub(this.start) / time.Millisecond)
+}
+
+func seq_lt(a uint32, b uint32) bool {
+	return int32(a - b) < 0
+}
+
+func seq_le(a uint32, b uint32) bool {
+	return int32(a - b) <= 0
+}
+
+func seq_gt(a uint32, b uint32) bool {
+	return int32(a - b) > 0
+}
+
+func seq_ge(a uint32, b uint32) bool {
+	return int32(a - b) >= 0
+}
+
+func time_diff(later uint32, earlier uint32) int32 {
+	return int32(later - earlier)
+}
+
+/**
+ * pseudo_tcp_socket_connect:
+ * @self: The #PseudoTcpSocket object.
+ *
+ * Connects the #PseudoTcpSocket to the peer with the same conversation id.
+ * The connection will only be successful after the
+ * %PseudoTcpCallbacks:PseudoTcpOpened callback is called
+ *
+ * Both peers may connect at the same time, the CONNECT segments then cross
+ * each other like a TCP simultaneous open.
+ */
+func (this *PseudoTcpSocket) pseudo_tcp_socket_connect() error {
+	if this.state != TCP_LISTEN {
+		return errors.New("pseudo tcp socket is already connecting")
+	}
+
+	this.state = TCP_SYN_SENT
+	this.outgoing = true
+	this.queue_connect_message()
+	this.attempt_send()
+	return nil
+}
+
+/**
+ * pseudo_tcp_socket_notify_mtu:
+ * @self: The #PseudoTcpSocket object.
+ * @mtu: The new MTU of the socket
+ *
+ * Notify the #PseudoTcpSocket of a new Path MTU so it can adjust its
+ * maximum segment size.
+ */
+func (this *PseudoTcpSocket) pseudo_tcp_socket_notify_mtu(mtu uint32) {
+	if mtu <= PSEUDO_TCP_PACKET_OVERHEAD || mtu > PSEUDO_TCP_MAX_PACKET {
+		return
+	}
+	this.mtu = mtu
+	if this.state == TCP_ESTABLISHED {
+		this.adjust_mtu()
+	}
+}
+
+func (this *PseudoTcpSocket) adjust_mtu() {
+	this.mss = this.mtu - PSEUDO_TCP_PACKET_OVERHEAD
+	/* Enforce minimums on ssthresh and cwnd */
+	if this.ssthresh < 2 * this.mss {
+		this.ssthresh = 2 * this.mss
+	}
+	if this.cwnd < this.mss {
+		this.cwnd = this.mss
+	}
+}
+
+/**
+ * pseudo_tcp_socket_recv:
+ * @self: The #PseudoTcpSocket object.
+ * @buffer: The buffer to fill with received data
+ *
+ * Receive data from the socket.
+ *
+ * <note>
+   <para>
+     Only call this on the %PseudoTcpCallbacks:PseudoTcpReadable callback.
+   </para>
+   <para>
+     This function should be called in a loop. If this function does not
+     return PSEUDO_TCP_ERR_WOULD_BLOCK, then it should be called again.
+   </para>
+ </note>
+ *
+ * Returns: The number of bytes received, 0 once the peer closed its side of
+ * the connection, or an error.
+ */
+func (this *PseudoTcpSocket) pseudo_tcp_socket_recv(buffer []byte) (int, error) {
+	if this.state == TCP_LISTEN || this.state == TCP_SYN_SENT || this.state == TCP_SYN_RECEIVED {
+		return -1, PSEUDO_TCP_ERR_NOT_CONNECTED
+	}
+
+	if len(this.rbuf) == 0 {
+		if this.rcv_fin || this.state == TCP_CLOSED {
+			return 0, nil
+		}
+		this.read_enable = true
+		return -1, PSEUDO_TCP_ERR_WOULD_BLOCK
+	}
+
+	n := copy(buffer, this.rbuf)
+	this.rbuf = this.rbuf[n:]
+	if len(this.rbuf) == 0 {
+		this.rbuf = nil
+	}
+
+	/* tell the peer about the reopened window once it is worth a segment */
+	available := this.rbuf_len - uint32(len(this.rbuf)) - this.rlist_len()
+	if (available > this.rcv_wnd && available - this.rcv_wnd >= this.mss) || (this.rcv_wnd == 0 && available > 0) {
+		this.rcv_wnd = available
+		this.send_ack()
+	} else {
+		this.rcv_wnd = available
+	}
+	return n, nil
+}
+
+/**
+ * pseudo_tcp_socket_send:
+ * @self: The #PseudoTcpSocket object.
+ * @buffer: The buffer with data to send
+ *
+ * Send data on the socket.
+ *
+ * <note>
+   <para>
+     If this function returns PSEUDO_TCP_ERR_WOULD_BLOCK, the
+     %PseudoTcpCallbacks:PseudoTcpWritable callback is called once more
+     space is available in the send buffer.
+   </para>
+ </note>
+ *
+ * Returns: The number of bytes queued, which may be less than len(buffer)
+ */
+func (this *PseudoTcpSocket) pseudo_tcp_socket_send(buffer []byte) (int, error) {
+	if this.state != TCP_ESTABLISHED && this.state != TCP_CLOSE_WAIT {
+		if this.err != nil {
+			return -1, this.err
+		}
+		return -1, PSEUDO_TCP_ERR_NOT_CONNECTED
+	}
+
+	if this.shutdown_write {
+		return -1, PSEUDO_TCP_ERR_PIPE
+	}
+
+	available := this.sbuf_len - uint32(len(this.sbuf))
+	if available == 0 {
+		this.write_enable = true
+		return -1, PSEUDO_TCP_ERR_WOULD_BLOCK
+	}
+
+	n := uint32(len(buffer))
+	if n > available {
+		n = available
+	}
+	this.sbuf = append(this.sbuf, buffer[:n]...)
+	this.attempt_send()
+	if n < uint32(len(buffer)) {
+		this.write_enable = true
+	}
+	return int(n), nil
+}
+
+/**
+ * pseudo_tcp_socket_send_messages:
+ * @self: The #PseudoTcpSocket object.
+ * @messages: The messages whose buffers are sent, in order
+ * @allow_partial: %TRUE to queue as many bytes as fit, %FALSE to queue
+ * each message whole or not at all
+ *
+ * Send the buffers of @messages as one stream of data on the socket.
+ *
+ * Returns: The number of bytes queued with @allow_partial, of messages
+ * queued otherwise. PSEUDO_TCP_ERR_WOULD_BLOCK if nothing could be.
+ */
+func (this *PseudoTcpSocket) pseudo_tcp_socket_send_messages(messages []*NiceOutputMessage, allow_partial bool) (int, error) {
+	sent := 0
+	for i := 0; i < len(messages); i++ {
+		if !allow_partial && output_message_get_size(messages[i]) > this.pseudo_tcp_socket_get_available_send_space() {
+			if i > 0 {
+				return i, nil
+			}
+			/* the reason, if the socket cannot send at all */
+			if _, err := this.pseudo_tcp_socket_send(nil); err != nil {
+				return -1, err
+			}
+			this.write_enable = true
+			return -1, PSEUDO_TCP_ERR_WOULD_BLOCK
+		}
+
+		for j := 0; j < len(messages[i].buffers); j++ {
+			buf := messages[i].buffers[j]
+			if len(buf) == 0 {
+				continue
+			}
+			n, err := this.pseudo_tcp_socket_send(buf)
+			if err != nil {
+				if sent > 0 {
+					return sent, nil
+				}
+				return -1, err
+			}
+			sent += n
+			if n < len(buf) {
+				return sent, nil
+			}
+		}
+	}
+	if allow_partial {
+		return sent, nil
+	}
+	return len(messages), nil
+}
+
+/**
+ * pseudo_tcp_socket_close:
+ * @self: The #PseudoTcpSocket object.
+ * @force: %TRUE to close the socket forcefully, %FALSE to close it gracefully
+ *
+ * Close the socket for sending. If @force is set to %FALSE, the socket will
+ * finish sending pending data before closing. If it is set to %TRUE, the socket
+ * will discard pending data and close the connection immediately (sending a TCP
+ * RST segment).
+ *
+ * The socket will be closed in both directions – sending and receiving – and
+ * any pending received data must be read before calling this function, by
+ * calling pseudo_tcp_socket_recv() until it blocks. If any pending data is in
+ * the receive buffer when pseudo_tcp_socket_close() is called, a TCP RST
+ * segment will be sent to the peer to notify it of the data loss.
+ */
+func (this *PseudoTcpSocket) pseudo_tcp_socket_close(force bool) {
+	if this.state == TCP_CLOSED {
+		return
+	}
+
+	if force || len(this.rbuf) > 0 || this.state == TCP_LISTEN || this.state == TCP_SYN_SENT {
+		if this.state != TCP_LISTEN {
+			this.send_packet(this.snd_nxt, PSEUDO_TCP_FLAG_RST, 0, 0)
+		}
+		this.closedown(nil)
+		return
+	}
+
+	this.pseudo_tcp_socket_shutdown_write()
+}
+
+/*
+ * Queues a FIN after the pending data. The connection is fully closed once
+ * both FINs are acknowledged.
+ */
+func (this *PseudoTcpSocket) pseudo_tcp_socket_shutdown_write() {
+	if this.shutdown_write {
+		return
+	}
+	this.shutdown_write = true
+
+	switch this.state {
+	case TCP_SYN_RECEIVED, TCP_ESTABLISHED:
+		this.state = TCP_FIN_WAIT_1
+	case TCP_CLOSE_WAIT:
+		this.state = TCP_LAST_ACK
+	default:
+		return
+	}
+
+	this.fin_queued = true
+	this.fin_seq = this.snd_una + uint32(len(this.sbuf))
+	this.attempt_send()
+}
+
+/**
+ * pseudo_tcp_socket_get_error:
+ * @self: The #PseudoTcpSocket object.
+ *
+ * Return the last encountered error.
+ */
+func (this *PseudoTcpSocket) pseudo_tcp_socket_get_error() error {
+	return this.err
+}
+
+/**
+ * pseudo_tcp_socket_is_closed:
+ * @self: The #PseudoTcpSocket object.
+ *
+ * Gets whether the socket is closed, with the shutdown handshake completed,
+ * and both peers no longer able to read or write data to the connection.
+ */
+func (this *PseudoTcpSocket) pseudo_tcp_socket_is_closed() bool {
+	return this.state == TCP_CLOSED
+}
+
+/**
+ * pseudo_tcp_socket_is_closed_remotely:
+ * @self: The #PseudoTcpSocket object.
+ *
+ * Gets whether the socket has received a FIN from the peer, or is closed:
+ * no more data will be received once the buffer is read.
+ */
+func (this *PseudoTcpSocket) pseudo_tcp_socket_is_closed_remotely() bool {
+	return this.rcv_fin || this.state == TCP_CLOSED
+}
+
+/**
+ * pseudo_tcp_socket_get_available_bytes:
+ * @self: The #PseudoTcpSocket object.
+ *
+ * Gets the number of bytes of data in the buffer that can be read without
+ * receiving more packets from the network.
+ */
+func (this *PseudoTcpSocket) pseudo_tcp_socket_get_available_bytes() int {
+	return len(this.rbuf)
+}
+
+/**
+ * pseudo_tcp_socket_get_available_send_space:
+ * @self: The #PseudoTcpSocket object.
+ *
+ * Gets the number of bytes of space available in the transmission buffer.
+ */
+func (this *PseudoTcpSocket) pseudo_tcp_socket_get_available_send_space() int {
+	if this.state != TCP_ESTABLISHED && this.state != TCP_CLOSE_WAIT {
+		return 0
+	}
+	return int(this.sbuf_len) - len(this.sbuf)
+}
+
+/**
+ * pseudo_tcp_socket_get_next_clock:
+ * @self: The #PseudoTcpSocket object.
+ *
+ * Call this to determine the timeout needed before the next time call
+ * to pseudo_tcp_socket_notify_clock() should be made.
+ *
+ * Returns: the delay and %TRUE, or %FALSE once the socket is closed and no
+ * longer needs a clock.
+ */
+func (this *PseudoTcpSocket) pseudo_tcp_socket_get_next_clock() (time.Duration, bool) {
+	if this.state == TCP_CLOSED {
+		return 0, false
+	}
+
+	now := this.get_current_time()
+	var timeout int32 = PSEUDO_TCP_DEFAULT_TIMEOUT
+
+	if this.t_ack != 0 {
+		timeout = min_int32(timeout, time_diff(this.t_ack + this.ack_delay, now))
+	}
+	if this.rto_base != 0 {
+		timeout = min_int32(timeout, time_diff(this.rto_base + this.rx_rto, now))
+	}
+	if this.snd_wnd == 0 {
+		timeout = min_int32(timeout, time_diff(this.lastsend + this.rx_rto, now))
+	}
+	if this.state == TCP_TIME_WAIT {
+		timeout = min_int32(timeout, time_diff(this.time_wait_base + PSEUDO_TCP_TIME_WAIT_TIMEOUT, now))
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+	return time.Duration(timeout) * time.Millisecond, true
+}
+
+func min_int32(a int32, b int32) int32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+/**
+ * pseudo_tcp_socket_notify_clock:
+ * @self: The #PseudoTcpSocket object.
+ *
+ * Start the processing of receiving data, pending data or syn/acks.
+ * Call this based on timeout value returned by
+ * pseudo_tcp_socket_get_next_clock().
+ * It's ok to call this too frequently.
+ */
+func (this *PseudoTcpSocket) pseudo_tcp_socket_notify_clock() {
+	if this.state == TCP_CLOSED {
+		return
+	}
+
+	now := this.get_current_time()
+
+	if this.state == TCP_TIME_WAIT && time_diff(now, this.time_wait_base) >= PSEUDO_TCP_TIME_WAIT_TIMEOUT {
+		this.closedown(nil)
+		return
+	}
+
+	/* Check if it's time to retransmit a segment */
+	if this.rto_base != 0 && time_diff(this.rto_base + this.rx_rto, now) <= 0 {
+		if len(this.slist) == 0 {
+			this.rto_base = 0
+		} else {
+			seg := this.slist[0]
+			if seg.xmit >= PSEUDO_TCP_MAX_RETRANSMISSIONS {
+				this.closedown(PSEUDO_TCP_ERR_TIMED_OUT)
+				return
+			}
+			if !this.transmit(seg, now) {
+				this.closedown(PSEUDO_TCP_ERR_CONNECTION_RESET)
+				return
+			}
+
+			in_flight := this.snd_nxt - this.snd_una
+			this.ssthresh = max_uint32(in_flight / 2, 2 * this.mss)
+			this.cwnd = this.mss
+			this.recover = this.snd_nxt
+			this.rx_rto = min_uint32(PSEUDO_TCP_MAX_RTO, this.rx_rto * 2)
+			this.rto_base = now
+		}
+	}
+
+	/* Check if it's time to probe closed windows */
+	if this.snd_wnd == 0 && time_diff(this.lastsend + this.rx_rto, now) <= 0 {
+		if time_diff(now, this.lastrecv) >= 15000 {
+			this.closedown(PSEUDO_TCP_ERR_CONNECTION_RESET)
+			return
+		}
+		/* probe the window */
+		this.send_packet(this.snd_nxt - 1, 0, 0, 0)
+		this.lastsend = now
+		/* back off retransmit timer */
+		this.rx_rto = min_uint32(PSEUDO_TCP_MAX_RTO, this.rx_rto * 2)
+	}
+
+	/* Check if it's time to send delayed acks */
+	if this.t_ack != 0 && time_diff(this.t_ack + this.ack_delay, now) <= 0 {
+		this.send_ack()
+	}
+}
+
+func max_uint32(a uint32, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min_uint32(a uint32, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+/**
+ * pseudo_tcp_socket_notify_packet:
+ * @self: The #PseudoTcpSocket object.
+ * @buffer: The buffer containing the received data
+ *
+ * Notify the #PseudoTcpSocket when a new packet arrives
+ *
+ * Returns: %TRUE if the packet was processed successfully, %FALSE otherwise
+ */
+func (this *PseudoTcpSocket) pseudo_tcp_socket_notify_packet(buffer []byte) bool {
+	if len(buffer) > PSEUDO_TCP_MAX_PACKET || len(buffer) < PSEUDO_TCP_HEADER_SIZE {
+		return false
+	}
+
+	var seg pseudo_tcp_incoming_segment
+	seg.conv = binary.BigEndian.Uint32(buffer[0:])
+	seg.seq = binary.BigEndian.Uint32(buffer[4:])
+	seg.ack = binary.BigEndian.Uint32(buffer[8:])
+	seg.flags = buffer[13]
+	seg.wnd = uint32(binary.BigEndian.Uint16(buffer[14:]))
+	seg.tsval = binary.BigEndian.Uint32(buffer[16:])
+	seg.tsecr = binary.BigEndian.Uint32(buffer[20:])
+	seg.data = buffer[PSEUDO_TCP_HEADER_SIZE:]
+	return this.process(&seg)
+}
+
+type pseudo_tcp_incoming_segment struct {
+	conv		uint32
+	seq			uint32
+	ack			uint32
+	flags		uint8
+	wnd			uint32
+	tsval		uint32
+	tsecr		uint32
+	data		[]byte
+}
+
+func (this *PseudoTcpSocket) queue_connect_message() {
+	this.sbuf = append(this.sbuf, PSEUDO_TCP_CTL_CONNECT)
+	this.slist = append(this.slist, &pseudo_tcp_segment{seq: this.snd_nxt, len: 1, flags: PSEUDO_TCP_FLAG_CTL})
+	this.snd_nxt++
+}
+
+func (this *PseudoTcpSocket) rlist_len() uint32 {
+	var l uint32 = 0
+	for i := 0; i < len(this.rlist); i++ {
+		l += uint32(len(this.rlist[i].data))
+	}
+	return l
+}
+
+func (this *PseudoTcpSocket) send_packet(seq uint32, flags uint8, offset uint32, length uint32) PseudoTcpWriteResult {
+	now := this.get_current_time()
+	buffer := make([]byte, PSEUDO_TCP_HEADER_SIZE + length)
+
+	wnd := this.rcv_wnd
+	if wnd > 0xffff {
+		wnd = 0xffff
+	}
+	binary.BigEndian.PutUint32(buffer[0:], this.conv)
+	binary.BigEndian.PutUint32(buffer[4:], seq)
+	binary.BigEndian.PutUint32(buffer[8:], this.rcv_nxt)
+	buffer[12] = 0
+	buffer[13] = flags
+	binary.BigEndian.PutUint16(buffer[14:], uint16(wnd))
+	binary.BigEndian.PutUint32(buffer[16:], now)
+	binary.BigEndian.PutUint32(buffer[20:], this.ts_recent)
+	if length > 0 {
+		copy(buffer[PSEUDO_TCP_HEADER_SIZE:], this.sbuf[offset:offset + length])
+	}
+
+	this.ts_lastack = this.rcv_nxt
+	this.t_ack = 0
+	this.lastsend = now
+
+	if this.callbacks.WritePacket == nil {
+		return WR_FAIL
+	}
+	return this.callbacks.WritePacket(this, buffer, this.callbacks.user_data)
+}
+
+func (this *PseudoTcpSocket) send_ack() {
+	this.send_packet(this.snd_nxt, 0, 0, 0)
+}
+
+/*
+ * Sends (or resends) 'seg'. Returns %FALSE when the packet could not be
+ * handed to the lower layer at all.
+ */
+func (this *PseudoTcpSocket) transmit(seg *pseudo_tcp_segment, now uint32) bool {
+	var wres PseudoTcpWriteResult
+	if seg.flags & PSEUDO_TCP_FLAG_FIN != 0 {
+		wres = this.send_packet(seg.seq, seg.flags, 0, 0)
+	} else {
+		wres = this.send_packet(seg.seq, seg.flags, seg.seq - this.snd_una, seg.len)
+	}
+	if wres == WR_FAIL {
+		return false
+	}
+
+	seg.xmit++
+	if this.rto_base == 0 {
+		this.rto_base = now
+	}
+	return true
+}
+
+/*
+ * Sends as much pending data as the congestion and the peer windows allow,
+ * followed by the FIN once all the data is out.
+ */
+func (this *PseudoTcpSocket) attempt_send() {
+	now := this.get_current_time()
+
+	for {
+		in_flight := this.snd_nxt - this.snd_una
+		window := min_uint32(this.snd_wnd, this.cwnd)
+		var available uint32 = 0
+		if window > in_flight {
+			available = window - in_flight
+		}
+
+		sent := this.snd_una + uint32(len(this.sbuf))
+		if this.fin_queued {
+			sent = this.fin_seq
+		}
+		var unsent uint32 = 0
+		if seq_gt(sent, this.snd_nxt) {
+			unsent = sent - this.snd_nxt
+		}
+
+		/* control segments already queued but not yet transmitted */
+		var seg *pseudo_tcp_segment
+		for i := 0; i < len(this.slist); i++ {
+			if this.slist[i].xmit == 0 {
+				seg = this.slist[i]
+				break
+			}
+		}
+
+		if seg == nil && unsent > 0 && available > 0 {
+			l := min_uint32(min_uint32(unsent, available), this.mss)
+			seg = &pseudo_tcp_segment{seq: this.snd_nxt, len: l}
+			this.slist = append(this.slist, seg)
+			this.snd_nxt += l
+		}
+
+		if seg == nil && unsent == 0 && this.fin_queued && this.snd_nxt == this.fin_seq {
+			seg = &pseudo_tcp_segment{seq: this.fin_seq, len: 1, flags: PSEUDO_TCP_FLAG_FIN}
+			this.slist = append(this.slist, seg)
+			this.snd_nxt++
+		}
+
+		if seg == nil {
+			break
+		}
+
+		if !this.transmit(seg, now) {
+			break
+		}
+	}
+}
+
+func (this *PseudoTcpSocket) closedown(err error) {
+	if this.state == TCP_CLOSED {
+		return
+	}
+	this.state = TCP_CLOSED
+	this.err = err
+	this.slist = nil
+	this.rto_base = 0
+	this.t_ack = 0
+	if this.callbacks.PseudoTcpClosed != nil {
+		this.callbacks.PseudoTcpClosed(this, err, this.callbacks.user_data)
+	}
+}
+
+func (this *PseudoTcpSocket) update_rtt(rtt uint32) {
+	if this.rx_srtt == 0 {
+		this.rx_srtt = rtt
+		this.rx_rttvar = rtt / 2
+	} else {
+		var delta uint32
+		if rtt > this.rx_srtt {
+			delta = rtt - this.rx_srtt
+		} else {
+			delta = this.rx_srtt - rtt
+		}
+		this.rx_rttvar = (3 * this.rx_rttvar + delta) / 4
+		this.rx_srtt = (7 * this.rx_srtt + rtt) / 8
+	}
+	rto := this.rx_srtt + max_uint32(1, 4 * this.rx_rttvar)
+	this.rx_rto = min_uint32(PSEUDO_TCP_MAX_RTO, max_uint32(PSEUDO_TCP_MIN_RTO, rto))
+}
+
+func (this *PseudoTcpSocket) process(seg *pseudo_tcp_incoming_segment) bool {
+	if seg.conv != this.conv {
+		return false
+	}
+
+	if this.state == TCP_CLOSED {
+		return false
+	}
+
+	now := this.get_current_time()
+	this.lastrecv = now
+
+	if seg.flags & PSEUDO_TCP_FLAG_RST != 0 {
+		this.closedown(PSEUDO_TCP_ERR_CONNECTION_RESET)
+		return true
+	}
+
+	/* Check if this is a valuable ack */
+	if seq_gt(seg.ack, this.snd_una) && seq_le(seg.ack, this.snd_nxt) {
+		/* Calculate round-trip time */
+		if seg.tsecr != 0 && time_diff(now, seg.tsecr) >= 0 {
+			this.update_rtt(uint32(time_diff(now, seg.tsecr)))
+		}
+
+		this.snd_wnd = seg.wnd
+		acked := seg.ack - this.snd_una
+		this.snd_una = seg.ack
+
+		/* the FIN consumes a sequence number but no buffer space */
+		data_acked := acked
+		if data_acked > uint32(len(this.sbuf)) {
+			data_acked = uint32(len(this.sbuf))
+		}
+		this.sbuf = this.sbuf[data_acked:]
+		if len(this.sbuf) == 0 {
+			this.sbuf = nil
+		}
+
+		for len(this.slist) > 0 && seq_le(this.slist[0].seq + this.slist[0].len, this.snd_una) {
+			this.slist = this.slist[1:]
+		}
+
+		if this.snd_una == this.snd_nxt {
+			this.rto_base = 0
+		} else {
+			this.rto_base = now
+		}
+
+		if this.dup_acks >= 3 {
+			if seq_ge(this.snd_una, this.recover) {
+				/* NewReno: full acknowledgement, exit fast recovery */
+				in_flight := this.snd_nxt - this.snd_una
+				this.cwnd = min_uint32(this.ssthresh, in_flight + this.mss)
+				this.dup_acks = 0
+			} else {
+				/* partial acknowledgement, retransmit the next hole */
+				if len(this.slist) > 0 && !this.transmit(this.slist[0], now) {
+					this.closedown(PSEUDO_TCP_ERR_CONNECTION_RESET)
+					return false
+				}
+				if acked > this.cwnd {
+					this.cwnd = this.mss
+				} else {
+					this.cwnd += this.mss - acked
+				}
+			}
+		} else {
+			this.dup_acks = 0
+			/* Slow start, congestion avoidance */
+			if this.cwnd < this.ssthresh {
+				this.cwnd += this.mss
+			} else {
+				this.cwnd += max_uint32(1, this.mss * this.mss / this.cwnd)
+			}
+		}
+
+		/* our CONNECT got acknowledged */
+		if this.state == TCP_SYN_RECEIVED && seq_ge(this.snd_una, 1) {
+			this.state = TCP_ESTABLISHED
+			this.adjust_mtu()
+			if this.callbacks.PseudoTcpOpened != nil {
+				this.callbacks.PseudoTcpOpened(this, this.callbacks.user_data)
+			}
+		}
+
+		/* our FIN got acknowledged */
+		if this.fin_queued && seq_gt(this.snd_una, this.fin_seq) {
+			switch this.state {
+			case TCP_FIN_WAIT_1:
+				this.state = TCP_FIN_WAIT_2
+			case TCP_CLOSING:
+				this.state = TCP_TIME_WAIT
+				this.time_wait_base = now
+			case TCP_LAST_ACK:
+				this.closedown(nil)
+				return true
+			}
+		}
+
+		if this.write_enable && this.pseudo_tcp_socket_get_available_send_space() > 0 {
+			this.write_enable = false
+			if this.callbacks.PseudoTcpWritable != nil {
+				this.callbacks.PseudoTcpWritable(this, this.callbacks.user_data)
+			}
+		}
+	} else if seg.ack == this.snd_una {
+		/* !?! Note, tcp says don't do this... but otherwise how does a
+		   closed window become open? */
+		this.snd_wnd = seg.wnd
+
+		/* Check duplicate acks */
+		if len(seg.data) > 0 || seg.flags & (PSEUDO_TCP_FLAG_CTL | PSEUDO_TCP_FLAG_FIN) != 0 {
+			/* it's a dup ack, but with a data payload, so don't modify dup_acks */
+		} else if this.snd_una != this.snd_nxt {
+			this.dup_acks++
+			if this.dup_acks == 3 {
+				/* (Fast Retransmit) */
+				if len(this.slist) > 0 && !this.transmit(this.slist[0], now) {
+					this.closedown(PSEUDO_TCP_ERR_CONNECTION_RESET)
+					return false
+				}
+				this.recover = this.snd_nxt
+				in_flight := this.snd_nxt - this.snd_una
+				this.ssthresh = max_uint32(in_flight / 2, 2 * this.mss)
+				this.cwnd = this.ssthresh + 3 * this.mss
+			} else if this.dup_acks > 3 {
+				this.cwnd += this.mss
+			}
+		} else {
+			this.dup_acks = 0
+		}
+	}
+
+	/* Update the timestamp to echo if this segment is the next one in order */
+	if seq_le(seg.seq, this.ts_lastack) && seq_ge(seg.seq + uint32(len(seg.data)), this.ts_lastack) {
+		this.ts_recent = seg.tsval
+	}
+
+	/* Control segments carry a single byte and consume one sequence number */
+	if seg.flags & PSEUDO_TCP_FLAG_CTL != 0 {
+		if len(seg.data) == 0 || seg.data[0] != PSEUDO_TCP_CTL_CONNECT {
+			return false
+		}
+
+		if seg.seq == this.rcv_nxt {
+			this.rcv_nxt++
+			switch this.state {
+			case TCP_LISTEN:
+				this.state = TCP_SYN_RECEIVED
+				this.queue_connect_message()
+			case TCP_SYN_SENT:
+				this.state = TCP_ESTABLISHED
+				this.adjust_mtu()
+				if this.callbacks.PseudoTcpOpened != nil {
+					this.callbacks.PseudoTcpOpened(this, this.callbacks.user_data)
+				}
+			}
+		}
+		this.send_ack()
+		this.attempt_send()
+		return true
+	}
+
+	if this.state == TCP_LISTEN || this.state == TCP_SYN_SENT {
+		/* data before the connection is established */
+		return false
+	}
+
+	new_data := false
+	out_of_order := false
+	if len(seg.data) > 0 && !this.rcv_fin {
+		seq := seg.seq
+		data := seg.data
+
+		/* trim what was already received */
+		if seq_lt(seq, this.rcv_nxt) {
+			skip := this.rcv_nxt - seq
+			if skip >= uint32(len(data)) {
+				data = nil
+			} else {
+				data = data[skip:]
+				seq = this.rcv_nxt
+			}
+		}
+
+		/* trim what does not fit the window */
+		if uint32(len(data)) > 0 {
+			limit := this.rbuf_len - uint32(len(this.rbuf))
+			end := seq - this.rcv_nxt + uint32(len(data))
+			if end > limit {
+				if seq - this.rcv_nxt >= limit {
+					data = nil
+				} else {
+					data = data[:limit - (seq - this.rcv_nxt)]
+				}
+			}
+		}
+
+		if len(data) > 0 {
+			if seq == this.rcv_nxt {
+				this.rbuf = append(this.rbuf, data...)
+				this.rcv_nxt += uint32(len(data))
+				new_data = true
+
+				/* Pull in any out-of-order segments that are now contiguous */
+				for {
+					progress := false
+					rest := this.rlist[:0]
+					for i := 0; i < len(this.rlist); i++ {
+						r := this.rlist[i]
+						r_end := r.seq + uint32(len(r.data))
+						if seq_le(r.seq, this.rcv_nxt) {
+							if seq_gt(r_end, this.rcv_nxt) {
+								this.rbuf = append(this.rbuf, r.data[this.rcv_nxt - r.seq:]...)
+								this.rcv_nxt = r_end
+							}
+							progress = true
+							continue
+						}
+						rest = append(rest, r)
+					}
+					this.rlist = rest
+					if !progress {
+						break
+					}
+				}
+			} else {
+				out_of_order = true
+				buf := make([]byte, len(data))
+				copy(buf, data)
+				this.rlist = append(this.rlist, pseudo_tcp_rsegment{seq: seq, data: buf})
+			}
+		}
+		this.rcv_wnd = this.rbuf_len - uint32(len(this.rbuf)) - this.rlist_len()
+	}
+
+	got_fin := false
+	if seg.flags & PSEUDO_TCP_FLAG_FIN != 0 && !this.rcv_fin && seg.seq + uint32(len(seg.data)) == this.rcv_nxt {
+		this.rcv_fin = true
+		this.rcv_nxt++
+		got_fin = true
+		switch this.state {
+		case TCP_ESTABLISHED, TCP_SYN_RECEIVED:
+			this.state = TCP_CLOSE_WAIT
+		case TCP_FIN_WAIT_1:
+			this.state = TCP_CLOSING
+		case TCP_FIN_WAIT_2:
+			this.state = TCP_TIME_WAIT
+			this.time_wait_base = now
+		}
+	}
+
+	/* an empty segment out of sequence is a window probe, answer it */
+	if len(seg.data) == 0 && !got_fin && seg.seq != this.rcv_nxt {
+		this.send_ack()
+	}
+
+	/* Decide when to acknowledge: right away for anything unusual or every
+	 * second segment, otherwise after the delayed ack timer */
+	if len(seg.data) > 0 || got_fin {
+		if out_of_order || got_fin || !new_data || this.t_ack != 0 || this.ack_delay == 0 {
+			this.send_ack()
+		} else {
+			this.t_ack = now
+		}
+	}
+
+	if (new_data || got_fin) && this.callbacks.PseudoTcpReadable != nil {
+		this.read_enable = false
+		this.callbacks.PseudoTcpReadable(this, this.callbacks.user_data)
+	}
+
+	this.attempt_send()
+	return true
+}
@@ -1,34 +1,85 @@
 package nice
 
 import (
-	"math/rand"
-	"time"
+	crand "crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
 )
 
+/*
+ * NiceRNG is the random source of an agent: credentials, foundations,
+ * tie-breakers, STUN transaction ids and port picks all come from it. It is
+ * backed by crypto/rand unless another source is given, e.g. a seeded
+ * math/rand.Rand for reproducible tests.
+ */
 type NiceRNG struct {
-	priv 	interface{}
+	mutex	sync.Mutex
+	source	io.Reader
 }
 
+/* Creates a generator reading crypto/rand */
 func NewNiceRNG() *NiceRNG {
-	return &NiceRNG{}
+	return &NiceRNG{source: crand.Reader}
+}
+
+/* Creates a generator reading @source, which needs not be goroutine-safe */
+func NewNiceRNGFromSource(source io.Reader) *NiceRNG {
+	if source == nil {
+		source = crand.Reader
+	}
+	return &NiceRNG{source: source}
+}
+
+/* Fills @buf, the agent cannot go on without randomness */
+func (this *NiceRNG) fill(buf []byte) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if _, err := io.ReadFull(this.source, buf); err != nil {
+		panic("nice: reading the random source failed: " + err.Error())
+	}
 }
 
 func (this *NiceRNG) rng_generate_bytes(len uint) []byte {
-	rand.Seed(time.Now().UnixNano())
 	b := make([]byte, len)
-	if n, err := rand.Read(b); err != nil || uint(n) != len {
-		return nil
-	}
+	this.fill(b)
 	return b
 }
 
+/*
+ * Returns a random integer uniformly distributed in [low, high], both
+ * included.
+ */
 func (this *NiceRNG) rng_generate_int(low uint, high uint) uint {
-	if low > high {
-		panic("low must little than high")
-		return 0
+	if low >= high {
+		return low
 	}
 
-	return low + uint(rand.Intn(int(high - low)))
+	span := uint64(high - low) + 1
+	if span == 0 {
+		/* the whole range of uint64 */
+		return low + uint(this.rng_generate_uint64())
+	}
+	/* rejects the top values that would bias the modulo */
+	limit := ^uint64(0) - (^uint64(0) % span + 1) % span
+	for {
+		v := this.rng_generate_uint64()
+		if v <= limit {
+			return low + uint(v % span)
+		}
+	}
+}
+
+func (this *NiceRNG) rng_generate_uint64() uint64 {
+	var b [8]byte
+	this.fill(b[:])
+	return binary.BigEndian.Uint64(b[:])
+}
+
+/* A new STUN transaction id */
+func (this *NiceRNG) rng_generate_transaction_id() *StunTransactionId {
+	var id StunTransactionId = this.rng_generate_bytes(STUN_MESSAGE_TRANS_ID_LEN)
+	return &id
 }
 
 /*
@@ -45,9 +96,10 @@ func (this *NiceRNG) rng_generate_int(low uint, high uint) uint {
 func (this *NiceRNG) nice_rng_generate_bytes_print(l uint) []byte {
 	var i uint
 	chars := string("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/")
-	buf := make([]byte, l)
+	buf := this.rng_generate_bytes(l)
 	for i = 0; i < l; i++ {
-		buf[i] = chars[this.rng_generate_int(0, uint(len(chars)))];
+		/* 64 characters, each takes 6 random bits */
+		buf[i] = chars[buf[i] & 0x3f];
 	}
 	return buf
-}
\ No newline at end of file
+}
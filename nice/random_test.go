@@ -0,0 +1,114 @@
+package nice
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+/* A generator of reproducible output, for the statistical tests */
+func test_rng_seeded() *NiceRNG {
+	return NewNiceRNGFromSource(rand.New(rand.NewSource(1)))
+}
+
+/*
+ * The chi-squared statistic of @counts against the uniform distribution
+ * of @total draws.
+ */
+func test_chi_squared(counts []int, total int) float64 {
+	expected := float64(total) / float64(len(counts))
+	chi2 := 0.0
+	for i := 0; i < len(counts); i++ {
+		d := float64(counts[i]) - expected
+		chi2 += d * d / expected
+	}
+	return chi2
+}
+
+/*
+ * The draws of rng_generate_int() fall uniformly in the range, bounds
+ * included: the chi-squared of 10 buckets stays under the 99.99th
+ * percentile of 9 degrees of freedom.
+ */
+func TestRngGenerateIntUniform(t *testing.T) {
+	rng := test_rng_seeded()
+	const low, high, draws = 1000, 1009, 100000
+	counts := make([]int, high - low + 1)
+	for i := 0; i < draws; i++ {
+		v := rng.rng_generate_int(low, high)
+		if v < low || v > high {
+			t.Fatalf("%d out of [%d, %d]", v, low, high)
+		}
+		counts[v - low]++
+	}
+	if chi2 := test_chi_squared(counts, draws); chi2 > 33.72 {
+		t.Fatalf("chi-squared %.2f, counts %v", chi2, counts)
+	}
+}
+
+/* A source handing out @data, then zeros */
+type test_rng_source struct {
+	data	[]byte
+}
+
+func (this *test_rng_source) Read(p []byte) (int, error) {
+	n := copy(p, this.data)
+	this.data = this.data[n:]
+	for i := n; i < len(p); i++ {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+/*
+ * The values past the last whole multiple of the span are drawn again:
+ * taken modulo the span, they would favour the low end of the range.
+ */
+func TestRngGenerateIntRejectsBias(t *testing.T) {
+	data := bytes.Repeat([]byte{0xff}, 8)
+	data = append(data, 0, 0, 0, 0, 0, 0, 0, 5)
+	rng := NewNiceRNGFromSource(&test_rng_source{data: data})
+
+	/* 2^64 - 1 is a multiple of 3, its last value is the one in excess */
+	if v := rng.rng_generate_int(10, 12); v != 12 {
+		t.Fatalf("drew %d, want 12 from the second value", v)
+	}
+}
+
+/*
+ * The credentials only use the 64 ice-chars, each as often as the others:
+ * the chi-squared stays under the 99.99th percentile of 63 degrees of
+ * freedom.
+ */
+func TestRngGenerateBytesPrintAlphabet(t *testing.T) {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+	rng := test_rng_seeded()
+	const draws = 64 * 2000
+	counts := make([]int, len(alphabet))
+	buf := rng.nice_rng_generate_bytes_print(draws)
+	for i := 0; i < len(buf); i++ {
+		j := strings.IndexByte(alphabet, buf[i])
+		if j < 0 {
+			t.Fatalf("%q is not an ice-char", buf[i])
+		}
+		counts[j]++
+	}
+	if chi2 := test_chi_squared(counts, draws); chi2 > 111.1 {
+		t.Fatalf("chi-squared %.2f", chi2)
+	}
+}
+
+/* The generated stream credentials are valid ones */
+func TestRngStreamCredentials(t *testing.T) {
+	agent := NewNiceAgent()
+	agent.SetRNG(test_rng_seeded())
+	id := agent.Nice_agent_add_stream(1)
+	ufrag, pwd, ok := agent.Nice_agent_get_local_credentials(id)
+	if !ok {
+		t.Fatal("no credentials")
+	}
+	if !nice_stream_credentials_are_valid(ufrag, pwd) {
+		t.Fatalf("invalid credentials %q %q", ufrag, pwd)
+	}
+}
@@ -0,0 +1,357 @@
+package nice
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * The reactors run the timers of the agents, in place of the GLib main
+ * context of libnice. A reactor is one goroutine, one timer of its Clock
+ * and a hierarchical timer wheel: every STUN retransmission, pacing tick,
+ * keepalive or pseudo TCP clock of the agents sharing the reactor is an
+ * entry of the wheel, and costs neither a goroutine nor a runtime timer.
+ *
+ * The wheel has NICE_TIMER_WHEEL_LEVELS levels of NICE_TIMER_WHEEL_SLOTS
+ * slots; a slot of level n spans NICE_TIMER_WHEEL_SLOTS^n ticks. Timers
+ * are filed in the level their expiry fits in and cascade to the lower
+ * levels as the wheel turns. Expiries are rounded up to the tick.
+ *
+ * The timer of the Clock is only armed for the next tick with something to
+ * do: the first timer due in level 0, or the next cascade of a non-empty
+ * slot of a higher level. The expired timers run in the function of the
+ * Clock timer (a goroutine of the runtime for NiceSystemClock, Advance()
+ * for a fakeclock), the tasks of nice_reactor_invoke() on the reactor
+ * goroutine; process_mutex keeps them from running concurrently.
+ */
+const NICE_TIMER_WHEEL_TICK = 5 * time.Millisecond
+const NICE_TIMER_WHEEL_BITS = 6
+const NICE_TIMER_WHEEL_SLOTS = 1 << NICE_TIMER_WHEEL_BITS
+const NICE_TIMER_WHEEL_MASK = NICE_TIMER_WHEEL_SLOTS - 1
+const NICE_TIMER_WHEEL_LEVELS = 4
+
+/*
+ * NiceTimer is a pending timeout of a reactor. It is an intrusive member of
+ * the list of its slot, so cancelling is O(1).
+ */
+type NiceTimer struct {
+	reactor			*NiceReactor
+	expires			uint64		/* in ticks */
+	callback		func()
+	prev			*NiceTimer
+	next			*NiceTimer
+	slot			*NiceTimer	/* head of the list the timer is in */
+}
+
+type nice_timer_wheel struct {
+	current			uint64		/* ticks processed so far */
+	slots			[NICE_TIMER_WHEEL_LEVELS][NICE_TIMER_WHEEL_SLOTS]NiceTimer
+	count			int
+}
+
+type NiceReactor struct {
+	process_mutex	sync.Mutex	/* held while the expired timers run */
+	mutex			sync.Mutex
+	clock			Clock
+	wheel			nice_timer_wheel
+	start			time.Time
+	tasks			[]func()
+	wakeup			chan struct{}
+	done			chan struct{}
+	free_once		sync.Once
+	timer			ClockTimer
+	armed			uint64		/* tick the timer is armed for, 0 if none */
+	expired			[]*NiceTimer	/* owned by process() */
+}
+
+/*
+ * Creates a reactor whose timers follow @clock, NiceSystemClock if nil.
+ */
+func NewNiceReactor(clock Clock) *NiceReactor {
+	if clock == nil {
+		clock = NiceSystemClock
+	}
+	r := &NiceReactor{}
+	r.clock = clock
+	r.start = clock.Now()
+	r.wakeup = make(chan struct{}, 1)
+	r.done = make(chan struct{})
+	for l := 0; l < NICE_TIMER_WHEEL_LEVELS; l++ {
+		for s := 0; s < NICE_TIMER_WHEEL_SLOTS; s++ {
+			head := &r.wheel.slots[l][s]
+			head.prev = head
+			head.next = head
+		}
+	}
+	go r.run()
+	return r
+}
+
+var nice_reactor_pool []*NiceReactor
+var nice_reactor_pool_once sync.Once
+var nice_reactor_pool_next uint32
+
+/*
+ * Returns one of the reactors shared by the agents of the process, one per
+ * CPU, handed out in turn.
+ */
+func nice_reactor_pool_get() *NiceReactor {
+	nice_reactor_pool_once.Do(func() {
+		n := runtime.NumCPU()
+		nice_reactor_pool = make([]*NiceReactor, n)
+		for i := 0; i < n; i++ {
+			nice_reactor_pool[i] = NewNiceReactor(NiceSystemClock)
+		}
+	})
+	i := atomic.AddUint32(&nice_reactor_pool_next, 1)
+	return nice_reactor_pool[int(i) % len(nice_reactor_pool)]
+}
+
+func (this *NiceReactor) now_tick() uint64 {
+	return uint64(this.clock.Now().Sub(this.start) / NICE_TIMER_WHEEL_TICK)
+}
+
+/*
+ * Calls @callback after @timeout, from the function of the Clock timer of
+ * the reactor (see process()).
+ */
+func (this *NiceReactor) nice_reactor_timeout_add(timeout time.Duration, callback func()) *NiceTimer {
+	t := &NiceTimer{reactor: this, callback: callback}
+	ticks := uint64((timeout + NICE_TIMER_WHEEL_TICK - 1) / NICE_TIMER_WHEEL_TICK)
+	if ticks == 0 {
+		ticks = 1
+	}
+
+	this.mutex.Lock()
+	/* relative to the wall clock, the wheel may lag behind it */
+	t.expires = this.now_tick() + ticks
+	if t.expires <= this.wheel.current {
+		t.expires = this.wheel.current + 1
+	}
+	this.wheel.insert(t)
+	this.rearm()
+	this.mutex.Unlock()
+	return t
+}
+
+/*
+ * Calls @callback on the reactor goroutine as soon as possible.
+ */
+func (this *NiceReactor) nice_reactor_invoke(callback func()) {
+	this.mutex.Lock()
+	this.tasks = append(this.tasks, callback)
+	this.mutex.Unlock()
+	this.signal()
+}
+
+/*
+ * Cancels the timer. Returns false if it already fired or was cancelled.
+ */
+func (this *NiceTimer) nice_timer_cancel() bool {
+	if this == nil {
+		return false
+	}
+	r := this.reactor
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if this.slot == nil {
+		return false
+	}
+	r.wheel.remove(this)
+	return true
+}
+
+func (this *NiceReactor) signal() {
+	select {
+	case this.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+/*
+ * Arms the timer of the clock for the next tick the wheel has something
+ * to do at, if it is not already.
+ */
+func (this *NiceReactor) rearm() {
+	if this.wheel.count == 0 {
+		return
+	}
+	select {
+	case <-this.done:
+		return
+	default:
+	}
+	next := this.wheel.next_tick()
+	if this.armed == next {
+		return
+	}
+	this.armed = next
+	d := this.start.Add(time.Duration(next) * NICE_TIMER_WHEEL_TICK).Sub(this.clock.Now())
+	if d < 0 {
+		d = 0
+	}
+	if this.timer == nil {
+		this.timer = this.clock.AfterFunc(d, this.process)
+	} else {
+		this.timer.Reset(d)
+	}
+}
+
+/*
+ * Stops the reactor of an agent which had its own, the timers still
+ * pending never run.
+ */
+func (this *NiceReactor) nice_reactor_free() {
+	this.free_once.Do(func() {
+		this.mutex.Lock()
+		if this.timer != nil {
+			this.timer.Stop()
+		}
+		this.mutex.Unlock()
+		close(this.done)
+	})
+}
+
+func (this *NiceReactor) run() {
+	for {
+		select {
+		case <-this.wakeup:
+			this.process()
+		case <-this.done:
+			return
+		}
+	}
+}
+
+/*
+ * Runs the queued tasks and the expired timers. Called in the function of
+ * the Clock timer, and by the reactor goroutine for the tasks.
+ */
+func (this *NiceReactor) process() {
+	this.process_mutex.Lock()
+	defer this.process_mutex.Unlock()
+
+	this.mutex.Lock()
+	tasks := this.tasks
+	this.tasks = nil
+	this.armed = 0
+	now := this.now_tick()
+	for this.wheel.current < now {
+		this.expired = this.wheel.advance(this.expired)
+	}
+	this.rearm()
+	this.mutex.Unlock()
+
+	for i := 0; i < len(tasks); i++ {
+		tasks[i]()
+	}
+	for i := 0; i < len(this.expired); i++ {
+		this.expired[i].callback()
+		this.expired[i] = nil
+	}
+	this.expired = this.expired[:0]
+}
+
+func (this *nice_timer_wheel) insert(t *NiceTimer) {
+	delta := t.expires - this.current
+	level := 0
+	for level < NICE_TIMER_WHEEL_LEVELS - 1 && delta >= uint64(1) << (NICE_TIMER_WHEEL_BITS * (level + 1)) {
+		level++
+	}
+	expires := t.expires
+	if level == NICE_TIMER_WHEEL_LEVELS - 1 {
+		/* beyond the wheel, parked in the last slot it can reach */
+		max := this.current + (uint64(1) << (NICE_TIMER_WHEEL_BITS * NICE_TIMER_WHEEL_LEVELS)) - 1
+		if expires > max {
+			expires = max
+		}
+	}
+	slot := (expires >> (NICE_TIMER_WHEEL_BITS * level)) & NICE_TIMER_WHEEL_MASK
+	head := &this.slots[level][slot]
+
+	t.slot = head
+	t.prev = head.prev
+	t.next = head
+	head.prev.next = t
+	head.prev = t
+	this.count++
+}
+
+func (this *nice_timer_wheel) remove(t *NiceTimer) {
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev = nil
+	t.next = nil
+	t.slot = nil
+	this.count--
+}
+
+/*
+ * The first tick after the current one which either expires a timer of
+ * level 0 or cascades a non-empty slot of a higher level. Waking up there
+ * is never late; the cascade may only bring the timers closer.
+ */
+func (this *nice_timer_wheel) next_tick() uint64 {
+	var next uint64 = 0
+	for k := uint64(1); k <= NICE_TIMER_WHEEL_SLOTS; k++ {
+		tick := this.current + k
+		if this.slots[0][tick & NICE_TIMER_WHEEL_MASK].next != &this.slots[0][tick & NICE_TIMER_WHEEL_MASK] {
+			next = tick
+			break
+		}
+	}
+	for level := 1; level < NICE_TIMER_WHEEL_LEVELS; level++ {
+		shift := uint64(NICE_TIMER_WHEEL_BITS * level)
+		for k := uint64(1); k <= NICE_TIMER_WHEEL_SLOTS; k++ {
+			tick := ((this.current >> shift) + k) << shift
+			if next != 0 && tick >= next {
+				break
+			}
+			head := &this.slots[level][(tick >> shift) & NICE_TIMER_WHEEL_MASK]
+			if head.next != head {
+				next = tick
+				break
+			}
+		}
+	}
+	if next == 0 {
+		next = this.current + 1
+	}
+	return next
+}
+
+/*
+ * Moves the wheel one tick forward, cascading the higher levels when the
+ * lower one wraps, and appends the timers due to @expired.
+ */
+func (this *nice_timer_wheel) advance(expired []*NiceTimer) []*NiceTimer {
+	this.current++
+
+	for level := 1; level < NICE_TIMER_WHEEL_LEVELS; level++ {
+		if this.current & ((uint64(1) << (NICE_TIMER_WHEEL_BITS * level)) - 1) != 0 {
+			break
+		}
+		slot := (this.current >> (NICE_TIMER_WHEEL_BITS * level)) & NICE_TIMER_WHEEL_MASK
+		head := &this.slots[level][slot]
+		for head.next != head {
+			t := head.next
+			this.remove(t)
+			this.insert(t)
+		}
+	}
+
+	head := &this.slots[0][this.current & NICE_TIMER_WHEEL_MASK]
+	for head.next != head {
+		t := head.next
+		this.remove(t)
+		if t.expires > this.current {
+			/* parked beyond the wheel, file it again */
+			this.insert(t)
+			continue
+		}
+		expired = append(expired, t)
+	}
+	return expired
+}
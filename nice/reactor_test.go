@@ -0,0 +1,67 @@
+package nice
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+ * The clock timer of a reactor is armed for the first tick with something
+ * to do, not for every tick.
+ */
+func TestReactorRearmNextExpiry(t *testing.T) {
+	clock := &test_clock{now: time.Unix(1000, 0)}
+	r := NewNiceReactor(clock)
+	defer r.nice_reactor_free()
+
+	/* 200 ticks: in level 1 until its slot cascades at tick 192 */
+	late := r.nice_reactor_timeout_add(time.Second, func() {})
+	r.mutex.Lock()
+	armed := r.armed
+	r.mutex.Unlock()
+	if armed != 192 {
+		t.Fatalf("armed for tick %d", armed)
+	}
+
+	early := r.nice_reactor_timeout_add(10 * time.Millisecond, func() {})
+	r.mutex.Lock()
+	armed = r.armed
+	r.mutex.Unlock()
+	if armed != 2 {
+		t.Fatalf("armed for tick %d", armed)
+	}
+
+	early.nice_timer_cancel()
+	late.nice_timer_cancel()
+}
+
+/* The cascades bring the timers down to level 0 in time for their expiry */
+func TestTimerWheelNextTick(t *testing.T) {
+	r := &NiceReactor{}
+	for l := 0; l < NICE_TIMER_WHEEL_LEVELS; l++ {
+		for s := 0; s < NICE_TIMER_WHEEL_SLOTS; s++ {
+			head := &r.wheel.slots[l][s]
+			head.prev = head
+			head.next = head
+		}
+	}
+	/* the second one parked beyond the wheel */
+	for _, expires := range []uint64{5000, 1 << 25 + 7} {
+		timer := &NiceTimer{reactor: r, expires: expires}
+		r.wheel.insert(timer)
+
+		var expired []*NiceTimer
+		for len(expired) == 0 {
+			next := r.wheel.next_tick()
+			if next <= r.wheel.current || next > timer.expires {
+				t.Fatalf("next tick %d at tick %d", next, r.wheel.current)
+			}
+			for r.wheel.current < next {
+				expired = r.wheel.advance(expired)
+			}
+		}
+		if r.wheel.current != expires {
+			t.Fatalf("expired at tick %d, not %d", r.wheel.current, expires)
+		}
+	}
+}
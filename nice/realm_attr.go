@@ -0,0 +1,20 @@
+package nice
+
+/* The REALM of the long-term credentials (RFC 5389 section 15.7) */
+type StunRealmAttrValue struct {
+	realm			string
+}
+
+func (this StunRealmAttrValue) Encode(stream *DataStream) error {
+	stream.WriteBytes([]byte(this.realm))
+	return nil
+}
+
+func (this *StunRealmAttrValue) Decode(stream *DataStream) error {
+	this.realm = string(stream.ReadLeftBytes())
+	return nil
+}
+
+func (this StunRealmAttrValue) GetSize() uint16 {
+	return uint16(len(this.realm))
+}
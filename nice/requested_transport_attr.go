@@ -0,0 +1,26 @@
+package nice
+
+/* The protocol of the relayed transport address, UDP (RFC 5766 section 14.7) */
+const STUN_REQUESTED_TRANSPORT_UDP = 17
+
+type StunRequestedTransportAttrValue struct {
+	protocol		byte	/* followed by 3 bytes RFFU */
+}
+
+func (this StunRequestedTransportAttrValue) Encode(stream *DataStream) error {
+	stream.WriteBytes([]byte{this.protocol, 0, 0, 0})
+	return nil
+}
+
+func (this *StunRequestedTransportAttrValue) Decode(stream *DataStream) error {
+	b, err := stream.ReadByte()
+	if err != nil {
+		return err
+	}
+	this.protocol = b
+	return nil
+}
+
+func (this StunRequestedTransportAttrValue) GetSize() uint16 {
+	return 4
+}
@@ -1,5 +1,7 @@
 package nice
 
+import "net"
+
 type NiceSocketType int
 const (
 	_ NiceSocketType = iota
@@ -30,6 +32,7 @@ type NiceSockInterface interface {
 	can_send(addr *NiceAddress) bool
 	set_writable_callback(cb NiceSocketWritableCb)
 	is_based_on(ohter *NiceSocket) bool
+	get_type() NiceSocketType
 	close()
 }
 
@@ -37,3 +40,17 @@ func EqualFamily(a NiceAddress, b NiceAddress) bool {
 	return a.family == b.family
 }
 
+
+/*
+ * The connection of the operating system under 'sock', nil for the sockets
+ * shared with other agents or wrapped by another protocol.
+ */
+func nice_socket_get_net_conn(sock NiceSockInterface) net.Conn {
+	switch s := sock.(type) {
+	case *UdpBsdSocket:
+		return s.conn
+	case *TcpBsdSocket:
+		return s.conn
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+package nice
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+ * The counters of a candidate pair, kept on its CandidateCheckPair and
+ * shared with the CandidatePair of the component once it is selected, so
+ * they survive the pruning of the check list.
+ *
+ * The bytes and packets only count the data of the application (with the
+ * pseudo TCP segments of a reliable agent), not the STUN messages of the
+ * checks and keepalives.
+ */
+type nice_pair_stats struct {
+	requests_sent			uint64
+	requests_received		uint64
+	responses_sent			uint64
+	responses_received		uint64
+	retransmissions_sent	uint64
+	bytes_sent				uint64
+	bytes_received			uint64
+	packets_sent			uint64
+	packets_received		uint64
+	current_rtt				time.Duration
+	total_rtt				time.Duration
+	rtt_samples				uint64
+	last_packet_sent		time.Time
+	last_packet_received	time.Time
+	last_request_sent		time.Time
+	last_request_received	time.Time
+	last_response_received	time.Time
+	consent_expired			time.Time
+}
+
+/*
+ * A snapshot of the statistics of a candidate pair, after the
+ * RTCIceCandidatePairStats dictionary of WebRTC. The round trip times are
+ * measured on the Binding transactions of the checks which were not
+ * retransmitted, RoundTripTimeSamples of them.
+ */
+type CandidatePairStats struct {
+	ID							string
+	StreamID					uint
+	ComponentID					uint
+	LocalCandidateID			string
+	RemoteCandidateID			string
+	State						string		/* frozen, waiting, in-progress, failed or succeeded */
+	Nominated					bool
+	Selected					bool
+	Priority					uint64
+	PacketsSent					uint64
+	PacketsReceived				uint64
+	BytesSent					uint64
+	BytesReceived				uint64
+	LastPacketSentTimestamp		time.Time
+	LastPacketReceivedTimestamp	time.Time
+	TotalRoundTripTime			time.Duration
+	CurrentRoundTripTime		time.Duration
+	RoundTripTimeSamples		uint64
+	RequestsSent				uint64
+	RequestsReceived			uint64
+	ResponsesSent				uint64
+	ResponsesReceived			uint64
+	RetransmissionsSent			uint64
+	LastRequestTimestamp		time.Time
+	LastRequestReceivedTimestamp	time.Time
+	LastResponseTimestamp		time.Time
+	ConsentExpiredTimestamp		time.Time
+}
+
+/*
+ * A snapshot of a local or remote candidate, after the
+ * RTCIceCandidateStats dictionary of WebRTC.
+ */
+type CandidateStats struct {
+	ID					string
+	StreamID			uint
+	ComponentID			uint
+	IsRemote			bool
+	Address				string
+	Port				int
+	Protocol			string		/* udp or tcp */
+	CandidateType		string		/* host, srflx, prflx or relay */
+	Priority			uint32
+	Foundation			string
+	RelatedAddress		string
+	RelatedPort			int
+	UsernameFragment	string
+	TCPType				string		/* active, passive or so, for tcp */
+	RelayProtocol		string		/* udp, tcp or tls, for relay */
+	URL					string		/* the server the candidate was obtained from */
+}
+
+/* A snapshot of the statistics of an agent, or of one of its streams */
+type Stats struct {
+	Timestamp			time.Time
+	CandidatePairs		[]CandidatePairStats
+	LocalCandidates		[]CandidateStats
+	RemoteCandidates	[]CandidateStats
+}
+
+/**
+ * Stats:
+ * @stream_id: The ID of the stream, 0 for all of them
+ *
+ * Returns a snapshot of the candidates and the candidate pairs of the
+ * stream: the pairs of the check list, and the selected pair of each
+ * component.
+ *
+ * Returns: the statistics, with no entry if the stream does not exist
+ */
+func (this *NiceAgent) Stats(stream_id uint) Stats {
+	this.agent_mutex.Lock()
+	defer this.agent_mutex.Unlock()
+
+	stats := Stats{Timestamp: this.clock.Now()}
+	for i := 0; i < len(this.streams); i++ {
+		stream := this.streams[i]
+		if stream_id != 0 && stream.id != stream_id {
+			continue
+		}
+		for j := 0; j < len(stream.components); j++ {
+			priv_component_stats(this, stream, stream.components[j], &stats)
+		}
+	}
+	return stats
+}
+
+func priv_component_stats(agent *NiceAgent, stream *NiceStream, component *NiceComponent, stats *Stats) {
+	for i := 0; i < len(component.local_candidates); i++ {
+		stats.LocalCandidates = append(stats.LocalCandidates, priv_candidate_stats(stream, component.local_candidates[i], false))
+	}
+	for i := 0; i < len(component.remote_candidates); i++ {
+		stats.RemoteCandidates = append(stats.RemoteCandidates, priv_candidate_stats(stream, component.remote_candidates[i], true))
+	}
+
+	selected := &component.selected_pair
+	selected_listed := false
+	for i := 0; i < len(stream.conncheck_list); i++ {
+		p := stream.conncheck_list[i]
+		if p.component_id != component.id {
+			continue
+		}
+		s := priv_pair_stats(p.stream_id, p.component_id, p.local, p.remote, &p.stats)
+		s.State = priv_check_state_to_string(p.state)
+		s.Nominated = p.nominated
+		s.Priority = p.priority
+		if selected.stats == &p.stats {
+			s.Selected = true
+			selected_listed = true
+		}
+		stats.CandidatePairs = append(stats.CandidatePairs, s)
+	}
+
+	/* the checks of a pair selected by hand are gone */
+	if !selected_listed && selected.local != nil && selected.remote != nil && selected.stats != nil {
+		s := priv_pair_stats(stream.id, component.id, selected.local, selected.remote, selected.stats)
+		s.State = "succeeded"
+		s.Nominated = selected.nominated
+		s.Selected = true
+		s.Priority = selected.priority
+		stats.CandidatePairs = append(stats.CandidatePairs, s)
+	}
+}
+
+func priv_pair_stats(stream_id uint, component_id uint, local *NiceCandidate, remote *NiceCandidate, ps *nice_pair_stats) CandidatePairStats {
+	var s CandidatePairStats
+	s.StreamID = stream_id
+	s.ComponentID = component_id
+	s.LocalCandidateID = priv_candidate_stats_id(local, false)
+	s.RemoteCandidateID = priv_candidate_stats_id(remote, true)
+	s.ID = s.LocalCandidateID + "-" + s.RemoteCandidateID
+	s.PacketsSent = ps.packets_sent
+	s.PacketsReceived = ps.packets_received
+	s.BytesSent = ps.bytes_sent
+	s.BytesReceived = ps.bytes_received
+	s.LastPacketSentTimestamp = ps.last_packet_sent
+	s.LastPacketReceivedTimestamp = ps.last_packet_received
+	s.TotalRoundTripTime = ps.total_rtt
+	s.CurrentRoundTripTime = ps.current_rtt
+	s.RoundTripTimeSamples = ps.rtt_samples
+	s.RequestsSent = ps.requests_sent
+	s.RequestsReceived = ps.requests_received
+	s.ResponsesSent = ps.responses_sent
+	s.ResponsesReceived = ps.responses_received
+	s.RetransmissionsSent = ps.retransmissions_sent
+	s.LastRequestTimestamp = ps.last_request_sent
+	s.LastRequestReceivedTimestamp = ps.last_request_received
+	s.LastResponseTimestamp = ps.last_response_received
+	s.ConsentExpiredTimestamp = ps.consent_expired
+	return s
+}
+
+func priv_candidate_stats(stream *NiceStream, c *NiceCandidate, remote bool) CandidateStats {
+	var s CandidateStats
+	s.ID = priv_candidate_stats_id(c, remote)
+	s.StreamID = c.stream_id
+	s.ComponentID = c.component_id
+	s.IsRemote = remote
+	s.Address = c.addr.ip
+	s.Port = c.addr.port
+	s.Priority = c.priority
+	s.Foundation = string(c.foundation)
+
+	s.Protocol = "tcp"
+	switch c.transport {
+	case NICE_CANDIDATE_TRANSPORT_UDP:
+		s.Protocol = "udp"
+	case NICE_CANDIDATE_TRANSPORT_TCP_ACTIVE:
+		s.TCPType = "active"
+	case NICE_CANDIDATE_TRANSPORT_TCP_PASSIVE:
+		s.TCPType = "passive"
+	case NICE_CANDIDATE_TRANSPORT_TCP_SO:
+		s.TCPType = "so"
+	}
+
+	s.CandidateType = Nice_candidate_type_to_string(c.typ)
+	if c.typ != NICE_CANDIDATE_TYPE_HOST {
+		s.RelatedAddress = c.base_addr.ip
+		s.RelatedPort = c.base_addr.port
+	}
+
+	if c.turn != nil {
+		switch c.turn.typ {
+		case NICE_RELAY_TYPE_TURN_UDP:
+			s.RelayProtocol = "udp"
+		case NICE_RELAY_TYPE_TURN_TCP:
+			s.RelayProtocol = "tcp"
+		case NICE_RELAY_TYPE_TURN_TLS:
+			s.RelayProtocol = "tls"
+		}
+		s.URL = "turn:" + nice_address_to_string(c.turn.server)
+	} else if c.typ == NICE_CANDIDATE_TYPE_SERVER_REFLEXIVE && !remote && c.server.ip != "" {
+		s.URL = "stun:" + nice_address_to_string(c.server)
+	}
+
+	if remote {
+		s.UsernameFragment = stream.remote_ufrag
+	} else {
+		s.UsernameFragment = stream.local_ufrag
+	}
+	if c.username != "" {
+		/* the dialects with credentials per candidate */
+		s.UsernameFragment = c.username
+	}
+	return s
+}
+
+/* A stable id of the candidate, unique within the agent */
+func priv_candidate_stats_id(c *NiceCandidate, remote bool) string {
+	side := "L"
+	if remote {
+		side = "R"
+	}
+	return fmt.Sprintf("%s%d-%d-%d-%s", side, c.stream_id, c.component_id, c.transport, nice_address_to_string(c.addr))
+}
+
+func priv_check_state_to_string(state NiceCheckState) string {
+	switch state {
+	case NICE_CHECK_WAITING:
+		return "waiting"
+	case NICE_CHECK_IN_PROGRESS:
+		return "in-progress"
+	case NICE_CHECK_SUCCEEDED, NICE_CHECK_DISCOVERED:
+		return "succeeded"
+	case NICE_CHECK_FAILED:
+		return "failed"
+	}
+	return "frozen"
+}
+
+/*
+ * Returns the counters of the pair of @component receiving from @from on
+ * @nicesock, nil if it is not paired.
+ * Must be called with the agent lock held.
+ */
+func priv_find_pair_stats(stream *NiceStream, component *NiceComponent, nicesock NiceSockInterface, from NiceAddress) *nice_pair_stats {
+	selected := &component.selected_pair
+	if selected.remote != nil && selected.stats != nil && priv_pair_stats_from(selected.remote, from) &&
+			component.nice_component_selected_socket() == nicesock {
+		return selected.stats
+	}
+	for i := 0; i < len(stream.conncheck_list); i++ {
+		p := stream.conncheck_list[i]
+		if p.component_id != component.id || p.remote == nil {
+			continue
+		}
+		sock := p.sockptr
+		if sock == nil && p.local != nil {
+			sock = p.local.sockptr
+		}
+		if sock == nicesock && priv_pair_stats_from(p.remote, from) {
+			return &p.stats
+		}
+	}
+	return nil
+}
+
+/* Whether @from is the address of the @remote candidate */
+func priv_pair_stats_from(remote *NiceCandidate, from NiceAddress) bool {
+	return remote.addr.ip == from.ip && remote.addr.port == from.port
+}
+
+/*
+ * Counts the success response sent to @from on @nicesock, which answered
+ * a check of the peer on a pair of @component.
+ * Must be called with the agent lock held.
+ */
+func conn_check_stats_response_sent(agent *NiceAgent, stream *NiceStream, component *NiceComponent, nicesock NiceSockInterface, from NiceAddress) {
+	if ps := priv_find_pair_stats(stream, component, nicesock, from); ps != nil {
+		ps.responses_sent++
+	}
+}
+
+/*
+ * Counts the check @buf received from @from on a pair of @component.
+ * The responses to ours are counted once validated, see
+ * conn_check_stats_response_received().
+ * Must be called with the agent lock held.
+ */
+func conn_check_stats_inbound_stun(agent *NiceAgent, stream *NiceStream, component *NiceComponent, nicesock NiceSockInterface, from NiceAddress, buf []byte) {
+	if !stun_message_is_binding_request(buf) {
+		return
+	}
+	if ps := priv_find_pair_stats(stream, component, nicesock, from); ps != nil {
+		ps.requests_received++
+		ps.last_request_received = agent.clock.Now()
+	}
+}
+
+/*
+ * Counts the response to the check @transaction of @pair, once its
+ * MESSAGE-INTEGRITY was checked, and samples its round trip time. A check
+ * which was retransmitted gives no sample: the response may answer any of
+ * its transmissions (Karn's algorithm, RFC 6298 sect 3).
+ * Must be called with the agent lock held.
+ */
+func conn_check_stats_response_received(agent *NiceAgent, pair *CandidateCheckPair, transaction *StunTransaction) {
+	now := agent.clock.Now()
+	pair.stats.responses_received++
+	pair.stats.last_response_received = now
+	if transaction.timer.retransmissions > 0 {
+		return
+	}
+	rtt := now.Sub(transaction.sent)
+	pair.stats.current_rtt = rtt
+	pair.stats.total_rtt += rtt
+	pair.stats.rtt_samples++
+}
+
+/*
+ * Counts the data sent on the selected pair of @component.
+ * Must be called with the agent lock held.
+ */
+func nice_component_stats_sent(agent *NiceAgent, component *NiceComponent, packets int, bytes int) {
+	ps := component.selected_pair.stats
+	if ps == nil || packets == 0 {
+		return
+	}
+	ps.packets_sent += uint64(packets)
+	ps.bytes_sent += uint64(bytes)
+	ps.last_packet_sent = agent.clock.Now()
+}
+
+/*
+ * Counts a data packet received from @from on the selected pair of
+ * @component.
+ * Must be called with the agent lock held.
+ */
+func nice_component_stats_received(agent *NiceAgent, component *NiceComponent, from NiceAddress, bytes int) {
+	ps := component.selected_pair.stats
+	remote := component.selected_pair.remote
+	if ps == nil || remote == nil || !priv_pair_stats_from(remote, from) {
+		return
+	}
+	ps.packets_received++
+	ps.bytes_received += uint64(bytes)
+	ps.last_packet_received = agent.clock.Now()
+}
@@ -0,0 +1,145 @@
+package nice
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+ * Each agent answers the checks of the other: the pair they selected
+ * counts the responses sent as well as the requests received.
+ */
+func TestStatsResponsesSent(t *testing.T) {
+	a, b := test_conn_check_agents(t, true, false)
+	test_conn_check_wait_ready(t, a)
+	test_conn_check_wait_ready(t, b)
+
+	for _, s := range []*Stream{a, b} {
+		var selected *CandidatePairStats
+		stats := s.Stats()
+		for i := 0; i < len(stats.CandidatePairs); i++ {
+			if stats.CandidatePairs[i].Selected {
+				selected = &stats.CandidatePairs[i]
+			}
+		}
+		if selected == nil {
+			t.Fatalf("stream %d: no selected pair in the stats", s.ID())
+		}
+		if selected.RequestsReceived == 0 || selected.ResponsesSent == 0 {
+			t.Fatalf("stream %d: %d requests received, %d responses sent", s.ID(), selected.RequestsReceived, selected.ResponsesSent)
+		}
+		if selected.ResponsesSent > selected.RequestsReceived + 1 {
+			t.Fatalf("stream %d: %d responses sent to %d requests", s.ID(), selected.ResponsesSent, selected.RequestsReceived)
+		}
+	}
+}
+
+/* The selected check pair of the component of @s, the agent lock held */
+func test_stats_selected_pair(t *testing.T, s *Stream) (*NiceStream, *NiceComponent, *CandidateCheckPair) {
+	agent := s.agent.agent
+	stream, component := agent.agent_find_component(s.ID(), 1)
+	for i := 0; i < len(stream.conncheck_list); i++ {
+		p := stream.conncheck_list[i]
+		if &p.stats == component.selected_pair.stats {
+			return stream, component, p
+		}
+	}
+	t.Fatal("no check pair selected")
+	return nil, nil, nil
+}
+
+/* A response to the check @transaction of @pair, signed with @key */
+func test_stats_response(t *testing.T, stream *NiceStream, transaction *StunTransaction, key []byte) []byte {
+	msg := NewStunMessage(STUN_RESPONSE, STUN_BINDING)
+	msg.messageHeader.transactionId = transaction.message.messageHeader.transactionId
+	buf, err := stun_agent_finish_message_short_term(&stream.stun_agent, msg, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+/*
+ * The responses are counted once their MESSAGE-INTEGRITY is checked, and
+ * only those to a check sent once give a round trip time.
+ */
+func TestStatsResponsesReceived(t *testing.T) {
+	a, b := test_conn_check_agents(t, true, false)
+	test_conn_check_wait_ready(t, a)
+	test_conn_check_wait_ready(t, b)
+
+	agent := a.agent.agent
+	agent.agent_mutex.Lock()
+	defer agent.agent_mutex.Unlock()
+	stream, component, pair := test_stats_selected_pair(t, a)
+	from := pair.remote.addr
+	key := priv_get_password(agent, stream, pair.remote, false)
+	check := func(transaction *StunTransaction, buf []byte) {
+		pair.stun_transactions = []*StunTransaction{transaction}
+		agent_recv_stun(agent, stream, component, pair.sockptr, from, buf, buf)
+	}
+	new_transaction := func(sent time.Duration, retransmissions uint32) *StunTransaction {
+		transaction := &StunTransaction{message: priv_conn_check_build_request(agent, stream, pair, false, false)}
+		transaction.sent = agent.clock.Now().Add(-sent)
+		transaction.timer.retransmissions = retransmissions
+		return transaction
+	}
+	responses := pair.stats.responses_received
+	samples := pair.stats.rtt_samples
+
+	forged := new_transaction(time.Second, 0)
+	check(forged, test_stats_response(t, stream, forged, []byte("wrongpasswordwrongpassword")))
+	if pair.stats.responses_received != responses || pair.stats.rtt_samples != samples {
+		t.Fatal("a response with a wrong message integrity was counted")
+	}
+
+	retransmitted := new_transaction(time.Second, 1)
+	check(retransmitted, test_stats_response(t, stream, retransmitted, key))
+	if pair.stats.responses_received != responses + 1 || pair.stats.rtt_samples != samples {
+		t.Fatalf("%d responses and %d samples after a retransmitted check", pair.stats.responses_received, pair.stats.rtt_samples)
+	}
+	if pair.stats.current_rtt >= time.Second {
+		t.Fatalf("round trip time %v sampled on a retransmitted check", pair.stats.current_rtt)
+	}
+
+	once := new_transaction(time.Second, 0)
+	check(once, test_stats_response(t, stream, once, key))
+	if pair.stats.responses_received != responses + 2 || pair.stats.rtt_samples != samples + 1 {
+		t.Fatalf("%d responses and %d samples after a check sent once", pair.stats.responses_received, pair.stats.rtt_samples)
+	}
+	if pair.stats.current_rtt < time.Second {
+		t.Fatalf("round trip time %v", pair.stats.current_rtt)
+	}
+}
+
+/* The pair whose consent expired tells when in its stats */
+func TestStatsConsentExpired(t *testing.T) {
+	a, b := test_conn_check_agents(t, true, false, WithConsentFreshness())
+	test_conn_check_wait_ready(t, a)
+	test_conn_check_wait_ready(t, b)
+
+	agent := a.agent.agent
+	var expired time.Time
+	var id string
+	func() {
+		agent.agent_mutex.Lock()
+		defer agent.agent_mutex.Unlock()
+		_, component, pair := test_stats_selected_pair(t, a)
+		expired = agent.clock.Now()
+		component.selected_pair.keepalive.consent_received = expired.Add(-NICE_AGENT_TIMER_CONSENT_TIMEOUT * time.Millisecond)
+		priv_conn_consent_tick_unlocked(agent)
+		id = priv_candidate_stats_id(pair.local, false) + "-" + priv_candidate_stats_id(pair.remote, true)
+	}()
+
+	stats := a.Stats()
+	for i := 0; i < len(stats.CandidatePairs); i++ {
+		if stats.CandidatePairs[i].ID != id {
+			continue
+		}
+		if stats.CandidatePairs[i].ConsentExpiredTimestamp.Before(expired) {
+			t.Fatalf("consent expired at %v", stats.CandidatePairs[i].ConsentExpiredTimestamp)
+		}
+		return
+	}
+	t.Fatal("the pair is not in the stats")
+}
@@ -1,5 +1,7 @@
 package nice
 
+import "time"
+
 type NiceStream struct {
 	name								string
 	id 									uint
@@ -8,9 +10,14 @@ type NiceStream struct {
 	conncheck_list						[]*CandidateCheckPair
 	gathering							bool
 	gathering_started					bool
+	gathering_start						time.Time	/* when nice_agent_gather_candidates() was called */
 	peer_gathering_done					bool
 	local_ufrag							string
 	local_password						string
+	local_credentials_set				bool	/* by nice_agent_set_local_credentials(), kept on a mux */
+	remote_ufrag						string
+	remote_password						string
+	stun_agent							StunAgent	/* of the connectivity checks */
 }
 
 func NewNiceStream(stream_id uint, n_components uint, agent *NiceAgent) *NiceStream {
@@ -34,9 +41,50 @@ func (this *NiceStream) find_component_by_id(component_id uint) *NiceComponent {
 	return nil
 }
 
+/*
+ * Closes the components of the stream, once it is removed from the agent.
+ */
+func nice_stream_close(agent *NiceAgent, stream *NiceStream) {
+	for i := 0; i < len(stream.components); i++ {
+		stream.components[i].nice_component_close(agent)
+	}
+}
+
 func (this *NiceStream) nice_stream_initialize_credentials(rng *NiceRNG) {
 	u := rng.nice_rng_generate_bytes_print(NICE_STREAM_DEF_UFRAG - 1)
 	this.local_ufrag = string(u)
 	p := rng.nice_rng_generate_bytes_print(NICE_STREAM_DEF_PWD - 1)
 	this.local_password = string(p)
-}
\ No newline at end of file
+}
+
+/*
+ * Checks that @ufrag and @pwd are valid local credentials: a ufrag of 4 to
+ * 256 'ice-char's and a password of 22 to 256, the characters
+ * nice_rng_generate_bytes_print() generates.
+ */
+func nice_stream_credentials_are_valid(ufrag string, pwd string) bool {
+	return nice_stream_credential_is_valid(ufrag, NICE_STREAM_DEF_UFRAG - 1, NICE_STREAM_MAX_UFRAG - 1) &&
+		nice_stream_credential_is_valid(pwd, NICE_STREAM_DEF_PWD - 1, NICE_STREAM_MAX_PWD - 1)
+}
+
+/*
+ * Whether the negotiation of the stream started, the local credentials in
+ * use by the checks: pairs were formed, or a check of the peer came in.
+ */
+func nice_stream_negotiation_started(stream *NiceStream) bool {
+	return len(stream.conncheck_list) > 0 || stream.initial_binding_request_received
+}
+
+func nice_stream_credential_is_valid(credential string, min_len int, max_len int) bool {
+	if len(credential) < min_len || len(credential) > max_len {
+		return false
+	}
+	for i := 0; i < len(credential); i++ {
+		ch := credential[i]
+		if !(ch >= 'A' && ch <= 'Z') && !(ch >= 'a' && ch <= 'z') &&
+				!(ch >= '0' && ch <= '9') && ch != '+' && ch != '/' {
+			return false
+		}
+	}
+	return true
+}
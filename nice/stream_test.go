@@ -0,0 +1,71 @@
+package nice
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+/*
+ * The local credentials are checked the same by both setters, and can no
+ * longer change once the checks of the stream started.
+ */
+func TestStreamSetLocalCredentials(t *testing.T) {
+	agent, err := NewAgent(WithLocalAddresses("127.0.0.1"), WithIceTcp(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close(context.Background())
+	s, err := agent.AddStream(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const ufrag = "abcd"
+	const pwd = "abcdefghijklmnopqrstuv"
+	for _, creds := range [][2]string{{"abc", pwd}, {ufrag, pwd[1:]}, {"ab:d", pwd}, {ufrag, pwd[1:] + "="}} {
+		if err := s.SetLocalCredentials(creds[0], creds[1]); err != ErrInvalidArgument {
+			t.Fatalf("%q %q: %v", creds[0], creds[1], err)
+		}
+		if agent.agent.Nice_agent_set_local_credentials(s.ID(), creds[0], creds[1]) {
+			t.Fatalf("%q %q accepted", creds[0], creds[1])
+		}
+	}
+	if err := s.SetLocalCredentials(ufrag, pwd); err != nil {
+		t.Fatal(err)
+	}
+	if u, p, _ := s.LocalCredentials(); u != ufrag || p != pwd {
+		t.Fatalf("credentials %q %q", u, p)
+	}
+	if err := priv_set_local_credentials(agent.agent, s.ID() + 1, ufrag, pwd); err != ErrNoSuchStream {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if err := s.Gather(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetRemoteCredentials("peer", "peerpasswordpeerpassword"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Component(1).AddRemoteCandidates(Candidate{
+		Type: NICE_CANDIDATE_TYPE_HOST,
+		Transport: NICE_CANDIDATE_TRANSPORT_UDP,
+		Address: "127.0.0.1",
+		Port: 9,
+		Priority: 1,
+		Foundation: "1",
+		StreamID: s.ID(),
+		ComponentID: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetLocalCredentials("efgh", pwd); err != ErrNegotiationStarted {
+		t.Fatal(err)
+	}
+	if agent.agent.Nice_agent_set_local_credentials(s.ID(), "efgh", pwd) {
+		t.Fatal("credentials changed during the negotiation")
+	}
+}
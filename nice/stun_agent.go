@@ -1,5 +1,10 @@
 package nice
 
+import (
+	"bytes"
+	"encoding/binary"
+)
+
 /**
  * SECTION:stunagent
  * @short_description: STUN agent for building and validating STUN messages
@@ -138,7 +143,7 @@ type StunAgentSavedIds struct {
 	id				StunTransactionId
 	method			StunMethod
 	key 			[]byte
-	long_term_key	[8]byte
+	long_term_key	[16]byte
 	long_term_valid	bool
 	valid 			bool
 }
@@ -202,8 +207,206 @@ func stun_agent_init(agent *StunAgent, compatibility StunCompatibility, usage_fl
 	agent.software_attribute = ""
 	agent.ms_ice2_send_legacy_connchecks = compatibility == STUN_COMPATIBILITY_MSICE2
 
-	for i := 0; i < STUN_AGENT_MAX_SAVED_IDS; i++ {
-		agent.sent_ids[i].valid = false
+	agent.sent_ids = make([]StunAgentSavedIds, STUN_AGENT_MAX_SAVED_IDS)
+}
+
+/*
+ * Applies to @msg the usage flags of @agent which change how it is
+ * encoded: STUN_AGENT_USAGE_NO_ALIGNED_ATTRIBUTES leaves its attributes
+ * unpadded.
+ */
+func stun_agent_prepare_message(agent *StunAgent, msg *StunMessage) {
+	msg.no_aligned_attributes = stun_agent_no_aligned(agent)
+}
+
+/* Whether the messages of @agent go without the magic cookie */
+func stun_agent_no_cookie(agent *StunAgent) bool {
+	return agent.compatibility == STUN_COMPATIBILITY_RFC3489 || agent.compatibility == STUN_COMPATIBILITY_OC2007
+}
+
+/* Whether the attributes of the messages of @agent are not aligned */
+func stun_agent_no_aligned(agent *StunAgent) bool {
+	return agent.usage_flags & STUN_AGENT_USAGE_NO_ALIGNED_ATTRIBUTES != 0
+}
+
+/*
+ * The long-term credentials of a server (RFC 5389 section 10.2), shared by
+ * the transactions with it: the REALM and NONCE it last challenged with,
+ * and the key derived from them.
+ */
+type StunLongTermCredentials struct {
+	username		string
+	password		string
+	realm			string
+	nonce			string
+	key				[]byte	/* stun_hash_creds(), nil until challenged */
+}
+
+/* The REALM and NONCE attribute types, swapped by OC2007 */
+func stun_agent_realm_nonce_types(agent *StunAgent) (StunAttributeType, StunAttributeType) {
+	if agent.compatibility == STUN_COMPATIBILITY_OC2007 {
+		return STUN_ATTRIBUTE_NONCE, STUN_ATTRIBUTE_REALM
 	}
+	return STUN_ATTRIBUTE_REALM, STUN_ATTRIBUTE_NONCE
+}
+
+/* Whether the long-term credentials apply to the requests of @agent */
+func stun_agent_uses_long_term_credentials(agent *StunAgent, creds *StunLongTermCredentials) bool {
+	return creds != nil && agent.usage_flags & STUN_AGENT_USAGE_LONG_TERM_CREDENTIALS != 0 &&
+		agent.compatibility != STUN_COMPATIBILITY_RFC3489
 }
 
+/*
+ * Encodes the request @msg. Once the server challenged @creds, it gets
+ * their USERNAME, REALM, NONCE and MESSAGE-INTEGRITY, and the key is saved
+ * with its transaction id for stun_agent_check_response(). Before that,
+ * it is sent as is, for the server to answer with its REALM and NONCE.
+ */
+func stun_agent_finish_message(agent *StunAgent, msg *StunMessage, creds *StunLongTermCredentials) ([]byte, error) {
+	authenticated := stun_agent_uses_long_term_credentials(agent, creds) && creds.key != nil
+	if authenticated {
+		realm_type, nonce_type := stun_agent_realm_nonce_types(agent)
+		msg.AddAttr(StunAttr{
+			header: StunAttrHeader{typ: STUN_ATTRIBUTE_USERNAME},
+			value:  &StunUsernameAttrValue{username: creds.username},
+		})
+		msg.AddAttr(StunAttr{
+			header: StunAttrHeader{typ: realm_type},
+			value:  &StunRealmAttrValue{realm: creds.realm},
+		})
+		msg.AddAttr(StunAttr{
+			header: StunAttrHeader{typ: nonce_type},
+			value:  &StunNonceAttrValue{nonce: creds.nonce},
+		})
+		if err := stun_message_append_integrity(msg, creds.key, stun_agent_no_cookie(agent)); err != nil {
+			return nil, err
+		}
+	}
+	if stun_agent_uses_fingerprint(agent) {
+		if err := stun_message_append_fingerprint(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	ds := NewDataStream(make([]byte, 0))
+	if err := msg.Encode(ds); err != nil {
+		return nil, err
+	}
+	if authenticated && msg.messageHeader.messageType.class == STUN_REQUEST {
+		/* only the requests are answered */
+		stun_agent_save_id(agent, msg, creds.key)
+	}
+	return ds.Data(), nil
+}
+
+/*
+ * Encodes the message @msg of the short-term credentials @key, those of
+ * the ICE connectivity checks: it gets its MESSAGE-INTEGRITY unless @key
+ * is nil or @agent ignores the credentials (Google), then its FINGERPRINT
+ * if the usage of @agent asks for one.
+ */
+func stun_agent_finish_message_short_term(agent *StunAgent, msg *StunMessage, key []byte) ([]byte, error) {
+	if key != nil && agent.usage_flags & STUN_AGENT_USAGE_IGNORE_CREDENTIALS == 0 {
+		if err := stun_message_append_integrity(msg, key, stun_agent_no_cookie(agent)); err != nil {
+			return nil, err
+		}
+	}
+	if stun_agent_uses_fingerprint(agent) {
+		if err := stun_message_append_fingerprint(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	ds := NewDataStream(make([]byte, 0))
+	if err := msg.Encode(ds); err != nil {
+		return nil, err
+	}
+	return ds.Data(), nil
+}
+
+/* Whether the messages of @agent end with a FINGERPRINT, which needs the
+ * magic cookie */
+func stun_agent_uses_fingerprint(agent *StunAgent) bool {
+	return agent.usage_flags & STUN_AGENT_USAGE_USE_FINGERPRINT != 0 && !stun_agent_no_cookie(agent)
+}
+
+/* Remembers the key the request @msg was authenticated with */
+func stun_agent_save_id(agent *StunAgent, msg *StunMessage, key []byte) {
+	var free *StunAgentSavedIds
+	for i := 0; i < len(agent.sent_ids); i++ {
+		if !agent.sent_ids[i].valid {
+			free = &agent.sent_ids[i]
+			break
+		}
+	}
+	if free == nil {
+		/* forget the oldest */
+		copy(agent.sent_ids, agent.sent_ids[1:])
+		free = &agent.sent_ids[len(agent.sent_ids) - 1]
+	}
+	free.id = *msg.messageHeader.transactionId
+	free.method = msg.messageHeader.messageType.method
+	free.key = nil
+	copy(free.long_term_key[:], key)
+	free.long_term_valid = true
+	free.valid = true
+}
+
+/*
+ * Checks the response @buf against the saved id of its request, which is
+ * then forgotten: the responses to an authenticated request must carry
+ * its MESSAGE-INTEGRITY, except the errors. @buf is the response as
+ * received, unaligned in the dialects without alignment.
+ *
+ * Returns: %FALSE if @buf must be ignored
+ */
+func stun_agent_check_response(agent *StunAgent, buf []byte) bool {
+	/* the magic cookie takes the first bytes of the transaction id */
+	tid := buf[4 + STUN_MAGIC_COOKIE_LEN:STUN_MESSAGE_HEADER_LENGTH]
+	for i := 0; i < len(agent.sent_ids); i++ {
+		saved := &agent.sent_ids[i]
+		if !saved.valid || !bytes.Equal(saved.id[STUN_MAGIC_COOKIE_LEN:], tid) {
+			continue
+		}
+		saved.valid = false
+		if !saved.long_term_valid || binary.BigEndian.Uint16(buf[0:2]) & 0x0110 == 0x0110 {
+			return true
+		}
+		return stun_message_check_integrity(buf, saved.long_term_key[:], stun_agent_no_cookie(agent), !stun_agent_no_aligned(agent))
+	}
+	return true
+}
+
+/*
+ * Takes the REALM and NONCE of the 401 (Unauthorized) or 438 (Stale
+ * Nonce) error @buf into @creds (RFC 5389 section 10.2.3).
+ *
+ * Returns: %TRUE if the request is worth sending again with @creds: they
+ * changed, or the request had none
+ */
+func stun_agent_update_long_term_credentials(agent *StunAgent, creds *StunLongTermCredentials, buf []byte, authenticated bool) bool {
+	if !stun_agent_uses_long_term_credentials(agent, creds) {
+		return false
+	}
+	code := stun_message_get_error_code(buf)
+	if code != STUN_ERROR_UNAUTHORIZED && code != STUN_ERROR_STALE_NONCE {
+		return false
+	}
+	realm_type, nonce_type := stun_agent_realm_nonce_types(agent)
+	realm := string(stun_message_find_attribute(buf, realm_type))
+	nonce := string(stun_message_find_attribute(buf, nonce_type))
+	if nonce == "" || (realm == "" && code == STUN_ERROR_UNAUTHORIZED) {
+		return false
+	}
+	if realm == "" {
+		realm = creds.realm
+	}
+
+	changed := !authenticated || realm != creds.realm || nonce != creds.nonce || creds.key == nil
+	if realm != creds.realm || creds.key == nil {
+		creds.key = stun_hash_creds(realm, creds.username, creds.password)
+	}
+	creds.realm = realm
+	creds.nonce = nonce
+	return changed
+}
@@ -280,22 +280,48 @@ type StunAttr struct {
 	padding 	[]byte
 }
 
+/*
+ * The bytes of padding after a value of 'l' bytes, which the attributes
+ * are aligned on 32 bits with (RFC 5389 section 15)
+ */
+func stun_attr_padding(l int) int {
+	return (4 - l % 4) % 4
+}
+
 func (this *StunAttr) Encode(stream *DataStream) error {
+	return this.encode(stream, true)
+}
+
+/*
+ * Encodes the attribute, padded unless 'aligned' is FALSE, see
+ * STUN_AGENT_USAGE_NO_ALIGNED_ATTRIBUTES.
+ */
+func (this *StunAttr) encode(stream *DataStream, aligned bool) error {
 	this.header.len = this.value.GetSize()
 	this.header.Encode(stream)
-	this.value.Encode(stream)
-	paddingBytes := 4 - this.value.GetSize()%4
-	if paddingBytes > 0 {
-		this.padding = make([]byte, paddingBytes)
-		stream.WriteBytes(this.padding)				//The padding bits are ignored, and may be any value
+	if err := this.value.Encode(stream); err != nil {
+		return err
+	}
+	this.padding = nil
+	if aligned {
+		if n := stun_attr_padding(int(this.header.len)); n > 0 {
+			this.padding = make([]byte, n)
+			stream.WriteBytes(this.padding)				//The padding bits are ignored, and may be any value
+		}
 	}
 	return nil
 }
 
 func (this StunAttr) GetSize() uint16 {
-	s := this.header.GetSize()
-	s += this.value.GetSize()
-	s = 4*((s + 3)%4)	//add padding
+	return this.size(true)
+}
+
+/* The size of the encoded attribute, with its padding if 'aligned' */
+func (this StunAttr) size(aligned bool) uint16 {
+	s := this.header.GetSize() + this.value.GetSize()
+	if aligned {
+		s += uint16(stun_attr_padding(int(this.value.GetSize())))
+	}
 	return s
 }
 
@@ -528,6 +554,7 @@ type StunMessage struct  {
 	messageHeader 	*StunMessageHeader
 	magicCookie		*StunMessageMagicCookie
 	attrs			[]StunAttr
+	no_aligned_attributes	bool	/* STUN_AGENT_USAGE_NO_ALIGNED_ATTRIBUTES, no padding */
 }
 
 func NewStunMessage(c StunClass, m StunMethod) *StunMessage {
@@ -553,17 +580,232 @@ func (this StunMessage) Encode(stream *DataStream) error {
 	//caculate the message length
 	var l uint16 = 0
 	for i := 0; i < len(this.attrs); i++ {
-		l += this.attrs[i].GetSize()
+		l += this.attrs[i].size(!this.no_aligned_attributes)
 	}
 	this.messageHeader.messageLen = l
 	//encode message header
 	this.messageHeader.Encode(stream)
 	if this.magicCookie != nil {
+		/* the cookie takes the first 4 bytes of the 16 bytes transaction id */
 		this.magicCookie.Encode(stream)
+		stream.WriteBytes((*this.messageHeader.transactionId)[STUN_MAGIC_COOKIE_LEN:])
+	} else {
+		this.messageHeader.transactionId.Encode(stream)
 	}
 	//encode attrs
 	for i := 0; i < len(this.attrs); i++ {
-		this.attrs[i].Encode(stream)
+		if err := this.attrs[i].encode(stream, !this.no_aligned_attributes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+/* Whether 'msg' was finished with a MESSAGE-INTEGRITY */
+func stun_message_has_integrity(msg *StunMessage) bool {
+	for i := 0; i < len(msg.attrs); i++ {
+		if msg.attrs[i].header.typ == STUN_ATTRIBUTE_MESSAGE_INTEGRITY {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Fast check of whether 'buf' holds a STUN message (RFC 5389 section 6):
+ * the two most significant bits are zero, the length field matches the
+ * buffer and is a multiple of 4, and the magic cookie is present.
+ */
+func stun_message_is_stun(buf []byte) bool {
+	return stun_message_validate(buf, true, true)
+}
+
+/*
+ * Fast check of whether 'buf' holds an RFC 3489 STUN message, which has no
+ * magic cookie: the two most significant bits are zero and the length
+ * field matches the buffer and is a multiple of 4. RFC 5389 messages pass
+ * too.
+ */
+func stun_message_is_stun_rfc3489(buf []byte) bool {
+	return stun_message_validate(buf, false, true)
+}
+
+/*
+ * Checks that 'buf' holds a STUN message, with the magic cookie if
+ * 'cookie'. Without 'aligned', see STUN_AGENT_USAGE_NO_ALIGNED_ATTRIBUTES,
+ * the length may be any and the attributes must fill the message exactly,
+ * padded or not.
+ */
+func stun_message_validate(buf []byte, cookie bool, aligned bool) bool {
+	if len(buf) < STUN_MESSAGE_HEADER_LENGTH {
+		return false
+	}
+	if buf[0] & 0xc0 != 0 {
+		return false
+	}
+	l := int(binary.BigEndian.Uint16(buf[2:4]))
+	if l + STUN_MESSAGE_HEADER_LENGTH != len(buf) {
+		return false
+	}
+	if cookie && binary.BigEndian.Uint32(buf[4:8]) != STUN_MAGIC_COOKIE {
+		return false
+	}
+	if aligned {
+		return l % 4 == 0
+	}
+	return stun_message_walk(buf, false) || stun_message_walk(buf, true)
+}
+
+/*
+ * Whether the attributes of the STUN message 'buf', padded if 'aligned',
+ * end exactly with the message.
+ */
+func stun_message_walk(buf []byte, aligned bool) bool {
+	offset := STUN_MESSAGE_HEADER_LENGTH
+	for offset + 4 <= len(buf) {
+		l := int(binary.BigEndian.Uint16(buf[offset + 2:offset + 4]))
+		offset += 4 + l
+		if aligned {
+			offset += stun_attr_padding(l)
+		}
+	}
+	return offset == len(buf)
+}
+
+/*
+ * Returns the STUN message 'buf', whose attributes may not be aligned (see
+ * stun_message_validate()), with its attributes padded, for the
+ * stun_message_find_*() functions. 'buf' itself is returned when it
+ * already is.
+ */
+func stun_message_align(buf []byte) []byte {
+	if !stun_message_walk(buf, false) {
+		return buf
+	}
+	offset := STUN_MESSAGE_HEADER_LENGTH
+	aligned := true
+	for offset + 4 <= len(buf) {
+		l := int(binary.BigEndian.Uint16(buf[offset + 2:offset + 4]))
+		if l % 4 != 0 {
+			aligned = false
+			break
+		}
+		offset += 4 + l
+	}
+	if aligned {
+		return buf
+	}
+
+	out := make([]byte, STUN_MESSAGE_HEADER_LENGTH, len(buf) + 3 * (len(buf) / 4))
+	copy(out, buf[:STUN_MESSAGE_HEADER_LENGTH])
+	offset = STUN_MESSAGE_HEADER_LENGTH
+	for offset + 4 <= len(buf) {
+		l := int(binary.BigEndian.Uint16(buf[offset + 2:offset + 4]))
+		out = append(out, buf[offset:offset + 4 + l]...)
+		out = append(out, make([]byte, stun_attr_padding(l))...)
+		offset += 4 + l
+	}
+	binary.BigEndian.PutUint16(out[2:4], uint16(len(out) - STUN_MESSAGE_HEADER_LENGTH))
+	return out
+}
+
+/*
+ * Returns the value of the first attribute of type 'typ' in the STUN
+ * message 'buf', or nil if it is absent. 'buf' must have been checked with
+ * stun_message_is_stun().
+ */
+func stun_message_find_attribute(buf []byte, typ StunAttributeType) []byte {
+	offset := STUN_MESSAGE_HEADER_LENGTH
+	for offset + 4 <= len(buf) {
+		t := StunAttributeType(binary.BigEndian.Uint16(buf[offset:offset + 2]))
+		l := int(binary.BigEndian.Uint16(buf[offset + 2:offset + 4]))
+		offset += 4
+		if offset + l > len(buf) {
+			return nil
+		}
+		if t == typ {
+			return buf[offset:offset + l]
+		}
+		/* attributes are padded to 4 bytes */
+		offset += l + stun_attr_padding(l)
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+/*
+ * Whether the STUN message 'buf' is a Binding request, from the class and
+ * method bits of its type.
+ */
+func stun_message_is_binding_request(buf []byte) bool {
+	return binary.BigEndian.Uint16(buf[0:2]) & 0x3fff == 0x0001
+}
+
+/*
+ * Whether the STUN message 'buf' is a success or error response, of any
+ * method.
+ */
+func stun_message_is_response(buf []byte) bool {
+	return binary.BigEndian.Uint16(buf[0:2]) & 0x0100 != 0
+}
+
+/*
+ * Whether the STUN message 'buf' is a Binding success or error response.
+ */
+func stun_message_is_binding_response(buf []byte) bool {
+	t := binary.BigEndian.Uint16(buf[0:2]) & 0x3fff
+	return t == 0x0101 || t == 0x0111
+}
+
+/*
+ * Returns the reflexive address of the Binding response 'buf': its
+ * XOR-MAPPED-ADDRESS, the MS-XOR-MAPPED-ADDRESS of the Microsoft servers,
+ * or the MAPPED-ADDRESS of the RFC 3489 ones.
+ */
+func stun_message_find_mapped_addr(buf []byte) (NiceAddress, bool) {
+	if addr, ok := stun_message_find_xor_addr(buf, STUN_ATTRIBUTE_XOR_MAPPED_ADDRESS); ok {
+		return addr, true
+	}
+	if addr, ok := stun_message_find_xor_addr(buf, STUN_ATTRIBUTE_MS_XOR_MAPPED_ADDRESS); ok {
+		return addr, true
+	}
+	return stun_message_find_addr(buf, STUN_ATTRIBUTE_MAPPED_ADDRESS)
+}
+
+/*
+ * Returns the code of the ERROR-CODE attribute of the STUN message 'buf'
+ * (RFC 5389 section 15.6), or -1 if it has none.
+ */
+func stun_message_get_error_code(buf []byte) int {
+	value := stun_message_find_attribute(buf, STUN_ATTRIBUTE_ERROR_CODE)
+	if len(value) < 4 {
+		return -1
+	}
+	return int(value[2] & 0x07) * 100 + int(value[3])
+}
+
+/*
+ * Whether the STUN message 'buf' answers 'msg', from its transaction id:
+ * the magic cookie takes the first 4 bytes of the id of 'msg', unless it
+ * was sent without.
+ */
+func stun_message_matches_transaction_id(buf []byte, msg *StunMessage) bool {
+	id := *msg.messageHeader.transactionId
+	if msg.magicCookie != nil {
+		return string(buf[8:STUN_MESSAGE_HEADER_LENGTH]) == string(id[STUN_MAGIC_COOKIE_LEN:])
+	}
+	return string(buf[4:STUN_MESSAGE_HEADER_LENGTH]) == string(id)
+}
+
+/*
+ * The transaction id of the STUN message 'buf', for the response to it:
+ * with the magic cookie in its first 4 bytes if 'buf' has one.
+ */
+func stun_message_transaction_id(buf []byte) *StunTransactionId {
+	id := make(StunTransactionId, STUN_MESSAGE_TRANS_ID_LEN)
+	copy(id, buf[4:STUN_MESSAGE_HEADER_LENGTH])
+	return &id
+}
+
+/* Whether the STUN message 'buf' carries the magic cookie of RFC 5389 */
+func stun_message_has_cookie(buf []byte) bool {
+	return binary.BigEndian.Uint32(buf[4:8]) == STUN_MAGIC_COOKIE
+}
@@ -0,0 +1,159 @@
+package nice
+
+import (
+	"bytes"
+	"testing"
+)
+
+func test_stun_transaction_id() *StunTransactionId {
+	id := make(StunTransactionId, STUN_MESSAGE_TRANS_ID_LEN)
+	for i := 0; i < len(id); i++ {
+		id[i] = byte(0x10 + i)
+	}
+	return &id
+}
+
+func test_stun_encode(t *testing.T, msg *StunMessage) []byte {
+	ds := NewDataStream(make([]byte, 0))
+	if err := msg.Encode(ds); err != nil {
+		t.Fatal(err)
+	}
+	return ds.Data()
+}
+
+/*
+ * With a magic cookie, the 16 bytes transaction id is sent as the cookie
+ * followed by its last 12 bytes: the header stays 20 bytes long.
+ */
+func TestStunMessageEncodeCookie(t *testing.T) {
+	msg := NewStunMessage(STUN_REQUEST, STUN_BINDING)
+	id := test_stun_transaction_id()
+	msg.messageHeader.transactionId = id
+
+	buf := test_stun_encode(t, msg)
+	want := []byte{0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42}
+	want = append(want, (*id)[STUN_MAGIC_COOKIE_LEN:]...)
+	if !bytes.Equal(buf, want) {
+		t.Fatalf("encoded\n% x\nwant\n% x", buf, want)
+	}
+	if !stun_message_is_stun(buf) {
+		t.Fatal("the message is not recognised as STUN")
+	}
+}
+
+/* Without a cookie (RFC 3489), the whole transaction id is sent */
+func TestStunMessageEncodeNoCookie(t *testing.T) {
+	msg := NewStunMessage(STUN_REQUEST, STUN_BINDING)
+	msg.magicCookie = nil
+	id := test_stun_transaction_id()
+	msg.messageHeader.transactionId = id
+
+	buf := test_stun_encode(t, msg)
+	want := append([]byte{0x00, 0x01, 0x00, 0x00}, (*id)...)
+	if !bytes.Equal(buf, want) {
+		t.Fatalf("encoded\n% x\nwant\n% x", buf, want)
+	}
+	if stun_message_is_stun(buf) {
+		t.Fatal("a message without cookie is taken for RFC 5389")
+	}
+}
+
+/* A Binding request with an attribute of odd length, then a PRIORITY */
+func test_stun_odd_message(no_aligned bool) *StunMessage {
+	msg := NewStunMessage(STUN_REQUEST, STUN_BINDING)
+	msg.messageHeader.transactionId = test_stun_transaction_id()
+	msg.no_aligned_attributes = no_aligned
+	msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_USERNAME}, value: &StunUsernameAttrValue{username: "abcde"}})
+	msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_PRIORITY}, value: &StunPriorityAttrValue{priority: 0x6e0001ff}})
+	return msg
+}
+
+/* The header of test_stun_odd_message() for a message of length @l */
+func test_stun_odd_header(l byte) []byte {
+	want := []byte{0x00, 0x01, 0x00, l, 0x21, 0x12, 0xa4, 0x42}
+	return append(want, (*test_stun_transaction_id())[STUN_MAGIC_COOKIE_LEN:]...)
+}
+
+/* The attributes are padded to 4 bytes with zeroes (RFC 5389 section 15) */
+func TestStunMessageEncodePadded(t *testing.T) {
+	buf := test_stun_encode(t, test_stun_odd_message(false))
+	want := append(test_stun_odd_header(20),
+		0x00, 0x06, 0x00, 0x05, 'a', 'b', 'c', 'd', 'e', 0x00, 0x00, 0x00,
+		0x00, 0x24, 0x00, 0x04, 0x6e, 0x00, 0x01, 0xff)
+	if !bytes.Equal(buf, want) {
+		t.Fatalf("encoded\n% x\nwant\n% x", buf, want)
+	}
+	if !stun_message_validate(buf, true, true) {
+		t.Fatal("the padded message does not validate")
+	}
+	if v := stun_message_find_attribute(buf, STUN_ATTRIBUTE_PRIORITY); !bytes.Equal(v, []byte{0x6e, 0x00, 0x01, 0xff}) {
+		t.Fatalf("PRIORITY % x", v)
+	}
+}
+
+/*
+ * With STUN_AGENT_USAGE_NO_ALIGNED_ATTRIBUTES, the attributes follow each
+ * other unpadded; stun_message_align() gives back the padded encoding.
+ */
+func TestStunMessageEncodeUnpadded(t *testing.T) {
+	buf := test_stun_encode(t, test_stun_odd_message(true))
+	want := append(test_stun_odd_header(17),
+		0x00, 0x06, 0x00, 0x05, 'a', 'b', 'c', 'd', 'e',
+		0x00, 0x24, 0x00, 0x04, 0x6e, 0x00, 0x01, 0xff)
+	if !bytes.Equal(buf, want) {
+		t.Fatalf("encoded\n% x\nwant\n% x", buf, want)
+	}
+	if stun_message_validate(buf, true, true) || !stun_message_validate(buf, true, false) {
+		t.Fatal("the unpadded message validates only without alignment")
+	}
+
+	aligned := stun_message_align(buf)
+	if padded := test_stun_encode(t, test_stun_odd_message(false)); !bytes.Equal(aligned, padded) {
+		t.Fatalf("aligned\n% x\nwant\n% x", aligned, padded)
+	}
+	if v := stun_message_find_attribute(aligned, STUN_ATTRIBUTE_USERNAME); string(v) != "abcde" {
+		t.Fatalf("USERNAME %q", v)
+	}
+	if !bytes.Equal(buf, want) {
+		t.Fatal("stun_message_align() changed the received message")
+	}
+}
+
+/*
+ * The MESSAGE-INTEGRITY and FINGERPRINT of an unpadded message are those
+ * of the bytes sent: they only check on the message as received, not on
+ * its aligned copy.
+ */
+func TestStunMessageCheckIntegrityUnpadded(t *testing.T) {
+	agent := &StunAgent{}
+	stun_agent_init(agent, STUN_COMPATIBILITY_MSICE2, STUN_AGENT_USAGE_SHORT_TERM_CREDENTIALS | STUN_AGENT_USAGE_USE_FINGERPRINT | STUN_AGENT_USAGE_NO_ALIGNED_ATTRIBUTES)
+	msg := test_stun_odd_message(false)
+	stun_agent_prepare_message(agent, msg)
+	key := []byte("password")
+	raw, err := stun_agent_finish_message_short_term(agent, msg, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* header, 9 + 8 bytes of attributes, MESSAGE-INTEGRITY, FINGERPRINT */
+	if len(raw) != STUN_MESSAGE_HEADER_LENGTH + 17 + 24 + 8 {
+		t.Fatalf("%d bytes sent", len(raw))
+	}
+
+	if !stun_message_check_integrity(raw, key, false, false) {
+		t.Fatal("bad MESSAGE-INTEGRITY of the message as received")
+	}
+	if stun_message_check_integrity(raw, []byte("wrong"), false, false) {
+		t.Fatal("MESSAGE-INTEGRITY checks with the wrong key")
+	}
+	if !stun_message_check_fingerprint(raw) {
+		t.Fatal("bad FINGERPRINT of the message as received")
+	}
+
+	aligned := stun_message_align(raw)
+	if stun_message_check_integrity(aligned, key, false, true) || stun_message_check_fingerprint(aligned) {
+		t.Fatal("the aligned copy checks")
+	}
+	if v := stun_message_find_attribute(aligned, STUN_ATTRIBUTE_PRIORITY); !bytes.Equal(v, []byte{0x6e, 0x00, 0x01, 0xff}) {
+		t.Fatalf("PRIORITY % x", v)
+	}
+}
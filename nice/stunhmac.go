@@ -1 +1,106 @@
 package nice
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+)
+
+/* The length of the HMAC-SHA1 of MESSAGE-INTEGRITY */
+const STUN_MESSAGE_INTEGRITY_LEN = 20
+
+/*
+ * The key of the long-term credentials (RFC 5389 section 15.4):
+ * MD5(username ":" realm ":" password).
+ */
+func stun_hash_creds(realm string, username string, password string) []byte {
+	sum := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return sum[:]
+}
+
+/*
+ * The HMAC-SHA1 with @key of the STUN message @buf, which ends right
+ * before its MESSAGE-INTEGRITY: the length in the header must already
+ * count the MESSAGE-INTEGRITY attribute. RFC 3489 hashes the message
+ * padded with zeroes to a multiple of 64 bytes, see @padding.
+ */
+func stun_sha1(buf []byte, key []byte, padding bool) []byte {
+	mac := hmac.New(sha1.New, key)
+	mac.Write(buf)
+	if padding {
+		/* as libnice, a whole block when already a multiple */
+		mac.Write(make([]byte, 64 - len(buf) % 64))
+	}
+	return mac.Sum(nil)
+}
+
+/*
+ * Appends the MESSAGE-INTEGRITY of @msg with @key: the HMAC of the message
+ * encoded so far, whose header length counts the new attribute but not
+ * the ones which may follow it (RFC 5389 section 15.4).
+ */
+func stun_message_append_integrity(msg *StunMessage, key []byte, padding bool) error {
+	ds := NewDataStream(make([]byte, 0))
+	if err := msg.Encode(ds); err != nil {
+		return err
+	}
+	buf := ds.Data()
+
+	integrity := &StunMessageIntegrityAttrValue{}
+	attr := StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_MESSAGE_INTEGRITY}, value: integrity}
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf) - STUN_MESSAGE_HEADER_LENGTH) + attr.size(!msg.no_aligned_attributes))
+	integrity.hmac = stun_sha1(buf, key, padding)
+	msg.AddAttr(attr)
+	return nil
+}
+
+/*
+ * Appends the FINGERPRINT of @msg, which must be its last attribute
+ * (RFC 5389 section 15.5).
+ */
+func stun_message_append_fingerprint(msg *StunMessage) error {
+	ds := NewDataStream(make([]byte, 0))
+	if err := msg.Encode(ds); err != nil {
+		return err
+	}
+	buf := ds.Data()
+
+	fingerprint := &StunFingerPrintAttrValue{}
+	attr := StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_FINGERPRINT}, value: fingerprint}
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf) - STUN_MESSAGE_HEADER_LENGTH) + attr.size(!msg.no_aligned_attributes))
+	fingerprint.crc = stun_fingerprint(buf)
+	msg.AddAttr(attr)
+	return nil
+}
+
+/*
+ * Checks the MESSAGE-INTEGRITY of the STUN message @buf with @key, see
+ * stun_sha1() for @padding. @buf must be the message as received: the
+ * attributes of the dialects without alignment are walked unpadded, as
+ * their sender hashed them, unless @aligned.
+ *
+ * Returns: %FALSE if @buf has no MESSAGE-INTEGRITY or a wrong one
+ */
+func stun_message_check_integrity(buf []byte, key []byte, padding bool, aligned bool) bool {
+	offset := STUN_MESSAGE_HEADER_LENGTH
+	for offset + 4 <= len(buf) {
+		t := StunAttributeType(binary.BigEndian.Uint16(buf[offset:offset + 2]))
+		l := int(binary.BigEndian.Uint16(buf[offset + 2:offset + 4]))
+		if t == STUN_ATTRIBUTE_MESSAGE_INTEGRITY {
+			if l != STUN_MESSAGE_INTEGRITY_LEN || offset + 4 + l > len(buf) {
+				return false
+			}
+			/* the length of the header as if MESSAGE-INTEGRITY ended it */
+			hashed := make([]byte, offset)
+			copy(hashed, buf[:offset])
+			binary.BigEndian.PutUint16(hashed[2:4], uint16(offset + 4 + l - STUN_MESSAGE_HEADER_LENGTH))
+			return hmac.Equal(stun_sha1(hashed, key, padding), buf[offset + 4:offset + 4 + l])
+		}
+		offset += 4 + l
+		if aligned {
+			offset += stun_attr_padding(l)
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package nice
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+/* Timeout of an ICE-TCP active connect, which runs before the first
+ * connectivity check can be sent on the pair */
+const NICE_TCP_ACTIVE_CONNECT_TIMEOUT = 5 * time.Second
+
+/*
+ * TcpActiveSocket is the socket of a local TCP active host candidate. It
+ * does not own a file descriptor: a new connection is created on demand by
+ * nice_tcp_active_socket_connect() when a connectivity check is sent on a
+ * pair, and that connection replaces the pair's socket.
+ */
+type TcpActiveSocket struct {
+	local_addr		NiceAddress
+	writable_cb		NiceSocketWritableCb
+}
+
+func NewTcpActiveSocket(addr NiceAddress) *TcpActiveSocket {
+	s := &TcpActiveSocket{}
+	s.local_addr = addr
+	s.local_addr.port = 0
+	return s
+}
+
+func nice_tcp_active_socket_new(addr NiceAddress) *TcpActiveSocket {
+	return NewTcpActiveSocket(addr)
+}
+
+/*
+ * Connects from the candidate's base address to @remote and returns the
+ * framed connection, of type NICE_SOCKET_TYPE_TCP_ACTIVE. Blocks until
+ * then, @ctx cancels it: see priv_conn_check_connect().
+ */
+func nice_tcp_active_socket_connect(ctx context.Context, sock *TcpActiveSocket, remote NiceAddress) (*TcpBsdSocket, error) {
+	dialer := net.Dialer{
+		LocalAddr: nice_address_to_tcp_addr(sock.local_addr),
+		Timeout:   NICE_TCP_ACTIVE_CONNECT_TIMEOUT,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", nice_address_to_string(remote))
+	if err != nil {
+		return nil, err
+	}
+	return nice_tcp_bsd_socket_new_from_conn(NICE_SOCKET_TYPE_TCP_ACTIVE, conn), nil
+}
+
+func (this *TcpActiveSocket) recv_messages(recv_msgs []*NiceInputMessage) error {
+	return errors.New("tcp active socket is not connected")
+}
+
+func (this *TcpActiveSocket) send_messages(to *NiceAddress, messages []*NiceOutputMessage) error {
+	return errors.New("tcp active socket is not connected")
+}
+
+func (this *TcpActiveSocket) send_messages_reliable(to *NiceAddress, messages []*NiceOutputMessage) error {
+	return this.send_messages(to, messages)
+}
+
+func (this *TcpActiveSocket) is_reliable() bool {
+	return true
+}
+
+func (this *TcpActiveSocket) can_send(addr *NiceAddress) bool {
+	return false
+}
+
+func (this *TcpActiveSocket) set_writable_callback(cb NiceSocketWritableCb) {
+	this.writable_cb = cb
+}
+
+func (this *TcpActiveSocket) is_based_on(ohter *NiceSocket) bool {
+	return ohter != nil && ohter.typ == NICE_SOCKET_TYPE_TCP_ACTIVE && nice_address_equal_no_port(ohter.addr, this.local_addr)
+}
+
+func (this *TcpActiveSocket) get_type() NiceSocketType {
+	return NICE_SOCKET_TYPE_TCP_ACTIVE
+}
+
+func (this *TcpActiveSocket) close() {
+
+}
@@ -0,0 +1,319 @@
+package nice
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+ * RFC 4571 framing: every packet carried over an ICE-TCP connection is
+ * prefixed with its length as a 16 bits unsigned integer in network
+ * byte order.
+ */
+const RFC4571_HEADER_LEN = 2
+const RFC4571_MAX_FRAME_SIZE = 0xffff
+
+/*
+ * Number of bytes a TcpBsdSocket queues while the peer does not read, past
+ * which the sends fail with NICE_AGENT_ERR_WOULD_BLOCK.
+ */
+const NICE_TCP_BSD_SEND_QUEUE_SIZE = 256 * 1024
+
+/*
+ * TcpBsdSocket is a connected TCP socket. The ICE-TCP types (both ends of
+ * a connection created by nice_tcp_active_socket_connect(), accepted by a
+ * TcpPassiveSocket or simultaneous-open) carry RFC 4571 framed packets.
+ * A NICE_SOCKET_TYPE_TCP_BSD socket, as used to reach a TCP relay, is a
+ * plain byte stream left to the wrapping socket to frame.
+ *
+ * The sends only queue the data, which a goroutine of the socket writes:
+ * they are called with the agent lock held, and must not block on a peer
+ * that stopped reading.
+ */
+type TcpBsdSocket struct {
+	typ 			NiceSocketType
+	local_addr		NiceAddress
+	remote_addr		NiceAddress
+	conn			net.Conn
+	reader			*bufio.Reader
+	writable_cb		NiceSocketWritableCb
+	idle_timeout	time.Duration	/* of the reads, none if 0 */
+
+	send_mutex		sync.Mutex		/* guards the fields below */
+	send_cond		*sync.Cond		/* signalled when there is data, or on close */
+	send_queue		[][]byte
+	send_queued		int				/* bytes in send_queue */
+	send_blocked	bool			/* a send failed with the queue full */
+	send_err		error			/* of the last write, the sends fail after it */
+	closed			bool
+}
+
+func NewTcpBsdSocket(typ NiceSocketType, conn net.Conn) *TcpBsdSocket {
+	s := &TcpBsdSocket{}
+	s.typ = typ
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+	s.local_addr = nice_address_from_net_addr(conn.LocalAddr())
+	s.remote_addr = nice_address_from_net_addr(conn.RemoteAddr())
+	s.send_cond = sync.NewCond(&s.send_mutex)
+	go s.write_loop()
+	return s
+}
+
+func nice_tcp_bsd_socket_new_from_conn(typ NiceSocketType, conn net.Conn) *TcpBsdSocket {
+	return NewTcpBsdSocket(typ, conn)
+}
+
+/*
+ * Connects a plain TCP socket from the address of 'local' to 'remote'.
+ * Blocks until then, 'ctx' cancels it.
+ */
+func nice_tcp_bsd_socket_connect(ctx context.Context, local NiceAddress, remote NiceAddress) (*TcpBsdSocket, error) {
+	local.port = 0
+	dialer := net.Dialer{
+		LocalAddr: nice_address_to_tcp_addr(local),
+		Timeout:   NICE_TCP_ACTIVE_CONNECT_TIMEOUT,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", nice_address_to_string(remote))
+	if err != nil {
+		return nil, err
+	}
+	return NewTcpBsdSocket(NICE_SOCKET_TYPE_TCP_BSD, conn), nil
+}
+
+func (this *TcpBsdSocket) is_framed() bool {
+	return this.typ != NICE_SOCKET_TYPE_TCP_BSD
+}
+
+/*
+ * Reads one RFC 4571 frame into each message, or whatever bytes are
+ * available for a plain stream. The call blocks until the first message
+ * is available, and returns io.EOF once the peer closed the connection,
+ * or a timeout once it stayed silent for 'idle_timeout'.
+ */
+func (this *TcpBsdSocket) recv_messages(recv_msgs []*NiceInputMessage) error {
+	if this.idle_timeout > 0 {
+		this.conn.SetReadDeadline(time.Now().Add(this.idle_timeout))
+	}
+	if !this.is_framed() {
+		return this.recv_messages_stream(recv_msgs)
+	}
+
+	for i := 0; i < len(recv_msgs); i++ {
+		msg := recv_msgs[i]
+		msg.length = 0
+		if i > 0 && this.reader.Buffered() < RFC4571_HEADER_LEN {
+			break
+		}
+
+		frame, err := nice_tcp_read_frame(this.reader)
+		if err != nil {
+			return err
+		}
+
+		n := 0
+		for j := 0; j < len(msg.buffers) && n < len(frame); j++ {
+			n += copy(msg.buffers[j], frame[n:])
+		}
+		msg.length = n
+		if msg.from != nil {
+			*msg.from = this.remote_addr
+		}
+	}
+	return nil
+}
+
+func (this *TcpBsdSocket) recv_messages_stream(recv_msgs []*NiceInputMessage) error {
+	for i := 0; i < len(recv_msgs); i++ {
+		msg := recv_msgs[i]
+		msg.length = 0
+		if len(msg.buffers) == 0 {
+			continue
+		}
+		if i > 0 && this.reader.Buffered() == 0 {
+			break
+		}
+
+		n, err := this.reader.Read(msg.buffers[0])
+		if err != nil {
+			return err
+		}
+		msg.length = n
+		if msg.from != nil {
+			*msg.from = this.remote_addr
+		}
+	}
+	return nil
+}
+
+/*
+ * Queues the messages, framed unless the socket is a plain stream. Fails
+ * with NICE_AGENT_ERR_WOULD_BLOCK, queueing none of them, once
+ * NICE_TCP_BSD_SEND_QUEUE_SIZE bytes wait for the peer: the writable
+ * callback is called once they are written.
+ */
+func (this *TcpBsdSocket) send_messages(to *NiceAddress, messages []*NiceOutputMessage) error {
+	if to != nil && (to.ip != this.remote_addr.ip || to.port != this.remote_addr.port) {
+		return errors.New("tcp socket is not connected to the destination")
+	}
+
+	data := make([][]byte, 0, len(messages))
+	size := 0
+	for i := 0; i < len(messages); i++ {
+		var buf []byte
+		if this.is_framed() {
+			var err error
+			if buf, err = nice_tcp_frame(messages[i].buffers); err != nil {
+				return err
+			}
+		} else {
+			for j := 0; j < len(messages[i].buffers); j++ {
+				buf = append(buf, messages[i].buffers[j]...)
+			}
+		}
+		data = append(data, buf)
+		size += len(buf)
+	}
+
+	this.send_mutex.Lock()
+	defer this.send_mutex.Unlock()
+	if this.closed {
+		return net.ErrClosed
+	}
+	if this.send_err != nil {
+		return this.send_err
+	}
+	if this.send_queued > 0 && this.send_queued + size > NICE_TCP_BSD_SEND_QUEUE_SIZE {
+		this.send_blocked = true
+		return NICE_AGENT_ERR_WOULD_BLOCK
+	}
+	this.send_queue = append(this.send_queue, data...)
+	this.send_queued += size
+	this.send_cond.Signal()
+	return nil
+}
+
+/* Writes the queued data, until the socket is closed or a write fails */
+func (this *TcpBsdSocket) write_loop() {
+	this.send_mutex.Lock()
+	defer this.send_mutex.Unlock()
+	for {
+		for len(this.send_queue) == 0 && !this.closed {
+			this.send_cond.Wait()
+		}
+		if this.closed {
+			return
+		}
+
+		buf := this.send_queue[0]
+		this.send_mutex.Unlock()
+		_, err := this.conn.Write(buf)
+		this.send_mutex.Lock()
+		if err != nil {
+			this.send_err = err
+			this.send_queue = nil
+			this.send_queued = 0
+			return
+		}
+		this.send_queue[0] = nil
+		this.send_queue = this.send_queue[1:]
+		this.send_queued -= len(buf)
+
+		if len(this.send_queue) == 0 && this.send_blocked && this.writable_cb != nil {
+			this.send_blocked = false
+			cb := this.writable_cb
+			this.send_mutex.Unlock()
+			var sock NiceSockInterface = this
+			cb(&sock, nil)
+			this.send_mutex.Lock()
+		}
+	}
+}
+
+func (this *TcpBsdSocket) send_messages_reliable(to *NiceAddress, messages []*NiceOutputMessage) error {
+	return this.send_messages(to, messages)
+}
+
+func (this *TcpBsdSocket) is_reliable() bool {
+	return true
+}
+
+func (this *TcpBsdSocket) can_send(addr *NiceAddress) bool {
+	this.send_mutex.Lock()
+	defer this.send_mutex.Unlock()
+	return !this.closed && this.send_err == nil
+}
+
+func (this *TcpBsdSocket) set_writable_callback(cb NiceSocketWritableCb) {
+	this.send_mutex.Lock()
+	defer this.send_mutex.Unlock()
+	this.writable_cb = cb
+}
+
+func (this *TcpBsdSocket) is_based_on(ohter *NiceSocket) bool {
+	return ohter != nil && ohter.typ == this.typ && nice_address_equal(ohter.addr, this.local_addr)
+}
+
+func (this *TcpBsdSocket) get_type() NiceSocketType {
+	return this.typ
+}
+
+func (this *TcpBsdSocket) close() {
+	this.send_mutex.Lock()
+	defer this.send_mutex.Unlock()
+	if this.closed {
+		return
+	}
+	this.closed = true
+	this.send_queue = nil
+	this.send_queued = 0
+	this.send_cond.Signal()
+	/* unblocks the write to a peer which stopped reading */
+	this.conn.Close()
+}
+
+func nice_tcp_read_frame(r *bufio.Reader) ([]byte, error) {
+	var hdr [RFC4571_HEADER_LEN]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func nice_tcp_write_frame(w io.Writer, buffers [][]byte) error {
+	frame, err := nice_tcp_frame(buffers)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+/* The RFC 4571 frame of the data of @buffers */
+func nice_tcp_frame(buffers [][]byte) ([]byte, error) {
+	var l int = 0
+	for i := 0; i < len(buffers); i++ {
+		l += len(buffers[i])
+	}
+	if l > RFC4571_MAX_FRAME_SIZE {
+		return nil, errors.New("message too large for RFC 4571 framing")
+	}
+
+	frame := make([]byte, RFC4571_HEADER_LEN, RFC4571_HEADER_LEN + l)
+	binary.BigEndian.PutUint16(frame, uint16(l))
+	for i := 0; i < len(buffers); i++ {
+		frame = append(frame, buffers[i]...)
+	}
+	return frame, nil
+}
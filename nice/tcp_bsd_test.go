@@ -0,0 +1,68 @@
+package nice
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+/*
+ * The sends to a peer which stopped reading never block: they fail with
+ * NICE_AGENT_ERR_WOULD_BLOCK once the queue is full, the writable callback
+ * tells when the peer drained it, and closing the socket unblocks its
+ * writer.
+ */
+func TestTcpBsdSocketSendQueue(t *testing.T) {
+	sock, srv := test_turn_tcp_conn(t)
+	writable := make(chan struct{}, 1)
+	sock.set_writable_callback(func(s *NiceSockInterface, user_data interface{}) {
+		select {
+		case writable <- struct{}{}:
+		default:
+		}
+	})
+
+	out := &NiceOutputMessage{buffers: [][]byte{make([]byte, 16 * 1024)}}
+	queued := 0
+	start := time.Now()
+	for {
+		err := sock.send_messages(nil, []*NiceOutputMessage{out})
+		if err == NICE_AGENT_ERR_WOULD_BLOCK {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		queued += len(out.buffers[0])
+		if time.Since(start) > 5 * time.Second {
+			t.Fatal("the queue never filled up")
+		}
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("sends blocked for %v", time.Since(start))
+	}
+
+	/* the peer reads everything, the socket is writable again */
+	go io.CopyN(io.Discard, srv, int64(queued))
+	select {
+	case <-writable:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not writable once drained")
+	}
+	if err := sock.send_messages(nil, []*NiceOutputMessage{out}); err != nil {
+		t.Fatal(err)
+	}
+
+	/* filled up again, until closed */
+	for sock.send_messages(nil, []*NiceOutputMessage{out}) == nil {
+	}
+	sock.close()
+	if sock.can_send(nil) {
+		t.Fatal("can send once closed")
+	}
+	if err := sock.send_messages(nil, []*NiceOutputMessage{out}); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("send once closed: %v", err)
+	}
+}
@@ -0,0 +1,300 @@
+package nice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/* Time an accepted connection has to send its first Binding request */
+const NICE_TCP_MUX_FIRST_FRAME_TIMEOUT = 10 * time.Second
+
+/*
+ * Time a connection handed to a stream may stay silent before it is
+ * closed: twice the keepalive period, so that the connections kept alive
+ * by their checks never reach it.
+ */
+const NICE_TCP_MUX_IDLE_TIMEOUT = 2 * NICE_AGENT_TIMER_TR_DEFAULT * time.Millisecond
+
+/* Number of identified connections waiting for their agent to accept them */
+const NICE_TCP_MUX_BACKLOG = 16
+
+/*
+ * NiceTcpMux shares one listening port between the ICE-TCP passive host
+ * candidates of many agents. The first RFC 4571 frame of every accepted
+ * connection must be a STUN Binding request; the local ufrag of its
+ * USERNAME tells which stream the connection is handed to, once its
+ * MESSAGE-INTEGRITY is checked against the password of the stream, and the
+ * last byte of its PRIORITY which component (ICE sect 4.1.2.1 ID-19).
+ * Connections which send anything else, an unknown ufrag, a wrong
+ * MESSAGE-INTEGRITY, or nothing before NICE_TCP_MUX_FIRST_FRAME_TIMEOUT
+ * are closed, and so are those handed over once silent for
+ * NICE_TCP_MUX_IDLE_TIMEOUT.
+ *
+ * As with the UDP mux, a ufrag belongs to the components of a single
+ * stream: the socket of another stream with the same ufrag is refused with
+ * ErrUfragInUse.
+ */
+type NiceTcpMux struct {
+	local_addr		NiceAddress
+	listener		*net.TCPListener
+	mutex			sync.Mutex
+	ufrags			map[string][]*TcpMuxSocket	/* the components of the stream of a ufrag */
+	closed			bool
+}
+
+/*
+ * TcpMuxSocket is the passive socket of one component of a stream on a
+ * NiceTcpMux. It
+ * behaves as a TcpPassiveSocket whose connections come from the mux
+ * rather than from a listener of its own.
+ */
+type TcpMuxSocket struct {
+	*TcpPassiveSocket
+	mux				*NiceTcpMux
+	ufrag			string
+	owner			interface{}		/* the stream, whose components share the ufrag */
+	component_id	uint
+	key				[]byte	/* the local password of the stream, nil if unchecked */
+	padding			bool	/* how @key signs, see stun_message_check_integrity() */
+	aligned			bool
+	incoming		chan *TcpBsdSocket
+	done			chan struct{}
+	close_once		sync.Once
+}
+
+func NewNiceTcpMux(addr NiceAddress) *NiceTcpMux {
+	listener, err := net.ListenTCP("tcp", nice_address_to_tcp_addr(addr))
+	if err != nil {
+		return nil
+	}
+
+	m := &NiceTcpMux{}
+	m.listener = listener
+	m.local_addr = nice_address_from_net_addr(listener.Addr())
+	m.ufrags = make(map[string][]*TcpMuxSocket)
+	go m.accept_loop()
+	return m
+}
+
+/**
+ * nice_tcp_mux_new:
+ * @addr: The local address and port to listen on
+ *
+ * Binds the shared ICE-TCP port. Set it on the agents with
+ * nice_agent_set_tcp_mux() before gathering.
+ *
+ * Returns: the mux, %NULL if the port could not be bound
+ */
+func nice_tcp_mux_new(addr NiceAddress) *NiceTcpMux {
+	return NewNiceTcpMux(addr)
+}
+
+/*
+ * Creates the passive socket of the component @component_id of the stream
+ * @owner, whose local ufrag is @ufrag, for the host address @addr. The
+ * first checks of its connections must be signed with @key, in the
+ * dialect of @stun_agent; a nil @key checks none (Google).
+ *
+ * Returns: the socket, ErrUfragInUse if another stream uses @ufrag on
+ * the mux, or an error if the mux is closed, bound to another address or
+ * already has a socket for the component
+ */
+func (this *NiceTcpMux) nice_tcp_mux_socket_new(addr NiceAddress, ufrag string, owner interface{}, component_id uint, key []byte, stun_agent *StunAgent) (*TcpMuxSocket, error) {
+	if !EqualFamily(addr, this.local_addr) {
+		return nil, ErrInvalidArgument
+	}
+	ip := net.ParseIP(this.local_addr.ip)
+	if ip != nil && !ip.IsUnspecified() && !ip.Equal(net.ParseIP(addr.ip)) {
+		return nil, ErrInvalidArgument
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return nil, net.ErrClosed
+	}
+	socks := this.ufrags[ufrag]
+	for i := 0; i < len(socks); i++ {
+		if socks[i].owner != owner {
+			return nil, ErrUfragInUse
+		}
+		if socks[i].component_id == component_id {
+			return nil, nice_mux_err_component_in_use
+		}
+	}
+
+	passive := &TcpPassiveSocket{}
+	passive.typ = NICE_SOCKET_TYPE_TCP_PASSIVE
+	passive.local_addr = addr
+	passive.local_addr.network = "tcp"
+	passive.local_addr.port = this.local_addr.port
+	passive.connections = make(map[string]*TcpBsdSocket)
+
+	s := &TcpMuxSocket{TcpPassiveSocket: passive}
+	s.mux = this
+	s.ufrag = ufrag
+	s.owner = owner
+	s.component_id = component_id
+	s.key = key
+	s.padding = stun_agent_no_cookie(stun_agent)
+	s.aligned = !stun_agent_no_aligned(stun_agent)
+	s.incoming = make(chan *TcpBsdSocket, NICE_TCP_MUX_BACKLOG)
+	s.done = make(chan struct{})
+	this.ufrags[ufrag] = append(socks, s)
+	return s, nil
+}
+
+func (this *NiceTcpMux) accept_loop() {
+	for {
+		conn, err := this.listener.AcceptTCP()
+		if err != nil {
+			this.mutex.Lock()
+			closed := this.closed
+			this.mutex.Unlock()
+			if closed {
+				return
+			}
+			continue
+		}
+		go this.identify(conn)
+	}
+}
+
+/*
+ * Reads the first frame of @conn and hands the connection to the socket of
+ * the ufrag it is addressed to, with the idle deadline of
+ * NICE_TCP_MUX_IDLE_TIMEOUT.
+ */
+func (this *NiceTcpMux) identify(conn *net.TCPConn) {
+	conn.SetReadDeadline(time.Now().Add(NICE_TCP_MUX_FIRST_FRAME_TIMEOUT))
+	reader := bufio.NewReader(conn)
+	frame, err := nice_tcp_read_frame(reader)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	sock := this.find_socket(frame)
+	if sock == nil || (sock.key != nil && !stun_message_check_integrity(frame, sock.key, sock.padding, sock.aligned)) {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(NICE_TCP_MUX_IDLE_TIMEOUT))
+
+	/* the Binding request is left in front of the stream, for the agent
+	 * to answer it */
+	var hdr [RFC4571_HEADER_LEN]byte
+	binary.BigEndian.PutUint16(hdr[:], uint16(len(frame)))
+	tcp := nice_tcp_bsd_socket_new_from_conn(NICE_SOCKET_TYPE_TCP_PASSIVE, conn)
+	tcp.idle_timeout = NICE_TCP_MUX_IDLE_TIMEOUT
+	tcp.reader = bufio.NewReader(io.MultiReader(bytes.NewReader(hdr[:]), bytes.NewReader(frame), reader))
+
+	select {
+	case sock.incoming <- tcp:
+	case <-sock.done:
+		tcp.close()
+	default:
+		tcp.close()
+	}
+}
+
+func (this *NiceTcpMux) find_socket(frame []byte) *TcpMuxSocket {
+	if !stun_message_is_stun(frame) {
+		return nil
+	}
+	if !stun_message_is_binding_request(frame) {
+		return nil
+	}
+
+	username := stun_message_find_attribute(frame, STUN_ATTRIBUTE_USERNAME)
+	if username == nil {
+		return nil
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	ufrag := nice_mux_local_ufrag(username, func(ufrag string) bool { return this.ufrags[ufrag] != nil })
+	socks := this.ufrags[ufrag]
+	if len(socks) == 0 {
+		return nil
+	}
+	if priority := stun_message_find_attribute(frame, STUN_ATTRIBUTE_PRIORITY); len(priority) == 4 {
+		component_id := 0x100 - uint(priority[3])
+		for i := 0; i < len(socks); i++ {
+			if socks[i].component_id == component_id {
+				return socks[i]
+			}
+		}
+	}
+	return socks[0]
+}
+
+func (this *NiceTcpMux) remove_socket(sock *TcpMuxSocket) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	socks := this.ufrags[sock.ufrag]
+	for i := 0; i < len(socks); i++ {
+		if socks[i] == sock {
+			socks = append(socks[:i], socks[i + 1:]...)
+			break
+		}
+	}
+	if len(socks) == 0 {
+		delete(this.ufrags, sock.ufrag)
+	} else {
+		this.ufrags[sock.ufrag] = socks
+	}
+}
+
+/*
+ * Closes the shared port and the sockets still open on it.
+ */
+func (this *NiceTcpMux) Close() {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return
+	}
+	this.closed = true
+	socks := make([]*TcpMuxSocket, 0, len(this.ufrags))
+	for _, s := range this.ufrags {
+		socks = append(socks, s...)
+	}
+	this.mutex.Unlock()
+
+	this.listener.Close()
+	for i := 0; i < len(socks); i++ {
+		socks[i].close()
+	}
+}
+
+/*
+ * Hands the connections identified by the mux to @cb until the socket is
+ * closed. Must be run in its own goroutine.
+ */
+func (this *TcpMuxSocket) accept_loop(cb NiceSocketAcceptCb) {
+	for {
+		select {
+		case sock := <-this.incoming:
+			this.add_connection(sock)
+			if cb != nil {
+				cb(this, sock)
+			}
+		case <-this.done:
+			return
+		}
+	}
+}
+
+func (this *TcpMuxSocket) close() {
+	this.close_once.Do(func() {
+		this.mux.remove_socket(this)
+		close(this.done)
+		this.TcpPassiveSocket.close()
+	})
+}
@@ -0,0 +1,192 @@
+package nice
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+/* A Binding request of @username, signed with @key unless nil */
+func test_tcp_mux_request(t *testing.T, username string, key []byte) []byte {
+	msg := NewStunMessage(STUN_REQUEST, STUN_BINDING)
+	msg.messageHeader.transactionId = test_stun_transaction_id()
+	msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_USERNAME}, value: &StunUsernameAttrValue{username: username}})
+	if key != nil {
+		if err := stun_message_append_integrity(msg, key, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return test_stun_encode(t, msg)
+}
+
+/*
+ * Only the connections whose first check is signed with the password of
+ * the stream are handed to it, with an idle deadline.
+ */
+func TestTcpMuxCheckIntegrity(t *testing.T) {
+	mux := nice_tcp_mux_new(NiceAddress{family: "ip4", network: "tcp", ip: "127.0.0.1"})
+	if mux == nil {
+		t.Fatal("no mux")
+	}
+	defer mux.Close()
+	stun_agent := StunAgent{}
+	stun_agent_init(&stun_agent, STUN_COMPATIBILITY_RFC5389, STUN_AGENT_USAGE_SHORT_TERM_CREDENTIALS)
+	sock, err := mux.nice_tcp_mux_socket_new(NiceAddress{family: "ip4", ip: "127.0.0.1"}, "ufrag", t, 1, []byte("password"), &stun_agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan *TcpBsdSocket, 4)
+	go sock.accept_loop(func(listener NiceSockInterface, conn *TcpBsdSocket) { got <- conn })
+
+	for _, key := range [][]byte{nil, []byte("wrong")} {
+		c, err := net.Dial("tcp", nice_address_to_string(mux.local_addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		nice_tcp_write_frame(c, [][]byte{test_tcp_mux_request(t, "ufrag:remote", key)})
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := c.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("connection of key %q not closed", key)
+		}
+	}
+
+	c, err := net.Dial("tcp", nice_address_to_string(mux.local_addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req := test_tcp_mux_request(t, "ufrag:remote", []byte("password"))
+	nice_tcp_write_frame(c, [][]byte{req})
+	select {
+	case conn := <-got:
+		if conn.idle_timeout != NICE_TCP_MUX_IDLE_TIMEOUT {
+			t.Fatalf("idle timeout %v", conn.idle_timeout)
+		}
+		buf := make([]byte, MAX_BUFFER_SIZE)
+		msg := &NiceInputMessage{buffers: [][]byte{buf}}
+		if err := conn.recv_messages([]*NiceInputMessage{msg}); err != nil || !bytes.Equal(buf[:msg.length], req) {
+			t.Fatalf("first check % x: %v", buf[:msg.length], err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("signed connection not handed over")
+	}
+	if len(got) != 0 {
+		t.Fatal("unsigned connection handed over")
+	}
+}
+
+/* A connection silent for its idle timeout fails its reads */
+func TestTcpBsdSocketIdleTimeout(t *testing.T) {
+	tcp, _ := test_turn_tcp_conn(t)
+	tcp.idle_timeout = 50 * time.Millisecond
+	buf := make([]byte, 16)
+	err := tcp.recv_messages([]*NiceInputMessage{{buffers: [][]byte{buf}}})
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("read of a silent connection: %v", err)
+	}
+}
+
+/* A mux on the loopback, closed at the end of the test */
+func test_tcp_mux(t *testing.T) *NiceTcpMux {
+	mux := nice_tcp_mux_new(NiceAddress{family: "ip4", network: "tcp", ip: "127.0.0.1"})
+	if mux == nil {
+		t.Fatal("no mux")
+	}
+	t.Cleanup(mux.Close)
+	return mux
+}
+
+/* A ufrag belongs to the components of a single stream */
+func TestTcpMuxUfragInUse(t *testing.T) {
+	mux := test_tcp_mux(t)
+	addr := NiceAddress{family: "ip4", ip: "127.0.0.1"}
+	stun_agent := StunAgent{}
+	if _, err := mux.nice_tcp_mux_socket_new(addr, "ufrag", "stream", 1, nil, &stun_agent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mux.nice_tcp_mux_socket_new(addr, "ufrag", "other", 1, nil, &stun_agent); err != ErrUfragInUse {
+		t.Fatalf("ufrag of another stream: %v", err)
+	}
+	if _, err := mux.nice_tcp_mux_socket_new(addr, "ufrag", "stream", 1, nil, &stun_agent); err == nil || err == ErrUfragInUse {
+		t.Fatalf("second socket of a component: %v", err)
+	}
+	if _, err := mux.nice_tcp_mux_socket_new(addr, "ufrag", "stream", 2, nil, &stun_agent); err != nil {
+		t.Fatalf("second component: %v", err)
+	}
+}
+
+/*
+ * The connections to the components of a stream, which share its ufrag,
+ * are handed over by the component in the PRIORITY of their first check.
+ */
+func TestTcpMuxRouteComponent(t *testing.T) {
+	mux := test_tcp_mux(t)
+	addr := NiceAddress{family: "ip4", ip: "127.0.0.1"}
+	stun_agent := StunAgent{}
+	got := make(chan uint, 2)
+	for component_id := uint(1); component_id <= 2; component_id++ {
+		sock, err := mux.nice_tcp_mux_socket_new(addr, "ufrag", "stream", component_id, nil, &stun_agent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go sock.accept_loop(func(listener NiceSockInterface, conn *TcpBsdSocket) {
+			got <- listener.(*TcpMuxSocket).component_id
+		})
+	}
+
+	for _, component_id := range []uint{2, 1} {
+		c, err := net.Dial("tcp", nice_address_to_string(mux.local_addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		msg := NewStunMessage(STUN_REQUEST, STUN_BINDING)
+		msg.messageHeader.transactionId = test_stun_transaction_id()
+		msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_USERNAME}, value: &StunUsernameAttrValue{username: "ufrag:remote"}})
+		msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_PRIORITY},
+			value: &StunPriorityAttrValue{priority: nice_candidate_ice_priority_full(90, 65535, component_id)}})
+		nice_tcp_write_frame(c, [][]byte{test_stun_encode(t, msg)})
+		select {
+		case id := <-got:
+			if id != component_id {
+				t.Fatalf("connection to component %d handed to %d", component_id, id)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("connection to component %d not handed over", component_id)
+		}
+	}
+}
+
+/* A ufrag set by the application and in use on the mux fails the gathering */
+func TestTcpMuxAgentUfragCollision(t *testing.T) {
+	mux := test_tcp_mux(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	var streams []*Stream
+	for i := 0; i < 2; i++ {
+		agent, err := NewAgent(WithLocalAddresses("127.0.0.1"), WithIceUdp(false), WithIceTcp(true), WithTcpMux(mux))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { agent.Close(context.Background()) })
+		s, err := agent.AddStream(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, s)
+	}
+
+	if err := streams[0].Gather(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ufrag, pwd, _ := streams[0].LocalCredentials()
+	if err := streams[1].SetLocalCredentials(ufrag, pwd); err != nil {
+		t.Fatal(err)
+	}
+	if err := streams[1].Gather(ctx); err != ErrUfragInUse {
+		t.Fatalf("gathering with the ufrag of another stream: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package nice
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+/*
+ * NiceSocketAcceptCb:
+ * @listener: the listening socket which accepted the connection
+ * @sock: the newly accepted, already framed, connection
+ *
+ * Called from the accept loop of a listening ICE-TCP socket for every new
+ * incoming connection.
+ */
+type NiceSocketAcceptCb func(listener NiceSockInterface, sock *TcpBsdSocket)
+
+/*
+ * TcpPassiveSocket is the socket of a local TCP passive host candidate. It
+ * only listens: every accepted connection becomes a separate TcpBsdSocket
+ * of type NICE_SOCKET_TYPE_TCP_PASSIVE which is handed to the accept
+ * callback. Sending through the listener looks up the accepted connection
+ * from the destination address, as the passive socket of libnice does.
+ */
+type TcpPassiveSocket struct {
+	typ 			NiceSocketType
+	local_addr		NiceAddress
+	listener		*net.TCPListener
+	mutex			sync.Mutex
+	connections		map[string]*TcpBsdSocket
+	writable_cb		NiceSocketWritableCb
+	closed			bool
+}
+
+func NewTcpPassiveSocket(addr NiceAddress) *TcpPassiveSocket {
+	listener, err := net.ListenTCP("tcp", nice_address_to_tcp_addr(addr))
+	if err != nil {
+		return nil
+	}
+	return new_tcp_passive_socket(NICE_SOCKET_TYPE_TCP_PASSIVE, listener)
+}
+
+func new_tcp_passive_socket(typ NiceSocketType, listener *net.TCPListener) *TcpPassiveSocket {
+	s := &TcpPassiveSocket{}
+	s.typ = typ
+	s.listener = listener
+	s.local_addr = nice_address_from_net_addr(listener.Addr())
+	s.connections = make(map[string]*TcpBsdSocket)
+	return s
+}
+
+func nice_tcp_passive_socket_new(addr NiceAddress) *TcpPassiveSocket {
+	return NewTcpPassiveSocket(addr)
+}
+
+/*
+ * Accepts incoming connections until the listener is closed. Must be run
+ * in its own goroutine.
+ */
+func (this *TcpPassiveSocket) accept_loop(cb NiceSocketAcceptCb) {
+	for {
+		conn, err := this.listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+
+		sock := nice_tcp_bsd_socket_new_from_conn(this.typ, conn)
+		this.add_connection(sock)
+		if cb != nil {
+			cb(this, sock)
+		}
+	}
+}
+
+func (this *TcpPassiveSocket) add_connection(sock *TcpBsdSocket) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		sock.close()
+		return
+	}
+	this.connections[nice_address_to_string(sock.remote_addr)] = sock
+}
+
+func (this *TcpPassiveSocket) remove_connection(sock *TcpBsdSocket) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	key := nice_address_to_string(sock.remote_addr)
+	if this.connections[key] == sock {
+		delete(this.connections, key)
+	}
+}
+
+func (this *TcpPassiveSocket) find_connection(to *NiceAddress) *TcpBsdSocket {
+	if to == nil {
+		return nil
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.connections[nice_address_to_string(*to)]
+}
+
+func (this *TcpPassiveSocket) recv_messages(recv_msgs []*NiceInputMessage) error {
+	return errors.New("tcp passive socket does not receive, its accepted connections do")
+}
+
+func (this *TcpPassiveSocket) send_messages(to *NiceAddress, messages []*NiceOutputMessage) error {
+	sock := this.find_connection(to)
+	if sock == nil {
+		return errors.New("no accepted tcp connection for the destination")
+	}
+	return sock.send_messages(to, messages)
+}
+
+func (this *TcpPassiveSocket) send_messages_reliable(to *NiceAddress, messages []*NiceOutputMessage) error {
+	return this.send_messages(to, messages)
+}
+
+func (this *TcpPassiveSocket) is_reliable() bool {
+	return true
+}
+
+func (this *TcpPassiveSocket) can_send(addr *NiceAddress) bool {
+	return this.find_connection(addr) != nil
+}
+
+func (this *TcpPassiveSocket) set_writable_callback(cb NiceSocketWritableCb) {
+	this.writable_cb = cb
+}
+
+func (this *TcpPassiveSocket) is_based_on(ohter *NiceSocket) bool {
+	return ohter != nil && ohter.typ == this.typ && nice_address_equal(ohter.addr, this.local_addr)
+}
+
+func (this *TcpPassiveSocket) get_type() NiceSocketType {
+	return this.typ
+}
+
+func (this *TcpPassiveSocket) close() {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return
+	}
+	this.closed = true
+	connections := this.connections
+	this.connections = make(map[string]*TcpBsdSocket)
+	this.mutex.Unlock()
+
+	if this.listener != nil {
+		this.listener.Close()
+	}
+	for _, sock := range connections {
+		sock.close()
+	}
+}
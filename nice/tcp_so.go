@@ -0,0 +1,54 @@
+package nice
+
+import (
+	"context"
+	"net"
+)
+
+/*
+ * TcpSoSocket is the socket of a local TCP simultaneous-open host
+ * candidate (RFC 6544 section 4.1). It listens on the candidate port like
+ * a passive socket, and connects from that very same port when a check is
+ * sent, so the two SYNs of the peers can cross. Both the accepted and the
+ * connected sockets are of type NICE_SOCKET_TYPE_TCP_SO.
+ */
+type TcpSoSocket struct {
+	*TcpPassiveSocket
+}
+
+func NewTcpSoSocket(addr NiceAddress) *TcpSoSocket {
+	lc := net.ListenConfig{Control: nice_tcp_so_reuse_control}
+	l, err := lc.Listen(context.Background(), "tcp", nice_address_to_string(addr))
+	if err != nil {
+		return nil
+	}
+	return &TcpSoSocket{new_tcp_passive_socket(NICE_SOCKET_TYPE_TCP_SO, l.(*net.TCPListener))}
+}
+
+func nice_tcp_so_socket_new(addr NiceAddress) *TcpSoSocket {
+	return NewTcpSoSocket(addr)
+}
+
+/*
+ * Connects to @remote from the listening port. If the peer already
+ * connected to us, the accepted connection is reused instead. Blocks until
+ * then, @ctx cancels it.
+ */
+func nice_tcp_so_socket_connect(ctx context.Context, sock *TcpSoSocket, remote NiceAddress) (*TcpBsdSocket, error) {
+	if c := sock.find_connection(&remote); c != nil {
+		return c, nil
+	}
+
+	dialer := net.Dialer{
+		LocalAddr: nice_address_to_tcp_addr(sock.local_addr),
+		Timeout:   NICE_TCP_ACTIVE_CONNECT_TIMEOUT,
+		Control:   nice_tcp_so_reuse_control,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", nice_address_to_string(remote))
+	if err != nil {
+		return nil, err
+	}
+	c := nice_tcp_bsd_socket_new_from_conn(NICE_SOCKET_TYPE_TCP_SO, conn)
+	sock.add_connection(c)
+	return c, nil
+}
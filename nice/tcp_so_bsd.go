@@ -0,0 +1,7 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package nice
+
+import "syscall"
+
+const nice_so_reuseport = syscall.SO_REUSEPORT
@@ -0,0 +1,4 @@
+package nice
+
+/* not exported by the syscall package on every linux architecture */
+const nice_so_reuseport = 0xf
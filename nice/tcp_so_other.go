@@ -0,0 +1,11 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package nice
+
+import "syscall"
+
+/* Port sharing is not available, simultaneous-open then only works when
+ * the peer connects to our listening port. */
+func nice_tcp_so_reuse_control(network string, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,21 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package nice
+
+import "syscall"
+
+/* Lets the simultaneous-open listener and the outgoing connections share
+ * the candidate port. */
+func nice_tcp_so_reuse_control(network string, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		if serr == nil {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, nice_so_reuseport, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
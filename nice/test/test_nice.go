@@ -1,30 +1,124 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"go-licode/nice"
+	"os"
 	"time"
 )
+
+/*
+ * Connects two agents of the same process over the loopback interface,
+ * exchanging the credentials and candidates as a signalling channel would,
+ * and sends a message from one to the other.
+ */
 func main() {
-	agent := nice.NewNiceAgent()
-	_ = agent
-	stream_id := agent.Nice_agent_add_stream(1)
-	agent.Nice_agent_gather_candidates(stream_id)
-
-	//listener1, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9981})
-	//if err != nil {
-	//	fmt.Println(err)
-	//	return
-	//}
-	//
-	//listener2, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9981})
-	//if err != nil {
-	//	fmt.Println(err)
-	//	return
-	//}
-	//_ = listener1
-	//_ = listener2
-
-	for {
-		time.Sleep(1)
+	if err := run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	left, err := nice.NewAgent(nice.WithControlling(true), nice.WithLocalAddresses("127.0.0.1"))
+	if err != nil {
+		return err
+	}
+	defer close_agent("left", left)
+	right, err := nice.NewAgent(nice.WithControlling(false), nice.WithLocalAddresses("127.0.0.1"))
+	if err != nil {
+		return err
+	}
+	defer close_agent("right", right)
+
+	lstream, err := left.AddStream(1)
+	if err != nil {
+		return err
+	}
+	rstream, err := right.AddStream(1)
+	if err != nil {
+		return err
+	}
+
+	if err := lstream.Gather(ctx); err != nil {
+		return fmt.Errorf("left gathering: %w", err)
+	}
+	if err := rstream.Gather(ctx); err != nil {
+		return fmt.Errorf("right gathering: %w", err)
+	}
+
+	if err := exchange(lstream, rstream); err != nil {
+		return err
+	}
+	if err := exchange(rstream, lstream); err != nil {
+		return err
+	}
+
+	received := make(chan error, 1)
+	go func() {
+		conn, err := rstream.Component(1).Connect(ctx)
+		if err != nil {
+			received <- fmt.Errorf("right connect: %w", err)
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1500)
+		n, err := conn.Read(buf)
+		if err != nil {
+			received <- fmt.Errorf("right read: %w", err)
+			return
+		}
+		fmt.Println("right received:", string(buf[:n]))
+		if string(buf[:n]) != "hello" {
+			received <- errors.New("right received the wrong message")
+			return
+		}
+		received <- nil
+	}()
+
+	conn, err := lstream.Component(1).Connect(ctx)
+	if err != nil {
+		return fmt.Errorf("left connect: %w", err)
+	}
+	fmt.Println("connected", conn.LocalAddr(), "->", conn.RemoteAddr())
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		return fmt.Errorf("left write: %w", err)
+	}
+	return <-received
+}
+
+/* Closes @agent, releasing its sockets, within a second */
+func close_agent(name string, agent *nice.Agent) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := agent.Close(ctx); err != nil {
+		fmt.Println(name, "close:", err)
+	}
+}
+
+/* Gives the credentials and candidates of @from to @to */
+func exchange(from *nice.Stream, to *nice.Stream) error {
+	ufrag, pwd, err := from.LocalCredentials()
+	if err != nil {
+		return err
+	}
+	if err := to.SetRemoteCredentials(ufrag, pwd); err != nil {
+		return err
+	}
+
+	candidates, err := from.Component(1).LocalCandidates()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(candidates); i++ {
+		fmt.Println("candidate", candidates[i].Address, candidates[i].Port,
+			nice.Nice_candidate_transport_to_string(candidates[i].Transport))
 	}
+	_, err = to.Component(1).AddRemoteCandidates(candidates...)
+	return err
 }
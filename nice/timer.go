@@ -2,14 +2,154 @@ package nice
 
 import "time"
 
+/**
+ * STUN_TIMER_DEFAULT_TIMEOUT:
+ *
+ * The default intial timeout to use for the timer
+ * RFC recommendds 500, but it's ridiculous, 50ms is known to work in most
+ * cases as it is also what is used by SIP style VoIP when sending A-Law and
+ * mu-Law audio, so 200ms should be hard to beat
+ */
+const STUN_TIMER_DEFAULT_TIMEOUT = 200
+
+/**
+ * STUN_TIMER_DEFAULT_MAX_RETRANSMISSIONS:
+ *
+ * The default maximum retransmissions allowed before a timer decides to timeout
+ */
+const STUN_TIMER_DEFAULT_MAX_RETRANSMISSIONS = 7
+
+/**
+ * STUN_TIMER_DEFAULT_RELIABLE_TIMEOUT:
+ *
+ * The default intial timeout to use for a reliable timer
+ */
+const STUN_TIMER_DEFAULT_RELIABLE_TIMEOUT = 7900
+
+/**
+ * StunUsageTimerReturn:
+ * @STUN_USAGE_TIMER_RETURN_SUCCESS: The timer was refreshed successfully
+ * and there is nothing to be done
+ * @STUN_USAGE_TIMER_RETURN_RETRANSMIT: The timer expired and the message
+ * should be retransmitted now.
+ * @STUN_USAGE_TIMER_RETURN_TIMEOUT: The timer expired as well as all the
+ * retransmissions, the transaction timed out
+ *
+ * Return value of stun_usage_timer_refresh() which provides you with status
+ * information on the timer.
+ */
+type StunUsageTimerReturn int
+const (
+	STUN_USAGE_TIMER_RETURN_SUCCESS StunUsageTimerReturn = iota
+	STUN_USAGE_TIMER_RETURN_RETRANSMIT
+	STUN_USAGE_TIMER_RETURN_TIMEOUT
+)
+
 /**
  * StunTimer:
  *
  * An opaque structure representing a STUN transaction retransmission timer
 */
 type StunTimer struct {
+	clock 				Clock
 	deadline 			time.Time
 	delay 				uint32
 	retransmissions 	uint32
 	max_retransmissions uint32
 }
+
+/**
+ * stun_timer_start:
+ * @timer: The #StunTimer to start
+ * @clock: The #Clock the deadlines follow, NiceSystemClock if nil
+ * @initial_timeout: The initial timeout to use before the first retransmission
+ * @max_retransmissions: The maximum number of transmissions before the
+ * #StunTimer times out
+ *
+ * Starts a STUN transaction retransmission timer.
+ * This should be called as soon as you send the message for the first time on
+ * a UDP socket.
+ * The timeout before the next retransmission is set to @initial_timeout, then
+ * each time a packet is retransmited, that timeout will be doubled, until the
+ * @max_retransmissions retransmissions limit is reached.
+ */
+func stun_timer_start(timer *StunTimer, clock Clock, initial_timeout uint, max_retransmissions uint) {
+	if clock == nil {
+		clock = NiceSystemClock
+	}
+	timer.clock = clock
+	timer.retransmissions = 0
+	timer.delay = uint32(initial_timeout)
+	timer.max_retransmissions = uint32(max_retransmissions)
+	timer.deadline = timer.clock.Now().Add(time.Duration(timer.delay) * time.Millisecond)
+}
+
+/**
+ * stun_timer_start_reliable:
+ * @timer: The #StunTimer to start
+ * @clock: The #Clock the deadline follows, NiceSystemClock if nil
+ * @initial_timeout: The initial timeout to use before the first retransmission
+ *
+ * Starts a STUN transaction retransmission timer for a reliable transport.
+ * This should be called as soon as you send the message for the first time on
+ * a TCP socket
+ */
+func stun_timer_start_reliable(timer *StunTimer, clock Clock, initial_timeout uint) {
+	stun_timer_start(timer, clock, initial_timeout, 0)
+}
+
+/**
+ * stun_timer_transaction_timeout:
+ * @initial_timeout: The initial timeout of the timer, in milliseconds
+ * @max_retransmissions: The maximum number of retransmissions
+ *
+ * Returns: how long a transaction started by stun_timer_start() with these
+ * settings runs before it times out
+ */
+func stun_timer_transaction_timeout(initial_timeout uint, max_retransmissions uint) time.Duration {
+	total := time.Duration(0)
+	delay := time.Duration(initial_timeout) * time.Millisecond
+	for i := uint(0); i <= max_retransmissions; i++ {
+		total += delay
+		delay *= 2
+	}
+	return total
+}
+
+/**
+ * stun_timer_remainder:
+ * @timer: The #StunTimer to query
+ *
+ * Query the timer on the time left before the next refresh should be done
+ *
+ * Returns: The time remaining for the timer to expire in milliseconds
+ */
+func stun_timer_remainder(timer *StunTimer) uint {
+	d := timer.deadline.Sub(timer.clock.Now())
+	if d <= 0 {
+		return 0
+	}
+	return uint(d / time.Millisecond)
+}
+
+/**
+ * stun_timer_refresh:
+ * @timer: The #StunTimer to refresh
+ *
+ * Updates a STUN transaction retransmission timer.
+ *
+ * Returns: A #StunUsageTimerReturn telling you what to do next
+ */
+func stun_timer_refresh(timer *StunTimer) StunUsageTimerReturn {
+	if timer.clock.Now().Before(timer.deadline) {
+		return STUN_USAGE_TIMER_RETURN_SUCCESS
+	}
+	if timer.retransmissions >= timer.max_retransmissions {
+		return STUN_USAGE_TIMER_RETURN_TIMEOUT
+	}
+
+	timer.delay *= 2
+	timer.retransmissions++
+	timer.deadline = timer.clock.Now().Add(time.Duration(timer.delay) * time.Millisecond)
+	return STUN_USAGE_TIMER_RETURN_RETRANSMIT
+}
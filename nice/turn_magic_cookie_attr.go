@@ -0,0 +1,31 @@
+package nice
+
+import "encoding/binary"
+
+/*
+ * The MAGIC-COOKIE of the early TURN drafts (midcom-TURN 08), which the
+ * Google relays still want in their requests.
+ */
+const STUN_TURN_MAGIC_COOKIE = 0x72c64bc6
+
+type StunTurnMagicCookieAttrValue struct {
+	cookie			uint32
+}
+
+func (this StunTurnMagicCookieAttrValue) Encode(stream *DataStream) error {
+	stream.WriteUInt32(this.cookie, binary.BigEndian)
+	return nil
+}
+
+func (this *StunTurnMagicCookieAttrValue) Decode(stream *DataStream) error {
+	v, err := stream.ReadInt32(binary.BigEndian)
+	if err != nil {
+		return err
+	}
+	this.cookie = uint32(v)
+	return nil
+}
+
+func (this StunTurnMagicCookieAttrValue) GetSize() uint16 {
+	return 4
+}
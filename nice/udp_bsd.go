@@ -1,8 +1,9 @@
 package nice
 
 import (
+	"errors"
 	"net"
-	"fmt"
+	"time"
 )
 
 type UdpBsdSocket struct {
@@ -14,12 +15,12 @@ func NewUdpBsdSocket(addr NiceAddress) *UdpBsdSocket {
 	s := &UdpBsdSocket{}
 	s.local_addr = addr
 	var err error
-	fmt.Println("port=", addr.port)
 	s.conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(addr.ip), Port: addr.port})
 	if err != nil {
 		//fmt.Println("NewUdpBsdSocket port=", addr.port, " error")
 		return nil
 	}
+	s.local_addr.port = s.conn.LocalAddr().(*net.UDPAddr).Port
 	return s
 }
 
@@ -27,11 +28,58 @@ func nice_udp_bsd_socket_new(addr NiceAddress) *UdpBsdSocket {
 	return NewUdpBsdSocket(addr)
 }
 
+/*
+ * Reads one datagram into each message, blocking until the first one is
+ * available.
+ */
 func (this *UdpBsdSocket) recv_messages(recv_msgs []*NiceInputMessage) error {
+	for i := 0; i < len(recv_msgs); i++ {
+		msg := recv_msgs[i]
+		msg.length = 0
+		if len(msg.buffers) == 0 {
+			continue
+		}
+		if i > 0 {
+			/* only the first message may block */
+			this.conn.SetReadDeadline(time.Now())
+		}
+		n, from, err := this.conn.ReadFromUDP(msg.buffers[0])
+		if i > 0 {
+			this.conn.SetReadDeadline(time.Time{})
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+		msg.length = n
+		if msg.from != nil {
+			*msg.from = nice_address_from_net_addr(from)
+		}
+	}
 	return nil
 }
 
 func (this *UdpBsdSocket) send_messages(to *NiceAddress, messages []*NiceOutputMessage) error {
+	if to == nil {
+		return errors.New("udp socket needs a destination")
+	}
+
+	addr := nice_address_to_udp_addr(*to)
+	for i := 0; i < len(messages); i++ {
+		var buf []byte
+		if len(messages[i].buffers) == 1 {
+			buf = messages[i].buffers[0]
+		} else {
+			for j := 0; j < len(messages[i].buffers); j++ {
+				buf = append(buf, messages[i].buffers[j]...)
+			}
+		}
+		if _, err := this.conn.WriteToUDP(buf, addr); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -55,6 +103,10 @@ func (this *UdpBsdSocket) is_based_on(ohter *NiceSocket) bool {
 	return true
 }
 
-func (this *UdpBsdSocket) close() {
+func (this *UdpBsdSocket) get_type() NiceSocketType {
+	return NICE_SOCKET_TYPE_UDP_BSD
+}
 
+func (this *UdpBsdSocket) close() {
+	this.conn.Close()
 }
\ No newline at end of file
@@ -0,0 +1,444 @@
+package nice
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+/* Number of datagrams queued on a muxed socket before new ones are dropped */
+const NICE_UDP_MUX_QUEUE_LEN = 256
+
+/* A component of the stream already has its socket on the mux */
+var nice_mux_err_component_in_use = errors.New("nice: component already on the mux")
+
+/*
+ * NiceUdpMux shares one UDP port between the UDP host candidates of many
+ * agents. Incoming datagrams are demultiplexed to the socket of a stream:
+ *  - a STUN request by the local ufrag in its USERNAME attribute, then
+ *    by its component: the one the remote address is bound to, or the
+ *    one whose id is in the last byte of its PRIORITY (ICE sect 4.1.2.1
+ *    ID-19). Once the agent checked its MESSAGE-INTEGRITY, the remote
+ *    address it came from is bound to the socket (see
+ *    nice_udp_mux_socket_bind()),
+ *  - a STUN response by the transaction id of the request it answers,
+ *    for as long as the transaction may run,
+ *  - anything else by the remote address learned from the requests.
+ * A datagram which matches nothing is dropped. The RFC 3489 messages,
+ * without magic cookie, are routed the same.
+ *
+ * A ufrag belongs to the components of a single stream: the socket of
+ * another stream with the same ufrag is refused with ErrUfragInUse.
+ */
+type NiceUdpMux struct {
+	local_addr		NiceAddress
+	conn			*net.UDPConn
+	mutex			sync.Mutex
+	ufrags			map[string][]*UdpMuxSocket	/* the components of the stream of a ufrag */
+	addresses		map[string]*UdpMuxSocket
+	transactions	map[string]udp_mux_transaction
+	closed			bool
+}
+
+/* A STUN request sent by @sock, answered until @deadline */
+type udp_mux_transaction struct {
+	sock			*UdpMuxSocket
+	deadline		time.Time
+}
+
+type udp_mux_packet struct {
+	buf				[]byte
+	from			NiceAddress
+}
+
+/*
+ * UdpMuxSocket is the virtual socket of one component of a stream on a
+ * NiceUdpMux.
+ */
+type UdpMuxSocket struct {
+	mux				*NiceUdpMux
+	ufrag			string
+	owner			interface{}		/* the stream, whose components share the ufrag */
+	component_id	uint
+	local_addr		NiceAddress
+	clock			Clock
+	transaction_timeout	time.Duration	/* of the STUN requests sent */
+	queue			chan udp_mux_packet
+	done			chan struct{}
+	close_once		sync.Once
+}
+
+func NewNiceUdpMux(addr NiceAddress) *NiceUdpMux {
+	conn, err := net.ListenUDP("udp", nice_address_to_udp_addr(addr))
+	if err != nil {
+		return nil
+	}
+
+	m := &NiceUdpMux{}
+	m.conn = conn
+	m.local_addr = nice_address_from_net_addr(conn.LocalAddr())
+	m.ufrags = make(map[string][]*UdpMuxSocket)
+	m.addresses = make(map[string]*UdpMuxSocket)
+	m.transactions = make(map[string]udp_mux_transaction)
+	go m.recv_loop()
+	return m
+}
+
+/**
+ * nice_udp_mux_new:
+ * @addr: The local address and port to listen on
+ *
+ * Binds the shared UDP port. Set it on the agents with
+ * nice_agent_set_udp_mux() before gathering.
+ *
+ * Returns: the mux, %NULL if the port could not be bound
+ */
+func nice_udp_mux_new(addr NiceAddress) *NiceUdpMux {
+	return NewNiceUdpMux(addr)
+}
+
+/*
+ * Creates the socket of the component @component_id of the stream @owner,
+ * whose local ufrag is @ufrag, for the host address @addr. The responses
+ * to its STUN requests are routed to it for @transaction_timeout on
+ * @clock.
+ *
+ * Returns: the socket, ErrUfragInUse if another stream uses @ufrag on
+ * the mux, or an error if the mux is closed, bound to another address or
+ * already has a socket for the component
+ */
+func (this *NiceUdpMux) nice_udp_mux_socket_new(addr NiceAddress, ufrag string, owner interface{}, component_id uint, clock Clock, transaction_timeout time.Duration) (*UdpMuxSocket, error) {
+	if !EqualFamily(addr, this.local_addr) {
+		return nil, ErrInvalidArgument
+	}
+	ip := net.ParseIP(this.local_addr.ip)
+	if ip != nil && !ip.IsUnspecified() && !ip.Equal(net.ParseIP(addr.ip)) {
+		return nil, ErrInvalidArgument
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return nil, net.ErrClosed
+	}
+	socks := this.ufrags[ufrag]
+	for i := 0; i < len(socks); i++ {
+		if socks[i].owner != owner {
+			return nil, ErrUfragInUse
+		}
+		if socks[i].component_id == component_id {
+			return nil, nice_mux_err_component_in_use
+		}
+	}
+
+	s := &UdpMuxSocket{}
+	s.mux = this
+	s.ufrag = ufrag
+	s.owner = owner
+	s.component_id = component_id
+	s.local_addr = addr
+	s.local_addr.port = this.local_addr.port
+	s.clock = clock
+	if s.clock == nil {
+		s.clock = NiceSystemClock
+	}
+	s.transaction_timeout = transaction_timeout
+	s.queue = make(chan udp_mux_packet, NICE_UDP_MUX_QUEUE_LEN)
+	s.done = make(chan struct{})
+	this.ufrags[ufrag] = append(socks, s)
+	return s, nil
+}
+
+func (this *NiceUdpMux) recv_loop() {
+	buf := make([]byte, MAX_BUFFER_SIZE)
+	for {
+		n, from, err := this.conn.ReadFromUDP(buf)
+		if err != nil {
+			this.mutex.Lock()
+			closed := this.closed
+			this.mutex.Unlock()
+			if closed {
+				return
+			}
+			continue
+		}
+
+		packet := udp_mux_packet{buf: append([]byte{}, buf[:n]...), from: nice_address_from_net_addr(from)}
+		sock := this.find_socket(packet.buf, packet.from)
+		if sock == nil {
+			continue
+		}
+		select {
+		case sock.queue <- packet:
+		default:
+			/* the reader is late, drop as the network would */
+		}
+	}
+}
+
+func (this *NiceUdpMux) find_socket(buf []byte, from NiceAddress) *UdpMuxSocket {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	key := nice_address_to_string(from)
+	if !udp_mux_is_stun(buf) {
+		return this.addresses[key]
+	}
+
+	class := udp_mux_stun_class(buf)
+	if class == STUN_RESPONSE || class == STUN_ERROR {
+		tid := string(buf[4:STUN_MESSAGE_HEADER_LENGTH])
+		if t, ok := this.transactions[tid]; ok {
+			delete(this.transactions, tid)
+			if t.sock.clock.Now().Before(t.deadline) {
+				return t.sock
+			}
+		}
+		return this.addresses[key]
+	}
+
+	username := stun_message_find_attribute(buf, STUN_ATTRIBUTE_USERNAME)
+	if username == nil {
+		return this.addresses[key]
+	}
+	ufrag := nice_mux_local_ufrag(username, func(ufrag string) bool { return this.ufrags[ufrag] != nil })
+	socks := this.ufrags[ufrag]
+	if len(socks) <= 1 {
+		if len(socks) == 0 {
+			return nil
+		}
+		return socks[0]
+	}
+
+	/* the components of the stream share the ufrag */
+	if s := this.addresses[key]; s != nil && s.ufrag == ufrag {
+		return s
+	}
+	if priority := stun_message_find_attribute(buf, STUN_ATTRIBUTE_PRIORITY); len(priority) == 4 {
+		component_id := 0x100 - uint(priority[3])
+		for i := 0; i < len(socks); i++ {
+			if socks[i].component_id == component_id {
+				return socks[i]
+			}
+		}
+	}
+	return socks[0]
+}
+
+/*
+ * The local ufrag in the USERNAME @username of a request, one @known
+ * accepts: before a ':' (the decoded usernames of MSN may hold some too),
+ * or the first half of the two usernames of the same length of the Google
+ * dialect, which have no separator.
+ */
+func nice_mux_local_ufrag(username []byte, known func(ufrag string) bool) string {
+	for i := 0; i < len(username); i++ {
+		if username[i] == ':' && known(string(username[:i])) {
+			return string(username[:i])
+		}
+	}
+	return string(username[:len(username) / 2])
+}
+
+/* Whether @buf is a STUN message, with the magic cookie or of RFC 3489 */
+func udp_mux_is_stun(buf []byte) bool {
+	return stun_message_is_stun(buf) || stun_message_is_stun_rfc3489(buf)
+}
+
+/* Whether @sock is still on its mux. Must be called with the mux lock held */
+func (this *NiceUdpMux) has_socket(sock *UdpMuxSocket) bool {
+	socks := this.ufrags[sock.ufrag]
+	for i := 0; i < len(socks); i++ {
+		if socks[i] == sock {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * nice_udp_mux_socket_bind:
+ * @sock: The socket a STUN request was routed to
+ * @from: The address the request came from
+ *
+ * Routes what comes from @from to @sock, once the agent of @sock checked the
+ * MESSAGE-INTEGRITY of the request: the ufrag alone, which travels in
+ * clear, would let anyone divert the packets of a peer.
+ */
+func nice_udp_mux_socket_bind(sock *UdpMuxSocket, from NiceAddress) {
+	mux := sock.mux
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	if mux.has_socket(sock) {
+		mux.addresses[nice_address_to_string(from)] = sock
+	}
+}
+
+/*
+ * Remembers the STUN requests sent by @sock so their responses, which have
+ * no USERNAME, get back to it until the transaction times out. The
+ * retransmissions keep the deadline of the first request.
+ */
+func (this *NiceUdpMux) track_request(sock *UdpMuxSocket, buf []byte) {
+	if !udp_mux_is_stun(buf) || udp_mux_stun_class(buf) != STUN_REQUEST {
+		return
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if !this.has_socket(sock) {
+		return
+	}
+	now := sock.clock.Now()
+	for k, t := range this.transactions {
+		if !now.Before(t.deadline) {
+			delete(this.transactions, k)
+		}
+	}
+	tid := string(buf[4:STUN_MESSAGE_HEADER_LENGTH])
+	if _, ok := this.transactions[tid]; !ok {
+		this.transactions[tid] = udp_mux_transaction{sock: sock, deadline: now.Add(sock.transaction_timeout)}
+	}
+}
+
+func (this *NiceUdpMux) remove_socket(sock *UdpMuxSocket) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	socks := this.ufrags[sock.ufrag]
+	for i := 0; i < len(socks); i++ {
+		if socks[i] == sock {
+			socks = append(socks[:i], socks[i + 1:]...)
+			break
+		}
+	}
+	if len(socks) == 0 {
+		delete(this.ufrags, sock.ufrag)
+	} else {
+		this.ufrags[sock.ufrag] = socks
+	}
+	for k, s := range this.addresses {
+		if s == sock {
+			delete(this.addresses, k)
+		}
+	}
+	for k, t := range this.transactions {
+		if t.sock == sock {
+			delete(this.transactions, k)
+		}
+	}
+}
+
+/*
+ * Closes the shared port. The sockets still open get an error on their
+ * next receive.
+ */
+func (this *NiceUdpMux) Close() {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return
+	}
+	this.closed = true
+	socks := make([]*UdpMuxSocket, 0, len(this.ufrags))
+	for _, s := range this.ufrags {
+		socks = append(socks, s...)
+	}
+	this.mutex.Unlock()
+
+	this.conn.Close()
+	for i := 0; i < len(socks); i++ {
+		socks[i].close()
+	}
+}
+
+func udp_mux_stun_class(buf []byte) StunClass {
+	t := binary.BigEndian.Uint16(buf[0:2])
+	return StunClass(((t & 0x0100) >> 7) | ((t & 0x0010) >> 4))
+}
+
+func (this *UdpMuxSocket) recv_messages(recv_msgs []*NiceInputMessage) error {
+	for i := 0; i < len(recv_msgs); i++ {
+		msg := recv_msgs[i]
+		msg.length = 0
+		if len(msg.buffers) == 0 {
+			continue
+		}
+
+		var packet udp_mux_packet
+		if i == 0 {
+			select {
+			case packet = <-this.queue:
+			case <-this.done:
+				return errors.New("udp mux socket closed")
+			}
+		} else {
+			/* only the first message may block */
+			select {
+			case packet = <-this.queue:
+			default:
+				return nil
+			}
+		}
+
+		msg.length = copy(msg.buffers[0], packet.buf)
+		if msg.from != nil {
+			*msg.from = packet.from
+		}
+	}
+	return nil
+}
+
+func (this *UdpMuxSocket) send_messages(to *NiceAddress, messages []*NiceOutputMessage) error {
+	if to == nil {
+		return errors.New("udp socket needs a destination")
+	}
+
+	addr := nice_address_to_udp_addr(*to)
+	for i := 0; i < len(messages); i++ {
+		var buf []byte
+		if len(messages[i].buffers) == 1 {
+			buf = messages[i].buffers[0]
+		} else {
+			for j := 0; j < len(messages[i].buffers); j++ {
+				buf = append(buf, messages[i].buffers[j]...)
+			}
+		}
+		this.mux.track_request(this, buf)
+		if _, err := this.mux.conn.WriteToUDP(buf, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *UdpMuxSocket) send_messages_reliable(to *NiceAddress, messages []*NiceOutputMessage) error {
+	return nil
+}
+
+func (this *UdpMuxSocket) is_reliable() bool {
+	return false
+}
+
+func (this *UdpMuxSocket) can_send(addr *NiceAddress) bool {
+	return true
+}
+
+func (this *UdpMuxSocket) set_writable_callback(cb NiceSocketWritableCb) {
+
+}
+
+func (this *UdpMuxSocket) is_based_on(ohter *NiceSocket) bool {
+	return true
+}
+
+func (this *UdpMuxSocket) get_type() NiceSocketType {
+	return NICE_SOCKET_TYPE_UDP_BSD
+}
+
+func (this *UdpMuxSocket) close() {
+	this.close_once.Do(func() {
+		this.mux.remove_socket(this)
+		close(this.done)
+	})
+}
@@ -0,0 +1,288 @@
+package nice
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+/* A clock whose Now() is moved by hand, its timers are the real ones */
+type test_clock struct {
+	now				time.Time
+}
+
+func (this *test_clock) Now() time.Time {
+	return this.now
+}
+
+func (this *test_clock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return time.AfterFunc(d, f)
+}
+
+func test_udp_mux_recv(t *testing.T, sock *UdpMuxSocket) (string, bool) {
+	select {
+	case packet := <-sock.queue:
+		return string(packet.buf), true
+	case <-time.After(200 * time.Millisecond):
+		return "", false
+	}
+}
+
+func test_udp_mux_stun(t *testing.T, class StunClass, tid *StunTransactionId, username string) []byte {
+	msg := NewStunMessage(class, STUN_BINDING)
+	msg.messageHeader.transactionId = tid
+	if username != "" {
+		msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_USERNAME}, value: &StunUsernameAttrValue{username: username}})
+	}
+	return test_stun_encode(t, msg)
+}
+
+/*
+ * The address of a peer is bound to a socket once its check passed, not
+ * on the ufrag of its request alone.
+ */
+func TestUdpMuxBindAfterCheck(t *testing.T) {
+	mux := nice_udp_mux_new(NiceAddress{family: "ip4", network: "udp", ip: "127.0.0.1"})
+	if mux == nil {
+		t.Fatal("no mux")
+	}
+	defer mux.Close()
+	sock, err := mux.nice_udp_mux_socket_new(NiceAddress{family: "ip4", ip: "127.0.0.1"}, "ufrag", t, 1, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := net.DialUDP("udp", nil, nice_address_to_udp_addr(mux.local_addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	peer.Write(test_udp_mux_stun(t, STUN_REQUEST, test_stun_transaction_id(), "ufrag:remote"))
+	if _, ok := test_udp_mux_recv(t, sock); !ok {
+		t.Fatal("request not routed by its ufrag")
+	}
+	peer.Write([]byte("data"))
+	if _, ok := test_udp_mux_recv(t, sock); ok {
+		t.Fatal("packet routed before the check passed")
+	}
+
+	nice_udp_mux_socket_bind(sock, nice_address_from_net_addr(peer.LocalAddr()))
+	peer.Write([]byte("data"))
+	if data, ok := test_udp_mux_recv(t, sock); !ok || data != "data" {
+		t.Fatalf("packet of a checked peer: %q", data)
+	}
+}
+
+/* The responses are routed for as long as their transaction runs */
+func TestUdpMuxTransactionTimeout(t *testing.T) {
+	mux := nice_udp_mux_new(NiceAddress{family: "ip4", network: "udp", ip: "127.0.0.1"})
+	if mux == nil {
+		t.Fatal("no mux")
+	}
+	defer mux.Close()
+	clock := &test_clock{now: time.Unix(1000, 0)}
+	sock, err := mux.nice_udp_mux_socket_new(NiceAddress{family: "ip4", ip: "127.0.0.1"}, "ufrag", t, 1, clock, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	to := nice_address_from_net_addr(peer.LocalAddr())
+
+	answered := test_stun_transaction_id()
+	expired := test_stun_transaction_id()
+	for _, tid := range []*StunTransactionId{answered, expired} {
+		out := &NiceOutputMessage{buffers: [][]byte{test_udp_mux_stun(t, STUN_REQUEST, tid, "remote:ufrag")}}
+		if err := sock.send_messages(&to, []*NiceOutputMessage{out}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	peer.WriteToUDP(test_udp_mux_stun(t, STUN_RESPONSE, answered, ""), nice_address_to_udp_addr(mux.local_addr))
+	if _, ok := test_udp_mux_recv(t, sock); !ok {
+		t.Fatal("response within the transaction not routed")
+	}
+
+	clock.now = clock.now.Add(2 * time.Second)
+	peer.WriteToUDP(test_udp_mux_stun(t, STUN_RESPONSE, expired, ""), nice_address_to_udp_addr(mux.local_addr))
+	if _, ok := test_udp_mux_recv(t, sock); ok {
+		t.Fatal("response of a timed out transaction routed")
+	}
+
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	if len(mux.transactions) != 0 {
+		t.Fatalf("%d transactions left", len(mux.transactions))
+	}
+}
+
+/* A mux on the loopback, closed at the end of the test */
+func test_udp_mux(t *testing.T) *NiceUdpMux {
+	mux := nice_udp_mux_new(NiceAddress{family: "ip4", network: "udp", ip: "127.0.0.1"})
+	if mux == nil {
+		t.Fatal("no mux")
+	}
+	t.Cleanup(mux.Close)
+	return mux
+}
+
+/* The socket of the component @component_id of @owner on @mux */
+func test_udp_mux_socket(t *testing.T, mux *NiceUdpMux, ufrag string, owner interface{}, component_id uint) *UdpMuxSocket {
+	sock, err := mux.nice_udp_mux_socket_new(NiceAddress{family: "ip4", ip: "127.0.0.1"}, ufrag, owner, component_id, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sock
+}
+
+/* A peer of @mux on the loopback */
+func test_udp_mux_peer(t *testing.T, mux *NiceUdpMux) *net.UDPConn {
+	peer, err := net.DialUDP("udp", nil, nice_address_to_udp_addr(mux.local_addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	return peer
+}
+
+/* A ufrag belongs to the components of a single stream */
+func TestUdpMuxUfragInUse(t *testing.T) {
+	mux := test_udp_mux(t)
+	addr := NiceAddress{family: "ip4", ip: "127.0.0.1"}
+	test_udp_mux_socket(t, mux, "ufrag", "stream", 1)
+
+	if _, err := mux.nice_udp_mux_socket_new(addr, "ufrag", "other", 1, nil, time.Second); err != ErrUfragInUse {
+		t.Fatalf("ufrag of another stream: %v", err)
+	}
+	if _, err := mux.nice_udp_mux_socket_new(addr, "ufrag", "stream", 1, nil, time.Second); err == nil || err == ErrUfragInUse {
+		t.Fatalf("second socket of a component: %v", err)
+	}
+	if _, err := mux.nice_udp_mux_socket_new(addr, "ufrag", "stream", 2, nil, time.Second); err != nil {
+		t.Fatalf("second component: %v", err)
+	}
+}
+
+/*
+ * The requests to the components of a stream, which share its ufrag, are
+ * routed by the component in their PRIORITY, then by the address bound
+ * to a component.
+ */
+func TestUdpMuxRouteComponent(t *testing.T) {
+	mux := test_udp_mux(t)
+	rtp := test_udp_mux_socket(t, mux, "ufrag", "stream", 1)
+	rtcp := test_udp_mux_socket(t, mux, "ufrag", "stream", 2)
+	peer := test_udp_mux_peer(t, mux)
+
+	for _, sock := range []*UdpMuxSocket{rtp, rtcp} {
+		msg := NewStunMessage(STUN_REQUEST, STUN_BINDING)
+		msg.messageHeader.transactionId = test_stun_transaction_id()
+		msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_USERNAME}, value: &StunUsernameAttrValue{username: "ufrag:remote"}})
+		msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_PRIORITY},
+			value: &StunPriorityAttrValue{priority: nice_candidate_ice_priority_full(110, 65535, sock.component_id)}})
+		peer.Write(test_stun_encode(t, msg))
+		if _, ok := test_udp_mux_recv(t, sock); !ok {
+			t.Fatalf("request to component %d not routed to it", sock.component_id)
+		}
+	}
+
+	nice_udp_mux_socket_bind(rtcp, nice_address_from_net_addr(peer.LocalAddr()))
+	peer.Write(test_udp_mux_stun(t, STUN_REQUEST, test_stun_transaction_id(), "ufrag:remote"))
+	if _, ok := test_udp_mux_recv(t, rtcp); !ok {
+		t.Fatal("request from a bound address not routed to its component")
+	}
+}
+
+/*
+ * The RFC 3489 messages, without magic cookie, are routed by their
+ * USERNAME and transaction id too; the Google usernames have no ':'.
+ */
+func TestUdpMuxRfc3489(t *testing.T) {
+	mux := test_udp_mux(t)
+	legacy := test_udp_mux_socket(t, mux, "legacy", "legacy", 1)
+	google := test_udp_mux_socket(t, mux, "abcdefghijklmnop", "google", 1)
+	peer := test_udp_mux_peer(t, mux)
+	rfc3489 := func(class StunClass, username string) (*StunTransactionId, []byte) {
+		msg := NewStunMessage(class, STUN_BINDING)
+		msg.messageHeader.transactionId = test_stun_transaction_id()
+		msg.magicCookie = nil
+		if username != "" {
+			msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_USERNAME}, value: &StunUsernameAttrValue{username: username}})
+		}
+		return msg.messageHeader.transactionId, test_stun_encode(t, msg)
+	}
+
+	_, req := rfc3489(STUN_REQUEST, "legacy:remote")
+	peer.Write(req)
+	if _, ok := test_udp_mux_recv(t, legacy); !ok {
+		t.Fatal("RFC 3489 request not routed by its ufrag")
+	}
+	_, req = rfc3489(STUN_REQUEST, "abcdefghijklmnopqrstuvwxyz012345")
+	peer.Write(req)
+	if _, ok := test_udp_mux_recv(t, google); !ok {
+		t.Fatal("Google request not routed by its username")
+	}
+
+	tid, req := rfc3489(STUN_REQUEST, "remote:legacy")
+	to := nice_address_from_net_addr(peer.LocalAddr())
+	if err := legacy.send_messages(&to, []*NiceOutputMessage{{buffers: [][]byte{req}}}); err != nil {
+		t.Fatal(err)
+	}
+	resp := NewStunMessage(STUN_RESPONSE, STUN_BINDING)
+	resp.messageHeader.transactionId = tid
+	resp.magicCookie = nil
+	peer.Write(test_stun_encode(t, resp))
+	if _, ok := test_udp_mux_recv(t, legacy); !ok {
+		t.Fatal("RFC 3489 response not routed by its transaction id")
+	}
+}
+
+/*
+ * A stream whose generated ufrag is used by another on the mux gets a new
+ * one; one set by the application makes the gathering fail instead.
+ */
+func TestUdpMuxAgentUfragCollision(t *testing.T) {
+	mux := test_udp_mux(t)
+	new_stream := func() *Stream {
+		agent, err := NewAgent(WithLocalAddresses("127.0.0.1"), WithIceTcp(false), WithUdpMux(mux))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { agent.Close(context.Background()) })
+		s, err := agent.AddStream(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+
+	first := new_stream()
+	if err := first.Gather(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ufrag, pwd, _ := first.LocalCredentials()
+
+	generated := new_stream()
+	agent := generated.agent.agent
+	agent.agent_mutex.Lock()
+	agent.find_stream(generated.ID()).local_ufrag = ufrag
+	agent.agent_mutex.Unlock()
+	if err := generated.Gather(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if u, _, _ := generated.LocalCredentials(); u == ufrag {
+		t.Fatal("ufrag of another stream kept")
+	}
+
+	set := new_stream()
+	if err := set.SetLocalCredentials(ufrag, pwd); err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Gather(ctx); err != ErrUfragInUse {
+		t.Fatalf("gathering with the ufrag of another stream: %v", err)
+	}
+}
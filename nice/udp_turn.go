@@ -0,0 +1,454 @@
+package nice
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+/*
+ * A ChannelBind is valid 10 minutes, the permission it installs 5 (RFC 5766
+ * sections 8 and 11): it is sent again before the permission expires.
+ */
+const NICE_TURN_CHANNEL_REFRESH = 240 * 1000
+
+/* The packets kept for a peer while its channel is being bound */
+const NICE_TURN_MAX_QUEUED_PACKETS = 16
+
+/* The header of the TURN ChannelData messages (RFC 5766 section 11.4) */
+const NICE_TURN_CHANNEL_HEADER_LEN = 4
+
+/*
+ * A peer of a relayed candidate: its channel on the TURN server, bound
+ * before the first packet to it, then bound again periodically.
+ */
+type TurnPeer struct {
+	addr			NiceAddress
+	channel			uint16
+	bound			bool	/* the ChannelBind succeeded */
+	stun_message	*StunMessage	/* the ChannelBind in flight */
+	stun_buffer		[]byte
+	timer			StunTimer
+	tick_source		*NiceTimer	/* retransmissions of the ChannelBind */
+	refresh_source	*NiceTimer	/* the next ChannelBind */
+	auth_retries	int
+	queued			[][]byte	/* waiting for the channel */
+}
+
+/*
+ * The socket of a relayed candidate (RFC 5766): the packets to a peer are
+ * wrapped in ChannelData, in Send indications for MS-TURN or in Send
+ * requests for the Google relays, and go to
+ * the TURN server through @base, the socket of the allocation. The
+ * packets of the peers come back through @base too, and are unwrapped by
+ * nice_udp_turn_socket_parse_recv().
+ *
+ * All of it runs with the agent lock held.
+ */
+type UdpTurnSocket struct {
+	agent			*NiceAgent
+	stream_id		uint
+	component_id	uint
+	base			NiceSockInterface
+	server			NiceAddress
+	local_addr		NiceAddress	/* the relayed address */
+	stun_agent		StunAgent
+	creds			*StunLongTermCredentials
+	username		string	/* of the Google relay session */
+	peers			[]*TurnPeer
+	next_channel	uint16
+	closed			bool
+}
+
+/*
+ * Creates the relay socket of the allocation @relayed, made on @server
+ * through @base in the STUN dialect of @stun_agent. @username names the
+ * session of a Google relay, which has no credentials.
+ */
+func nice_udp_turn_socket_new(agent *NiceAgent, stream_id uint, component_id uint, base NiceSockInterface, server NiceAddress, relayed NiceAddress, stun_agent *StunAgent, creds *StunLongTermCredentials, username string) *UdpTurnSocket {
+	s := &UdpTurnSocket{}
+	s.agent = agent
+	s.stream_id = stream_id
+	s.component_id = component_id
+	s.base = base
+	s.server = server
+	s.local_addr = relayed
+	stun_agent_init(&s.stun_agent, stun_agent.compatibility, stun_agent.usage_flags)
+	s.creds = creds
+	s.username = username
+	s.next_channel = STUN_CHANNEL_NUMBER_MIN
+	return s
+}
+
+/* Whether MS-TURN relays the packets of @this, in Send indications */
+func priv_turn_socket_ms_turn(this *UdpTurnSocket) bool {
+	return this.stun_agent.compatibility == STUN_COMPATIBILITY_OC2007
+}
+
+/* Whether a Google relay relays the packets of @this, in Send requests */
+func priv_turn_socket_google(this *UdpTurnSocket) bool {
+	return this.stun_agent.compatibility == STUN_COMPATIBILITY_RFC3489
+}
+
+func priv_turn_socket_find_peer(this *UdpTurnSocket, addr NiceAddress) *TurnPeer {
+	for i := 0; i < len(this.peers); i++ {
+		if this.peers[i].addr.ip == addr.ip && this.peers[i].addr.port == addr.port {
+			return this.peers[i]
+		}
+	}
+	return nil
+}
+
+func priv_turn_socket_forget_peer(this *UdpTurnSocket, peer *TurnPeer) {
+	agent_timeout_remove(&peer.tick_source)
+	agent_timeout_remove(&peer.refresh_source)
+	for i := 0; i < len(this.peers); i++ {
+		if this.peers[i] == peer {
+			this.peers = append(this.peers[:i], this.peers[i + 1:]...)
+			break
+		}
+	}
+}
+
+/* The family and bytes of the IP of @addr, for the address attributes */
+func priv_turn_address_ip(addr NiceAddress) (MAPPED_ADDRESS_FAMILY, net.IP) {
+	ip := net.ParseIP(addr.ip)
+	if ip4 := ip.To4(); ip4 != nil {
+		return MAPPED_ADDRESS_FAMILY_IPV4, ip4
+	}
+	return MAPPED_ADDRESS_FAMILY_IPV6, ip
+}
+
+func priv_turn_socket_send_to_server(this *UdpTurnSocket, buf []byte) error {
+	out := &NiceOutputMessage{buffers: [][]byte{buf}}
+	return this.base.send_messages(&this.server, []*NiceOutputMessage{out})
+}
+
+/*
+ * Sends the ChannelBind of @peer, retransmitted until it is answered
+ * (RFC 5766 section 11.1). It also installs the permission of the peer.
+ */
+func priv_turn_socket_channel_bind(this *UdpTurnSocket, peer *TurnPeer) bool {
+	agent := this.agent
+	msg := NewStunMessage(STUN_REQUEST, STUN_CHANNELBIND)
+	msg.messageHeader.transactionId = agent.rng.rng_generate_transaction_id()
+	stun_agent_prepare_message(&this.stun_agent, msg)
+	msg.AddAttr(StunAttr{
+		header: StunAttrHeader{typ: STUN_ATTRIBUTE_CHANNEL_NUMBER},
+		value:  &StunChannelNumberAttrValue{channel: peer.channel},
+	})
+	family, ip := priv_turn_address_ip(peer.addr)
+	value := NewStunXorMappedAddressAttrValue(family, uint16(peer.addr.port), ip)
+	value.SetMagicCookie(msg.magicCookie)
+	value.SetTransactionId(msg.messageHeader.transactionId)
+	msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_XOR_PEER_ADDRESS}, value: value})
+
+	buf, err := stun_agent_finish_message(&this.stun_agent, msg, this.creds)
+	if err != nil {
+		return false
+	}
+	peer.stun_message = msg
+	peer.stun_buffer = buf
+
+	if this.base.is_reliable() {
+		stun_timer_start_reliable(&peer.timer, agent.clock, agent.stun_reliable_timeout)
+	} else {
+		stun_timer_start(&peer.timer, agent.clock, agent.stun_initial_timeout, agent.stun_max_retransmissions)
+	}
+	if !priv_turn_socket_send_channel_bind(this, peer) {
+		return false
+	}
+	agent_timeout_add(agent, &peer.tick_source, stun_timer_remainder(&peer.timer), func(agent *NiceAgent) bool {
+		return priv_turn_socket_channel_bind_tick(this, peer)
+	})
+	return true
+}
+
+func priv_turn_socket_send_channel_bind(this *UdpTurnSocket, peer *TurnPeer) bool {
+	nice_log_stun(nice_agent_log(this.agent, NICE_LOG_TURN), "sending TURN channel bind", this.stream_id, this.component_id, this.server, peer.stun_buffer)
+	if err := priv_turn_socket_send_to_server(this, peer.stun_buffer); err != nil {
+		nice_component_log(this.agent, NICE_LOG_SOCKET, this.stream_id, this.component_id).Warn("could not send the TURN channel bind",
+			"server", nice_address_to_string(this.server), "error", err)
+		return false
+	}
+	return true
+}
+
+func priv_turn_socket_channel_bind_tick(this *UdpTurnSocket, peer *TurnPeer) bool {
+	switch stun_timer_refresh(&peer.timer) {
+	case STUN_USAGE_TIMER_RETURN_TIMEOUT:
+		nice_component_log(this.agent, NICE_LOG_TURN, this.stream_id, this.component_id).Warn("TURN channel bind timed out",
+			"server", nice_address_to_string(this.server), "peer", nice_address_to_string(peer.addr))
+		priv_turn_socket_forget_peer(this, peer)
+		return false
+	case STUN_USAGE_TIMER_RETURN_RETRANSMIT:
+		this.agent.metrics.StunRetransmission()
+		if !priv_turn_socket_send_channel_bind(this, peer) {
+			priv_turn_socket_forget_peer(this, peer)
+			return false
+		}
+	}
+	agent_timeout_add(this.agent, &peer.tick_source, stun_timer_remainder(&peer.timer), func(agent *NiceAgent) bool {
+		return priv_turn_socket_channel_bind_tick(this, peer)
+	})
+	return true
+}
+
+/*
+ * Matches the response @buf to a ChannelBind of @this, see
+ * agent_recv_stun() for @raw. Once bound, the packets queued for the peer
+ * go in its channel.
+ *
+ * Returns: %FALSE if @buf answers none of them
+ */
+func nice_udp_turn_socket_handle_inbound_stun(this *UdpTurnSocket, buf []byte, raw []byte) bool {
+	if this.closed || !stun_message_is_response(buf) {
+		return false
+	}
+	if priv_turn_socket_google(this) {
+		/* the answers to the Send requests, which carry nothing */
+		return binary.BigEndian.Uint16(buf[0:2]) & 0x3eef == STUN_SEND
+	}
+	var peer *TurnPeer
+	for i := 0; i < len(this.peers); i++ {
+		p := this.peers[i]
+		if p.stun_message != nil && stun_message_matches_transaction_id(buf, p.stun_message) {
+			peer = p
+			break
+		}
+	}
+	if peer == nil {
+		return false
+	}
+	agent := this.agent
+	log := nice_component_log(agent, NICE_LOG_TURN, this.stream_id, this.component_id)
+	nice_log_stun(nice_agent_log(agent, NICE_LOG_TURN), "received TURN channel bind response", this.stream_id, this.component_id, this.server, buf)
+
+	if !stun_agent_check_response(&this.stun_agent, raw) {
+		log.Warn("TURN channel bind response with a wrong MESSAGE-INTEGRITY", "server", nice_address_to_string(this.server))
+		agent.metrics.StunAuthFailure()
+		return true
+	}
+	agent_timeout_remove(&peer.tick_source)
+
+	code := stun_message_get_error_code(buf)
+	if (code == STUN_ERROR_UNAUTHORIZED || code == STUN_ERROR_STALE_NONCE) && peer.auth_retries < NICE_DISCOVERY_MAX_AUTH_RETRIES &&
+		stun_agent_update_long_term_credentials(&this.stun_agent, this.creds, buf, stun_message_has_integrity(peer.stun_message)) {
+		peer.auth_retries++
+		if priv_turn_socket_channel_bind(this, peer) {
+			return true
+		}
+	}
+	peer.stun_message = nil
+	peer.auth_retries = 0
+	if code >= 0 {
+		log.Warn("TURN channel bind rejected", "server", nice_address_to_string(this.server),
+			"peer", nice_address_to_string(peer.addr), "code", code)
+		priv_turn_socket_forget_peer(this, peer)
+		return true
+	}
+
+	peer.bound = true
+	queued := peer.queued
+	peer.queued = nil
+	for i := 0; i < len(queued); i++ {
+		priv_turn_socket_send_to_server(this, priv_turn_socket_channel_data(peer.channel, queued[i]))
+	}
+	agent_timeout_add(agent, &peer.refresh_source, NICE_TURN_CHANNEL_REFRESH, func(agent *NiceAgent) bool {
+		if !priv_turn_socket_channel_bind(this, peer) {
+			priv_turn_socket_forget_peer(this, peer)
+		}
+		return false
+	})
+	return true
+}
+
+/* The ChannelData message of @data in @channel */
+func priv_turn_socket_channel_data(channel uint16, data []byte) []byte {
+	buf := make([]byte, NICE_TURN_CHANNEL_HEADER_LEN, NICE_TURN_CHANNEL_HEADER_LEN + len(data))
+	binary.BigEndian.PutUint16(buf[0:2], channel)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(data)))
+	return append(buf, data...)
+}
+
+/*
+ * The MS-TURN Send indication of @data to @to: the DESTINATION-ADDRESS is
+ * not XOR-ed, and the indication is signed as the requests. The Google
+ * relays want a Send request instead, of their MAGIC-COOKIE and USERNAME
+ * and unsigned; nothing waits for its answer.
+ */
+func priv_turn_socket_send_indication(this *UdpTurnSocket, to NiceAddress, data []byte) ([]byte, error) {
+	var msg *StunMessage
+	if priv_turn_socket_google(this) {
+		msg = NewStunMessage(STUN_REQUEST, STUN_SEND)
+	} else {
+		msg = NewStunMessage(STUN_INDICATION, STUN_IND_SEND)
+	}
+	msg.messageHeader.transactionId = this.agent.rng.rng_generate_transaction_id()
+	stun_agent_prepare_message(&this.stun_agent, msg)
+	msg.magicCookie = nil
+	if priv_turn_socket_google(this) {
+		msg.AddAttr(StunAttr{
+			header: StunAttrHeader{typ: STUN_ATTRIBUTE_MAGIC_COOKIE},
+			value:  &StunTurnMagicCookieAttrValue{cookie: STUN_TURN_MAGIC_COOKIE},
+		})
+		msg.AddAttr(StunAttr{
+			header: StunAttrHeader{typ: STUN_ATTRIBUTE_USERNAME},
+			value:  &StunUsernameAttrValue{username: this.username},
+		})
+	} else {
+		msg.AddAttr(StunAttr{
+			header: StunAttrHeader{typ: STUN_ATTRIBUTE_MS_VERSION},
+			value:  &StunMsVersionAttrValue{version: STUN_MS_TURN_VERSION},
+		})
+	}
+	family, ip := priv_turn_address_ip(to)
+	msg.AddAttr(StunAttr{
+		header: StunAttrHeader{typ: STUN_ATTRIBUTE_DESTINATION_ADDRESS},
+		value:  NewStunMappedAddressAttrValue(family, uint16(to.port), ip),
+	})
+	msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_DATA}, value: &StunDataAttrValue{data: data}})
+	return stun_agent_finish_message(&this.stun_agent, msg, this.creds)
+}
+
+/*
+ * Relays each message to @to. The first packet to a peer binds its
+ * channel, the packets are kept until it is bound.
+ */
+func (this *UdpTurnSocket) send_messages(to *NiceAddress, messages []*NiceOutputMessage) error {
+	if to == nil {
+		return errors.New("turn socket needs a destination")
+	}
+	if this.closed {
+		return errors.New("turn socket closed")
+	}
+
+	for i := 0; i < len(messages); i++ {
+		var data []byte
+		for j := 0; j < len(messages[i].buffers); j++ {
+			data = append(data, messages[i].buffers[j]...)
+		}
+
+		if priv_turn_socket_ms_turn(this) || priv_turn_socket_google(this) {
+			buf, err := priv_turn_socket_send_indication(this, *to, data)
+			if err != nil {
+				return err
+			}
+			if err := priv_turn_socket_send_to_server(this, buf); err != nil {
+				return err
+			}
+			continue
+		}
+
+		peer := priv_turn_socket_find_peer(this, *to)
+		if peer == nil {
+			if this.next_channel > STUN_CHANNEL_NUMBER_MAX {
+				return errors.New("no TURN channel left")
+			}
+			peer = &TurnPeer{addr: *to, channel: this.next_channel}
+			this.next_channel++
+			this.peers = append(this.peers, peer)
+			if !priv_turn_socket_channel_bind(this, peer) {
+				priv_turn_socket_forget_peer(this, peer)
+				return errors.New("could not bind the TURN channel")
+			}
+		}
+		if !peer.bound {
+			if len(peer.queued) < NICE_TURN_MAX_QUEUED_PACKETS {
+				peer.queued = append(peer.queued, data)
+			}
+			continue
+		}
+		if err := priv_turn_socket_send_to_server(this, priv_turn_socket_channel_data(peer.channel, data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Unwraps the packet @buf received from @from on the base socket of @this:
+ * the ChannelData of a bound channel, or a Data indication.
+ *
+ * Returns: the packet and the peer which sent it, %FALSE if @buf is not
+ * relayed by the server of @this
+ */
+func nice_udp_turn_socket_parse_recv(this *UdpTurnSocket, from NiceAddress, buf []byte) (NiceAddress, []byte, bool) {
+	var peer NiceAddress
+	if this.closed || from.ip != this.server.ip || from.port != this.server.port || len(buf) < NICE_TURN_CHANNEL_HEADER_LEN {
+		return peer, nil, false
+	}
+
+	if buf[0] & 0xc0 == 0x40 {
+		channel := binary.BigEndian.Uint16(buf[0:2])
+		l := int(binary.BigEndian.Uint16(buf[2:4]))
+		if NICE_TURN_CHANNEL_HEADER_LEN + l > len(buf) {
+			return peer, nil, false
+		}
+		for i := 0; i < len(this.peers); i++ {
+			if this.peers[i].bound && this.peers[i].channel == channel {
+				return this.peers[i].addr, buf[NICE_TURN_CHANNEL_HEADER_LEN:NICE_TURN_CHANNEL_HEADER_LEN + l], true
+			}
+		}
+		return peer, nil, false
+	}
+
+	if len(buf) < STUN_MESSAGE_HEADER_LENGTH || binary.BigEndian.Uint16(buf[0:2]) & 0x3fff != 0x0010 | STUN_IND_DATA {
+		return peer, nil, false
+	}
+	var ok bool
+	if priv_turn_socket_ms_turn(this) || priv_turn_socket_google(this) {
+		/* the REMOTE-ADDRESS of MS-TURN and the Google relays, not XOR-ed */
+		peer, ok = stun_message_find_addr(buf, STUN_ATTRIBUTE_REMOTE_ADDRESS)
+	} else {
+		peer, ok = stun_message_find_xor_addr(buf, STUN_ATTRIBUTE_XOR_PEER_ADDRESS)
+	}
+	data := stun_message_find_attribute(buf, STUN_ATTRIBUTE_DATA)
+	if !ok || data == nil {
+		return peer, nil, false
+	}
+	peer.network = "udp"
+	return peer, data, true
+}
+
+/* The packets of the peers come through the base socket */
+func (this *UdpTurnSocket) recv_messages(recv_msgs []*NiceInputMessage) error {
+	return errors.New("turn socket receives through its base socket")
+}
+
+func (this *UdpTurnSocket) send_messages_reliable(to *NiceAddress, messages []*NiceOutputMessage) error {
+	return nil
+}
+
+func (this *UdpTurnSocket) is_reliable() bool {
+	return false
+}
+
+func (this *UdpTurnSocket) can_send(addr *NiceAddress) bool {
+	return !this.closed
+}
+
+func (this *UdpTurnSocket) set_writable_callback(cb NiceSocketWritableCb) {
+
+}
+
+func (this *UdpTurnSocket) is_based_on(ohter *NiceSocket) bool {
+	return this.base.is_based_on(ohter)
+}
+
+func (this *UdpTurnSocket) get_type() NiceSocketType {
+	return NICE_SOCKET_TYPE_UDP_TURN
+}
+
+/* Stops the channel binds; @base belongs to the component */
+func (this *UdpTurnSocket) close() {
+	if this.closed {
+		return
+	}
+	this.closed = true
+	for i := 0; i < len(this.peers); i++ {
+		agent_timeout_remove(&this.peers[i].tick_source)
+		agent_timeout_remove(&this.peers[i].refresh_source)
+	}
+	this.peers = nil
+}
@@ -0,0 +1,197 @@
+package nice
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+ * NiceTurnOverTcpCompatibility:
+ * @NICE_TURN_OVER_TCP_COMPATIBILITY_RFC5766: STUN messages and ChannelData
+ * back to back, as framed by their own lengths (RFC 5766 section 11.5)
+ * @NICE_TURN_OVER_TCP_COMPATIBILITY_GOOGLE: every message prefixed with its
+ * length, as RFC 4571 does
+ * @NICE_TURN_OVER_TCP_COMPATIBILITY_OC2007: every message prefixed with the
+ * MS-TURN header of its type and length
+ *
+ * The ways the TURN servers frame the messages of a TCP connection.
+ */
+type NiceTurnOverTcpCompatibility int
+const (
+	NICE_TURN_OVER_TCP_COMPATIBILITY_RFC5766 NiceTurnOverTcpCompatibility = iota
+	NICE_TURN_OVER_TCP_COMPATIBILITY_GOOGLE
+	NICE_TURN_OVER_TCP_COMPATIBILITY_OC2007
+)
+
+/* The header of a message of MS-TURN over TCP: its type, 0, its length */
+const MS_TURN_TCP_HEADER_LEN = 4
+const MS_TURN_TCP_TYPE_CONTROL = 0x02
+const MS_TURN_TCP_TYPE_DATA = 0x03
+
+/*
+ * UdpTurnOverTcpSocket frames the messages of a TURN server reached over
+ * TCP (or the pseudo-SSL of a TLS relay), as the UDP ones: every call to
+ * recv_messages() returns a whole message, and every message sent goes in
+ * a frame of its own.
+ */
+type UdpTurnOverTcpSocket struct {
+	base			NiceSockInterface
+	compatibility	NiceTurnOverTcpCompatibility
+	recv_buf		[]byte	/* the bytes of the next messages */
+	from			NiceAddress
+	writable_cb		NiceSocketWritableCb
+}
+
+func NewUdpTurnOverTcpSocket(base NiceSockInterface, compatibility NiceTurnOverTcpCompatibility) *UdpTurnOverTcpSocket {
+	s := &UdpTurnOverTcpSocket{}
+	s.base = base
+	s.compatibility = compatibility
+	return s
+}
+
+/**
+ * nice_udp_turn_over_tcp_socket_new:
+ * @base_socket: The connection to the TURN server
+ * @compatibility: The framing the server expects
+ *
+ * Frames the messages of @base_socket.
+ *
+ * Returns: the new socket
+ */
+func nice_udp_turn_over_tcp_socket_new(base NiceSockInterface, compatibility NiceTurnOverTcpCompatibility) *UdpTurnOverTcpSocket {
+	return NewUdpTurnOverTcpSocket(base, compatibility)
+}
+
+/*
+ * Returns the length of the frame at the start of 'recv_buf' and the
+ * offset and length of its message, or a frame length of 0 when more
+ * bytes are needed to know.
+ */
+func (this *UdpTurnOverTcpSocket) next_frame() (int, int, int) {
+	buf := this.recv_buf
+	switch this.compatibility {
+	case NICE_TURN_OVER_TCP_COMPATIBILITY_GOOGLE:
+		if len(buf) < RFC4571_HEADER_LEN {
+			return 0, 0, 0
+		}
+		l := int(binary.BigEndian.Uint16(buf[0:2]))
+		return RFC4571_HEADER_LEN + l, RFC4571_HEADER_LEN, l
+	case NICE_TURN_OVER_TCP_COMPATIBILITY_OC2007:
+		if len(buf) < MS_TURN_TCP_HEADER_LEN {
+			return 0, 0, 0
+		}
+		l := int(binary.BigEndian.Uint16(buf[2:4]))
+		return MS_TURN_TCP_HEADER_LEN + l, MS_TURN_TCP_HEADER_LEN, l
+	}
+
+	if len(buf) < NICE_TURN_CHANNEL_HEADER_LEN {
+		return 0, 0, 0
+	}
+	l := int(binary.BigEndian.Uint16(buf[2:4]))
+	if buf[0] & 0xc0 == 0x40 {
+		/* ChannelData, padded to 4 bytes over TCP */
+		return NICE_TURN_CHANNEL_HEADER_LEN + (l + 3) &^ 3, 0, NICE_TURN_CHANNEL_HEADER_LEN + l
+	}
+	return STUN_MESSAGE_HEADER_LENGTH + l, 0, STUN_MESSAGE_HEADER_LENGTH + l
+}
+
+/*
+ * Reads from the base socket until a whole message arrived, and returns
+ * it in the first of @recv_msgs.
+ */
+func (this *UdpTurnOverTcpSocket) recv_messages(recv_msgs []*NiceInputMessage) error {
+	for i := 0; i < len(recv_msgs); i++ {
+		recv_msgs[i].length = 0
+	}
+	if len(recv_msgs) == 0 || len(recv_msgs[0].buffers) == 0 {
+		return nil
+	}
+
+	var from NiceAddress
+	buf := make([]byte, MAX_BUFFER_SIZE)
+	in := &NiceInputMessage{buffers: [][]byte{buf}, from: &from}
+	for {
+		frame_len, offset, l := this.next_frame()
+		if frame_len > 0 && len(this.recv_buf) >= frame_len {
+			msg := recv_msgs[0]
+			n := 0
+			for j := 0; j < len(msg.buffers) && n < l; j++ {
+				n += copy(msg.buffers[j], this.recv_buf[offset + n:offset + l])
+			}
+			msg.length = n
+			if msg.from != nil {
+				*msg.from = this.from
+			}
+			this.recv_buf = this.recv_buf[frame_len:]
+			return nil
+		}
+
+		if err := this.base.recv_messages([]*NiceInputMessage{in}); err != nil {
+			return err
+		}
+		this.from = from
+		this.recv_buf = append(this.recv_buf, buf[:in.length]...)
+	}
+}
+
+/* Each message in a frame of its own */
+func (this *UdpTurnOverTcpSocket) send_messages(to *NiceAddress, messages []*NiceOutputMessage) error {
+	framed := make([]*NiceOutputMessage, len(messages))
+	for i := 0; i < len(messages); i++ {
+		var data []byte
+		for j := 0; j < len(messages[i].buffers); j++ {
+			data = append(data, messages[i].buffers[j]...)
+		}
+		if len(data) > RFC4571_MAX_FRAME_SIZE {
+			return errors.New("message too large for the TURN TCP framing")
+		}
+
+		var header []byte
+		switch this.compatibility {
+		case NICE_TURN_OVER_TCP_COMPATIBILITY_GOOGLE:
+			header = make([]byte, RFC4571_HEADER_LEN)
+			binary.BigEndian.PutUint16(header, uint16(len(data)))
+		case NICE_TURN_OVER_TCP_COMPATIBILITY_OC2007:
+			header = make([]byte, MS_TURN_TCP_HEADER_LEN)
+			header[0] = MS_TURN_TCP_TYPE_DATA
+			if nice_packet_classify(data) == NICE_PACKET_CLASS_STUN {
+				header[0] = MS_TURN_TCP_TYPE_CONTROL
+			}
+			binary.BigEndian.PutUint16(header[2:4], uint16(len(data)))
+		default:
+			if len(data) > 0 && data[0] & 0xc0 == 0x40 {
+				data = append(data, make([]byte, (4 - len(data) % 4) % 4)...)
+			}
+		}
+		framed[i] = &NiceOutputMessage{buffers: [][]byte{append(header, data...)}}
+	}
+	return this.base.send_messages(to, framed)
+}
+
+func (this *UdpTurnOverTcpSocket) send_messages_reliable(to *NiceAddress, messages []*NiceOutputMessage) error {
+	return this.send_messages(to, messages)
+}
+
+func (this *UdpTurnOverTcpSocket) is_reliable() bool {
+	return this.base.is_reliable()
+}
+
+func (this *UdpTurnOverTcpSocket) can_send(addr *NiceAddress) bool {
+	return this.base.can_send(addr)
+}
+
+func (this *UdpTurnOverTcpSocket) set_writable_callback(cb NiceSocketWritableCb) {
+	this.writable_cb = cb
+}
+
+func (this *UdpTurnOverTcpSocket) is_based_on(ohter *NiceSocket) bool {
+	return this.base.is_based_on(ohter)
+}
+
+func (this *UdpTurnOverTcpSocket) get_type() NiceSocketType {
+	return NICE_SOCKET_TYPE_UDP_TURN_OVER_TCP
+}
+
+func (this *UdpTurnOverTcpSocket) close() {
+	this.base.close()
+}
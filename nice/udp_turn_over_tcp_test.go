@@ -0,0 +1,152 @@
+package nice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+/* A TCP connection to a TURN server on the loopback, and the server end */
+func test_turn_tcp_conn(t *testing.T) (*TcpBsdSocket, net.Conn) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := <-accepted
+	if srv == nil {
+		t.Fatal("no connection")
+	}
+	t.Cleanup(func() { srv.Close() })
+	sock := NewTcpBsdSocket(NICE_SOCKET_TYPE_TCP_BSD, c)
+	t.Cleanup(sock.close)
+	return sock, srv
+}
+
+func test_turn_tcp_recv(t *testing.T, sock *UdpTurnOverTcpSocket) []byte {
+	buf := make([]byte, MAX_BUFFER_SIZE)
+	msg := &NiceInputMessage{buffers: [][]byte{buf}}
+	if err := sock.recv_messages([]*NiceInputMessage{msg}); err != nil {
+		t.Fatal(err)
+	}
+	return buf[:msg.length]
+}
+
+/*
+ * RFC 5766 frames the STUN messages and the ChannelData by their own
+ * lengths, whatever the TCP segments; ChannelData is padded to 4 bytes.
+ */
+func TestUdpTurnOverTcpSocketRfc5766(t *testing.T) {
+	tcp, srv := test_turn_tcp_conn(t)
+	sock := nice_udp_turn_over_tcp_socket_new(tcp, NICE_TURN_OVER_TCP_COMPATIBILITY_RFC5766)
+
+	msg := NewStunMessage(STUN_RESPONSE, STUN_ALLOCATE)
+	msg.messageHeader.transactionId = test_stun_transaction_id()
+	msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_LIFETIME}, value: &StunLifetimeAttrValue{lifetime: 600}})
+	stun := test_stun_encode(t, msg)
+	channel := []byte{0x40, 0x00, 0x00, 0x03, 'a', 'b', 'c', 0}
+	stream := append(append([]byte{}, stun...), channel...)
+	go func() {
+		srv.Write(stream[:7])
+		time.Sleep(10 * time.Millisecond)
+		srv.Write(stream[7:])
+	}()
+	if got := test_turn_tcp_recv(t, sock); !bytes.Equal(got, stun) {
+		t.Fatalf("STUN message % x", got)
+	}
+	if got := test_turn_tcp_recv(t, sock); string(got) != "\x40\x00\x00\x03abc" {
+		t.Fatalf("ChannelData % x", got)
+	}
+
+	if err := sock.send_messages(nil, []*NiceOutputMessage{{buffers: [][]byte{[]byte("\x40\x00\x00\x05"), []byte("hello")}}}); err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, 12)
+	srv.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(srv, out); err != nil || string(out) != "\x40\x00\x00\x05hello\x00\x00\x00" {
+		t.Fatalf("sent % x: %v", out, err)
+	}
+}
+
+/* MS-TURN prefixes its messages with their type and length */
+func TestUdpTurnOverTcpSocketOc2007(t *testing.T) {
+	tcp, srv := test_turn_tcp_conn(t)
+	sock := nice_udp_turn_over_tcp_socket_new(tcp, NICE_TURN_OVER_TCP_COMPATIBILITY_OC2007)
+
+	go srv.Write([]byte{MS_TURN_TCP_TYPE_CONTROL, 0, 0, 3, 'a', 'b', 'c', MS_TURN_TCP_TYPE_CONTROL, 0, 0, 1, 'd'})
+	if got := test_turn_tcp_recv(t, sock); string(got) != "abc" {
+		t.Fatalf("received %q", got)
+	}
+	if got := test_turn_tcp_recv(t, sock); string(got) != "d" {
+		t.Fatalf("received %q", got)
+	}
+
+	msg := NewStunMessage(STUN_REQUEST, STUN_ALLOCATE)
+	msg.messageHeader.transactionId = test_stun_transaction_id()
+	stun := test_stun_encode(t, msg)
+	if err := sock.send_messages(nil, []*NiceOutputMessage{{buffers: [][]byte{stun}}}); err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, MS_TURN_TCP_HEADER_LEN + len(stun))
+	srv.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(srv, out); err != nil {
+		t.Fatal(err)
+	}
+	if out[0] != MS_TURN_TCP_TYPE_CONTROL || int(binary.BigEndian.Uint16(out[2:4])) != len(stun) || !bytes.Equal(out[MS_TURN_TCP_HEADER_LEN:], stun) {
+		t.Fatalf("sent % x", out)
+	}
+}
+
+/*
+ * The discovery of a TCP relay is not scheduled before its connect is
+ * done, which does not hold the agent lock; the Allocate then goes framed
+ * on the new connection.
+ */
+func TestDiscoveryTurnTcpConnect(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, _, base := test_turn_server(t)
+	agent := NewNiceAgent()
+	defer test_turn_close(agent)
+	id := agent.Nice_agent_add_stream(1)
+
+	agent.agent_mutex.Lock()
+	stream, _ := agent.agent_find_component(id, 1)
+	turn := &TurnServer{server: nice_address_from_net_addr(l.Addr()), username: "user", password: "pass", typ: NICE_RELAY_TYPE_TURN_TCP}
+	priv_add_new_candidate_discovery_turn(agent, base, turn, stream, 1)
+	if len(agent.discovery_list) != 1 || !agent.discovery_list[0].connecting || agent.discovery_unsched_items != 0 {
+		agent.agent_mutex.Unlock()
+		t.Fatal("the TCP relay discovery is scheduled before its connect")
+	}
+	agent.agent_mutex.Unlock()
+
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(2 * time.Second))
+	srv, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetReadDeadline(time.Now().Add(2 * time.Second))
+	hdr := make([]byte, STUN_MESSAGE_HEADER_LENGTH)
+	if _, err := io.ReadFull(srv, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(hdr[0:2]) != STUN_ALLOCATE {
+		t.Fatalf("sent % x", hdr)
+	}
+}
@@ -0,0 +1,425 @@
+package nice
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+/* A TURN server on the loopback, and the socket of an allocation on it */
+func test_turn_server(t *testing.T) (*net.UDPConn, NiceAddress, *UdpBsdSocket) {
+	srv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	server := nice_address_from_net_addr(srv.LocalAddr())
+	base := NewUdpBsdSocket(NiceAddress{ip: "127.0.0.1", network: "udp", family: "ip4"})
+	if base == nil {
+		t.Fatal("no socket")
+	}
+	t.Cleanup(base.close)
+	return srv, server, base
+}
+
+/* Closes @agent without waiting for the release of its allocations */
+func test_turn_close(agent *NiceAgent) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+	defer cancel()
+	agent.Close(ctx)
+}
+
+func test_turn_read(t *testing.T, srv *net.UDPConn) []byte {
+	buf := make([]byte, 1500)
+	srv.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := srv.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+/* The success response of the TURN server to @req */
+func test_turn_response(t *testing.T, req []byte, method StunMethod, attrs ...StunAttr) []byte {
+	msg := NewStunMessage(STUN_RESPONSE, method)
+	msg.messageHeader.transactionId = stun_message_transaction_id(req)
+	for i := 0; i < len(attrs); i++ {
+		if value, ok := attrs[i].value.(*StunXorMappedAddressAttrValue); ok {
+			value.SetMagicCookie(msg.magicCookie)
+			value.SetTransactionId(msg.messageHeader.transactionId)
+		}
+		msg.AddAttr(attrs[i])
+	}
+	return test_stun_encode(t, msg)
+}
+
+func test_turn_xor_addr(typ StunAttributeType, ip net.IP, port int) StunAttr {
+	return StunAttr{header: StunAttrHeader{typ: typ}, value: NewStunXorMappedAddressAttrValue(MAPPED_ADDRESS_FAMILY_IPV4, uint16(port), ip.To4())}
+}
+
+/*
+ * The first packet to a peer binds a channel, and waits for it; then the
+ * packets go in ChannelData, and the ChannelData of the server come out
+ * as sent by the peer.
+ */
+func TestUdpTurnSocketChannelBind(t *testing.T) {
+	srv, server, base := test_turn_server(t)
+	agent := NewNiceAgent()
+	defer agent.Close(context.Background())
+	peer := NiceAddress{ip: "198.51.100.7", port: 5000, network: "udp", family: "ip4"}
+
+	agent.agent_mutex.Lock()
+	stun_agent := StunAgent{}
+	stun_agent_init(&stun_agent, STUN_COMPATIBILITY_RFC5389, STUN_AGENT_USAGE_LONG_TERM_CREDENTIALS)
+	sock := nice_udp_turn_socket_new(agent, 1, 1, base, server, NiceAddress{ip: "203.0.113.1", port: 4000}, &stun_agent, nil, "")
+	err := sock.send_messages(&peer, []*NiceOutputMessage{{buffers: [][]byte{[]byte("hel"), []byte("lo")}}})
+	agent.agent_mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := test_turn_read(t, srv)
+	if binary.BigEndian.Uint16(req[0:2]) != STUN_CHANNELBIND {
+		t.Fatalf("sent % x", req)
+	}
+	if v := stun_message_find_attribute(req, STUN_ATTRIBUTE_CHANNEL_NUMBER); !bytes.Equal(v, []byte{0x40, 0x00, 0, 0}) {
+		t.Fatalf("CHANNEL-NUMBER % x", v)
+	}
+	if addr, ok := stun_message_find_xor_addr(req, STUN_ATTRIBUTE_XOR_PEER_ADDRESS); !ok || addr.ip != peer.ip || addr.port != peer.port {
+		t.Fatalf("XOR-PEER-ADDRESS %v", addr)
+	}
+
+	resp := test_turn_response(t, req, STUN_CHANNELBIND)
+	agent.agent_mutex.Lock()
+	handled := nice_udp_turn_socket_handle_inbound_stun(sock, resp, resp)
+	agent.agent_mutex.Unlock()
+	if !handled {
+		t.Fatal("channel bind response not handled")
+	}
+	want := []byte{0x40, 0x00, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	if data := test_turn_read(t, srv); !bytes.Equal(data, want) {
+		t.Fatalf("relayed % x, want % x", data, want)
+	}
+
+	agent.agent_mutex.Lock()
+	defer agent.agent_mutex.Unlock()
+	from, data, ok := nice_udp_turn_socket_parse_recv(sock, server, []byte{0x40, 0x00, 0x00, 0x02, 'h', 'i', 0, 0})
+	if !ok || string(data) != "hi" || from.ip != peer.ip || from.port != peer.port {
+		t.Fatalf("ChannelData from %v: %q", from, data)
+	}
+	if _, _, ok := nice_udp_turn_socket_parse_recv(sock, peer, []byte{0x40, 0x00, 0x00, 0x02, 'h', 'i'}); ok {
+		t.Fatal("ChannelData taken from another address than the server")
+	}
+	if _, _, ok := nice_udp_turn_socket_parse_recv(sock, server, []byte{0x40, 0x01, 0x00, 0x02, 'h', 'i'}); ok {
+		t.Fatal("ChannelData of an unbound channel taken")
+	}
+}
+
+/* The Data indications of the server come out as sent by their peer */
+func TestUdpTurnSocketDataIndication(t *testing.T) {
+	_, server, base := test_turn_server(t)
+	agent := NewNiceAgent()
+	defer agent.Close(context.Background())
+	agent.agent_mutex.Lock()
+	defer agent.agent_mutex.Unlock()
+	stun_agent := StunAgent{}
+	stun_agent_init(&stun_agent, STUN_COMPATIBILITY_RFC5389, STUN_AGENT_USAGE_LONG_TERM_CREDENTIALS)
+	sock := nice_udp_turn_socket_new(agent, 1, 1, base, server, NiceAddress{ip: "203.0.113.1", port: 4000}, &stun_agent, nil, "")
+
+	msg := NewStunMessage(STUN_INDICATION, STUN_IND_DATA)
+	msg.messageHeader.transactionId = test_stun_transaction_id()
+	peer := test_turn_xor_addr(STUN_ATTRIBUTE_XOR_PEER_ADDRESS, net.IPv4(198, 51, 100, 7), 5000)
+	peer.value.(*StunXorMappedAddressAttrValue).SetMagicCookie(msg.magicCookie)
+	peer.value.(*StunXorMappedAddressAttrValue).SetTransactionId(msg.messageHeader.transactionId)
+	msg.AddAttr(peer)
+	msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_DATA}, value: &StunDataAttrValue{data: []byte("hello")}})
+	buf := test_stun_encode(t, msg)
+
+	from, data, ok := nice_udp_turn_socket_parse_recv(sock, server, buf)
+	if !ok || string(data) != "hello" || from.ip != "198.51.100.7" || from.port != 5000 {
+		t.Fatalf("Data indication from %v: %q", from, data)
+	}
+}
+
+/*
+ * The relayed candidate of an allocation is signalled with its relay
+ * socket, once the Refresh of the allocation is scheduled.
+ */
+func TestDiscoveryTurnAllocated(t *testing.T) {
+	srv, server, base := test_turn_server(t)
+	agent := NewNiceAgent()
+	defer test_turn_close(agent)
+	id := agent.Nice_agent_add_stream(1)
+	agent.agent_mutex.Lock()
+	defer agent.agent_mutex.Unlock()
+	stream, component := agent.agent_find_component(id, 1)
+
+	cand := NewCandidateDiscovery()
+	cand.typ = NICE_CANDIDATE_TYPE_RELAYED
+	cand.nicesock = base
+	cand.server = server
+	cand.turn = &TurnServer{server: server, typ: NICE_RELAY_TYPE_TURN_UDP}
+	cand.stream_id = id
+	cand.component_id = 1
+	stun_agent_init(&cand.stun_agent, STUN_COMPATIBILITY_RFC5389, STUN_AGENT_USAGE_LONG_TERM_CREDENTIALS)
+	if !priv_discovery_send_request(agent, cand) {
+		t.Fatal("allocate not sent")
+	}
+	req := test_turn_read(t, srv)
+	resp := test_turn_response(t, req, STUN_ALLOCATE,
+		test_turn_xor_addr(STUN_ATTRIBUTE_XOR_RELAYED_ADDRESS, net.IPv4(203, 0, 113, 1), 4000),
+		StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_LIFETIME}, value: &StunLifetimeAttrValue{lifetime: 300}})
+	priv_discovery_turn_allocated(agent, stream, component, cand, resp)
+
+	if len(agent.refresh_list) != 1 || agent.refresh_list[0].timer_source == nil {
+		t.Fatal("the allocation is not refreshed")
+	}
+	relayed := agent.refresh_list[0].candidate
+	if relayed == nil || relayed.addr.ip != "203.0.113.1" || relayed.addr.port != 4000 {
+		t.Fatalf("relayed candidate %v", relayed)
+	}
+	if sock, ok := relayed.sockptr.(*UdpTurnSocket); !ok || sock.base != base {
+		t.Fatalf("relayed candidate of socket %T", relayed.sockptr)
+	}
+}
+
+/*
+ * The ChannelData of the TURN server of a relayed candidate reach the io
+ * callback unwrapped; those of no bound channel are dropped.
+ */
+func TestComponentRecvChannelData(t *testing.T) {
+	_, server, base := test_turn_server(t)
+	agent := NewNiceAgent()
+	defer test_turn_close(agent)
+	id := agent.Nice_agent_add_stream(1)
+
+	agent.agent_mutex.Lock()
+	_, component := agent.agent_find_component(id, 1)
+	stun_agent := StunAgent{}
+	stun_agent_init(&stun_agent, STUN_COMPATIBILITY_RFC5389, STUN_AGENT_USAGE_LONG_TERM_CREDENTIALS)
+	sock := nice_udp_turn_socket_new(agent, id, 1, base, server, NiceAddress{ip: "203.0.113.1", port: 4000}, &stun_agent, nil, "")
+	sock.peers = append(sock.peers, &TurnPeer{addr: NiceAddress{ip: "198.51.100.7", port: 5000}, channel: 0x4000, bound: true})
+	relayed := nice_candidate_new(NICE_CANDIDATE_TYPE_RELAYED)
+	relayed.sockptr = sock
+	component.local_candidates = append(component.local_candidates, relayed)
+	got := make(chan string, 2)
+	component.io_callback = func(agent *NiceAgent, stream_id uint, component_id uint, buf []byte, user_data []byte) {
+		got <- string(buf)
+	}
+	agent.agent_mutex.Unlock()
+
+	source := &SocketSource{socket: base, component: component}
+	component_io_cb(source, []byte{0x40, 0x01, 0x00, 0x03, 'b', 'a', 'd', 0}, server)
+	component_io_cb(source, []byte{0x40, 0x00, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o', 0, 0, 0}, server)
+	select {
+	case data := <-got:
+		if data != "hello" {
+			t.Fatalf("received %q", data)
+		}
+	default:
+		t.Fatal("nothing received")
+	}
+	if len(got) != 0 {
+		t.Fatal("ChannelData of an unbound channel received")
+	}
+}
+
+/*
+ * The MS-TURN Allocate opens a connection of MS-SEQUENCE-NUMBER, which
+ * the release of the allocation goes on numbering.
+ */
+func TestDiscoveryMsTurnSequenceNumber(t *testing.T) {
+	srv, server, base := test_turn_server(t)
+	agent := NewNiceAgent()
+	agent.compatibility = NICE_COMPATIBILITY_OC2007
+	defer test_turn_close(agent)
+	id := agent.Nice_agent_add_stream(1)
+	agent.agent_mutex.Lock()
+	defer agent.agent_mutex.Unlock()
+	stream, component := agent.agent_find_component(id, 1)
+
+	cand := NewCandidateDiscovery()
+	cand.typ = NICE_CANDIDATE_TYPE_RELAYED
+	cand.nicesock = base
+	cand.server = server
+	cand.turn = &TurnServer{server: server, username: "user", typ: NICE_RELAY_TYPE_TURN_UDP}
+	cand.stream_id = id
+	cand.component_id = 1
+	stun_agent_init(&cand.stun_agent, STUN_COMPATIBILITY_OC2007, STUN_AGENT_USAGE_NO_ALIGNED_ATTRIBUTES)
+	if !priv_discovery_send_request(agent, cand) {
+		t.Fatal("allocate not sent")
+	}
+	req := test_turn_read(t, srv)
+	connection_id, sequence_num, ok := stun_message_find_ms_sequence_number(stun_message_align(req))
+	if !ok || sequence_num != 1 {
+		t.Fatalf("Allocate without MS-SEQUENCE-NUMBER: % x", req)
+	}
+
+	msg := NewStunMessage(STUN_RESPONSE, STUN_ALLOCATE)
+	msg.messageHeader.transactionId = stun_message_transaction_id(req)
+	msg.magicCookie = nil
+	msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_MAPPED_ADDRESS}, value: NewStunMappedAddressAttrValue(MAPPED_ADDRESS_FAMILY_IPV4, 4000, net.IPv4(203, 0, 113, 1).To4())})
+	msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_MS_SEQUENCE_NUMBER}, value: &StunMsSequenceNumberAttrValue{connection_id: connection_id, sequence_number: 7}})
+	priv_discovery_turn_allocated(agent, stream, component, cand, test_stun_encode(t, msg))
+	if len(agent.refresh_list) != 1 {
+		t.Fatal("no allocation")
+	}
+
+	refresh_release(agent, agent.refresh_list[0])
+	release := stun_message_align(test_turn_read(t, srv))
+	released_id, released_num, ok := stun_message_find_ms_sequence_number(release)
+	if !ok || !bytes.Equal(released_id, connection_id) || released_num != 8 {
+		t.Fatalf("release of connection % x number %d", released_id, released_num)
+	}
+}
+
+/*
+ * The Google relays allocate with their MAGIC-COOKIE and USERNAME, answer
+ * the relayed address in MAPPED-ADDRESS, and relay the Send requests.
+ */
+func TestDiscoveryGoogleRelayAllocated(t *testing.T) {
+	srv, server, base := test_turn_server(t)
+	agent := NewNiceAgent()
+	defer test_turn_close(agent)
+	id := agent.Nice_agent_add_stream(1)
+	agent.agent_mutex.Lock()
+	defer agent.agent_mutex.Unlock()
+	stream, component := agent.agent_find_component(id, 1)
+
+	cand := NewCandidateDiscovery()
+	cand.typ = NICE_CANDIDATE_TYPE_RELAYED
+	cand.nicesock = base
+	cand.server = server
+	cand.turn = &TurnServer{server: server, username: "session", typ: NICE_RELAY_TYPE_TURN_UDP}
+	cand.stream_id = id
+	cand.component_id = 1
+	stun_agent_init(&cand.stun_agent, STUN_COMPATIBILITY_RFC3489, 0)
+	if !priv_discovery_send_request(agent, cand) {
+		t.Fatal("allocate not sent")
+	}
+	req := test_turn_read(t, srv)
+	if binary.BigEndian.Uint32(req[4:8]) == STUN_MAGIC_COOKIE {
+		t.Fatal("Allocate with the magic cookie of RFC 5389")
+	}
+	if cookie := stun_message_find_attribute(req, STUN_ATTRIBUTE_MAGIC_COOKIE); len(cookie) != 4 || binary.BigEndian.Uint32(cookie) != STUN_TURN_MAGIC_COOKIE {
+		t.Fatalf("Allocate without MAGIC-COOKIE: % x", req)
+	}
+	if username := stun_message_find_attribute(req, STUN_ATTRIBUTE_USERNAME); string(username) != "session" {
+		t.Fatalf("Allocate of USERNAME %q", username)
+	}
+
+	msg := NewStunMessage(STUN_RESPONSE, STUN_ALLOCATE)
+	msg.messageHeader.transactionId = stun_message_transaction_id(req)
+	msg.magicCookie = nil
+	msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_MAPPED_ADDRESS}, value: NewStunMappedAddressAttrValue(MAPPED_ADDRESS_FAMILY_IPV4, 4000, net.IPv4(203, 0, 113, 1).To4())})
+	priv_discovery_turn_allocated(agent, stream, component, cand, test_stun_encode(t, msg))
+	if len(agent.refresh_list) != 0 {
+		t.Fatal("the Google relay allocation is refreshed")
+	}
+	var relayed *NiceCandidate
+	for i := 0; i < len(component.local_candidates); i++ {
+		if component.local_candidates[i].typ == NICE_CANDIDATE_TYPE_RELAYED {
+			relayed = component.local_candidates[i]
+		}
+	}
+	if relayed == nil || relayed.addr.ip != "203.0.113.1" || relayed.addr.port != 4000 {
+		t.Fatalf("relayed candidate %v", relayed)
+	}
+
+	to := NiceAddress{ip: "198.51.100.7", port: 5000}
+	if err := relayed.sockptr.send_messages(&to, []*NiceOutputMessage{{buffers: [][]byte{[]byte("hello")}}}); err != nil {
+		t.Fatal(err)
+	}
+	send := test_turn_read(t, srv)
+	if binary.BigEndian.Uint16(send[0:2]) != STUN_SEND {
+		t.Fatalf("relayed in % x", send)
+	}
+	dest, ok := stun_message_find_addr(send, STUN_ATTRIBUTE_DESTINATION_ADDRESS)
+	if !ok || dest.ip != "198.51.100.7" || dest.port != 5000 {
+		t.Fatalf("Send request to %v", dest)
+	}
+	if data := stun_message_find_attribute(send, STUN_ATTRIBUTE_DATA); string(data) != "hello" {
+		t.Fatalf("Send request of %q", data)
+	}
+}
+
+/* The error response of the TURN server to @req, with its REALM and NONCE */
+func test_turn_error(t *testing.T, req []byte, code int, realm string, nonce string) []byte {
+	msg := NewStunMessage(STUN_ERROR, STUN_ALLOCATE)
+	msg.messageHeader.transactionId = stun_message_transaction_id(req)
+	msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_ERROR_CODE}, value: &StunErrorCodeAttrValue{code: code}})
+	msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_REALM}, value: &StunRealmAttrValue{realm: realm}})
+	msg.AddAttr(StunAttr{header: StunAttrHeader{typ: STUN_ATTRIBUTE_NONCE}, value: &StunNonceAttrValue{nonce: nonce}})
+	return test_stun_encode(t, msg)
+}
+
+/*
+ * The Allocate challenged with a 401, then a 438 (Stale Nonce), is sent
+ * again each time with the REALM and NONCE of the last error, and signed
+ * with the key of that realm.
+ */
+func TestDiscoveryTurnStaleNonce(t *testing.T) {
+	srv, server, base := test_turn_server(t)
+	agent := NewNiceAgent()
+	defer test_turn_close(agent)
+	id := agent.Nice_agent_add_stream(1)
+	agent.agent_mutex.Lock()
+	defer agent.agent_mutex.Unlock()
+	stream, component := agent.agent_find_component(id, 1)
+
+	cand := NewCandidateDiscovery()
+	cand.typ = NICE_CANDIDATE_TYPE_RELAYED
+	cand.nicesock = base
+	cand.server = server
+	cand.turn = &TurnServer{server: server, username: "user", password: "pass", typ: NICE_RELAY_TYPE_TURN_UDP}
+	cand.creds = &StunLongTermCredentials{username: "user", password: "pass"}
+	cand.stream_id = id
+	cand.component_id = 1
+	cand.pending = true
+	stun_agent_init(&cand.stun_agent, STUN_COMPATIBILITY_RFC5389, STUN_AGENT_USAGE_LONG_TERM_CREDENTIALS)
+	agent.discovery_list = append(agent.discovery_list, cand)
+	if !priv_discovery_send_request(agent, cand) {
+		t.Fatal("allocate not sent")
+	}
+	req := test_turn_read(t, srv)
+	if stun_message_has_integrity(cand.stun_message) {
+		t.Fatal("the first Allocate is signed")
+	}
+
+	challenges := []struct {
+		code		int
+		realm		string
+		nonce		string
+	}{
+		{STUN_ERROR_UNAUTHORIZED, "realm1", "nonce1"},
+		{STUN_ERROR_STALE_NONCE, "realm2", "nonce2"},
+	}
+	for _, c := range challenges {
+		resp := test_turn_error(t, req, c.code, c.realm, c.nonce)
+		if !discovery_handle_inbound_stun(agent, stream, component, server, resp, resp) {
+			t.Fatalf("%d not handled", c.code)
+		}
+		req = test_turn_read(t, srv)
+		if realm := string(stun_message_find_attribute(req, STUN_ATTRIBUTE_REALM)); realm != c.realm {
+			t.Fatalf("after %d, REALM %q", c.code, realm)
+		}
+		if nonce := string(stun_message_find_attribute(req, STUN_ATTRIBUTE_NONCE)); nonce != c.nonce {
+			t.Fatalf("after %d, NONCE %q", c.code, nonce)
+		}
+		if !stun_message_check_integrity(req, stun_hash_creds(c.realm, "user", "pass"), false, true) {
+			t.Fatalf("after %d, not signed with the key of %s", c.code, c.realm)
+		}
+	}
+	if cand.done || cand.auth_retries != 2 {
+		t.Fatalf("done %v after %d retries", cand.done, cand.auth_retries)
+	}
+
+	/* the same nonce again is not worth another request */
+	resp := test_turn_error(t, req, STUN_ERROR_STALE_NONCE, "realm2", "nonce2")
+	if !discovery_handle_inbound_stun(agent, stream, component, server, resp, resp) || !cand.done {
+		t.Fatal("Allocate sent again with an unchanged nonce")
+	}
+}
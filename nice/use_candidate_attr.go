@@ -0,0 +1,20 @@
+package nice
+
+/*
+ * The USE-CANDIDATE of ICE (RFC 5245 section 19.1): the controlling agent
+ * nominates the pair of the check. It has no value.
+ */
+type StunUseCandidateAttrValue struct {
+}
+
+func (this StunUseCandidateAttrValue) Encode(stream *DataStream) error {
+	return nil
+}
+
+func (this *StunUseCandidateAttrValue) Decode(stream *DataStream) error {
+	return nil
+}
+
+func (this StunUseCandidateAttrValue) GetSize() uint16 {
+	return 0
+}
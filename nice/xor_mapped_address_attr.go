@@ -3,6 +3,7 @@ package nice
 import (
 	"encoding/binary"
 	"errors"
+	"net"
 )
 
 type StunXorMappedAddressAttrValue struct {
@@ -39,31 +40,21 @@ func (this StunXorMappedAddressAttrValue) GetSize() uint16 {
 func (this StunXorMappedAddressAttrValue) Encode(stream *DataStream) error {
 	stream.WriteByte(this.zero)
 	stream.WriteByte(byte(this.family))
-	if this.magicCookie == nil {
-		return errors.New("need magic cookie to encode xor mapped address attr")
+	if this.magicCookie == nil || this.transactionId == nil {
+		return errors.New("need magic cookie and transaction id to encode xor mapped address attr")
 	}
-	m,_ := BytesToUInt16(*this.magicCookie, HostByteOrder)
-	p := this.port ^ m
-	stream.WriteUInt16(p, binary.BigEndian)
+	/* the port is XOR-ed with the most significant half of the cookie, the
+	 * address with the cookie and the 12 bytes of the transaction id sent
+	 * after it */
+	mask := append(append([]byte{}, (*this.magicCookie)...), (*this.transactionId)[STUN_MAGIC_COOKIE_LEN:]...)
+	stream.WriteUInt16(this.port ^ binary.BigEndian.Uint16(mask[0:2]), binary.BigEndian)
 
-	if len(this.ip) == 4 {
-		q, err := XOR(this.ip, *this.magicCookie)
-		if err != nil {
-			return err
-		}
-		stream.WriteBytes(ToNetworkOrder(q))
-	} else if len(this.ip) == 16 {
-		d := make([]byte, 0)
-		d = append(d, *this.magicCookie...)
-		d = append(d, *this.transactionId...)
-		q, err := XOR(this.ip, d)
-		if err != nil {
-			return err
-		}
-		stream.WriteBytes(ToNetworkOrder(q))
-	} else {
+	if len(this.ip) != 4 && len(this.ip) != 16 {
 		return errors.New("ip len error")
 	}
+	for i := 0; i < len(this.ip); i++ {
+		stream.WriteByte(this.ip[i] ^ mask[i])
+	}
 	return nil
 }
 
@@ -95,4 +86,44 @@ func (this *StunXorMappedAddressAttrValue) Decode(stream *DataStream) (err error
 		return
 	}
 	return
-}
\ No newline at end of file
+}
+/*
+ * Returns the address of the XOR-MAPPED-ADDRESS style attribute of type
+ * 'typ' of the STUN message 'buf' (RFC 5389 section 15.2): the port is
+ * XOR-ed with the magic cookie, the address with the cookie and the
+ * transaction id. The MS-XOR-MAPPED-ADDRESS of MS-TURN is encoded the
+ * same way.
+ */
+func stun_message_find_xor_addr(buf []byte, typ StunAttributeType) (NiceAddress, bool) {
+	var addr NiceAddress
+	value := stun_message_find_attribute(buf, typ)
+	if len(value) != 8 && len(value) != 20 {
+		return addr, false
+	}
+	var mask [16]byte
+	binary.BigEndian.PutUint32(mask[0:4], STUN_MAGIC_COOKIE)
+	copy(mask[4:], buf[8:STUN_MESSAGE_HEADER_LENGTH])
+
+	ip := make(net.IP, len(value) - 4)
+	for i := 0; i < len(ip); i++ {
+		ip[i] = value[4 + i] ^ mask[i]
+	}
+	switch MAPPED_ADDRESS_FAMILY(value[1]) {
+	case MAPPED_ADDRESS_FAMILY_IPV4:
+		if len(ip) != 4 {
+			return addr, false
+		}
+		addr.family = "ip4"
+	case MAPPED_ADDRESS_FAMILY_IPV6:
+		if len(ip) != 16 {
+			return addr, false
+		}
+		addr.family = "ip6"
+	default:
+		return addr, false
+	}
+	addr.port = int(binary.BigEndian.Uint16(value[2:4]) ^ uint16(STUN_MAGIC_COOKIE >> 16))
+	addr.ip = ip.String()
+	addr.network = "udp"
+	return addr, true
+}